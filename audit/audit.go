@@ -0,0 +1,47 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event is a single entry in the audit trail.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	// Action is what happened, e.g. an operation kind or approve.
+	Action string `json:"action"`
+	Key    string `json:"key"`
+	Status string `json:"status,omitempty"`
+	// Actor is who triggered or approved the change, when known.
+	Actor string `json:"actor,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type Logger interface {
+	Log(ctx context.Context, event Event) error
+}
+
+// JSONLogger writes one JSON encoded event per line.
+type JSONLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{enc: json.NewEncoder(w)}
+}
+
+func (l *JSONLogger) Log(ctx context.Context, event Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.enc.Encode(event)
+}
@@ -0,0 +1,41 @@
+package aws
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awscfg "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/tiagoposse/go-identity-sync/config"
+)
+
+// loadConfig loads the SDK configuration with the provider's retry settings
+// and, when set, the named shared config profile.
+func loadConfig(ctx context.Context, rl *config.RateLimitConfig, profile *string) (aws.Config, error) {
+	if err := rl.Validate(); err != nil {
+		return aws.Config{}, err
+	}
+
+	opts := []func(*awscfg.LoadOptions) error{withRetryer(rl)}
+	if profile != nil {
+		opts = append(opts, awscfg.WithSharedConfigProfile(*profile))
+	}
+
+	return awscfg.LoadDefaultConfig(ctx, opts...)
+}
+
+// withRetryer maps the provider rate limit settings onto the SDK's adaptive
+// retryer, which already understands AWS throttling errors and applies client
+// side rate limiting once they occur.
+func withRetryer(rl *config.RateLimitConfig) awscfg.LoadOptionsFunc {
+	resolved := rl.WithDefaults()
+
+	return awscfg.WithRetryer(func() aws.Retryer {
+		return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+			o.StandardOptions = append(o.StandardOptions, func(so *retry.StandardOptions) {
+				so.MaxAttempts = resolved.MaxRetries + 1
+				so.MaxBackoff = resolved.MaxBackoff
+			})
+		})
+	})
+}
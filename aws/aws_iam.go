@@ -2,25 +2,47 @@ package aws
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
-	awscfg "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
 	"github.com/aws/aws-sdk-go-v2/service/iam/types"
 	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
 	"github.com/tiagoposse/go-identity-sync/utils"
 )
 
+const (
+	// deprovisionedTag marks suspended users with the time they were deprovisioned.
+	deprovisionedTag = "identity-sync.deprovisionedAt"
+	// suspendedKeysTag lists the access keys deactivated on suspension, so
+	// only those are turned back on when the user is reactivated.
+	suspendedKeysTag = "identity-sync.suspendedKeys"
+)
+
+// iamUserFields are the attributes IAM keeps on the user itself. Every other
+// mapped field is stored as a tag.
+var iamUserFields = map[string]bool{
+	"UserName": true,
+	"UserId":   true,
+	"Arn":      true,
+	"Path":     true,
+}
+
 type awsIAMProvider struct {
 	config.BaseConfig
 
-	client *iam.Client
+	client    *iam.Client
+	groups    []config.AwsIAMGroupConfig
+	groupPath string
 }
 
 func NewAwsIAMProvider(ctx context.Context, cfg *config.AwsIAMConfig) (*awsIAMProvider, error) {
 	// Load AWS SDK configuration
-	clicfg, err := awscfg.LoadDefaultConfig(ctx)
+	clicfg, err := loadConfig(ctx, cfg.RateLimit, cfg.Profile)
 	if err != nil {
 		return nil, fmt.Errorf("loading AWS SDK configuration: %w", err)
 	}
@@ -30,6 +52,8 @@ func NewAwsIAMProvider(ctx context.Context, cfg *config.AwsIAMConfig) (*awsIAMPr
 	return &awsIAMProvider{
 		BaseConfig: cfg.BaseConfig,
 		client:     client,
+		groups:     cfg.Groups,
+		groupPath:  cfg.GroupPath,
 	}, nil
 }
 
@@ -38,7 +62,7 @@ func (aws *awsIAMProvider) GetUser(ctx context.Context, id string) (*types.User,
 		UserName: utils.StrPtr(id),
 	}
 
-	output, err := aws.client.GetUser(context.Background(), input)
+	output, err := aws.client.GetUser(ctx, input)
 	if err != nil {
 		return nil, fmt.Errorf("getting user information: %w", err)
 	}
@@ -46,33 +70,387 @@ func (aws *awsIAMProvider) GetUser(ctx context.Context, id string) (*types.User,
 	return output.User, nil
 }
 
-func (aws *awsIAMProvider) GetUsers(ctx context.Context) ([]types.User, error) {
-	return aws.SearchUsers(ctx, "")
+func (aws *awsIAMProvider) GetUsers(ctx context.Context, lo utils.ListOptions) ([]types.User, error) {
+	filter := ""
+	if lo.Filter != nil {
+		filter = *lo.Filter
+	}
+
+	return aws.SearchUsers(ctx, filter)
 }
 
 func (aws *awsIAMProvider) SearchUsers(ctx context.Context, filter string) ([]types.User, error) {
-	input := &iam.ListUsersInput{}
-	output, err := aws.client.ListUsers(ctx, input)
+	filteredUsers := make([]types.User, 0)
+
+	paginator := iam.NewListUsersPaginator(aws.client, &iam.ListUsersInput{})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing users: %w", err)
+		}
+
+		for _, user := range output.Users {
+			if filter == "" || strings.Contains(*user.UserName, filter) || strings.Contains(*user.UserId, filter) {
+				filteredUsers = append(filteredUsers, user)
+			}
+		}
+	}
+
+	return filteredUsers, nil
+}
+
+// getTags returns the user's tags. ListUsers does not include them.
+func (aws *awsIAMProvider) getTags(ctx context.Context, userName string) (map[string]string, error) {
+	tags := make(map[string]string)
+
+	paginator := iam.NewListUserTagsPaginator(aws.client, &iam.ListUserTagsInput{UserName: &userName})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing tags for user %s: %w", userName, err)
+		}
+
+		for _, tag := range output.Tags {
+			tags[*tag.Key] = *tag.Value
+		}
+	}
+
+	return tags, nil
+}
+
+// userAttributes flattens a user and its tags into one object to map from.
+// Mapped tags the user does not have are empty.
+func (aws *awsIAMProvider) userAttributes(user types.User, tags map[string]string) map[string]any {
+	attrs := map[string]any{
+		"UserName": *user.UserName,
+		"UserId":   *user.UserId,
+		"Arn":      *user.Arn,
+		"Path":     *user.Path,
+	}
+
+	for field := range aws.BaseConfig.Mapping {
+		if !iamUserFields[field] {
+			attrs[field] = tags[field]
+		}
+	}
+
+	return attrs
+}
+
+// getUsersAttributes returns every user's attributes and whether it is suspended, by user name.
+func (aws *awsIAMProvider) getUsersAttributes(ctx context.Context, lo utils.ListOptions) ([]map[string]any, map[string]bool, error) {
+	users, err := aws.GetUsers(ctx, lo)
 	if err != nil {
-		return nil, fmt.Errorf("listing users: %w", err)
+		return nil, nil, err
 	}
 
-	filteredUsers := make([]types.User, 0)
-	for _, user := range output.Users {
-		if filter == "" || strings.Contains(*user.UserName, filter) || strings.Contains(*user.UserId, filter) {
-			filteredUsers = append(filteredUsers, user)
+	attrs := make([]map[string]any, 0, len(users))
+	suspended := make(map[string]bool)
+	for _, user := range users {
+		tags, err := aws.getTags(ctx, *user.UserName)
+		if err != nil {
+			return nil, nil, err
 		}
+
+		attrs = append(attrs, aws.userAttributes(user, tags))
+		_, suspended[*user.UserName] = tags[deprovisionedTag]
 	}
 
-	return filteredUsers, nil
+	return attrs, suspended, nil
+}
+
+func (aws *awsIAMProvider) GetUsersConverted(ctx context.Context, lo utils.ListOptions) ([]map[string]any, error) {
+	attrs, _, err := aws.getUsersAttributes(ctx, lo)
+	if err != nil {
+		return nil, err
+	}
+
+	return aws.BaseConfig.ConvertUsers(attrs)
+}
+
+// Plan keys users by their mapped UserName, which is how IAM addresses them.
+func (aws *awsIAMProvider) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
+	attrs, suspendedByName, err := aws.getUsersAttributes(ctx, utils.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	field := aws.BaseConfig.Mapping["UserName"]
+	current, err := aws.BaseConfig.ConvertUsers(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	toAdd, toRemove, toUpdate, err := aws.BaseConfig.RawCompareUsers(current, source, field)
+	if err != nil {
+		return nil, err
+	}
+
+	suspended := make(map[string]bool)
+	for i, u := range attrs {
+		suspended[config.KeyOf(current[i], field)] = suspendedByName[u["UserName"].(string)]
+	}
+
+	plan := engine.NewPlan("aws/iam")
+	plan.SetState(current, source, field)
+	for _, u := range toAdd {
+		u := u
+		key := config.KeyOf(u, field)
+		plan.AddVerified(engine.OperationCreate, key, u, func(ctx context.Context) error {
+			return aws.createUser(ctx, u)
+		}, func(ctx context.Context) (bool, error) {
+			return aws.exists(ctx, key)
+		})
+	}
+
+	for _, u := range toRemove {
+		key := config.KeyOf(u, field)
+		plan.AddRemoval(aws.BaseConfig.Deprovisioning, key, u, suspended[key], func(ctx context.Context) error {
+			return aws.suspendUser(ctx, key)
+		}, func(ctx context.Context) error {
+			return aws.deleteUser(ctx, key)
+		})
+	}
+
+	// Users that reappear in the source are reactivated instead of recreated.
+	if aws.BaseConfig.Deprovisioning.Suspends() {
+		for _, u := range source {
+			key := config.KeyOf(u, field)
+			if suspended[key] {
+				plan.Add(engine.OperationReactivate, key, u, func(ctx context.Context) error {
+					return aws.reactivateUser(ctx, key)
+				})
+			}
+		}
+	}
+
+	for _, u := range toUpdate {
+		u := u
+		plan.Add(engine.OperationUpdate, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return aws.updateUser(ctx, u)
+		})
+	}
+
+	if err := aws.planGroups(ctx, plan, source); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+func (aws *awsIAMProvider) SyncProvider(ctx context.Context, source []map[string]any, opts ...engine.Option) (*engine.Result, error) {
+	plan, err := aws.Plan(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]engine.Option{engine.WithConfig(aws.BaseConfig)}, opts...)
+	return engine.Apply(ctx, plan, opts...)
+}
+
+// exists reports whether a user with the given name exists.
+func (aws *awsIAMProvider) exists(ctx context.Context, userName string) (bool, error) {
+	_, err := aws.client.GetUser(ctx, &iam.GetUserInput{UserName: &userName})
+	if isNoSuchEntity(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("getting user %s: %w", userName, err)
+	}
+
+	return true, nil
+}
+
+// providerUser splits a user in provider fields into its name, path and tags.
+func (aws *awsIAMProvider) providerUser(u map[string]any) (name, path string, tags map[string]string, err error) {
+	mapped, err := aws.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	name, _ = mapped["UserName"].(string)
+	if name == "" {
+		return "", "", nil, fmt.Errorf("user has no UserName: %v", u)
+	}
+
+	path, _ = mapped["Path"].(string)
+
+	tags = make(map[string]string)
+	for field, val := range mapped {
+		if !iamUserFields[field] && val != nil {
+			tags[field] = fmt.Sprint(val)
+		}
+	}
+
+	return name, path, tags, nil
+}
+
+func toTags(tags map[string]string) []types.Tag {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := make([]types.Tag, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, types.Tag{Key: utils.StrPtr(k), Value: utils.StrPtr(tags[k])})
+	}
+
+	return res
+}
+
+func (aws *awsIAMProvider) createUser(ctx context.Context, u map[string]any) error {
+	name, path, tags, err := aws.providerUser(u)
+	if err != nil {
+		return err
+	}
+
+	// Unset attributes are left untagged rather than tagged with an empty value.
+	for k, v := range tags {
+		if v == "" {
+			delete(tags, k)
+		}
+	}
+
+	input := &iam.CreateUserInput{
+		UserName: &name,
+		Tags:     toTags(tags),
+	}
+	if path != "" {
+		input.Path = &path
+	}
+
+	if _, err := aws.client.CreateUser(ctx, input); err != nil {
+		return fmt.Errorf("creating user %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// updateUser moves the user to its mapped path and rewrites its mapped tags.
+// Tags that are not mapped are left alone.
+func (aws *awsIAMProvider) updateUser(ctx context.Context, u map[string]any) error {
+	name, path, tags, err := aws.providerUser(u)
+	if err != nil {
+		return err
+	}
+
+	if path != "" {
+		if _, err := aws.client.UpdateUser(ctx, &iam.UpdateUserInput{UserName: &name, NewPath: &path}); err != nil {
+			return fmt.Errorf("updating path of user %s: %w", name, err)
+		}
+	}
+
+	set := make(map[string]string)
+	unset := make([]string, 0)
+	for k, v := range tags {
+		if v == "" {
+			unset = append(unset, k)
+		} else {
+			set[k] = v
+		}
+	}
+
+	if len(set) > 0 {
+		if _, err := aws.client.TagUser(ctx, &iam.TagUserInput{UserName: &name, Tags: toTags(set)}); err != nil {
+			return fmt.Errorf("tagging user %s: %w", name, err)
+		}
+	}
+
+	if len(unset) > 0 {
+		sort.Strings(unset)
+		if _, err := aws.client.UntagUser(ctx, &iam.UntagUserInput{UserName: &name, TagKeys: unset}); err != nil {
+			return fmt.Errorf("untagging user %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// suspendUser removes the console password and deactivates the active access
+// keys, remembering which ones so reactivation restores only those. IAM has
+// no disabled state, so the password has to be reset after reactivation.
+func (aws *awsIAMProvider) suspendUser(ctx context.Context, userName string) error {
+	if err := aws.deleteLoginProfile(ctx, userName); err != nil {
+		return err
+	}
+
+	keys, err := aws.accessKeys(ctx, userName)
+	if err != nil {
+		return err
+	}
+
+	deactivated := make([]string, 0)
+	for _, key := range keys {
+		if key.Status != types.StatusTypeActive {
+			continue
+		}
+
+		if _, err := aws.client.UpdateAccessKey(ctx, &iam.UpdateAccessKeyInput{
+			UserName:    &userName,
+			AccessKeyId: key.AccessKeyId,
+			Status:      types.StatusTypeInactive,
+		}); err != nil {
+			return fmt.Errorf("deactivating access key %s of user %s: %w", *key.AccessKeyId, userName, err)
+		}
+		deactivated = append(deactivated, *key.AccessKeyId)
+	}
+
+	tags := map[string]string{
+		deprovisionedTag: time.Now().UTC().Format(time.RFC3339),
+	}
+	if len(deactivated) > 0 {
+		tags[suspendedKeysTag] = strings.Join(deactivated, " ")
+	}
+
+	if _, err := aws.client.TagUser(ctx, &iam.TagUserInput{UserName: &userName, Tags: toTags(tags)}); err != nil {
+		return fmt.Errorf("tagging suspended user %s: %w", userName, err)
+	}
+
+	return nil
+}
+
+// reactivateUser turns the access keys deactivated by suspendUser back on.
+func (aws *awsIAMProvider) reactivateUser(ctx context.Context, userName string) error {
+	tags, err := aws.getTags(ctx, userName)
+	if err != nil {
+		return err
+	}
+
+	for _, keyID := range strings.Fields(tags[suspendedKeysTag]) {
+		keyID := keyID
+		_, err := aws.client.UpdateAccessKey(ctx, &iam.UpdateAccessKeyInput{
+			UserName:    &userName,
+			AccessKeyId: &keyID,
+			Status:      types.StatusTypeActive,
+		})
+		// Keys deleted while the user was suspended stay deleted.
+		if err != nil && !isNoSuchEntity(err) {
+			return fmt.Errorf("reactivating access key %s of user %s: %w", keyID, userName, err)
+		}
+	}
+
+	if _, err := aws.client.UntagUser(ctx, &iam.UntagUserInput{
+		UserName: &userName,
+		TagKeys:  []string{deprovisionedTag, suspendedKeysTag},
+	}); err != nil {
+		return fmt.Errorf("untagging reactivated user %s: %w", userName, err)
+	}
+
+	return nil
+}
+
+func isNoSuchEntity(err error) bool {
+	var nse *types.NoSuchEntityException
+	return errors.As(err, &nse)
 }
 
 func (aws *awsIAMProvider) Sync(ctx context.Context, target []map[string]any) (add, remove, update []map[string]any, retErr error) {
-	currentUsers, err := aws.GetUsers(ctx)
+	currentUsers, _, err := aws.getUsersAttributes(ctx, utils.ListOptions{})
 	if err != nil {
 		retErr = err
 		return
 	}
 
-	return aws.BaseConfig.CompareUsers(currentUsers, target, aws.BaseConfig.Mapping["UserId"])
+	return aws.BaseConfig.CompareUsers(currentUsers, target, aws.BaseConfig.Mapping["UserName"])
 }
@@ -0,0 +1,290 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+)
+
+func (aws *awsIAMProvider) GetGroups(ctx context.Context) ([]types.Group, error) {
+	groups := make([]types.Group, 0)
+
+	paginator := iam.NewListGroupsPaginator(aws.client, &iam.ListGroupsInput{})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing groups: %w", err)
+		}
+
+		groups = append(groups, output.Groups...)
+	}
+
+	return groups, nil
+}
+
+// GetGroupMembers returns the names of the users in a group.
+func (aws *awsIAMProvider) GetGroupMembers(ctx context.Context, groupName string) ([]string, error) {
+	members := make([]string, 0)
+
+	input := &iam.GetGroupInput{GroupName: &groupName}
+	for {
+		output, err := aws.client.GetGroup(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("getting members of group %s: %w", groupName, err)
+		}
+
+		for _, user := range output.Users {
+			members = append(members, *user.UserName)
+		}
+
+		if !output.IsTruncated {
+			return members, nil
+		}
+		input.Marker = output.Marker
+	}
+}
+
+// attachedPolicies returns the ARNs of the managed policies attached to a group.
+func (aws *awsIAMProvider) attachedPolicies(ctx context.Context, groupName string) ([]string, error) {
+	arns := make([]string, 0)
+
+	paginator := iam.NewListAttachedGroupPoliciesPaginator(aws.client, &iam.ListAttachedGroupPoliciesInput{GroupName: &groupName})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if isNoSuchEntity(err) {
+			return arns, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("listing policies of group %s: %w", groupName, err)
+		}
+
+		for _, policy := range output.AttachedPolicies {
+			arns = append(arns, *policy.PolicyArn)
+		}
+	}
+
+	return arns, nil
+}
+
+// desiredMembers returns the names of the source users that belong to each declared group.
+func (aws *awsIAMProvider) desiredMembers(source []map[string]any) map[string][]string {
+	field := aws.BaseConfig.Mapping["UserName"]
+
+	desired := make(map[string][]string)
+	for _, group := range aws.groups {
+		desired[group.Name] = make([]string, 0)
+		for _, u := range source {
+			for _, sourceGroup := range aws.BaseConfig.GroupsOf(u) {
+				if slices.Contains(group.SourceGroups, sourceGroup) {
+					desired[group.Name] = append(desired[group.Name], config.KeyOf(u, field))
+					break
+				}
+			}
+		}
+	}
+
+	return desired
+}
+
+// planGroups adds the operations that create the declared groups, attach
+// their policies and set their members. Undeclared groups in the group path
+// are deleted once everything else is applied.
+func (aws *awsIAMProvider) planGroups(ctx context.Context, plan *engine.Plan, source []map[string]any) error {
+	groups, err := aws.GetGroups(ctx)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]types.Group)
+	for _, group := range groups {
+		existing[*group.GroupName] = group
+	}
+
+	current := make(map[string][]string)
+	for _, group := range aws.groups {
+		group := group
+		policies := make([]string, 0)
+
+		if _, ok := existing[group.Name]; ok {
+			members, err := aws.GetGroupMembers(ctx, group.Name)
+			if err != nil {
+				return err
+			}
+
+			// Ignored users are never removed, so they do not count as members.
+			current[group.Name] = slices.DeleteFunc(members, func(m string) bool {
+				return slices.Contains(aws.BaseConfig.IgnoreUsers, m)
+			})
+
+			if policies, err = aws.attachedPolicies(ctx, group.Name); err != nil {
+				return err
+			}
+		} else {
+			plan.AddVerified(engine.OperationCreateGroup, group.Name, map[string]any{"name": group.Name}, func(ctx context.Context) error {
+				return aws.createGroup(ctx, group.Name)
+			}, func(ctx context.Context) (bool, error) {
+				return aws.groupExists(ctx, group.Name)
+			})
+		}
+
+		if !sameSet(policies, group.ManagedPolicies) {
+			obj := map[string]any{
+				"group":           group.Name,
+				"managedPolicies": group.ManagedPolicies,
+			}
+			plan.Add(engine.OperationUpdateGroup, group.Name, obj, func(ctx context.Context) error {
+				return aws.setGroupPolicies(ctx, group.Name, group.ManagedPolicies)
+			})
+		}
+	}
+
+	plan.AddMemberships(current, aws.desiredMembers(source), aws.addToGroup, aws.removeFromGroup)
+
+	if aws.groupPath == "" {
+		return nil
+	}
+
+	for _, group := range groups {
+		name := *group.GroupName
+		if *group.Path != aws.groupPath || slices.ContainsFunc(aws.groups, func(g config.AwsIAMGroupConfig) bool { return g.Name == name }) {
+			continue
+		}
+
+		plan.Add(engine.OperationDeleteGroup, name, map[string]any{"name": name}, func(ctx context.Context) error {
+			return aws.deleteGroup(ctx, name)
+		})
+	}
+
+	return nil
+}
+
+func sameSet(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	sort.Strings(a)
+	sort.Strings(b)
+	return slices.Equal(slices.Compact(a), slices.Compact(b))
+}
+
+func (aws *awsIAMProvider) groupExists(ctx context.Context, groupName string) (bool, error) {
+	_, err := aws.client.GetGroup(ctx, &iam.GetGroupInput{GroupName: &groupName})
+	if isNoSuchEntity(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("getting group %s: %w", groupName, err)
+	}
+
+	return true, nil
+}
+
+func (aws *awsIAMProvider) createGroup(ctx context.Context, groupName string) error {
+	input := &iam.CreateGroupInput{GroupName: &groupName}
+	if aws.groupPath != "" {
+		input.Path = &aws.groupPath
+	}
+
+	if _, err := aws.client.CreateGroup(ctx, input); err != nil {
+		return fmt.Errorf("creating group %s: %w", groupName, err)
+	}
+
+	return nil
+}
+
+// setGroupPolicies attaches the declared managed policies and detaches any other.
+func (aws *awsIAMProvider) setGroupPolicies(ctx context.Context, groupName string, policies []string) error {
+	attached, err := aws.attachedPolicies(ctx, groupName)
+	if err != nil {
+		return err
+	}
+
+	for _, arn := range policies {
+		arn := arn
+		if slices.Contains(attached, arn) {
+			continue
+		}
+
+		if _, err := aws.client.AttachGroupPolicy(ctx, &iam.AttachGroupPolicyInput{GroupName: &groupName, PolicyArn: &arn}); err != nil {
+			return fmt.Errorf("attaching %s to group %s: %w", arn, groupName, err)
+		}
+	}
+
+	for _, arn := range attached {
+		arn := arn
+		if slices.Contains(policies, arn) {
+			continue
+		}
+
+		_, err := aws.client.DetachGroupPolicy(ctx, &iam.DetachGroupPolicyInput{GroupName: &groupName, PolicyArn: &arn})
+		if err != nil && !isNoSuchEntity(err) {
+			return fmt.Errorf("detaching %s from group %s: %w", arn, groupName, err)
+		}
+	}
+
+	return nil
+}
+
+func (aws *awsIAMProvider) addToGroup(ctx context.Context, groupName, userName string) error {
+	if _, err := aws.client.AddUserToGroup(ctx, &iam.AddUserToGroupInput{GroupName: &groupName, UserName: &userName}); err != nil {
+		return fmt.Errorf("adding user %s to group %s: %w", userName, groupName, err)
+	}
+
+	return nil
+}
+
+// removeFromGroup tolerates users that are already gone, e.g. deleted earlier in the same plan.
+func (aws *awsIAMProvider) removeFromGroup(ctx context.Context, groupName, userName string) error {
+	_, err := aws.client.RemoveUserFromGroup(ctx, &iam.RemoveUserFromGroupInput{GroupName: &groupName, UserName: &userName})
+	if err != nil && !isNoSuchEntity(err) {
+		return fmt.Errorf("removing user %s from group %s: %w", userName, groupName, err)
+	}
+
+	return nil
+}
+
+// deleteGroup removes the group's members and policies, which IAM requires
+// before the group itself can be deleted.
+func (aws *awsIAMProvider) deleteGroup(ctx context.Context, groupName string) error {
+	members, err := aws.GetGroupMembers(ctx, groupName)
+	if isNoSuchEntity(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, member := range members {
+		if err := aws.removeFromGroup(ctx, groupName, member); err != nil {
+			return err
+		}
+	}
+
+	if err := aws.setGroupPolicies(ctx, groupName, nil); err != nil {
+		return err
+	}
+
+	paginator := iam.NewListGroupPoliciesPaginator(aws.client, &iam.ListGroupPoliciesInput{GroupName: &groupName})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing inline policies of group %s: %w", groupName, err)
+		}
+
+		for _, name := range output.PolicyNames {
+			name := name
+			_, err := aws.client.DeleteGroupPolicy(ctx, &iam.DeleteGroupPolicyInput{GroupName: &groupName, PolicyName: &name})
+			if err != nil && !isNoSuchEntity(err) {
+				return fmt.Errorf("deleting inline policy %s of group %s: %w", name, groupName, err)
+			}
+		}
+	}
+
+	_, err = aws.client.DeleteGroup(ctx, &iam.DeleteGroupInput{GroupName: &groupName})
+	if err != nil && !isNoSuchEntity(err) {
+		return fmt.Errorf("deleting group %s: %w", groupName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,255 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+)
+
+// deleteUser removes everything IAM requires to be gone before a user can be
+// deleted. Each step tolerates entities that are already gone, so a teardown
+// interrupted halfway can be run again.
+func (aws *awsIAMProvider) deleteUser(ctx context.Context, userName string) error {
+	steps := []struct {
+		name string
+		run  func(context.Context, string) error
+	}{
+		{"access keys", aws.deleteAccessKeys},
+		{"login profile", aws.deleteLoginProfile},
+		{"MFA devices", aws.deleteMFADevices},
+		{"SSH public keys", aws.deleteSSHPublicKeys},
+		{"signing certificates", aws.deleteSigningCertificates},
+		{"service specific credentials", aws.deleteServiceSpecificCredentials},
+		{"group memberships", aws.removeFromGroups},
+		{"attached policies", aws.detachPolicies},
+		{"inline policies", aws.deleteInlinePolicies},
+		{"permissions boundary", aws.deletePermissionsBoundary},
+	}
+
+	for _, step := range steps {
+		if err := step.run(ctx, userName); err != nil {
+			return fmt.Errorf("deleting user %s: removing %s: %w", userName, step.name, err)
+		}
+	}
+
+	_, err := aws.client.DeleteUser(ctx, &iam.DeleteUserInput{UserName: &userName})
+	if err != nil && !isNoSuchEntity(err) {
+		return fmt.Errorf("deleting user %s: %w", userName, err)
+	}
+
+	return nil
+}
+
+func (aws *awsIAMProvider) accessKeys(ctx context.Context, userName string) ([]types.AccessKeyMetadata, error) {
+	keys := make([]types.AccessKeyMetadata, 0)
+
+	paginator := iam.NewListAccessKeysPaginator(aws.client, &iam.ListAccessKeysInput{UserName: &userName})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if isNoSuchEntity(err) {
+			return keys, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("listing access keys of user %s: %w", userName, err)
+		}
+
+		keys = append(keys, output.AccessKeyMetadata...)
+	}
+
+	return keys, nil
+}
+
+func (aws *awsIAMProvider) deleteAccessKeys(ctx context.Context, userName string) error {
+	keys, err := aws.accessKeys(ctx, userName)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		_, err := aws.client.DeleteAccessKey(ctx, &iam.DeleteAccessKeyInput{UserName: &userName, AccessKeyId: key.AccessKeyId})
+		if err != nil && !isNoSuchEntity(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (aws *awsIAMProvider) deleteLoginProfile(ctx context.Context, userName string) error {
+	_, err := aws.client.DeleteLoginProfile(ctx, &iam.DeleteLoginProfileInput{UserName: &userName})
+	if err != nil && !isNoSuchEntity(err) {
+		return fmt.Errorf("deleting login profile of user %s: %w", userName, err)
+	}
+
+	return nil
+}
+
+// deleteMFADevices deactivates every MFA device. Virtual devices are deleted
+// as well, since they would otherwise linger in the account unassigned.
+func (aws *awsIAMProvider) deleteMFADevices(ctx context.Context, userName string) error {
+	paginator := iam.NewListMFADevicesPaginator(aws.client, &iam.ListMFADevicesInput{UserName: &userName})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if isNoSuchEntity(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, device := range output.MFADevices {
+			_, err := aws.client.DeactivateMFADevice(ctx, &iam.DeactivateMFADeviceInput{UserName: &userName, SerialNumber: device.SerialNumber})
+			if err != nil && !isNoSuchEntity(err) {
+				return err
+			}
+
+			if !strings.Contains(*device.SerialNumber, ":mfa/") {
+				continue
+			}
+
+			_, err = aws.client.DeleteVirtualMFADevice(ctx, &iam.DeleteVirtualMFADeviceInput{SerialNumber: device.SerialNumber})
+			if err != nil && !isNoSuchEntity(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (aws *awsIAMProvider) deleteSSHPublicKeys(ctx context.Context, userName string) error {
+	paginator := iam.NewListSSHPublicKeysPaginator(aws.client, &iam.ListSSHPublicKeysInput{UserName: &userName})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if isNoSuchEntity(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, key := range output.SSHPublicKeys {
+			_, err := aws.client.DeleteSSHPublicKey(ctx, &iam.DeleteSSHPublicKeyInput{UserName: &userName, SSHPublicKeyId: key.SSHPublicKeyId})
+			if err != nil && !isNoSuchEntity(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (aws *awsIAMProvider) deleteSigningCertificates(ctx context.Context, userName string) error {
+	paginator := iam.NewListSigningCertificatesPaginator(aws.client, &iam.ListSigningCertificatesInput{UserName: &userName})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if isNoSuchEntity(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, cert := range output.Certificates {
+			_, err := aws.client.DeleteSigningCertificate(ctx, &iam.DeleteSigningCertificateInput{UserName: &userName, CertificateId: cert.CertificateId})
+			if err != nil && !isNoSuchEntity(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (aws *awsIAMProvider) deleteServiceSpecificCredentials(ctx context.Context, userName string) error {
+	output, err := aws.client.ListServiceSpecificCredentials(ctx, &iam.ListServiceSpecificCredentialsInput{UserName: &userName})
+	if isNoSuchEntity(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, cred := range output.ServiceSpecificCredentials {
+		_, err := aws.client.DeleteServiceSpecificCredential(ctx, &iam.DeleteServiceSpecificCredentialInput{
+			UserName:                    &userName,
+			ServiceSpecificCredentialId: cred.ServiceSpecificCredentialId,
+		})
+		if err != nil && !isNoSuchEntity(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (aws *awsIAMProvider) removeFromGroups(ctx context.Context, userName string) error {
+	paginator := iam.NewListGroupsForUserPaginator(aws.client, &iam.ListGroupsForUserInput{UserName: &userName})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if isNoSuchEntity(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, group := range output.Groups {
+			_, err := aws.client.RemoveUserFromGroup(ctx, &iam.RemoveUserFromGroupInput{UserName: &userName, GroupName: group.GroupName})
+			if err != nil && !isNoSuchEntity(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (aws *awsIAMProvider) detachPolicies(ctx context.Context, userName string) error {
+	paginator := iam.NewListAttachedUserPoliciesPaginator(aws.client, &iam.ListAttachedUserPoliciesInput{UserName: &userName})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if isNoSuchEntity(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, policy := range output.AttachedPolicies {
+			_, err := aws.client.DetachUserPolicy(ctx, &iam.DetachUserPolicyInput{UserName: &userName, PolicyArn: policy.PolicyArn})
+			if err != nil && !isNoSuchEntity(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (aws *awsIAMProvider) deleteInlinePolicies(ctx context.Context, userName string) error {
+	paginator := iam.NewListUserPoliciesPaginator(aws.client, &iam.ListUserPoliciesInput{UserName: &userName})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if isNoSuchEntity(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		for _, name := range output.PolicyNames {
+			name := name
+			_, err := aws.client.DeleteUserPolicy(ctx, &iam.DeleteUserPolicyInput{UserName: &userName, PolicyName: &name})
+			if err != nil && !isNoSuchEntity(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (aws *awsIAMProvider) deletePermissionsBoundary(ctx context.Context, userName string) error {
+	_, err := aws.client.DeleteUserPermissionsBoundary(ctx, &iam.DeleteUserPermissionsBoundaryInput{UserName: &userName})
+	if err != nil && !isNoSuchEntity(err) {
+		return err
+	}
+
+	return nil
+}
@@ -2,119 +2,661 @@ package aws
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"sort"
 	"strings"
 
-	awscfg "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/identitystore"
+	"github.com/aws/aws-sdk-go-v2/service/identitystore/document"
 	"github.com/aws/aws-sdk-go-v2/service/identitystore/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssoadmin"
 	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
 	"github.com/tiagoposse/go-identity-sync/utils"
 )
 
+// storeAttributePaths maps the flattened user fields that can be written to
+// their attribute path in UpdateUser. UserId and ExternalId are read only.
+var storeAttributePaths = map[string]string{
+	"UserName":          "userName",
+	"DisplayName":       "displayName",
+	"NickName":          "nickName",
+	"Title":             "title",
+	"Locale":            "locale",
+	"Timezone":          "timezone",
+	"UserType":          "userType",
+	"PreferredLanguage": "preferredLanguage",
+	"ProfileUrl":        "profileUrl",
+	"GivenName":         "name.givenName",
+	"FamilyName":        "name.familyName",
+	"MiddleName":        "name.middleName",
+	"Email":             "emails",
+}
+
 type awsIdentityStoreProvider struct {
 	config.BaseConfig
 
 	client          *identitystore.Client
 	identityStoreID *string
+
+	sso         *ssoadmin.Client
+	instanceArn string
+	assignments []config.AwsAssignmentConfig
 }
 
 func NewAwsIdentityStoreProvider(ctx context.Context, cfg *config.AwsIdentityStoreConfig) (*awsIdentityStoreProvider, error) {
+	// The Identity Store API cannot disable users.
+	if cfg.Deprovisioning.Suspends() {
+		return nil, errors.New("identity store users cannot be suspended, use the delete deprovisioning mode")
+	}
+
 	// Load AWS SDK configuration
-	clicfg, err := awscfg.LoadDefaultConfig(ctx)
+	clicfg, err := loadConfig(ctx, cfg.RateLimit, cfg.Profile)
 	if err != nil {
 		return nil, fmt.Errorf("loading AWS SDK configuration: %w", err)
 	}
 
+	if len(cfg.Assignments) > 0 && cfg.InstanceArn == "" {
+		return nil, errors.New("assignments require the identity center instanceArn")
+	}
+
 	// Create an identitystore client
 	client := identitystore.NewFromConfig(clicfg)
 	return &awsIdentityStoreProvider{
 		BaseConfig:      cfg.BaseConfig,
 		client:          client,
 		identityStoreID: &cfg.IdentityStoreID,
+		sso:             ssoadmin.NewFromConfig(clicfg),
+		instanceArn:     cfg.InstanceArn,
+		assignments:     cfg.Assignments,
 	}, nil
 }
 
-func (aws *awsIdentityStoreProvider) GetUser(ctx context.Context, id string) {
-	// Call GetUser API to get information for the specified user
+func (aws *awsIdentityStoreProvider) GetUser(ctx context.Context, id string) (*identitystore.DescribeUserOutput, error) {
 	input := &identitystore.DescribeUserInput{
 		IdentityStoreId: aws.identityStoreID,
 		UserId:          utils.StrPtr(id),
 	}
 
-	output, err := aws.client.DescribeUser(context.Background(), input)
+	output, err := aws.client.DescribeUser(ctx, input)
 	if err != nil {
-		fmt.Println("Error getting user information:", err)
-		return
+		return nil, fmt.Errorf("getting user information: %w", err)
 	}
 
-	fmt.Printf("Username: %s\n", *output.UserName)
-	fmt.Printf("User ID: %s\n", *output.UserId)
+	return output, nil
 }
 
-// func (aws *awsIdentityStoreProvider) GetUsers(ctx context.Context) ([]types.User, error) {
-// 	return aws.SearchUsers(ctx, "")
-// }
+// GetUserId looks up the id of the user provisioned with the given external id.
+func (aws *awsIdentityStoreProvider) GetUserId(ctx context.Context, issuer, externalID string) (string, error) {
+	output, err := aws.client.GetUserId(ctx, &identitystore.GetUserIdInput{
+		IdentityStoreId: aws.identityStoreID,
+		AlternateIdentifier: &types.AlternateIdentifierMemberExternalId{
+			Value: types.ExternalId{Issuer: &issuer, Id: &externalID},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("looking up user with external id %s/%s: %w", issuer, externalID, err)
+	}
 
-func (aws *awsIdentityStoreProvider) GetUsersAndMemberships(ctx context.Context, filter string) ([]types.User, map[string][]string, error) {
-	input := &identitystore.ListUsersInput{}
-	output, err := aws.client.ListUsers(ctx, input)
+	return *output.UserId, nil
+}
+
+func (aws *awsIdentityStoreProvider) userIDByName(ctx context.Context, userName string) (string, error) {
+	output, err := aws.client.GetUserId(ctx, &identitystore.GetUserIdInput{
+		IdentityStoreId: aws.identityStoreID,
+		AlternateIdentifier: &types.AlternateIdentifierMemberUniqueAttribute{
+			Value: types.UniqueAttribute{
+				AttributePath:  utils.StrPtr("userName"),
+				AttributeValue: document.NewLazyDocument(userName),
+			},
+		},
+	})
 	if err != nil {
-		return nil, nil, fmt.Errorf("listing users: %w", err)
+		return "", fmt.Errorf("looking up user %s: %w", userName, err)
+	}
+
+	return *output.UserId, nil
+}
+
+func (aws *awsIdentityStoreProvider) groupIDByName(ctx context.Context, displayName string) (string, error) {
+	output, err := aws.client.GetGroupId(ctx, &identitystore.GetGroupIdInput{
+		IdentityStoreId: aws.identityStoreID,
+		AlternateIdentifier: &types.AlternateIdentifierMemberUniqueAttribute{
+			Value: types.UniqueAttribute{
+				AttributePath:  utils.StrPtr("displayName"),
+				AttributeValue: document.NewLazyDocument(displayName),
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("looking up group %s: %w", displayName, err)
+	}
+
+	return *output.GroupId, nil
+}
+
+func (aws *awsIdentityStoreProvider) GetUsers(ctx context.Context, lo utils.ListOptions) ([]types.User, error) {
+	filter := ""
+	if lo.Filter != nil {
+		filter = *lo.Filter
+	}
+
+	users := make([]types.User, 0)
+
+	paginator := identitystore.NewListUsersPaginator(aws.client, &identitystore.ListUsersInput{IdentityStoreId: aws.identityStoreID})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing users: %w", err)
+		}
+
+		for _, user := range output.Users {
+			if filter == "" ||
+				strings.Contains(deref(user.UserName), filter) ||
+				strings.Contains(deref(user.UserId), filter) ||
+				strings.Contains(deref(user.DisplayName), filter) ||
+				strings.Contains(deref(user.NickName), filter) {
+				users = append(users, user)
+			}
+		}
 	}
 
-	groups := make(map[string][]string)
+	return users, nil
+}
+
+func (aws *awsIdentityStoreProvider) GetGroups(ctx context.Context) ([]types.Group, error) {
+	groups := make([]types.Group, 0)
 
-	filteredUsers := make([]types.User, 0)
-	for _, user := range output.Users {
-		if filter == "" ||
-			strings.Contains(*user.UserName, filter) ||
-			strings.Contains(*user.UserId, filter) ||
-			strings.Contains(*user.DisplayName, filter) ||
-			strings.Contains(*user.NickName, filter) {
-			filteredUsers = append(filteredUsers, user)
+	paginator := identitystore.NewListGroupsPaginator(aws.client, &identitystore.ListGroupsInput{IdentityStoreId: aws.identityStoreID})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing groups: %w", err)
 		}
-		userMemberships, err := aws.client.ListGroupMembershipsForMember(
-			ctx,
-			&identitystore.ListGroupMembershipsForMemberInput{},
-		)
+
+		groups = append(groups, output.Groups...)
+	}
+
+	return groups, nil
+}
+
+// GetGroupMembers returns the user ids of the members of a group.
+func (aws *awsIdentityStoreProvider) GetGroupMembers(ctx context.Context, groupID string) ([]string, error) {
+	members := make([]string, 0)
+
+	paginator := identitystore.NewListGroupMembershipsPaginator(aws.client, &identitystore.ListGroupMembershipsInput{
+		IdentityStoreId: aws.identityStoreID,
+		GroupId:         &groupID,
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing members of group %s: %w", groupID, err)
+		}
+
+		for _, membership := range output.GroupMemberships {
+			if member, ok := membership.MemberId.(*types.MemberIdMemberUserId); ok {
+				members = append(members, member.Value)
+			}
+		}
+	}
+
+	return members, nil
+}
+
+// GetUsersAndMemberships returns the users and the display names of their groups by user id.
+func (aws *awsIdentityStoreProvider) GetUsersAndMemberships(ctx context.Context, lo utils.ListOptions) ([]types.User, map[string][]string, error) {
+	users, err := aws.GetUsers(ctx, lo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	groups, err := aws.GetGroups(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	memberships := make(map[string][]string)
+	for _, group := range groups {
+		members, err := aws.GetGroupMembers(ctx, *group.GroupId)
 		if err != nil {
 			return nil, nil, err
 		}
 
-		groups[*user.UserId] = make([]string, 0)
-		for _, group := range userMemberships.GroupMemberships {
-			groups[*user.UserId] = append(groups[*user.UserId], *group.GroupId)
+		for _, member := range members {
+			memberships[member] = append(memberships[member], deref(group.DisplayName))
 		}
 	}
 
-	return filteredUsers, groups, nil
+	return users, memberships, nil
 }
 
-func (aws *awsIdentityStoreProvider) GetUsersConverted(ctx context.Context, filter string) ([]map[string]any, error) {
-	users, memberships, err := aws.GetUsersAndMemberships(ctx, filter)
+func (aws *awsIdentityStoreProvider) GetUsersConverted(ctx context.Context, lo utils.ListOptions) ([]map[string]any, error) {
+	users, memberships, err := aws.GetUsersAndMemberships(ctx, lo)
 	if err != nil {
 		return nil, err
 	}
 
 	convertedUsers := make([]map[string]any, 0)
 	for _, item := range users {
-		if user, err := aws.BaseConfig.ConvertUser(item); err != nil {
+		if user, err := aws.BaseConfig.ConvertUser(storeUserAttributes(item)); err != nil {
 			return nil, err
 		} else {
-			user[aws.BaseConfig.GroupField] = memberships[item.Id]
+			user[aws.BaseConfig.GroupField] = memberships[*item.UserId]
 			convertedUsers = append(convertedUsers, user)
 		}
 	}
 	return convertedUsers, nil
 }
 
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// storeUserAttributes flattens a user into the fields that can be mapped, using
+// the primary email and the first external id.
+func storeUserAttributes(user types.User) map[string]any {
+	attrs := map[string]any{
+		"UserId":            deref(user.UserId),
+		"UserName":          deref(user.UserName),
+		"DisplayName":       deref(user.DisplayName),
+		"NickName":          deref(user.NickName),
+		"Title":             deref(user.Title),
+		"Locale":            deref(user.Locale),
+		"Timezone":          deref(user.Timezone),
+		"UserType":          deref(user.UserType),
+		"PreferredLanguage": deref(user.PreferredLanguage),
+		"ProfileUrl":        deref(user.ProfileUrl),
+		"GivenName":         "",
+		"FamilyName":        "",
+		"MiddleName":        "",
+		"Email":             "",
+		"ExternalId":        "",
+	}
+
+	if user.Name != nil {
+		attrs["GivenName"] = deref(user.Name.GivenName)
+		attrs["FamilyName"] = deref(user.Name.FamilyName)
+		attrs["MiddleName"] = deref(user.Name.MiddleName)
+	}
+
+	for i, email := range user.Emails {
+		if email.Primary || i == 0 {
+			attrs["Email"] = deref(email.Value)
+		}
+	}
+
+	if len(user.ExternalIds) > 0 {
+		attrs["ExternalId"] = deref(user.ExternalIds[0].Id)
+	}
+
+	return attrs
+}
+
+// Plan keys users by their mapped UserName, which is unique in the store.
+// Group memberships follow the groups of the source users, matched to store
+// groups by display name. Groups in IgnoreGroups are left alone.
+func (aws *awsIdentityStoreProvider) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
+	users, err := aws.GetUsers(ctx, utils.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make([]map[string]any, 0, len(users))
+	for _, user := range users {
+		attrs = append(attrs, storeUserAttributes(user))
+	}
+
+	field := aws.BaseConfig.Mapping["UserName"]
+	current, err := aws.BaseConfig.ConvertUsers(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	toAdd, toRemove, toUpdate, err := aws.BaseConfig.RawCompareUsers(current, source, field)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]string)
+	names := make(map[string]string)
+	for i, user := range users {
+		ids[config.KeyOf(current[i], field)] = *user.UserId
+		names[*user.UserId] = config.KeyOf(current[i], field)
+	}
+
+	plan := engine.NewPlan(fmt.Sprintf("aws/identitystore/%s", *aws.identityStoreID))
+	plan.SetState(current, source, field)
+	for _, u := range toAdd {
+		u := u
+		key := config.KeyOf(u, field)
+		plan.AddVerified(engine.OperationCreate, key, u, func(ctx context.Context) error {
+			return aws.createUser(ctx, u)
+		}, func(ctx context.Context) (bool, error) {
+			_, err := aws.userIDByName(ctx, key)
+			return err == nil, ignoreNotFound(err)
+		})
+	}
+
+	for _, u := range toRemove {
+		id := ids[config.KeyOf(u, field)]
+		plan.Add(engine.OperationDelete, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return aws.deleteUser(ctx, id)
+		})
+	}
+
+	for _, u := range toUpdate {
+		u := u
+		id := ids[config.KeyOf(u, field)]
+		plan.Add(engine.OperationUpdate, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return aws.updateUser(ctx, id, u)
+		})
+	}
+
+	groups, err := aws.GetGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := aws.planMemberships(ctx, plan, source, groups, names); err != nil {
+		return nil, err
+	}
+
+	if err := aws.planAssignments(ctx, plan, groups); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// planMemberships creates the source groups missing from the store and
+// brings the members of every managed group in line with the source.
+func (aws *awsIdentityStoreProvider) planMemberships(ctx context.Context, plan *engine.Plan, source []map[string]any, groups []types.Group, names map[string]string) error {
+	field := aws.BaseConfig.Mapping["UserName"]
+
+	current := make(map[string][]string)
+	desired := make(map[string][]string)
+	for _, group := range groups {
+		name := deref(group.DisplayName)
+		if slices.Contains(aws.BaseConfig.IgnoreGroups, name) {
+			continue
+		}
+
+		members, err := aws.GetGroupMembers(ctx, *group.GroupId)
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			if userName, ok := names[member]; ok && !slices.Contains(aws.BaseConfig.IgnoreUsers, userName) {
+				current[name] = append(current[name], userName)
+			}
+		}
+		desired[name] = make([]string, 0)
+	}
+
+	missing := make(map[string]bool)
+	for _, u := range source {
+		for _, group := range aws.BaseConfig.GroupsOf(u) {
+			if slices.Contains(aws.BaseConfig.IgnoreGroups, group) {
+				continue
+			}
+
+			if _, ok := desired[group]; !ok {
+				missing[group] = true
+			}
+			desired[group] = append(desired[group], config.KeyOf(u, field))
+		}
+	}
+
+	created := make([]string, 0, len(missing))
+	for group := range missing {
+		created = append(created, group)
+	}
+	sort.Strings(created)
+
+	for _, group := range created {
+		group := group
+		plan.AddVerified(engine.OperationCreateGroup, group, map[string]any{"name": group}, func(ctx context.Context) error {
+			return aws.createGroup(ctx, group)
+		}, func(ctx context.Context) (bool, error) {
+			_, err := aws.groupIDByName(ctx, group)
+			return err == nil, ignoreNotFound(err)
+		})
+	}
+
+	plan.AddMemberships(current, desired, aws.addMember, aws.removeMember)
+	return nil
+}
+
+func ignoreNotFound(err error) error {
+	var nf *types.ResourceNotFoundException
+	if errors.As(err, &nf) {
+		return nil
+	}
+
+	return err
+}
+
+func (aws *awsIdentityStoreProvider) SyncProvider(ctx context.Context, source []map[string]any, opts ...engine.Option) (*engine.Result, error) {
+	plan, err := aws.Plan(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]engine.Option{engine.WithConfig(aws.BaseConfig)}, opts...)
+	return engine.Apply(ctx, plan, opts...)
+}
+
+// providerValues returns the user's mapped provider fields as strings.
+func (aws *awsIdentityStoreProvider) providerValues(u map[string]any) (map[string]string, error) {
+	mapped, err := aws.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for k, v := range mapped {
+		if v != nil {
+			values[k] = fmt.Sprint(v)
+		}
+	}
+
+	return values, nil
+}
+
+func strOrNil(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func primaryEmail(email string) []types.Email {
+	if email == "" {
+		return nil
+	}
+
+	return []types.Email{{Value: &email, Primary: true, Type: utils.StrPtr("work")}}
+}
+
+func (aws *awsIdentityStoreProvider) createUser(ctx context.Context, u map[string]any) error {
+	values, err := aws.providerValues(u)
+	if err != nil {
+		return err
+	}
+
+	input := &identitystore.CreateUserInput{
+		IdentityStoreId:   aws.identityStoreID,
+		UserName:          strOrNil(values["UserName"]),
+		DisplayName:       strOrNil(values["DisplayName"]),
+		NickName:          strOrNil(values["NickName"]),
+		Title:             strOrNil(values["Title"]),
+		Locale:            strOrNil(values["Locale"]),
+		Timezone:          strOrNil(values["Timezone"]),
+		UserType:          strOrNil(values["UserType"]),
+		PreferredLanguage: strOrNil(values["PreferredLanguage"]),
+		ProfileUrl:        strOrNil(values["ProfileUrl"]),
+		Emails:            primaryEmail(values["Email"]),
+		Name: &types.Name{
+			GivenName:  strOrNil(values["GivenName"]),
+			FamilyName: strOrNil(values["FamilyName"]),
+			MiddleName: strOrNil(values["MiddleName"]),
+		},
+	}
+
+	if _, err := aws.client.CreateUser(ctx, input); err != nil {
+		return fmt.Errorf("creating user %s: %w", values["UserName"], err)
+	}
+
+	return nil
+}
+
+// updateUser replaces every mapped writable attribute. Empty values remove the attribute.
+func (aws *awsIdentityStoreProvider) updateUser(ctx context.Context, id string, u map[string]any) error {
+	values, err := aws.providerValues(u)
+	if err != nil {
+		return err
+	}
+
+	fields := make([]string, 0, len(values))
+	for field := range values {
+		if _, ok := storeAttributePaths[field]; ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	operations := make([]types.AttributeOperation, 0, len(fields))
+	for _, field := range fields {
+		op := types.AttributeOperation{AttributePath: utils.StrPtr(storeAttributePaths[field])}
+
+		switch {
+		case values[field] == "":
+		case field == "Email":
+			// The document encoder keeps Go field names, so the emails are
+			// spelled out with the attribute names UpdateUser expects.
+			op.AttributeValue = document.NewLazyDocument([]map[string]any{
+				{"value": values[field], "type": "work", "primary": true},
+			})
+		default:
+			op.AttributeValue = document.NewLazyDocument(values[field])
+		}
+
+		operations = append(operations, op)
+	}
+
+	if len(operations) == 0 {
+		return nil
+	}
+
+	if _, err := aws.client.UpdateUser(ctx, &identitystore.UpdateUserInput{
+		IdentityStoreId: aws.identityStoreID,
+		UserId:          &id,
+		Operations:      operations,
+	}); err != nil {
+		return fmt.Errorf("updating user %s: %w", id, err)
+	}
+
+	return nil
+}
+
+func (aws *awsIdentityStoreProvider) deleteUser(ctx context.Context, id string) error {
+	_, err := aws.client.DeleteUser(ctx, &identitystore.DeleteUserInput{
+		IdentityStoreId: aws.identityStoreID,
+		UserId:          &id,
+	})
+	if ignoreNotFound(err) != nil {
+		return fmt.Errorf("deleting user %s: %w", id, err)
+	}
+
+	return nil
+}
+
+func (aws *awsIdentityStoreProvider) createGroup(ctx context.Context, displayName string) error {
+	if _, err := aws.client.CreateGroup(ctx, &identitystore.CreateGroupInput{
+		IdentityStoreId: aws.identityStoreID,
+		DisplayName:     &displayName,
+	}); err != nil {
+		return fmt.Errorf("creating group %s: %w", displayName, err)
+	}
+
+	return nil
+}
+
+// addMember resolves the group and user when applied, so both may have been
+// created earlier in the same plan.
+func (aws *awsIdentityStoreProvider) addMember(ctx context.Context, group, userName string) error {
+	groupID, err := aws.groupIDByName(ctx, group)
+	if err != nil {
+		return err
+	}
+
+	userID, err := aws.userIDByName(ctx, userName)
+	if err != nil {
+		return err
+	}
+
+	if _, err := aws.client.CreateGroupMembership(ctx, &identitystore.CreateGroupMembershipInput{
+		IdentityStoreId: aws.identityStoreID,
+		GroupId:         &groupID,
+		MemberId:        &types.MemberIdMemberUserId{Value: userID},
+	}); err != nil {
+		return fmt.Errorf("adding user %s to group %s: %w", userName, group, err)
+	}
+
+	return nil
+}
+
+// removeMember tolerates memberships that are already gone, e.g. because the
+// user was deleted earlier in the same plan.
+func (aws *awsIdentityStoreProvider) removeMember(ctx context.Context, group, userName string) error {
+	groupID, err := aws.groupIDByName(ctx, group)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+
+	userID, err := aws.userIDByName(ctx, userName)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+
+	output, err := aws.client.GetGroupMembershipId(ctx, &identitystore.GetGroupMembershipIdInput{
+		IdentityStoreId: aws.identityStoreID,
+		GroupId:         &groupID,
+		MemberId:        &types.MemberIdMemberUserId{Value: userID},
+	})
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+
+	_, err = aws.client.DeleteGroupMembership(ctx, &identitystore.DeleteGroupMembershipInput{
+		IdentityStoreId: aws.identityStoreID,
+		MembershipId:    output.MembershipId,
+	})
+	if ignoreNotFound(err) != nil {
+		return fmt.Errorf("removing user %s from group %s: %w", userName, group, err)
+	}
+
+	return nil
+}
+
 func (aws *awsIdentityStoreProvider) Sync(ctx context.Context, users []map[string]any) (add, remove, update []map[string]any, retErr error) {
-	sourceUsers, err := aws.GetUsers(ctx)
+	sourceUsers, err := aws.GetUsers(ctx, utils.ListOptions{})
 	if err != nil {
 		retErr = err
 		return
 	}
 
-	return aws.BaseConfig.CompareUsers(sourceUsers, users, aws.BaseConfig.Mapping["UserId"])
+	attrs := make([]map[string]any, 0, len(sourceUsers))
+	for _, user := range sourceUsers {
+		attrs = append(attrs, storeUserAttributes(user))
+	}
+
+	return aws.BaseConfig.CompareUsers(attrs, users, aws.BaseConfig.Mapping["UserName"])
 }
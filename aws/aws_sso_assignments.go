@@ -0,0 +1,271 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/identitystore/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssoadmin"
+	ssotypes "github.com/aws/aws-sdk-go-v2/service/ssoadmin/types"
+	"github.com/tiagoposse/go-identity-sync/engine"
+)
+
+// assignmentPollInterval is how often the status of an account assignment
+// request is checked, since the SSO Admin API applies them asynchronously.
+const assignmentPollInterval = 2 * time.Second
+
+// assignment is a permission set given to a group in an account.
+type assignment struct {
+	Group         string
+	PermissionSet string
+	Account       string
+}
+
+func (a assignment) key() string {
+	return fmt.Sprintf("%s/%s/%s", a.Group, a.PermissionSet, a.Account)
+}
+
+func (a assignment) object() map[string]any {
+	return map[string]any{
+		"group":         a.Group,
+		"permissionSet": a.PermissionSet,
+		"account":       a.Account,
+	}
+}
+
+// permissionSetArns returns the ARN of every permission set in the instance by name.
+func (aws *awsIdentityStoreProvider) permissionSetArns(ctx context.Context) (map[string]string, error) {
+	arns := make(map[string]string)
+
+	paginator := ssoadmin.NewListPermissionSetsPaginator(aws.sso, &ssoadmin.ListPermissionSetsInput{InstanceArn: &aws.instanceArn})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing permission sets: %w", err)
+		}
+
+		for _, arn := range output.PermissionSets {
+			arn := arn
+			ps, err := aws.sso.DescribePermissionSet(ctx, &ssoadmin.DescribePermissionSetInput{
+				InstanceArn:      &aws.instanceArn,
+				PermissionSetArn: &arn,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("describing permission set %s: %w", arn, err)
+			}
+
+			arns[*ps.PermissionSet.Name] = arn
+		}
+	}
+
+	return arns, nil
+}
+
+// currentAssignments returns the group principals assigned the permission set in the account.
+func (aws *awsIdentityStoreProvider) currentAssignments(ctx context.Context, permissionSetArn, account string) ([]string, error) {
+	principals := make([]string, 0)
+
+	paginator := ssoadmin.NewListAccountAssignmentsPaginator(aws.sso, &ssoadmin.ListAccountAssignmentsInput{
+		InstanceArn:      &aws.instanceArn,
+		PermissionSetArn: &permissionSetArn,
+		AccountId:        &account,
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("listing assignments of %s in %s: %w", permissionSetArn, account, err)
+		}
+
+		for _, a := range output.AccountAssignments {
+			if a.PrincipalType == ssotypes.PrincipalTypeGroup {
+				principals = append(principals, *a.PrincipalId)
+			}
+		}
+	}
+
+	return principals, nil
+}
+
+// planAssignments brings the group assignments of every permission set and
+// account named in the config in line with it. Assignments of other
+// permission sets or accounts are left alone.
+func (aws *awsIdentityStoreProvider) planAssignments(ctx context.Context, plan *engine.Plan, groups []types.Group) error {
+	if len(aws.assignments) == 0 {
+		return nil
+	}
+
+	arns, err := aws.permissionSetArns(ctx)
+	if err != nil {
+		return err
+	}
+
+	groupNames := make(map[string]string)
+	for _, group := range groups {
+		groupNames[*group.GroupId] = deref(group.DisplayName)
+	}
+
+	desired := make(map[assignment]bool)
+	for _, cfg := range aws.assignments {
+		arn := cfg.PermissionSet
+		if !strings.HasPrefix(arn, "arn:") {
+			if arn = arns[cfg.PermissionSet]; arn == "" {
+				return fmt.Errorf("permission set %s does not exist", cfg.PermissionSet)
+			}
+		}
+
+		for _, account := range cfg.Accounts {
+			desired[assignment{Group: cfg.Group, PermissionSet: arn, Account: account}] = true
+		}
+	}
+
+	scopes := make(map[assignment]bool)
+	for a := range desired {
+		scopes[assignment{PermissionSet: a.PermissionSet, Account: a.Account}] = true
+	}
+
+	current := make(map[assignment]string)
+	for scope := range scopes {
+		principals, err := aws.currentAssignments(ctx, scope.PermissionSet, scope.Account)
+		if err != nil {
+			return err
+		}
+
+		for _, principal := range principals {
+			name, ok := groupNames[principal]
+			if !ok {
+				name = principal
+			}
+			current[assignment{Group: name, PermissionSet: scope.PermissionSet, Account: scope.Account}] = principal
+		}
+	}
+
+	// Assigned principals count towards the members revokes are checked against.
+	plan.Members += len(current)
+	plan.DesiredMembers += len(desired)
+
+	for _, a := range sortedAssignments(desired) {
+		a := a
+		if _, ok := current[a]; ok {
+			continue
+		}
+
+		plan.Add(engine.OperationGrant, a.key(), a.object(), func(ctx context.Context) error {
+			groupID, err := aws.groupIDByName(ctx, a.Group)
+			if err != nil {
+				return err
+			}
+
+			return aws.createAssignment(ctx, a, groupID)
+		})
+	}
+
+	extra := make(map[assignment]bool)
+	for a := range current {
+		if !desired[a] {
+			extra[a] = true
+		}
+	}
+
+	for _, a := range sortedAssignments(extra) {
+		a := a
+		principal := current[a]
+		plan.Add(engine.OperationRevoke, a.key(), a.object(), func(ctx context.Context) error {
+			return aws.deleteAssignment(ctx, a, principal)
+		})
+	}
+
+	return nil
+}
+
+func sortedAssignments(set map[assignment]bool) []assignment {
+	list := make([]assignment, 0, len(set))
+	for a := range set {
+		list = append(list, a)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].key() < list[j].key()
+	})
+
+	return list
+}
+
+func (aws *awsIdentityStoreProvider) createAssignment(ctx context.Context, a assignment, groupID string) error {
+	output, err := aws.sso.CreateAccountAssignment(ctx, &ssoadmin.CreateAccountAssignmentInput{
+		InstanceArn:      &aws.instanceArn,
+		PermissionSetArn: &a.PermissionSet,
+		PrincipalId:      &groupID,
+		PrincipalType:    ssotypes.PrincipalTypeGroup,
+		TargetId:         &a.Account,
+		TargetType:       ssotypes.TargetTypeAwsAccount,
+	})
+	if err != nil {
+		return fmt.Errorf("assigning %s to %s in %s: %w", a.PermissionSet, a.Group, a.Account, err)
+	}
+
+	return aws.waitForAssignment(ctx, output.AccountAssignmentCreationStatus, func(ctx context.Context, id *string) (*ssotypes.AccountAssignmentOperationStatus, error) {
+		res, err := aws.sso.DescribeAccountAssignmentCreationStatus(ctx, &ssoadmin.DescribeAccountAssignmentCreationStatusInput{
+			InstanceArn:                        &aws.instanceArn,
+			AccountAssignmentCreationRequestId: id,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res.AccountAssignmentCreationStatus, nil
+	})
+}
+
+func (aws *awsIdentityStoreProvider) deleteAssignment(ctx context.Context, a assignment, principal string) error {
+	output, err := aws.sso.DeleteAccountAssignment(ctx, &ssoadmin.DeleteAccountAssignmentInput{
+		InstanceArn:      &aws.instanceArn,
+		PermissionSetArn: &a.PermissionSet,
+		PrincipalId:      &principal,
+		PrincipalType:    ssotypes.PrincipalTypeGroup,
+		TargetId:         &a.Account,
+		TargetType:       ssotypes.TargetTypeAwsAccount,
+	})
+	if err != nil {
+		return fmt.Errorf("removing %s from %s in %s: %w", a.PermissionSet, a.Group, a.Account, err)
+	}
+
+	return aws.waitForAssignment(ctx, output.AccountAssignmentDeletionStatus, func(ctx context.Context, id *string) (*ssotypes.AccountAssignmentOperationStatus, error) {
+		res, err := aws.sso.DescribeAccountAssignmentDeletionStatus(ctx, &ssoadmin.DescribeAccountAssignmentDeletionStatusInput{
+			InstanceArn:                        &aws.instanceArn,
+			AccountAssignmentDeletionRequestId: id,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return res.AccountAssignmentDeletionStatus, nil
+	})
+}
+
+// waitForAssignment polls an assignment request until it succeeds or fails.
+func (aws *awsIdentityStoreProvider) waitForAssignment(ctx context.Context, status *ssotypes.AccountAssignmentOperationStatus, describe func(ctx context.Context, id *string) (*ssotypes.AccountAssignmentOperationStatus, error)) error {
+	ticker := time.NewTicker(assignmentPollInterval)
+	defer ticker.Stop()
+
+	for {
+		switch status.Status {
+		case ssotypes.StatusValuesSucceeded:
+			return nil
+		case ssotypes.StatusValuesFailed:
+			return fmt.Errorf("assignment request %s failed: %s", deref(status.RequestId), deref(status.FailureReason))
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for assignment request %s: %w", deref(status.RequestId), ctx.Err())
+		case <-ticker.C:
+		}
+
+		next, err := describe(ctx, status.RequestId)
+		if err != nil {
+			return fmt.Errorf("checking assignment request %s: %w", deref(status.RequestId), err)
+		}
+		status = next
+	}
+}
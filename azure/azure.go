@@ -0,0 +1,505 @@
+package azure
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/utils"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	keyAttribute     = "userPrincipalName"
+	enabledAttribute = "accountEnabled"
+)
+
+// azureProvider syncs users and security groups of a Microsoft Entra ID
+// tenant through Microsoft Graph. Users are keyed by their userPrincipalName
+// and groups by displayName.
+type azureProvider struct {
+	config.BaseConfig
+
+	client     *Client
+	tenant     string
+	transitive bool
+}
+
+// NewAzureProvider authenticates with the client credentials of an app
+// registration that has the User.ReadWrite.All and GroupMember.ReadWrite.All
+// application permissions.
+func NewAzureProvider(ctx context.Context, cfg *config.AzureConfig) (*azureProvider, error) {
+	if cfg.TenantID == "" || cfg.ClientID == "" {
+		return nil, errors.New("azure requires a tenantID and a clientID")
+	}
+
+	if cfg.ClientSecret == nil || cfg.ClientSecret.Value == nil {
+		return nil, errors.New("azure requires a clientSecret")
+	}
+
+	loginUrl := cfg.LoginUrl
+	if loginUrl == "" {
+		loginUrl = defaultLoginUrl
+	}
+
+	cc := clientcredentials.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: *cfg.ClientSecret.Value,
+		TokenURL:     fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(loginUrl, "/"), cfg.TenantID),
+		Scopes:       []string{graphScope},
+	}
+
+	return NewAzureProviderWithClient(cfg, cc.Client(ctx))
+}
+
+// NewAzureProviderWithClient sends the Graph requests through client, which
+// has to authenticate them, e.g. to run against a local Graph stand-in. The
+// requests are rate limited and retried on top of its transport.
+func NewAzureProviderWithClient(cfg *config.AzureConfig, client *http.Client) (*azureProvider, error) {
+	if _, ok := cfg.Mapping[keyAttribute]; !ok {
+		return nil, fmt.Errorf("the %s attribute must be mapped", keyAttribute)
+	}
+
+	transport, err := utils.NewRateLimitTransport(client.Transport, cfg.RateLimit, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	limited := *client
+	limited.Transport = transport
+
+	return &azureProvider{
+		BaseConfig: cfg.BaseConfig,
+		client:     NewClient(cfg.GraphUrl, &limited, cfg.RateLimit),
+		tenant:     cfg.TenantID,
+		transitive: cfg.TransitiveMembership,
+	}, nil
+}
+
+// selected lists the user properties to request: the mapped ones plus the
+// ones the provider needs itself.
+func (ap *azureProvider) selected() []string {
+	attrs := []string{"id", keyAttribute, enabledAttribute}
+	for attr := range ap.BaseConfig.Mapping {
+		if !slices.Contains(attrs, attr) {
+			attrs = append(attrs, attr)
+		}
+	}
+	sort.Strings(attrs[3:])
+
+	return attrs
+}
+
+// GetUsers returns the users matching the OData filter in the list options.
+func (ap *azureProvider) GetUsers(ctx context.Context, lo utils.ListOptions) ([]map[string]any, error) {
+	filter := ""
+	if lo.Filter != nil {
+		filter = *lo.Filter
+	}
+
+	return ap.client.ListUsers(ctx, filter, ap.selected())
+}
+
+func (ap *azureProvider) GetGroups(ctx context.Context, filter string) ([]Group, error) {
+	return ap.client.ListGroups(ctx, filter)
+}
+
+// memberships maps user ids to the names of the groups they are in, through
+// nested groups too when transitive is set.
+func (ap *azureProvider) memberships(ctx context.Context, groups []Group, transitive bool) (map[string][]string, error) {
+	groupIDs := make([]string, 0, len(groups))
+	for _, group := range groups {
+		groupIDs = append(groupIDs, group.ID)
+	}
+
+	members, err := ap.client.MemberIDs(ctx, groupIDs, transitive)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships := make(map[string][]string)
+	for _, group := range groups {
+		for _, id := range members[group.ID] {
+			memberships[id] = append(memberships[id], group.DisplayName)
+		}
+	}
+
+	return memberships, nil
+}
+
+func (ap *azureProvider) GetUsersConverted(ctx context.Context, lo utils.ListOptions) ([]map[string]any, error) {
+	users, err := ap.GetUsers(ctx, lo)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := ap.GetGroups(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	memberships, err := ap.memberships(ctx, groups, ap.transitive)
+	if err != nil {
+		return nil, err
+	}
+
+	convertedUsers := make([]map[string]any, 0, len(users))
+	for _, item := range users {
+		user, err := ap.BaseConfig.ConvertUser(item)
+		if err != nil {
+			return nil, err
+		}
+
+		user[ap.BaseConfig.GroupField] = memberships[fmt.Sprint(item["id"])]
+		convertedUsers = append(convertedUsers, user)
+	}
+
+	return convertedUsers, nil
+}
+
+func (ap *azureProvider) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
+	users, err := ap.GetUsers(ctx, utils.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	field := ap.BaseConfig.Mapping[keyAttribute]
+	current, err := ap.BaseConfig.ConvertUsers(users)
+	if err != nil {
+		return nil, err
+	}
+
+	toAdd, toRemove, toUpdate, err := ap.BaseConfig.RawCompareUsers(current, source, field)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]string)
+	names := make(map[string]string)
+	suspended := make(map[string]bool)
+	for i, user := range users {
+		key := config.KeyOf(current[i], field)
+		id := fmt.Sprint(user["id"])
+		ids[key] = id
+		names[id] = key
+		suspended[key] = user[enabledAttribute] == false
+	}
+
+	known := &planIDs{users: ids, groups: make(map[string]string)}
+
+	plan := engine.NewPlan(fmt.Sprintf("azure/%s", ap.tenant))
+	plan.SetState(current, source, field)
+	for _, u := range toAdd {
+		u := u
+		key := config.KeyOf(u, field)
+		plan.AddVerified(engine.OperationCreate, key, u, func(ctx context.Context) error {
+			id, err := ap.createUser(ctx, u)
+			if err == nil {
+				known.users[key] = id
+			}
+			return err
+		}, func(ctx context.Context) (bool, error) {
+			user, err := ap.findUser(ctx, key)
+			return user != nil, err
+		})
+	}
+
+	for _, u := range toRemove {
+		id := ids[config.KeyOf(u, field)]
+		plan.AddRemoval(ap.BaseConfig.Deprovisioning, config.KeyOf(u, field), u, suspended[config.KeyOf(u, field)], func(ctx context.Context) error {
+			return ap.setEnabled(ctx, id, false)
+		}, func(ctx context.Context) error {
+			return ap.deleteUser(ctx, id)
+		})
+	}
+
+	if ap.BaseConfig.Deprovisioning.Suspends() {
+		for _, u := range source {
+			key := config.KeyOf(u, field)
+			if id, ok := ids[key]; ok && suspended[key] {
+				plan.Add(engine.OperationReactivate, key, u, func(ctx context.Context) error {
+					return ap.setEnabled(ctx, id, true)
+				})
+			}
+		}
+	}
+
+	for _, u := range toUpdate {
+		u := u
+		id := ids[config.KeyOf(u, field)]
+		plan.Add(engine.OperationUpdate, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return ap.updateUser(ctx, id, u)
+		})
+	}
+
+	if err := ap.planGroups(ctx, plan, source, names, known); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// planGroups creates missing source groups and syncs the direct members of
+// every group that is not ignored, as nested memberships cannot be written.
+func (ap *azureProvider) planGroups(ctx context.Context, plan *engine.Plan, source []map[string]any, names map[string]string, known *planIDs) error {
+	field := ap.BaseConfig.Mapping[keyAttribute]
+
+	groups, err := ap.GetGroups(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	groups = slices.DeleteFunc(groups, func(group Group) bool {
+		return slices.Contains(ap.BaseConfig.IgnoreGroups, group.DisplayName)
+	})
+
+	memberships, err := ap.memberships(ctx, groups, false)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string][]string)
+	desired := make(map[string][]string)
+	for _, group := range groups {
+		known.groups[group.DisplayName] = group.ID
+		desired[group.DisplayName] = make([]string, 0)
+	}
+
+	for id, groups := range memberships {
+		if key, ok := names[id]; ok {
+			for _, group := range groups {
+				current[group] = append(current[group], key)
+			}
+		}
+	}
+
+	missing := make([]string, 0)
+	for _, u := range source {
+		for _, group := range ap.BaseConfig.GroupsOf(u) {
+			if slices.Contains(ap.BaseConfig.IgnoreGroups, group) {
+				continue
+			}
+
+			if _, ok := desired[group]; !ok {
+				missing = append(missing, group)
+				desired[group] = make([]string, 0)
+			}
+			desired[group] = append(desired[group], config.KeyOf(u, field))
+		}
+	}
+	sort.Strings(missing)
+
+	for _, group := range missing {
+		group := group
+		plan.AddVerified(engine.OperationCreateGroup, group, map[string]any{"name": group}, func(ctx context.Context) error {
+			id, err := ap.client.CreateGroup(ctx, group)
+			if err == nil {
+				known.groups[group] = id
+			}
+			return err
+		}, func(ctx context.Context) (bool, error) {
+			found, err := ap.findGroup(ctx, group)
+			return found != nil, err
+		})
+	}
+
+	plan.AddMemberships(current, desired, func(ctx context.Context, group, member string) error {
+		return ap.addMember(ctx, known, group, member)
+	}, func(ctx context.Context, group, member string) error {
+		return ap.removeMember(ctx, known, group, member)
+	})
+	return nil
+}
+
+func (ap *azureProvider) SyncProvider(ctx context.Context, source []map[string]any, opts ...engine.Option) (*engine.Result, error) {
+	plan, err := ap.Plan(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]engine.Option{engine.WithConfig(ap.BaseConfig)}, opts...)
+	return engine.Apply(ctx, plan, opts...)
+}
+
+// findUser returns the user with the given userPrincipalName, or nil if there is none.
+func (ap *azureProvider) findUser(ctx context.Context, upn string) (map[string]any, error) {
+	user, err := ap.client.GetUser(ctx, upn, []string{"id", keyAttribute})
+	if IsNotFound(err) {
+		return nil, nil
+	}
+
+	return user, err
+}
+
+// findGroup returns the group with the given displayName, or nil if there is none.
+func (ap *azureProvider) findGroup(ctx context.Context, name string) (*Group, error) {
+	groups, err := ap.GetGroups(ctx, fmt.Sprintf("displayName eq %s", quote(name)))
+	if err != nil || len(groups) == 0 {
+		return nil, err
+	}
+
+	return &groups[0], nil
+}
+
+// writable returns the mapped attributes Graph accepts in a write, with empty
+// values as null so that they are cleared.
+func (ap *azureProvider) writable(u map[string]any) (map[string]any, error) {
+	mapped, err := ap.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return nil, err
+	}
+	delete(mapped, "id")
+	delete(mapped, enabledAttribute)
+
+	for attr, val := range mapped {
+		if val == "" {
+			mapped[attr] = nil
+		}
+	}
+
+	return mapped, nil
+}
+
+// randomPassword returns an initial password that meets the tenant's
+// complexity rules. Users have to change it when they first sign in.
+func randomPassword() (string, error) {
+	bs := make([]byte, 24)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(bs) + "Aa1!", nil
+}
+
+// createUser creates an enabled user. Graph requires a displayName, a
+// mailNickname and a password, which are derived when they are not mapped.
+func (ap *azureProvider) createUser(ctx context.Context, u map[string]any) (string, error) {
+	user, err := ap.writable(u)
+	if err != nil {
+		return "", err
+	}
+
+	for attr, val := range user {
+		if val == nil {
+			delete(user, attr)
+		}
+	}
+
+	upn := fmt.Sprint(user[keyAttribute])
+	if _, ok := user["displayName"]; !ok {
+		user["displayName"] = upn
+	}
+	if _, ok := user["mailNickname"]; !ok {
+		user["mailNickname"] = mailNickname(upn)
+	}
+
+	password, err := randomPassword()
+	if err != nil {
+		return "", fmt.Errorf("generating password: %w", err)
+	}
+
+	user[enabledAttribute] = true
+	user["passwordProfile"] = map[string]any{
+		"forceChangePasswordNextSignIn": true,
+		"password":                      password,
+	}
+
+	return ap.client.CreateUser(ctx, user)
+}
+
+// updateUser replaces the mapped attributes, clearing the ones that are empty.
+func (ap *azureProvider) updateUser(ctx context.Context, id string, u map[string]any) error {
+	user, err := ap.writable(u)
+	if err != nil {
+		return err
+	}
+
+	if len(user) == 0 {
+		return nil
+	}
+
+	return ap.client.UpdateUser(ctx, id, user)
+}
+
+// setEnabled disables or re-enables sign-in for a user.
+func (ap *azureProvider) setEnabled(ctx context.Context, id string, enabled bool) error {
+	return ap.client.UpdateUser(ctx, id, map[string]any{enabledAttribute: enabled})
+}
+
+// deleteUser moves a user to the tenant's deleted items, from where it can be
+// restored for 30 days.
+func (ap *azureProvider) deleteUser(ctx context.Context, id string) error {
+	if err := ap.client.DeleteUser(ctx, id); err != nil && !IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// planIDs are the ids of the users and groups of a plan by name. They are
+// known from planning or recorded as objects are created, so membership
+// operations only look up objects created by an earlier, interrupted apply.
+type planIDs struct {
+	users  map[string]string
+	groups map[string]string
+}
+
+// memberIDs resolves a group and a user by name to their ids, looking them up
+// once when they are not known yet.
+func (ap *azureProvider) memberIDs(ctx context.Context, known *planIDs, group, member string) (string, string, error) {
+	if _, ok := known.groups[group]; !ok {
+		g, err := ap.findGroup(ctx, group)
+		if err != nil {
+			return "", "", err
+		}
+		if g == nil {
+			return "", "", fmt.Errorf("group %s not found", group)
+		}
+		known.groups[group] = g.ID
+	}
+
+	if _, ok := known.users[member]; !ok {
+		user, err := ap.findUser(ctx, member)
+		if err != nil {
+			return "", "", err
+		}
+		if user == nil {
+			return "", "", fmt.Errorf("user %s not found", member)
+		}
+		known.users[member] = fmt.Sprint(user["id"])
+	}
+
+	return known.groups[group], known.users[member], nil
+}
+
+func (ap *azureProvider) addMember(ctx context.Context, known *planIDs, group, member string) error {
+	groupID, userID, err := ap.memberIDs(ctx, known, group, member)
+	if err != nil {
+		return err
+	}
+
+	return ap.client.AddMember(ctx, groupID, userID)
+}
+
+// removeMember tolerates members that are already gone, such as users
+// deleted earlier in the same plan, which Graph removes from their groups.
+func (ap *azureProvider) removeMember(ctx context.Context, known *planIDs, group, member string) error {
+	groupID, userID, err := ap.memberIDs(ctx, known, group, member)
+	if err != nil {
+		return err
+	}
+
+	if err := ap.client.RemoveMember(ctx, groupID, userID); err != nil && !IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
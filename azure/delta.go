@@ -0,0 +1,207 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/utils"
+)
+
+// deltaCursor holds the delta links of the users and groups delta queries.
+type deltaCursor struct {
+	Users  string `json:"users"`
+	Groups string `json:"groups"`
+}
+
+// groupDelta is a group as returned by the groups delta query. DisplayName is
+// only set when it changed, and members@delta only lists the changed members.
+type groupDelta struct {
+	ID          string          `json:"id"`
+	DisplayName *string         `json:"displayName"`
+	Removed     json.RawMessage `json:"@removed"`
+	Members     []struct {
+		ID   string `json:"id"`
+		Type string `json:"@odata.type"`
+	} `json:"members@delta"`
+}
+
+// isResync reports whether Graph can no longer resume a delta query, so it
+// has to start over from a full read.
+func isResync(err error) bool {
+	var graphErr *Error
+	if !errors.As(err, &graphErr) {
+		return false
+	}
+
+	return graphErr.StatusCode == http.StatusGone ||
+		graphErr.Code == "resyncRequired" ||
+		strings.HasPrefix(graphErr.Code, "syncState")
+}
+
+// Cursor starts the users and groups delta queries at the current state of
+// the tenant.
+func (ap *azureProvider) Cursor(ctx context.Context) (string, error) {
+	users, err := ap.client.LatestDelta(ctx, "/users/delta", ap.selected())
+	if err != nil {
+		return "", err
+	}
+
+	groups, err := ap.client.LatestDelta(ctx, "/groups/delta", []string{"displayName", "members"})
+	if err != nil {
+		return "", err
+	}
+
+	bs, err := json.Marshal(deltaCursor{Users: users, Groups: groups})
+	return string(bs), err
+}
+
+// ReadAll returns every converted user by object id.
+func (ap *azureProvider) ReadAll(ctx context.Context) (map[string]map[string]any, error) {
+	users, err := ap.GetUsers(ctx, utils.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := ap.GetGroups(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	memberships, err := ap.memberships(ctx, groups, ap.transitive)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]map[string]any, len(users))
+	for _, item := range users {
+		id := fmt.Sprint(item["id"])
+		user, err := ap.BaseConfig.ConvertUser(item)
+		if err != nil {
+			return nil, err
+		}
+
+		user[ap.BaseConfig.GroupField] = memberships[id]
+		res[id] = user
+	}
+
+	return res, nil
+}
+
+// Changes runs the delta queries of the cursor. Users that changed, or whose
+// memberships changed, are read again with their groups. Deleted groups need
+// a full read, as the delta does not say who their members were.
+func (ap *azureProvider) Changes(ctx context.Context, cursor string) ([]engine.Change, string, error) {
+	var links deltaCursor
+	if err := json.Unmarshal([]byte(cursor), &links); err != nil || links.Users == "" || links.Groups == "" {
+		return nil, "", fmt.Errorf("%w: invalid delta cursor", engine.ErrFullSyncRequired)
+	}
+
+	users, usersLink, err := delta[map[string]any](ctx, ap.client, links.Users)
+	if isResync(err) {
+		return nil, "", fmt.Errorf("%w: %s", engine.ErrFullSyncRequired, err)
+	} else if err != nil {
+		return nil, "", fmt.Errorf("reading users delta: %w", err)
+	}
+
+	groups, groupsLink, err := delta[groupDelta](ctx, ap.client, links.Groups)
+	if isResync(err) {
+		return nil, "", fmt.Errorf("%w: %s", engine.ErrFullSyncRequired, err)
+	} else if err != nil {
+		return nil, "", fmt.Errorf("reading groups delta: %w", err)
+	}
+
+	ids := make([]string, 0)
+	changed := make(map[string]bool)
+	mark := func(id string) {
+		if !changed[id] {
+			changed[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	for _, user := range users {
+		mark(fmt.Sprint(user["id"]))
+	}
+
+	affected := make([]string, 0)
+	for _, group := range groups {
+		if group.Removed != nil {
+			return nil, "", fmt.Errorf("%w: group %s was deleted", engine.ErrFullSyncRequired, group.ID)
+		}
+
+		// Renaming a group changes the groups of all its members, and so does
+		// adding or removing a nested group with transitive membership.
+		if group.DisplayName != nil {
+			affected = append(affected, group.ID)
+		}
+
+		for _, member := range group.Members {
+			switch {
+			case member.Type == "#microsoft.graph.user":
+				mark(member.ID)
+			case member.Type == "#microsoft.graph.group" && ap.transitive:
+				affected = append(affected, member.ID)
+			}
+		}
+
+	}
+
+	if len(affected) > 0 {
+		members, err := ap.client.MemberIDs(ctx, affected, ap.transitive)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, groupID := range affected {
+			for _, id := range members[groupID] {
+				mark(id)
+			}
+		}
+	}
+
+	changes := make([]engine.Change, 0, len(ids))
+	for _, id := range ids {
+		user, err := ap.readUser(ctx, id)
+		if err != nil {
+			return nil, "", err
+		}
+
+		changes = append(changes, engine.Change{ID: id, User: user})
+	}
+
+	bs, err := json.Marshal(deltaCursor{Users: usersLink, Groups: groupsLink})
+	return changes, string(bs), err
+}
+
+// readUser returns a converted user with its groups, or nil when it no longer exists.
+func (ap *azureProvider) readUser(ctx context.Context, id string) (map[string]any, error) {
+	item, err := ap.client.GetUser(ctx, id, ap.selected())
+	if IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	groups, err := ap.client.UserGroups(ctx, id, ap.transitive)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, group := range groups {
+		names = append(names, group.DisplayName)
+	}
+
+	user, err := ap.BaseConfig.ConvertUser(item)
+	if err != nil {
+		return nil, err
+	}
+
+	user[ap.BaseConfig.GroupField] = names
+	return user, nil
+}
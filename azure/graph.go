@@ -0,0 +1,482 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+)
+
+const (
+	defaultGraphUrl = "https://graph.microsoft.com/v1.0"
+	defaultLoginUrl = "https://login.microsoftonline.com"
+	graphScope      = "https://graph.microsoft.com/.default"
+
+	// batchLimit is the most requests Graph accepts in one $batch.
+	batchLimit = 20
+)
+
+// Error is a Microsoft Graph error response.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("graph returned %d (%s): %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("graph returned %d: %s", e.StatusCode, e.Message)
+}
+
+// graphError decodes the error of a failed response, falling back to the
+// body as the message.
+func graphError(status int, bs []byte) *Error {
+	var body struct {
+		Error *Error `json:"error"`
+	}
+	if json.Unmarshal(bs, &body) != nil || body.Error == nil {
+		body.Error = &Error{Message: strings.TrimSpace(string(bs))}
+	}
+	body.Error.StatusCode = status
+
+	return body.Error
+}
+
+func IsNotFound(err error) bool {
+	var graphErr *Error
+	return errors.As(err, &graphErr) && graphErr.StatusCode == http.StatusNotFound
+}
+
+// Group is the part of a Graph group the provider reads.
+type Group struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+}
+
+// page is one page of a Graph collection. The last page of a delta query
+// carries a delta link instead of a next link.
+type page[T any] struct {
+	Value     []T    `json:"value"`
+	NextLink  string `json:"@odata.nextLink"`
+	DeltaLink string `json:"@odata.deltaLink"`
+}
+
+// batchRequest is one request of a $batch. URL is relative to the version,
+// e.g. /groups/{id}/members.
+type batchRequest struct {
+	ID     string `json:"id"`
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+// batchResponse is the response to one request of a $batch.
+type batchResponse struct {
+	ID      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+// decode decodes the body into out, or returns the error of a failed response.
+func (r batchResponse) decode(out any) error {
+	if r.Status < 200 || r.Status > 299 {
+		return graphError(r.Status, r.Body)
+	}
+
+	return json.Unmarshal(r.Body, out)
+}
+
+// retryAfter returns the wait Graph asked for when it throttled the request.
+func (r batchResponse) retryAfter() time.Duration {
+	for name, val := range r.Headers {
+		if secs, err := strconv.Atoi(val); err == nil && strings.EqualFold(name, "Retry-After") {
+			return time.Duration(secs) * time.Second
+		}
+	}
+
+	return 0
+}
+
+// Client talks to the users and groups endpoints of Microsoft Graph.
+type Client struct {
+	http    *http.Client
+	baseURL string
+	// retry limits the retries of requests throttled within a $batch, which
+	// the transport cannot see as the batch itself succeeds.
+	retry config.RateLimitConfig
+}
+
+// NewClient returns a client for the Graph API at baseURL. The http client is
+// expected to authenticate the requests, so tests can hand in a plain client
+// pointed at a local stand-in.
+func NewClient(baseURL string, client *http.Client, rl *config.RateLimitConfig) *Client {
+	if baseURL == "" {
+		baseURL = defaultGraphUrl
+	}
+
+	return &Client{
+		http:    client,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		retry:   rl.WithDefaults(),
+	}
+}
+
+// do sends a request to path, which is either relative to the base URL or an
+// absolute URL as returned in @odata.nextLink.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(bs)
+	}
+
+	u := path
+	if !strings.HasPrefix(path, "https://") && !strings.HasPrefix(path, "http://") {
+		u = c.baseURL + path
+	}
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// Filters on directory objects are advanced queries that need an eventual
+	// consistency level.
+	if query.Has("$filter") || query.Has("$count") {
+		req.Header.Set("ConsistencyLevel", "eventual")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bs, _ := io.ReadAll(resp.Body)
+		return graphError(resp.StatusCode, bs)
+	}
+
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("decoding response of %s %s: %w", method, path, err)
+		}
+	}
+
+	return nil
+}
+
+// list follows @odata.nextLink through every page of a collection.
+func list[T any](ctx context.Context, c *Client, path string, query url.Values) ([]T, error) {
+	items := make([]T, 0)
+
+	for next := path; next != ""; {
+		var p page[T]
+		if err := c.do(ctx, http.MethodGet, next, query, nil, &p); err != nil {
+			return nil, fmt.Errorf("listing %s: %w", path, err)
+		}
+
+		items = append(items, p.Value...)
+		// The next link already carries the query.
+		next, query = p.NextLink, nil
+	}
+
+	return items, nil
+}
+
+// batch sends the requests through $batch, batchLimit at a time, and returns
+// their responses in the same order. Requests that Graph throttled are sent
+// again, in new batches, after the longest wait it asked for.
+func (c *Client) batch(ctx context.Context, reqs []batchRequest) ([]batchResponse, error) {
+	responses := make([]batchResponse, len(reqs))
+	pending := make([]int, 0, len(reqs))
+	for i := range reqs {
+		pending = append(pending, i)
+	}
+
+	for attempt := 0; len(pending) > 0; attempt++ {
+		throttled := make([]int, 0)
+		wait := time.Duration(0)
+
+		for start := 0; start < len(pending); start += batchLimit {
+			var body struct {
+				Requests []batchRequest `json:"requests"`
+			}
+			for _, i := range pending[start:min(start+batchLimit, len(pending))] {
+				req := reqs[i]
+				req.ID = strconv.Itoa(i)
+				body.Requests = append(body.Requests, req)
+			}
+
+			var out struct {
+				Responses []batchResponse `json:"responses"`
+			}
+			if err := c.do(ctx, http.MethodPost, "/$batch", nil, body, &out); err != nil {
+				return nil, fmt.Errorf("sending batch: %w", err)
+			}
+
+			for _, resp := range out.Responses {
+				i, err := strconv.Atoi(resp.ID)
+				if err != nil || i < 0 || i >= len(reqs) {
+					return nil, fmt.Errorf("batch returned a response to unknown request %q", resp.ID)
+				}
+
+				responses[i] = resp
+				if resp.Status == http.StatusTooManyRequests && attempt < c.retry.MaxRetries {
+					throttled = append(throttled, i)
+					wait = max(wait, resp.retryAfter())
+				}
+			}
+		}
+
+		if pending = throttled; len(pending) == 0 {
+			break
+		}
+
+		// Like the transport, never wait longer than MaxBackoff, even when
+		// Graph asks for it.
+		if wait <= 0 {
+			wait = c.retry.MinBackoff << attempt
+		}
+		wait = min(wait, c.retry.MaxBackoff)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	return responses, nil
+}
+
+// ListUsers returns every user matching the OData filter, which may be empty,
+// with only the selected properties.
+func (c *Client) ListUsers(ctx context.Context, filter string, selected []string) ([]map[string]any, error) {
+	query := url.Values{"$select": []string{strings.Join(selected, ",")}}
+	if filter != "" {
+		query.Set("$filter", filter)
+		query.Set("$count", "true")
+	}
+
+	return list[map[string]any](ctx, c, "/users", query)
+}
+
+// GetUser returns a user by id or userPrincipalName.
+func (c *Client) GetUser(ctx context.Context, id string, selected []string) (map[string]any, error) {
+	var user map[string]any
+	query := url.Values{"$select": []string{strings.Join(selected, ",")}}
+	if err := c.do(ctx, http.MethodGet, "/users/"+url.PathEscape(id), query, nil, &user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// CreateUser creates a user and returns its id.
+func (c *Client) CreateUser(ctx context.Context, user map[string]any) (string, error) {
+	var created struct {
+		ID string `json:"id"`
+	}
+	err := c.do(ctx, http.MethodPost, "/users", nil, user, &created)
+
+	return created.ID, err
+}
+
+func (c *Client) UpdateUser(ctx context.Context, id string, attrs map[string]any) error {
+	return c.do(ctx, http.MethodPatch, "/users/"+url.PathEscape(id), nil, attrs, nil)
+}
+
+func (c *Client) DeleteUser(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/users/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// ListGroups returns every group matching the OData filter, which may be empty.
+func (c *Client) ListGroups(ctx context.Context, filter string) ([]Group, error) {
+	query := url.Values{"$select": []string{"id,displayName"}}
+	if filter != "" {
+		query.Set("$filter", filter)
+		query.Set("$count", "true")
+	}
+
+	return list[Group](ctx, c, "/groups", query)
+}
+
+// CreateGroup creates a security group that is not mail enabled and returns its id.
+func (c *Client) CreateGroup(ctx context.Context, name string) (string, error) {
+	var created Group
+	err := c.do(ctx, http.MethodPost, "/groups", nil, map[string]any{
+		"displayName":     name,
+		"mailEnabled":     false,
+		"mailNickname":    mailNickname(name),
+		"securityEnabled": true,
+	}, &created)
+
+	return created.ID, err
+}
+
+// MemberIDs returns the ids of the users in each group by group id,
+// including the ones that are members through nested groups when transitive
+// is set. The first page of every group is read through $batch.
+func (c *Client) MemberIDs(ctx context.Context, groupIDs []string, transitive bool) (map[string][]string, error) {
+	relation := "members"
+	if transitive {
+		relation = "transitiveMembers"
+	}
+
+	// The cast segment leaves out groups, devices and service principals.
+	query := url.Values{"$select": []string{"id"}}.Encode()
+	reqs := make([]batchRequest, 0, len(groupIDs))
+	for _, id := range groupIDs {
+		reqs = append(reqs, batchRequest{
+			Method: http.MethodGet,
+			URL:    fmt.Sprintf("/groups/%s/%s/microsoft.graph.user?%s", url.PathEscape(id), relation, query),
+		})
+	}
+
+	responses, err := c.batch(ctx, reqs)
+	if err != nil {
+		return nil, err
+	}
+
+	type member struct {
+		ID string `json:"id"`
+	}
+
+	res := make(map[string][]string, len(groupIDs))
+	for i, resp := range responses {
+		var p page[member]
+		if err := resp.decode(&p); err != nil {
+			return nil, fmt.Errorf("listing members of group %s: %w", groupIDs[i], err)
+		}
+
+		members := p.Value
+		if p.NextLink != "" {
+			rest, err := list[member](ctx, c, p.NextLink, nil)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, rest...)
+		}
+
+		ids := make([]string, 0, len(members))
+		for _, m := range members {
+			ids = append(ids, m.ID)
+		}
+		res[groupIDs[i]] = ids
+	}
+
+	return res, nil
+}
+
+// UserGroups returns the groups a user is in, including the ones it is in
+// through nested groups when transitive is set.
+func (c *Client) UserGroups(ctx context.Context, userID string, transitive bool) ([]Group, error) {
+	relation := "memberOf"
+	if transitive {
+		relation = "transitiveMemberOf"
+	}
+
+	path := fmt.Sprintf("/users/%s/%s/microsoft.graph.group", url.PathEscape(userID), relation)
+	return list[Group](ctx, c, path, url.Values{"$select": []string{"id,displayName"}})
+}
+
+// delta follows a delta link through every page of changes and returns them
+// with the delta link of the next round.
+func delta[T any](ctx context.Context, c *Client, link string) ([]T, string, error) {
+	items := make([]T, 0)
+
+	for next := link; ; {
+		var p page[T]
+		if err := c.do(ctx, http.MethodGet, next, nil, nil, &p); err != nil {
+			return nil, "", err
+		}
+
+		items = append(items, p.Value...)
+		if p.NextLink == "" {
+			return items, p.DeltaLink, nil
+		}
+		next = p.NextLink
+	}
+}
+
+// LatestDelta returns a delta link that only reports changes made from now on.
+func (c *Client) LatestDelta(ctx context.Context, path string, selected []string) (string, error) {
+	query := url.Values{
+		"$select":     []string{strings.Join(selected, ",")},
+		"$deltatoken": []string{"latest"},
+	}
+
+	var p page[json.RawMessage]
+	if err := c.do(ctx, http.MethodGet, path, query, nil, &p); err != nil {
+		return "", err
+	}
+
+	if p.DeltaLink == "" {
+		return "", fmt.Errorf("%s returned no delta link", path)
+	}
+
+	return p.DeltaLink, nil
+}
+
+func (c *Client) AddMember(ctx context.Context, groupID, userID string) error {
+	ref := map[string]string{"@odata.id": fmt.Sprintf("%s/directoryObjects/%s", c.baseURL, userID)}
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/groups/%s/members/$ref", url.PathEscape(groupID)), nil, ref, nil)
+}
+
+func (c *Client) RemoveMember(ctx context.Context, groupID, userID string) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/groups/%s/members/%s/$ref", url.PathEscape(groupID), url.PathEscape(userID)), nil, nil, nil)
+}
+
+// quote renders a string literal for an OData filter.
+func quote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// mailNickname derives the mandatory mail alias from a name, keeping only the
+// characters Graph accepts.
+func mailNickname(name string) string {
+	if at := strings.Index(name, "@"); at > 0 {
+		name = name[:at]
+	}
+
+	nickname := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return -1
+		}
+	}, name)
+
+	if nickname == "" {
+		nickname = "group"
+	}
+	if len(nickname) > 64 {
+		nickname = nickname[:64]
+	}
+	return nickname
+}
@@ -0,0 +1,311 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/utils"
+)
+
+// fakeGraph is a Microsoft Graph stand-in that serves canned responses by
+// method and path. The requests of a $batch are served by the same handlers
+// and answered in reverse order, as Graph does not keep their order.
+type fakeGraph struct {
+	mu     sync.Mutex
+	routes map[string]http.HandlerFunc
+	// batches holds the number of requests in every $batch.
+	batches []int
+}
+
+func newFakeGraph(t *testing.T) (*fakeGraph, *httptest.Server) {
+	fake := &fakeGraph{routes: make(map[string]http.HandlerFunc)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	return fake, srv
+}
+
+func (f *fakeGraph) handle(method, path string, h http.HandlerFunc) {
+	f.routes[method+" "+path] = h
+}
+
+func (f *fakeGraph) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && r.URL.Path == "/$batch" {
+		f.serveBatch(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	h, ok := f.routes[r.Method+" "+r.URL.Path]
+	f.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, "Request_ResourceNotFound")
+		return
+	}
+	h(w, r)
+}
+
+func (f *fakeGraph) serveBatch(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Requests []batchRequest `json:"requests"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Requests) > batchLimit {
+		writeError(w, http.StatusBadRequest, "BadRequest")
+		return
+	}
+
+	f.mu.Lock()
+	f.batches = append(f.batches, len(body.Requests))
+	f.mu.Unlock()
+
+	responses := make([]batchResponse, 0, len(body.Requests))
+	for i := len(body.Requests) - 1; i >= 0; i-- {
+		req := body.Requests[i]
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, httptest.NewRequest(req.Method, req.URL, nil))
+
+		headers := make(map[string]string)
+		for name := range rec.Header() {
+			headers[name] = rec.Header().Get(name)
+		}
+
+		resp := batchResponse{ID: req.ID, Status: rec.Code, Headers: headers}
+		if rec.Body.Len() > 0 {
+			resp.Body = rec.Body.Bytes()
+		}
+		responses = append(responses, resp)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"responses": responses})
+}
+
+func writeJSON(t *testing.T, w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Errorf("encoding response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": map[string]string{"code": code, "message": http.StatusText(status)}})
+}
+
+func members(ids ...string) map[string]any {
+	value := make([]map[string]string, 0, len(ids))
+	for _, id := range ids {
+		value = append(value, map[string]string{"id": id})
+	}
+
+	return map[string]any{"value": value}
+}
+
+func newTestProvider(t *testing.T, srv *httptest.Server) *azureProvider {
+	ap, err := NewAzureProviderWithClient(&config.AzureConfig{
+		BaseConfig: config.BaseConfig{
+			Mapping:    map[string]string{"userPrincipalName": "email", "displayName": "name"},
+			GroupField: "groups",
+			RateLimit:  &config.RateLimitConfig{MaxRetries: 2, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+		},
+		TenantID: "tenant",
+		GraphUrl: srv.URL,
+	}, srv.Client())
+	if err != nil {
+		t.Fatalf("creating provider: %v", err)
+	}
+
+	return ap
+}
+
+func TestListUsersFollowsNextLinks(t *testing.T) {
+	fake, srv := newFakeGraph(t)
+	fake.handle(http.MethodGet, "/users", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if got := query["$select"]; !slices.Equal(got, []string{"id,userPrincipalName,accountEnabled,displayName"}) {
+			t.Errorf("$select = %v, want the mapped and the needed properties once", got)
+		}
+
+		if query.Get("$skiptoken") == "" {
+			writeJSON(t, w, map[string]any{
+				"value":           []map[string]any{{"id": "1", "userPrincipalName": "alice@example.org"}},
+				"@odata.nextLink": srv.URL + "/users?$select=id,userPrincipalName,accountEnabled,displayName&$skiptoken=2",
+			})
+			return
+		}
+		writeJSON(t, w, map[string]any{"value": []map[string]any{{"id": "2", "userPrincipalName": "bob@example.org"}}})
+	})
+
+	ap := newTestProvider(t, srv)
+	users, err := ap.GetUsers(context.Background(), utils.ListOptions{})
+	if err != nil {
+		t.Fatalf("GetUsers: %v", err)
+	}
+
+	upns := make([]string, 0, len(users))
+	for _, user := range users {
+		upns = append(upns, fmt.Sprint(user["userPrincipalName"]))
+	}
+	if want := []string{"alice@example.org", "bob@example.org"}; !slices.Equal(upns, want) {
+		t.Errorf("GetUsers = %v, want %v", upns, want)
+	}
+}
+
+func TestMemberIDsSplitsBatches(t *testing.T) {
+	fake, srv := newFakeGraph(t)
+
+	groupIDs := make([]string, 0, 45)
+	for i := 0; i < 45; i++ {
+		id := fmt.Sprintf("g%d", i)
+		groupIDs = append(groupIDs, id)
+
+		fake.handle(http.MethodGet, fmt.Sprintf("/groups/%s/members/microsoft.graph.user", id), func(w http.ResponseWriter, r *http.Request) {
+			if got := r.URL.Query().Get("$select"); got != "id" {
+				t.Errorf("$select = %q, want id", got)
+			}
+
+			switch {
+			case id != "g0":
+				writeJSON(t, w, members("u"+id))
+			case r.URL.Query().Get("$skiptoken") == "":
+				page := members("ug0")
+				page["@odata.nextLink"] = srv.URL + r.URL.Path + "?$select=id&$skiptoken=2"
+				writeJSON(t, w, page)
+			default:
+				writeJSON(t, w, members("ug0-2"))
+			}
+		})
+	}
+
+	ap := newTestProvider(t, srv)
+	got, err := ap.client.MemberIDs(context.Background(), groupIDs, false)
+	if err != nil {
+		t.Fatalf("MemberIDs: %v", err)
+	}
+
+	if want := []int{20, 20, 5}; !slices.Equal(fake.batches, want) {
+		t.Errorf("sent batches of %v, want %v", fake.batches, want)
+	}
+
+	if want := []string{"ug0", "ug0-2"}; !slices.Equal(got["g0"], want) {
+		t.Errorf("members of g0 = %v, want %v from both pages", got["g0"], want)
+	}
+
+	for _, id := range groupIDs[1:] {
+		if want := []string{"u" + id}; !slices.Equal(got[id], want) {
+			t.Errorf("members of %s = %v, want %v", id, got[id], want)
+		}
+	}
+}
+
+func TestBatchRetriesThrottledRequests(t *testing.T) {
+	fake, srv := newFakeGraph(t)
+
+	var throttled []time.Time
+	for _, id := range []string{"a", "b", "c"} {
+		id := id
+		fake.handle(http.MethodGet, fmt.Sprintf("/groups/%s/members/microsoft.graph.user", id), func(w http.ResponseWriter, r *http.Request) {
+			if id == "b" {
+				throttled = append(throttled, time.Now())
+				if len(throttled) == 1 {
+					w.Header().Set("Retry-After", "1")
+					writeError(w, http.StatusTooManyRequests, "TooManyRequests")
+					return
+				}
+			}
+			writeJSON(t, w, members("u"+id))
+		})
+	}
+
+	ap := newTestProvider(t, srv)
+	got, err := ap.client.MemberIDs(context.Background(), []string{"a", "b", "c"}, false)
+	if err != nil {
+		t.Fatalf("MemberIDs: %v", err)
+	}
+
+	if want := []int{3, 1}; !slices.Equal(fake.batches, want) {
+		t.Errorf("sent batches of %v, want the throttled request alone in the second", fake.batches)
+	}
+	if waited := throttled[1].Sub(throttled[0]); waited < 10*time.Millisecond || waited >= time.Second {
+		t.Errorf("retried after %s, want the 1s Retry-After capped at the 10ms maxBackoff", waited)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if want := []string{"u" + id}; !slices.Equal(got[id], want) {
+			t.Errorf("members of %s = %v, want %v", id, got[id], want)
+		}
+	}
+}
+
+func TestPlanResolvesMemberIDsFromThePlan(t *testing.T) {
+	fake, srv := newFakeGraph(t)
+
+	var writes []string
+	record := func(status int, body any) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			writes = append(writes, r.Method+" "+r.URL.Path)
+			if status == http.StatusNotFound {
+				writeError(w, status, "Request_ResourceNotFound")
+				return
+			}
+			w.WriteHeader(status)
+			if body != nil {
+				_ = json.NewEncoder(w).Encode(body)
+			}
+		}
+	}
+
+	fake.handle(http.MethodGet, "/users", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, map[string]any{"value": []map[string]any{
+			{"id": "u1", "userPrincipalName": "alice@example.org", "displayName": "alice", "accountEnabled": true},
+			{"id": "u2", "userPrincipalName": "bob@example.org", "displayName": "bob", "accountEnabled": true},
+		}})
+	})
+	fake.handle(http.MethodGet, "/groups", func(w http.ResponseWriter, r *http.Request) {
+		if filter := r.URL.Query().Get("$filter"); filter != "" {
+			t.Errorf("looked up a group with %s, want its id from the plan", filter)
+		}
+		writeJSON(t, w, map[string]any{"value": []Group{{ID: "g1", DisplayName: "eng"}}})
+	})
+	fake.handle(http.MethodGet, "/groups/g1/members/microsoft.graph.user", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, members("u1", "u2"))
+	})
+	fake.handle(http.MethodPost, "/groups", record(http.StatusCreated, Group{ID: "g2", DisplayName: "ops"}))
+	fake.handle(http.MethodPost, "/groups/g2/members/$ref", record(http.StatusNoContent, nil))
+	fake.handle(http.MethodDelete, "/users/u2", record(http.StatusNoContent, nil))
+	// Graph drops the memberships of deleted users with them.
+	fake.handle(http.MethodDelete, "/groups/g1/members/u2/$ref", record(http.StatusNotFound, nil))
+
+	ap := newTestProvider(t, srv)
+	plan, err := ap.Plan(context.Background(), []map[string]any{
+		{"email": "alice@example.org", "name": "alice", "groups": []string{"eng", "ops"}},
+	})
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+
+	if _, err := engine.Apply(context.Background(), plan); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	want := []string{
+		"DELETE /users/u2",
+		"POST /groups",
+		"DELETE /groups/g1/members/u2/$ref",
+		"POST /groups/g2/members/$ref",
+	}
+	if !slices.Equal(writes, want) {
+		t.Errorf("requested %v, want %v", writes, want)
+	}
+}
@@ -3,6 +3,9 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"strconv"
+	"time"
 )
 
 type BaseConfig struct {
@@ -12,12 +15,171 @@ type BaseConfig struct {
 	UserFilters  []string          `yaml:"userFilters"`
 	Mapping      map[string]string `yaml:"mapping"`
 	GroupField   string            `yaml:"groupField"`
+	RateLimit    *RateLimitConfig  `yaml:"rateLimit"`
+	// ContinueOnError keeps applying the remaining changes after one fails.
+	ContinueOnError bool                  `yaml:"continueOnError"`
+	Safety          *SafetyConfig         `yaml:"safety"`
+	Deprovisioning  *DeprovisioningConfig `yaml:"deprovisioning"`
+	Approval        *ApprovalConfig       `yaml:"approval"`
+	Incremental     *IncrementalConfig    `yaml:"incremental"`
+}
+
+// IncrementalConfig reads a source through its change feed, when it has one,
+// instead of listing every user on each run.
+type IncrementalConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// FullSyncInterval forces a full read when the last one is older. Zero
+	// only reads in full when the feed cannot resume from its cursor.
+	FullSyncInterval time.Duration `yaml:"fullSyncInterval"`
+}
+
+// Reads reports whether a source should be read incrementally. It is safe to
+// call on a nil config.
+func (ic *IncrementalConfig) Reads() bool {
+	return ic != nil && ic.Enabled
+}
+
+// ApprovalConfig lists the changes that are never applied unattended. They are
+// held as pending approvals until someone approves them.
+type ApprovalConfig struct {
+	// Operations lists operation kinds that always need approval, e.g. delete.
+	Operations []string `yaml:"operations"`
+	// Groups lists sensitive groups, e.g. admin groups, that need approval
+	// before anyone is added to them or granted a role in or through them.
+	Groups []string `yaml:"groups"`
+	// Roles lists sensitive roles, e.g. realm-admin, that need approval
+	// before they are granted.
+	Roles []string `yaml:"roles"`
+	// IgnoredUsers requires approval for any change to a user in IgnoreUsers.
+	IgnoredUsers bool `yaml:"ignoredUsers"`
+	// Expiry is how long a pending approval stays valid. Defaults to a week.
+	Expiry time.Duration `yaml:"expiry"`
+}
+
+const (
+	DeprovisionDelete  = "delete"
+	DeprovisionSuspend = "suspend"
+)
+
+// User statuses that providers normalize their lifecycle states to, in the
+// common field their status attribute is mapped to.
+const (
+	UserStaged        = "staged"
+	UserActive        = "active"
+	UserSuspended     = "suspended"
+	UserDeprovisioned = "deprovisioned"
+)
+
+// DeprovisioningConfig decides what happens to users that disappear from the
+// source. Providers that cannot suspend users reject the suspend mode.
+type DeprovisioningConfig struct {
+	// Mode is either delete, the default, or suspend.
+	Mode string `yaml:"mode"`
+	// GracePeriod is how long a suspended user is kept before it is deleted.
+	// Zero keeps suspended users indefinitely.
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+}
+
+// Suspends reports whether removed users should be suspended rather than
+// deleted. It is safe to call on a nil config.
+func (dc *DeprovisioningConfig) Suspends() bool {
+	return dc != nil && dc.Mode == DeprovisionSuspend
+}
+
+// SafetyConfig holds the thresholds that block an apply unless it is
+// explicitly overridden. Zero values disable the corresponding check.
+type SafetyConfig struct {
+	MaxDeletes int `yaml:"maxDeletes"`
+	// MaxDeletePercent is relative to the number of objects currently in the target.
+	MaxDeletePercent float64 `yaml:"maxDeletePercent"`
+	MaxUpdates       int     `yaml:"maxUpdates"`
+	MaxUpdatePercent float64 `yaml:"maxUpdatePercent"`
+	// MaxGroupRemovals and MaxGroupRemovalPercent limit the member removals,
+	// revokes and group deletes. The percentage is relative to the current
+	// members of the managed groups. When unset, MaxDeletes and
+	// MaxDeletePercent apply to them too.
+	MaxGroupRemovals       int     `yaml:"maxGroupRemovals"`
+	MaxGroupRemovalPercent float64 `yaml:"maxGroupRemovalPercent"`
+	// MinSourcePercent blocks when the source shrank below this percentage of
+	// the previous snapshot.
+	MinSourcePercent float64 `yaml:"minSourcePercent"`
+}
+
+// RateLimitConfig controls the client side rate limiting and retry behaviour
+// applied to every request a provider makes.
+type RateLimitConfig struct {
+	// RequestsPerSecond is the token bucket refill rate. Zero disables client side limiting.
+	RequestsPerSecond float64 `yaml:"requestsPerSecond"`
+	// Burst is the token bucket size.
+	Burst int `yaml:"burst"`
+	// MaxRetries is the number of retries after the first attempt. A negative value disables retries.
+	MaxRetries int           `yaml:"maxRetries"`
+	MinBackoff time.Duration `yaml:"minBackoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+	// RetryWrites allows non idempotent requests (POST, PATCH) to be retried
+	// on errors where the server may have processed them.
+	RetryWrites bool `yaml:"retryWrites"`
+}
+
+// Validate checks that the backoff bounds can be used to compute waits. It is
+// safe to call on a nil config.
+func (rl *RateLimitConfig) Validate() error {
+	if rl == nil {
+		return nil
+	}
+
+	if rl.MinBackoff < 0 || rl.MaxBackoff < 0 {
+		return fmt.Errorf("rate limit backoffs cannot be negative, got minBackoff %s and maxBackoff %s", rl.MinBackoff, rl.MaxBackoff)
+	}
+
+	resolved := rl.WithDefaults()
+	if resolved.MinBackoff > resolved.MaxBackoff {
+		return fmt.Errorf("rate limit minBackoff %s is longer than maxBackoff %s", resolved.MinBackoff, resolved.MaxBackoff)
+	}
+
+	return nil
+}
+
+// WithDefaults returns a copy of the config with unset fields filled in. It is
+// safe to call on a nil config.
+func (rl *RateLimitConfig) WithDefaults() RateLimitConfig {
+	res := RateLimitConfig{
+		MaxRetries: 5,
+		MinBackoff: 500 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+	}
+	if rl == nil {
+		return res
+	}
+
+	res.RequestsPerSecond = rl.RequestsPerSecond
+	res.Burst = rl.Burst
+	res.RetryWrites = rl.RetryWrites
+	if rl.MaxRetries != 0 {
+		res.MaxRetries = max(rl.MaxRetries, 0)
+	}
+	if rl.MinBackoff != 0 {
+		res.MinBackoff = rl.MinBackoff
+	}
+	if rl.MaxBackoff != 0 {
+		res.MaxBackoff = rl.MaxBackoff
+	}
+	if res.Burst == 0 && res.RequestsPerSecond > 0 {
+		res.Burst = 1
+	}
+
+	return res
 }
 
 func (bc BaseConfig) ConvertUsers(arr any) ([]map[string]any, error) {
+	val := reflect.ValueOf(arr)
+	if val.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("expected a list of users, got %T", arr)
+	}
+
 	sourceUsers := make([]map[string]any, 0)
-	for _, item := range arr.([]any) {
-		if user, err := bc.ConvertUser(item); err != nil {
+	for i := 0; i < val.Len(); i++ {
+		if user, err := bc.ConvertUser(val.Index(i).Interface()); err != nil {
 			return nil, err
 		} else {
 			sourceUsers = append(sourceUsers, user)
@@ -73,19 +235,15 @@ func (bc BaseConfig) ConvertUserToProvider(user any) (map[string]any, error) {
 	return converted, nil
 }
 
-func (bc BaseConfig) CompareUsers(source, target any, field string) (toAdd, toRemove, toUpdate []map[string]any, retErr error) {
-	sourceAsList := make(map[string]any)
-	// Create a map from source array for easier comparison
-	for _, item := range source.([]any) {
-		if user, err := bc.ConvertUser(item); err != nil {
-			retErr = err
-			return
-		} else {
-			sourceMap[user[field].(string)] = item
-		}
+// CompareUsers converts the provider's current users and compares them with the desired ones.
+func (bc BaseConfig) CompareUsers(current any, desired []map[string]any, field string) (toAdd, toRemove, toUpdate []map[string]any, retErr error) {
+	converted, err := bc.ConvertUsers(current)
+	if err != nil {
+		retErr = err
+		return
 	}
 
-	return toAdd, toRemove, toUpdate, nil
+	return bc.RawCompareUsers(converted, desired, field)
 }
 
 func (bc BaseConfig) RawCompareUsers(source, target []map[string]any, field string) (toAdd, toRemove, toUpdate []map[string]any, retErr error) {
@@ -93,12 +251,12 @@ func (bc BaseConfig) RawCompareUsers(source, target []map[string]any, field stri
 
 	// Create a map from source array for easier comparison
 	for _, item := range source {
-		sourceMap[item[field].(string)] = item
+		sourceMap[KeyOf(item, field)] = item
 	}
 
 	// Compare each element in the target array
 	for _, item := range target {
-		key := item[field].(string)
+		key := KeyOf(item, field)
 
 		if sourceItem, ok := sourceMap[key]; !ok {
 			// Item in target not found in source, add toAdd
@@ -120,12 +278,47 @@ func (bc BaseConfig) RawCompareUsers(source, target []map[string]any, field stri
 	return toAdd, toRemove, toUpdate, nil
 }
 
+// KeyOf returns the value of field as a string. Numeric ids decoded from JSON
+// are float64, so they are formatted without an exponent.
+func KeyOf(user map[string]any, field string) string {
+	switch val := user[field].(type) {
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// StringList returns a list field such as a user's groups as strings,
+// whether it was built in code or decoded from JSON.
+func StringList(val any) []string {
+	switch list := val.(type) {
+	case []string:
+		return list
+	case []any:
+		res := make([]string, 0, len(list))
+		for _, item := range list {
+			res = append(res, fmt.Sprint(item))
+		}
+		return res
+	}
+
+	return nil
+}
+
+// GroupsOf returns the groups of a user in common fields.
+func (bc BaseConfig) GroupsOf(user map[string]any) []string {
+	return StringList(user[bc.GroupField])
+}
+
 // Function to compare two maps
 func compareMaps(map1, map2 map[string]any) bool {
 	// Compare maps based on your desired criteria
 	// For simplicity, this example assumes that the maps are equal if all keys and values match
 	for key, value := range map1 {
-		if map2Val, ok := map2[key]; !ok || map2Val != value {
+		if map2Val, ok := map2[key]; !ok || !reflect.DeepEqual(map2Val, value) {
 			return false
 		}
 	}
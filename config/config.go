@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	resolvers "github.com/tiagoposse/go-secret-resolvers"
 )
 
@@ -8,6 +10,9 @@ type Config struct {
 	Okta             *OktaConfig             `yaml:"okta"`
 	Google           *GoogleConfig           `yaml:"google"`
 	Gitlab           *GitlabConfig           `yaml:"gitlab"`
+	GitlabSCIM       *GitlabSCIMConfig       `yaml:"gitlabScim"`
+	SCIM             []*SCIMConfig           `yaml:"scim"`
+	SCIMServer       *SCIMServerConfig       `yaml:"scimServer"`
 	Github           *GithubConfig           `yaml:"github"`
 	AwsIAM           *AwsIAMConfig           `yaml:"awsIAM"`
 	AwsIdentityStore *AwsIdentityStoreConfig `yaml:"awsIdentityStore"`
@@ -17,26 +22,158 @@ type Config struct {
 	ActiveDirectory  *ADConfig               `yaml:"ad"`
 	OneLogin         *OneLoginConfig         `yaml:"onelogin"`
 	Keycloak         *KeycloakConfig         `yaml:"keycloak"`
+	State            *StateConfig            `yaml:"state"`
+	Lock             *LockConfig             `yaml:"lock"`
+	// Safety thresholds applied to the whole run, across every provider, see
+	// engine.NewRun.
+	Safety *SafetyConfig `yaml:"safety"`
+}
+
+// StateConfig sets up the store that keeps engine state between runs, see
+// state.New.
+type StateConfig struct {
+	// Dir keeps one file per key in this directory.
+	Dir string `yaml:"dir"`
+}
+
+// LockConfig controls the lock taken on a target while it is being applied,
+// see lock.New.
+type LockConfig struct {
+	// Dir holds an flock on one file per target in this directory instead of
+	// a lease in the state store. Every runner has to share the directory.
+	Dir string `yaml:"dir"`
+	// TTL is how long a lease survives without a heartbeat. Defaults to a
+	// minute. Locks in Dir do not expire.
+	TTL time.Duration `yaml:"ttl"`
 }
 
 type OktaConfig struct {
 	BaseConfig `yaml:",inline"`
 	Domain     string                   `yaml:"domain"`
 	Token      *resolvers.ResolverField `yaml:"token"`
+	// Activate activates created users, which emails them an activation
+	// link. Created users are staged otherwise.
+	Activate bool `yaml:"activate"`
+	// Staged is how users that were never activated are compared to the
+	// source: keep, the default, syncs them like any other user, activate
+	// also activates the ones in the source, and ignore leaves them alone.
+	Staged string `yaml:"staged"`
+	// DeleteGroups deletes the Okta groups no source user is a member of,
+	// other than the ignored ones. Without it their members are only removed.
+	DeleteGroups bool            `yaml:"deleteGroups"`
+	Apps         []OktaAppConfig `yaml:"apps"`
+}
+
+const (
+	OktaStagedKeep     = "keep"
+	OktaStagedActivate = "activate"
+	OktaStagedIgnore   = "ignore"
+)
+
+// OktaAppConfig assigns an application to the members of the source groups.
+// Only the assignments of the listed applications are managed.
+type OktaAppConfig struct {
+	// ID is the id of the application, e.g. 0oa1gjh63g214q0Hq0g4.
+	ID     string   `yaml:"id"`
+	Groups []string `yaml:"groups"`
+	// AssignGroups assigns the application to the groups themselves instead
+	// of their members.
+	AssignGroups bool `yaml:"assignGroups"`
 }
 
+// GoogleConfig requests the scopes the provider needs and nothing more: read
+// only ones when ReadOnly is set, user writes otherwise, and group writes
+// when Groups is set.
 type GoogleConfig struct {
 	BaseConfig        `yaml:",inline"`
 	Domain            string                   `yaml:"domain"`
 	ServiceAccountKey *resolvers.ResolverField `yaml:"serviceAccountKey"`
 	UserToImpersonate string                   `yaml:"userToImpersonate"`
+	// ReadOnly is for a provider that is only read as a source. Planning or
+	// syncing it fails.
+	ReadOnly bool                `yaml:"readOnly"`
+	Groups   *GoogleGroupsConfig `yaml:"groups"`
+}
+
+// GoogleGroupsConfig syncs the groups of the source users, which are group
+// emails, and their members. Members of every group that is not ignored are
+// managed, except nested groups and users from outside the domain.
+type GoogleGroupsConfig struct {
+	// Delete deletes the groups no source user is a member of. Without it
+	// their members are only removed.
+	Delete bool                    `yaml:"delete"`
+	Roles  []GoogleGroupRoleConfig `yaml:"roles"`
+	// Settings are applied to every managed group, by Groups Settings API
+	// field, e.g. whoCanJoin: INVITED_CAN_JOIN.
+	Settings map[string]string `yaml:"settings"`
+}
+
+// GoogleGroupRoleConfig gives the members of a group that are also in one of
+// the source groups a role other than MEMBER, i.e. MANAGER or OWNER.
+type GoogleGroupRoleConfig struct {
+	Group        string   `yaml:"group"`
+	Role         string   `yaml:"role"`
+	SourceGroups []string `yaml:"sourceGroups"`
 }
 
 type GitlabConfig struct {
-	BaseConfig   `yaml:",inline"`
+	BaseConfig `yaml:",inline"`
+	// Url of a self-managed instance, gitlab.com when empty.
 	Url          string                   `yaml:"url"`
 	Organisation string                   `yaml:"org"`
 	Token        *resolvers.ResolverField `yaml:"token"`
+	// AccessLevel is given to members whose source user has no mapped
+	// access_level. It defaults to guest (10).
+	AccessLevel int `yaml:"accessLevel"`
+}
+
+// GitlabSCIMConfig provisions SAML identities of a GitLab.com group through
+// its SCIM API, which takes the token generated in the group's SAML settings.
+type GitlabSCIMConfig struct {
+	BaseConfig `yaml:",inline"`
+	// Url of the instance, gitlab.com when empty.
+	Url       string                   `yaml:"url"`
+	Group     string                   `yaml:"group"`
+	ScimToken *resolvers.ResolverField `yaml:"scimToken"`
+	// Token is an optional API token used to report members without a SAML identity.
+	Token *resolvers.ResolverField `yaml:"token"`
+}
+
+// SCIMConfig provisions users and groups into any SCIM 2.0 service provider.
+type SCIMConfig struct {
+	BaseConfig `yaml:",inline"`
+	// Name identifies the service provider in plans and state, e.g. slack.
+	Name string `yaml:"name"`
+	// Url is the SCIM base URL that /Users and /Groups are relative to.
+	Url    string                   `yaml:"url"`
+	Token  *resolvers.ResolverField `yaml:"token"`
+	Quirks SCIMQuirks               `yaml:"quirks"`
+}
+
+// SCIMQuirks works around service providers that only implement part of the spec.
+type SCIMQuirks struct {
+	// PutOnly replaces whole resources instead of sending PATCH requests.
+	PutOnly bool `yaml:"putOnly"`
+	// NoFilter lists every resource and filters client side.
+	NoFilter bool `yaml:"noFilter"`
+	// NoGroups skips group management for providers without /Groups.
+	NoGroups bool `yaml:"noGroups"`
+	// BooleanStrings sends booleans as "True" and "False", as Azure AD does.
+	BooleanStrings bool `yaml:"booleanStrings"`
+	// PageSize overrides the number of resources requested per page.
+	PageSize int `yaml:"pageSize"`
+}
+
+// SCIMServerConfig configures the SCIM server identity providers push to. The
+// mapping turns the flattened SCIM attributes, e.g. name.givenName, into the
+// common fields the targets are planned from.
+type SCIMServerConfig struct {
+	BaseConfig `yaml:",inline"`
+	// Tokens are the bearer tokens clients authenticate with, by client name.
+	// The name is recorded as the actor of every write.
+	Tokens map[string]*resolvers.ResolverField `yaml:"tokens"`
+	// PageSize is the maximum number of resources returned per page.
+	PageSize int `yaml:"pageSize"`
 }
 
 type GithubConfig struct {
@@ -47,25 +184,116 @@ type GithubConfig struct {
 
 type AwsIAMConfig struct {
 	BaseConfig `yaml:",inline"`
-	Profile    *string `yaml:"profile"`
+	Profile    *string             `yaml:"profile"`
+	Groups     []AwsIAMGroupConfig `yaml:"groups"`
+	// GroupPath is the path groups are created in. Groups in this path that
+	// are no longer declared are deleted, so it should only hold managed groups.
+	GroupPath string `yaml:"groupPath"`
+}
+
+// AwsIAMGroupConfig declares an IAM group, the source groups whose members
+// belong to it and the managed policies attached to it.
+type AwsIAMGroupConfig struct {
+	Name            string   `yaml:"name"`
+	SourceGroups    []string `yaml:"sourceGroups"`
+	ManagedPolicies []string `yaml:"managedPolicies"`
 }
 
 type AwsIdentityStoreConfig struct {
 	BaseConfig      `yaml:",inline"`
 	IdentityStoreID string  `yaml:"storeID"`
 	Profile         *string `yaml:"profile"`
+	// InstanceArn is the IAM Identity Center instance the assignments are made in.
+	InstanceArn string                `yaml:"instanceArn"`
+	Assignments []AwsAssignmentConfig `yaml:"assignments"`
+}
+
+// AwsAssignmentConfig gives the members of a source group a permission set in
+// each of the listed accounts. PermissionSet is a permission set name or ARN.
+type AwsAssignmentConfig struct {
+	Group         string   `yaml:"group"`
+	PermissionSet string   `yaml:"permissionSet"`
+	Accounts      []string `yaml:"accounts"`
 }
 
 type AzureConfig struct {
-	BaseConfig `yaml:",inline"`
+	BaseConfig   `yaml:",inline"`
+	TenantID     string                   `yaml:"tenantID"`
+	ClientID     string                   `yaml:"clientID"`
+	ClientSecret *resolvers.ResolverField `yaml:"clientSecret"`
+	// GraphUrl defaults to https://graph.microsoft.com/v1.0.
+	GraphUrl string `yaml:"graphUrl"`
+	// LoginUrl defaults to https://login.microsoftonline.com.
+	LoginUrl string `yaml:"loginUrl"`
+	// TransitiveMembership reports users as members of the groups they are
+	// in through nested groups too.
+	TransitiveMembership bool `yaml:"transitiveMembership"`
 }
 
+// GcpConfig reconciles IAM policy bindings on projects, folders and
+// organizations. Only the role and condition pairs named in Bindings are
+// managed on each resource, every other binding is left alone.
 type GcpConfig struct {
 	BaseConfig `yaml:",inline"`
+	// ServiceAccountKey is optional, application default credentials are
+	// used without it.
+	ServiceAccountKey *resolvers.ResolverField `yaml:"serviceAccountKey"`
+	Bindings          []GcpBindingConfig       `yaml:"bindings"`
 }
 
+// GcpBindingConfig grants a role on each of the listed resources, which are
+// projects/<id>, folders/<id> or organizations/<id>, to the members of the
+// source groups.
+type GcpBindingConfig struct {
+	Role      string   `yaml:"role"`
+	Resources []string `yaml:"resources"`
+	Groups    []string `yaml:"groups"`
+	// BindGroups grants the role to the groups themselves instead of their
+	// members. The group names then have to be Google group emails.
+	BindGroups bool                `yaml:"bindGroups"`
+	Condition  *GcpConditionConfig `yaml:"condition"`
+}
+
+// GcpConditionConfig makes a binding conditional on a CEL expression.
+type GcpConditionConfig struct {
+	Title       string `yaml:"title"`
+	Description string `yaml:"description"`
+	Expression  string `yaml:"expression"`
+}
+
+// LdapConfig reads users and groups from an LDAP directory and, when Write is
+// set, manages them. Mapped fields are entry attributes, plus dn.
 type LdapConfig struct {
 	BaseConfig `yaml:",inline"`
+	// Url is either ldap://host:389 or ldaps://host:636.
+	Url                string                   `yaml:"url"`
+	StartTLS           bool                     `yaml:"startTLS"`
+	InsecureSkipVerify bool                     `yaml:"insecureSkipVerify"`
+	BindDN             string                   `yaml:"bindDN"`
+	BindPassword       *resolvers.ResolverField `yaml:"bindPassword"`
+
+	UserBaseDN string `yaml:"userBaseDN"`
+	// UserFilter selects user entries, (objectClass=inetOrgPerson) by default.
+	UserFilter  string `yaml:"userFilter"`
+	GroupBaseDN string `yaml:"groupBaseDN"`
+	// GroupFilter selects group entries, (objectClass=groupOfNames) by default.
+	GroupFilter string `yaml:"groupFilter"`
+	// MemberAttribute holds the DNs of a group's members, member by default.
+	MemberAttribute string `yaml:"memberAttribute"`
+	// PageSize is the number of entries requested per page, 500 by default.
+	PageSize uint32 `yaml:"pageSize"`
+
+	// Write enables adding, modifying and deleting entries.
+	Write bool `yaml:"write"`
+	// UserRDN is the attribute new user entries are named by, uid by default.
+	// Users are keyed by its mapped field.
+	UserRDN            string   `yaml:"userRDN"`
+	UserObjectClasses  []string `yaml:"userObjectClasses"`
+	GroupObjectClasses []string `yaml:"groupObjectClasses"`
+	// DeleteGroups deletes the groups no source user is a member of, other
+	// than the ignored ones. Without it they are left alone, as groupOfNames
+	// entries cannot be emptied.
+	DeleteGroups bool `yaml:"deleteGroups"`
 }
 
 type OneLoginConfig struct {
@@ -74,16 +302,47 @@ type OneLoginConfig struct {
 	BaseConfig   `yaml:",inline"`
 }
 
+// KeycloakConfig manages a realm. With a username the provider logs in as
+// that user, through admin-cli unless ClientID is set, otherwise it logs in
+// with the service account of the ClientID client.
 type KeycloakConfig struct {
-	BaseConfig   `yaml:",inline"`
-	Url          string                   `yaml:"string"`
-	Realm        string                   `yaml:"realm"`
+	BaseConfig `yaml:",inline"`
+	Url        string `yaml:"url"`
+	Realm      string `yaml:"realm"`
+	// AuthRealm is the realm to log in to, e.g. master, and defaults to Realm.
+	AuthRealm    string                   `yaml:"authRealm"`
 	ClientID     *resolvers.ResolverField `yaml:"clientID"`
 	ClientSecret *resolvers.ResolverField `yaml:"clientSecret"`
 	Username     *resolvers.ResolverField `yaml:"username"`
 	Password     *resolvers.ResolverField `yaml:"password"`
+	// DeleteGroups deletes the groups no source user is a member of, other
+	// than the ignored ones. Without it their members are only removed.
+	DeleteGroups bool                 `yaml:"deleteGroups"`
+	Roles        []KeycloakRoleConfig `yaml:"roles"`
 }
 
+// KeycloakRoleConfig maps a realm role, or a client role when Client is set,
+// to the members of the source groups. Groups are group paths, e.g.
+// /engineering/backend. Only the users or groups holding the declared roles
+// are managed, other role mappings are left alone.
+type KeycloakRoleConfig struct {
+	Role string `yaml:"role"`
+	// Client is the clientId of the client the role belongs to.
+	Client string   `yaml:"client"`
+	Groups []string `yaml:"groups"`
+	// BindGroups maps the role to the groups themselves instead of their
+	// members.
+	BindGroups bool `yaml:"bindGroups"`
+}
+
+// ADConfig reads users and groups from Active Directory. It takes the LDAP
+// settings, with filters defaulting to AD users and groups. Entries are never
+// written, except to disable accounts on deprovisioning.
 type ADConfig struct {
-	BaseConfig `yaml:",inline"`
+	LdapConfig `yaml:",inline"`
+	// KeyAttribute identifies users in plans, objectGUID by default. Use
+	// userPrincipalName or sAMAccountName when the source has no GUIDs.
+	KeyAttribute string `yaml:"keyAttribute"`
+	// NestedGroups includes the groups users are members of through other groups.
+	NestedGroups bool `yaml:"nestedGroups"`
 }
@@ -0,0 +1,264 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/audit"
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/state"
+)
+
+const defaultApprovalExpiry = 7 * 24 * time.Hour
+
+var (
+	ErrApprovalNotFound = errors.New("approval not found")
+	ErrApprovalExpired  = errors.New("approval expired")
+)
+
+// PendingApproval is an operation held back until someone approves it.
+type PendingApproval struct {
+	ID          string         `json:"id"`
+	Target      string         `json:"target"`
+	Kind        OperationKind  `json:"kind"`
+	Key         string         `json:"key"`
+	Object      map[string]any `json:"object,omitempty"`
+	Reasons     []string       `json:"reasons"`
+	RequestedAt time.Time      `json:"requestedAt"`
+	ExpiresAt   time.Time      `json:"expiresAt"`
+	ApprovedBy  string         `json:"approvedBy,omitempty"`
+	ApprovedAt  *time.Time     `json:"approvedAt,omitempty"`
+}
+
+func (pa PendingApproval) Expired() bool {
+	return time.Now().After(pa.ExpiresAt)
+}
+
+func approvalKey(target, id string) string {
+	return fmt.Sprintf("approvals/%s/%s", target, id)
+}
+
+// approvalReasons returns why an operation needs approval, or nothing when it
+// can be applied unattended.
+func (o *options) approvalReasons(plan *Plan, op Operation) []string {
+	reasons := make([]string, 0)
+	if o.approval == nil {
+		return reasons
+	}
+
+	if slices.Contains(o.approval.Operations, string(op.Kind)) {
+		reasons = append(reasons, fmt.Sprintf("%s operations require approval", op.Kind))
+	}
+
+	if o.approval.IgnoredUsers && o.ignored(op.Key, op.Object, plan.Existing[op.Key]) {
+		reasons = append(reasons, "user is in the ignore list")
+	}
+
+	if op.Kind == OperationCreate || op.Kind == OperationUpdate || op.Kind == OperationReactivate {
+		existing := config.StringList(plan.Existing[op.Key][o.groupField])
+		for _, group := range config.StringList(op.Object[o.groupField]) {
+			if slices.Contains(o.approval.Groups, group) && !slices.Contains(existing, group) {
+				reasons = append(reasons, fmt.Sprintf("grants membership of %s", group))
+			}
+		}
+	}
+
+	if group, _ := op.Object["group"].(string); op.Kind == OperationAddMember && slices.Contains(o.approval.Groups, group) {
+		reasons = append(reasons, fmt.Sprintf("grants membership of %s", group))
+	}
+
+	if op.Kind == OperationGrant {
+		if role, _ := op.Object["role"].(string); slices.Contains(o.approval.Roles, role) {
+			reasons = append(reasons, fmt.Sprintf("grants role %s", role))
+		}
+		if group, _ := op.Object["group"].(string); slices.Contains(o.approval.Groups, group) {
+			reasons = append(reasons, fmt.Sprintf("grants a role in %s", group))
+		}
+	}
+
+	return reasons
+}
+
+// ignored reports whether the key or any value of the given objects is in the ignore list.
+func (o *options) ignored(key string, objs ...map[string]any) bool {
+	if slices.Contains(o.ignoreUsers, key) {
+		return true
+	}
+
+	for _, obj := range objs {
+		for _, val := range obj {
+			if str, ok := val.(string); ok && slices.Contains(o.ignoreUsers, str) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// approvalGate decides whether an operation that needs approval can run. It
+// returns the approver when it was approved, or pending when it is still
+// waiting, in which case a pending approval is stored if none is valid.
+func (o *options) approvalGate(ctx context.Context, plan *Plan, op Operation) (approver string, pending bool, err error) {
+	reasons := o.approvalReasons(plan, op)
+	if len(reasons) == 0 {
+		return "", false, nil
+	}
+
+	if o.store == nil {
+		return "", false, fmt.Errorf("operation requires approval (%s) but no state store is configured", strings.Join(reasons, ", "))
+	}
+
+	key := approvalKey(plan.Target, op.ID())
+
+	var rec PendingApproval
+	err = state.GetJSON(ctx, o.store, key, &rec)
+	if err != nil && !errors.Is(err, state.ErrNotFound) {
+		return "", false, err
+	}
+
+	// A stored approval only counts while it is valid and for the same change.
+	if err == nil && !rec.Expired() && sameObject(rec.Object, op.Object) {
+		if rec.ApprovedBy != "" {
+			return rec.ApprovedBy, false, nil
+		}
+		return "", true, nil
+	}
+
+	expiry := defaultApprovalExpiry
+	if o.approval.Expiry > 0 {
+		expiry = o.approval.Expiry
+	}
+
+	now := time.Now()
+	return "", true, state.PutJSON(ctx, o.store, key, PendingApproval{
+		ID:          op.ID(),
+		Target:      plan.Target,
+		Kind:        op.Kind,
+		Key:         op.Key,
+		Object:      op.Object,
+		Reasons:     reasons,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(expiry),
+	})
+}
+
+// clearApproval removes a used approval so it cannot be applied twice.
+func (o *options) clearApproval(ctx context.Context, target string, op Operation) error {
+	return o.store.Delete(ctx, approvalKey(target, op.ID()))
+}
+
+// sameObject compares objects the way they round trip through the state store.
+func sameObject(stored, obj map[string]any) bool {
+	bs, err := json.Marshal(obj)
+	if err != nil {
+		return false
+	}
+
+	var decoded map[string]any
+	if err := json.Unmarshal(bs, &decoded); err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(stored, decoded)
+}
+
+// Approvals manages pending approvals stored by the engine.
+type Approvals struct {
+	store state.Store
+	log   audit.Logger
+}
+
+// NewApprovals returns an approval manager. log may be nil.
+func NewApprovals(store state.Store, log audit.Logger) *Approvals {
+	return &Approvals{
+		store: store,
+		log:   log,
+	}
+}
+
+// List returns every stored approval, including approved ones that have not been applied yet.
+func (a *Approvals) List(ctx context.Context) ([]PendingApproval, error) {
+	keys, err := a.store.List(ctx, "approvals/")
+	if err != nil {
+		return nil, err
+	}
+
+	approvals := make([]PendingApproval, 0, len(keys))
+	for _, key := range keys {
+		var rec PendingApproval
+		if err := state.GetJSON(ctx, a.store, key, &rec); err != nil {
+			return nil, err
+		}
+		approvals = append(approvals, rec)
+	}
+
+	return approvals, nil
+}
+
+// Approve marks a pending approval as approved so the next apply runs it.
+func (a *Approvals) Approve(ctx context.Context, target, id, approver string) error {
+	rec, err := a.get(ctx, target, id)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	rec.ApprovedBy = approver
+	rec.ApprovedAt = &now
+	if err := state.PutJSON(ctx, a.store, approvalKey(target, id), rec); err != nil {
+		return err
+	}
+
+	return a.audit(ctx, rec, "approve", approver)
+}
+
+// Reject drops a pending approval. The operation is requested again if the
+// next plan still contains it.
+func (a *Approvals) Reject(ctx context.Context, target, id, approver string) error {
+	rec, err := a.get(ctx, target, id)
+	if err != nil {
+		return err
+	}
+
+	if err := a.store.Delete(ctx, approvalKey(target, id)); err != nil {
+		return err
+	}
+
+	return a.audit(ctx, rec, "reject", approver)
+}
+
+func (a *Approvals) get(ctx context.Context, target, id string) (PendingApproval, error) {
+	var rec PendingApproval
+	err := state.GetJSON(ctx, a.store, approvalKey(target, id), &rec)
+	if errors.Is(err, state.ErrNotFound) {
+		return rec, fmt.Errorf("%s %s: %w", target, id, ErrApprovalNotFound)
+	} else if err != nil {
+		return rec, err
+	}
+
+	if rec.Expired() {
+		return rec, fmt.Errorf("%s %s: %w", target, id, ErrApprovalExpired)
+	}
+
+	return rec, nil
+}
+
+func (a *Approvals) audit(ctx context.Context, rec PendingApproval, action, actor string) error {
+	if a.log == nil {
+		return nil
+	}
+
+	return a.log.Log(ctx, audit.Event{
+		Target: rec.Target,
+		Action: action,
+		Key:    rec.ID,
+		Actor:  actor,
+	})
+}
@@ -0,0 +1,85 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+type approvalRequest struct {
+	Target string `json:"target"`
+	ID     string `json:"id"`
+}
+
+// NewApprovalHandler serves the approvals API:
+//
+//	GET  /         lists approvals
+//	POST /approve  approves {"target": ..., "id": ...}
+//	POST /reject   rejects {"target": ..., "id": ...}
+//
+// identify authenticates the request and returns the approver's identity,
+// which is recorded in the audit trail.
+func NewApprovalHandler(approvals *Approvals, identify func(r *http.Request) (string, error)) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if _, err := identify(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		list, err := approvals.List(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(list)
+	})
+
+	mux.HandleFunc("/approve", approvalAction(identify, approvals.Approve))
+	mux.HandleFunc("/reject", approvalAction(identify, approvals.Reject))
+
+	return mux
+}
+
+func approvalAction(identify func(r *http.Request) (string, error), action func(ctx context.Context, target, id, approver string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		approver, err := identify(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var req approvalRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = action(r.Context(), req.Target, req.ID, approver)
+		switch {
+		case errors.Is(err, ErrApprovalNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrApprovalExpired):
+			http.Error(w, err.Error(), http.StatusGone)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
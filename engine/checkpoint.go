@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/state"
+)
+
+// Checkpoint tracks the progress of a plan so an interrupted apply can resume.
+type Checkpoint struct {
+	// Completed maps the ids of applied operations to their fingerprint.
+	Completed map[string]string `json:"completed"`
+	// InFlight is the operation that was being applied when the checkpoint was written.
+	InFlight            string    `json:"inFlight,omitempty"`
+	InFlightFingerprint string    `json:"inFlightFingerprint,omitempty"`
+	UpdatedAt           time.Time `json:"updatedAt"`
+}
+
+func checkpointKey(target string) string {
+	return fmt.Sprintf("checkpoints/%s", target)
+}
+
+// fingerprint identifies the exact change an operation makes, so a completed
+// operation is only skipped when the recomputed plan asks for the same thing.
+func fingerprint(op Operation) string {
+	bs, _ := json.Marshal(op.Object)
+	sum := sha256.Sum256(append([]byte(op.ID()+"\n"), bs...))
+	return hex.EncodeToString(sum[:])
+}
+
+func (cp *Checkpoint) completed(op Operation) bool {
+	fp, ok := cp.Completed[op.ID()]
+	return ok && fp == fingerprint(op)
+}
+
+func (cp *Checkpoint) inFlight(op Operation) bool {
+	return cp.InFlight == op.ID() && cp.InFlightFingerprint == fingerprint(op)
+}
+
+func (o *options) loadCheckpoint(ctx context.Context, target string) (*Checkpoint, error) {
+	cp := &Checkpoint{Completed: make(map[string]string)}
+	if o.store == nil {
+		return cp, nil
+	}
+
+	err := state.GetJSON(ctx, o.store, checkpointKey(target), cp)
+	if err != nil && !errors.Is(err, state.ErrNotFound) {
+		return nil, err
+	}
+
+	if cp.Completed == nil {
+		cp.Completed = make(map[string]string)
+	}
+
+	return cp, nil
+}
+
+func (o *options) saveCheckpoint(ctx context.Context, target string, cp *Checkpoint) error {
+	if o.store == nil {
+		return nil
+	}
+
+	cp.UpdatedAt = time.Now()
+	return state.PutJSON(ctx, o.store, checkpointKey(target), cp)
+}
+
+func (o *options) clearCheckpoint(ctx context.Context, target string) error {
+	if o.store == nil {
+		return nil
+	}
+
+	return o.store.Delete(ctx, checkpointKey(target))
+}
+
+// resumed reports whether the operation was already applied by an interrupted
+// run. The operation that was in flight is re-verified when it can be.
+func (o *options) resumed(ctx context.Context, target string, cp *Checkpoint, op Operation) (bool, error) {
+	if cp.completed(op) {
+		return true, nil
+	}
+
+	if !cp.inFlight(op) || op.Verify == nil {
+		return false, nil
+	}
+
+	done, err := op.Verify(ctx)
+	if err != nil {
+		return false, fmt.Errorf("verifying interrupted operation: %w", err)
+	} else if !done {
+		return false, nil
+	}
+
+	cp.Completed[op.ID()] = fingerprint(op)
+	cp.InFlight, cp.InFlightFingerprint = "", ""
+	return true, o.saveCheckpoint(ctx, target, cp)
+}
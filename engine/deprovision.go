@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/state"
+)
+
+// Deprovisioned records when the engine suspended a user that left the source.
+type Deprovisioned struct {
+	SuspendedAt time.Time `json:"suspendedAt"`
+}
+
+func deprovisionedKey(target, key string) string {
+	return fmt.Sprintf("deprovisioned/%s/%s", target, key)
+}
+
+// AddRemoval plans the removal of a user according to the deprovisioning
+// policy. Active users are suspended, while users that are already suspended
+// get a deferred delete that only runs once the grace period has passed.
+func (p *Plan) AddRemoval(policy *config.DeprovisioningConfig, key string, obj map[string]any, suspended bool, suspend, remove func(ctx context.Context) error) {
+	switch {
+	case !policy.Suspends():
+		p.Add(OperationDelete, key, obj, remove)
+	case suspended:
+		p.Add(OperationDelete, key, obj, remove)
+		p.Operations[len(p.Operations)-1].Deferred = true
+	default:
+		p.Add(OperationSuspend, key, obj, suspend)
+	}
+}
+
+// AddRecordedDelete plans the deferred delete of a user that is already gone
+// from the target without being suspended, e.g. one deactivated because it
+// could not be suspended. It only runs for users the engine removed itself,
+// so the ones removed by hand are left alone.
+func (p *Plan) AddRecordedDelete(key string, obj map[string]any, remove func(ctx context.Context) error) {
+	p.Add(OperationDelete, key, obj, remove)
+	p.Operations[len(p.Operations)-1].Deferred = true
+	p.Operations[len(p.Operations)-1].Recorded = true
+}
+
+// deprovisionGate reports whether an operation should be held back. Deferred
+// deletes wait for the grace period, and only users suspended by the engine
+// are reactivated so manual suspensions are left alone.
+func (o *options) deprovisionGate(ctx context.Context, target string, op Operation) (bool, error) {
+	if op.Kind != OperationReactivate && !op.Deferred {
+		return false, nil
+	}
+
+	if o.store == nil {
+		// Without state there is no record of when, or whether, the engine
+		// suspended the user, so neither is safe to apply.
+		return true, nil
+	}
+
+	var rec Deprovisioned
+	err := state.GetJSON(ctx, o.store, deprovisionedKey(target, op.Key), &rec)
+	if errors.Is(err, state.ErrNotFound) {
+		if op.Kind == OperationReactivate || op.Recorded {
+			return true, nil
+		}
+
+		// Suspended outside of a sync, start the grace period now.
+		return true, state.PutJSON(ctx, o.store, deprovisionedKey(target, op.Key), Deprovisioned{SuspendedAt: time.Now()})
+	} else if err != nil {
+		return false, err
+	}
+
+	if op.Kind == OperationReactivate {
+		return false, nil
+	}
+
+	if o.deprovisioning == nil || o.deprovisioning.GracePeriod == 0 {
+		return true, nil
+	}
+
+	return time.Now().Before(rec.SuspendedAt.Add(o.deprovisioning.GracePeriod)), nil
+}
+
+// recordDeprovisioning keeps the suspension records in line with a successful operation.
+func (o *options) recordDeprovisioning(ctx context.Context, target string, op Operation) error {
+	if o.store == nil {
+		return nil
+	}
+
+	switch {
+	case op.Kind == OperationSuspend:
+		return state.PutJSON(ctx, o.store, deprovisionedKey(target, op.Key), Deprovisioned{SuspendedAt: time.Now()})
+	case op.Kind == OperationReactivate, op.Deferred:
+		return o.store.Delete(ctx, deprovisionedKey(target, op.Key))
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/state"
+)
+
+func noop(context.Context) error { return nil }
+
+func TestDeferredDeletesDoNotCountAsRemovals(t *testing.T) {
+	policy := &config.DeprovisioningConfig{Mode: config.DeprovisionSuspend}
+	safety := &config.SafetyConfig{MaxDeletes: 1}
+
+	tests := []struct {
+		name      string
+		suspended []bool
+		removals  int
+		blocked   bool
+	}{
+		{name: "suspends", suspended: []bool{false, false}, removals: 2, blocked: true},
+		{name: "deferred deletes", suspended: []bool{true, true, true}, removals: 0},
+		{name: "mixed", suspended: []bool{true, false, true}, removals: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := NewPlan("test")
+			for i, suspended := range tt.suspended {
+				plan.AddRemoval(policy, string(rune('a'+i)), nil, suspended, noop, noop)
+			}
+			plan.Current, plan.Desired = 10, 10
+
+			if got := plan.Removals(); got != tt.removals {
+				t.Errorf("Removals() = %d, want %d", got, tt.removals)
+			}
+
+			_, err := Apply(context.Background(), plan, WithConfig(config.BaseConfig{Safety: safety, Deprovisioning: policy}))
+			var safetyErr *SafetyError
+			if blocked := errors.As(err, &safetyErr); blocked != tt.blocked {
+				t.Errorf("Apply error = %v, want blocked %v", err, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestDeprovisioningWithoutStateIsHeld(t *testing.T) {
+	policy := &config.DeprovisioningConfig{Mode: config.DeprovisionSuspend}
+
+	applied := make([]string, 0)
+	apply := func(id string) func(context.Context) error {
+		return func(context.Context) error {
+			applied = append(applied, id)
+			return nil
+		}
+	}
+
+	plan := NewPlan("test")
+	plan.AddRemoval(policy, "suspended", nil, true, apply("suspend:suspended"), apply("delete:suspended"))
+	plan.AddRemoval(policy, "active", nil, false, apply("suspend:active"), apply("delete:active"))
+	plan.Add(OperationReactivate, "returning", nil, apply("reactivate:returning"))
+
+	res, err := Apply(context.Background(), plan, WithConfig(config.BaseConfig{Deprovisioning: policy}))
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	if want := []string{"suspend:active"}; !slices.Equal(applied, want) {
+		t.Errorf("applied %v, want %v", applied, want)
+	}
+	if got := res.Count(StatusDeferred); got != 2 {
+		t.Errorf("%d operations deferred, want the delete and the reactivation", got)
+	}
+}
+
+func TestRecordedDeletesOnlyApplyToUsersTheEngineRemoved(t *testing.T) {
+	ctx := context.Background()
+	store, err := state.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("creating store: %v", err)
+	}
+
+	policy := &config.DeprovisioningConfig{Mode: config.DeprovisionSuspend, GracePeriod: time.Hour}
+	if err := state.PutJSON(ctx, store, deprovisionedKey("test", "removed"), Deprovisioned{SuspendedAt: time.Now().Add(-2 * time.Hour)}); err != nil {
+		t.Fatalf("recording removal: %v", err)
+	}
+
+	applied := make([]string, 0)
+	plan := NewPlan("test")
+	for _, key := range []string{"manual", "removed"} {
+		key := key
+		plan.AddRecordedDelete(key, nil, func(context.Context) error {
+			applied = append(applied, key)
+			return nil
+		})
+	}
+
+	if _, err := Apply(ctx, plan, WithConfig(config.BaseConfig{Deprovisioning: policy}), WithStateStore(store)); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	if want := []string{"removed"}; !slices.Equal(applied, want) {
+		t.Errorf("deleted %v, want %v", applied, want)
+	}
+
+	var rec Deprovisioned
+	if err := state.GetJSON(ctx, store, deprovisionedKey("test", "manual"), &rec); !errors.Is(err, state.ErrNotFound) {
+		t.Errorf("record of the manually removed user = %+v, %v, want none", rec, err)
+	}
+	if err := state.GetJSON(ctx, store, deprovisionedKey("test", "removed"), &rec); !errors.Is(err, state.ErrNotFound) {
+		t.Errorf("record of the deleted user = %+v, %v, want it cleared", rec, err)
+	}
+}
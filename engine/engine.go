@@ -0,0 +1,364 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/tiagoposse/go-identity-sync/audit"
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/lock"
+	"github.com/tiagoposse/go-identity-sync/state"
+)
+
+type OperationKind string
+
+const (
+	OperationCreate OperationKind = "create"
+	OperationUpdate OperationKind = "update"
+	OperationDelete OperationKind = "delete"
+	// OperationSuspend and OperationReactivate disable and re-enable a user
+	// without deleting it, see DeprovisioningConfig.
+	OperationSuspend    OperationKind = "suspend"
+	OperationReactivate OperationKind = "reactivate"
+)
+
+// Operation is a single change a provider makes against its target.
+type Operation struct {
+	Kind OperationKind
+	// Key identifies the object the operation applies to, usually its mapped id.
+	Key    string
+	Object map[string]any
+	Apply  func(ctx context.Context) error
+	// Deferred marks a delete of a suspended user that only runs once the
+	// deprovisioning grace period has passed.
+	Deferred bool
+	// Recorded makes a deferred delete wait for the engine's record of the
+	// user's removal instead of starting one, see AddRecordedDelete.
+	Recorded bool
+	// Verify optionally checks whether the operation already took effect. It
+	// is used when resuming an apply that was interrupted mid-operation.
+	Verify func(ctx context.Context) (bool, error)
+}
+
+// ID uniquely identifies the operation within a plan.
+func (op Operation) ID() string {
+	return fmt.Sprintf("%s:%s", op.Kind, op.Key)
+}
+
+// Plan is the list of operations needed to bring a target in line with its source.
+type Plan struct {
+	// Target names the provider instance the plan applies to, e.g. github/my-org.
+	Target     string
+	Operations []Operation
+	// Current and Desired are the number of objects in the target and the
+	// source when the plan was computed.
+	Current int
+	Desired int
+	// Existing holds the target's objects by key as they were when planned.
+	Existing map[string]map[string]any
+	// Field is the source field objects are keyed by.
+	Field string
+	// Members and DesiredMembers are the number of current and desired
+	// members of the groups the plan manages memberships of.
+	Members        int
+	DesiredMembers int
+}
+
+func NewPlan(target string) *Plan {
+	return &Plan{
+		Target:     target,
+		Operations: make([]Operation, 0),
+		Existing:   make(map[string]map[string]any),
+	}
+}
+
+// SetState records the target and source the plan was computed from.
+func (p *Plan) SetState(current, desired []map[string]any, field string) {
+	p.Current, p.Desired = len(current), len(desired)
+	p.Field = field
+	for _, obj := range current {
+		p.Existing[config.KeyOf(obj, field)] = obj
+	}
+}
+
+// Count returns the number of operations of the given kind.
+func (p *Plan) Count(kind OperationKind) int {
+	count := 0
+	for _, op := range p.Operations {
+		if op.Kind == kind {
+			count++
+		}
+	}
+
+	return count
+}
+
+// AddVerified appends an operation that can check whether it already took effect.
+func (p *Plan) AddVerified(kind OperationKind, key string, obj map[string]any, apply func(ctx context.Context) error, verify func(ctx context.Context) (bool, error)) {
+	p.Add(kind, key, obj, apply)
+	p.Operations[len(p.Operations)-1].Verify = verify
+}
+
+// Removals returns the number of operations that take a user away from the
+// target, whether by deleting or suspending it. Deferred deletes are left out,
+// as their users were counted when they were suspended.
+func (p *Plan) Removals() int {
+	count := 0
+	for _, op := range p.Operations {
+		if op.Kind == OperationSuspend || op.Kind == OperationDelete && !op.Deferred {
+			count++
+		}
+	}
+
+	return count
+}
+
+// GroupRemovals returns the number of operations that take access away,
+// whether by removing members, revoking grants or deleting groups.
+func (p *Plan) GroupRemovals() int {
+	return p.Count(OperationRemoveMember) + p.Count(OperationRevoke) + p.Count(OperationDeleteGroup)
+}
+
+// Add appends an operation to the plan.
+func (p *Plan) Add(kind OperationKind, key string, obj map[string]any, apply func(ctx context.Context) error) {
+	p.Operations = append(p.Operations, Operation{
+		Kind:   kind,
+		Key:    key,
+		Object: obj,
+		Apply:  apply,
+	})
+}
+
+type Option func(*options)
+
+type options struct {
+	continueOnError bool
+	safety          *config.SafetyConfig
+	overrideSafety  bool
+	run             *Run
+	store           state.Store
+	deprovisioning  *config.DeprovisioningConfig
+	approval        *config.ApprovalConfig
+	groupField      string
+	ignoreUsers     []string
+	audit           audit.Logger
+	locker          lock.Locker
+	failures        io.Writer
+}
+
+// WithConfig applies the engine settings from a provider's config block.
+func WithConfig(cfg config.BaseConfig) Option {
+	return func(o *options) {
+		o.continueOnError = cfg.ContinueOnError
+		o.safety = cfg.Safety
+		o.deprovisioning = cfg.Deprovisioning
+		o.approval = cfg.Approval
+		o.groupField = cfg.GroupField
+		o.ignoreUsers = cfg.IgnoreUsers
+	}
+}
+
+// WithAuditLogger records the outcome of every operation in the audit trail.
+func WithAuditLogger(log audit.Logger) Option {
+	return func(o *options) {
+		o.audit = log
+	}
+}
+
+// WithLocker locks the target for the duration of the apply, so concurrent
+// runs against the same target fail instead of racing each other.
+func WithLocker(locker lock.Locker) Option {
+	return func(o *options) {
+		o.locker = locker
+	}
+}
+
+// WithFailureReport writes a table of the failed operations to w when the
+// apply does not fully succeed.
+func WithFailureReport(w io.Writer) Option {
+	return func(o *options) {
+		o.failures = w
+	}
+}
+
+// WithContinueOnError keeps applying the remaining operations after one fails.
+func WithContinueOnError(val bool) Option {
+	return func(o *options) {
+		o.continueOnError = val
+	}
+}
+
+// Apply runs every operation in the plan and records the outcome of each. The
+// returned error is an *ApplyError when at least one operation failed or the
+// apply was interrupted before the end of the plan.
+func Apply(ctx context.Context, plan *Plan, opts ...Option) (res *Result, retErr error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	res = &Result{
+		Target:     plan.Target,
+		Operations: make([]OperationResult, 0, len(plan.Operations)),
+	}
+
+	if o.failures != nil {
+		defer func() {
+			if res.ExitCode() == ExitSuccess {
+				return
+			}
+			if err := res.WriteFailures(o.failures); err != nil && retErr == nil {
+				retErr = fmt.Errorf("writing failure report: %w", err)
+			}
+		}()
+	}
+
+	if o.locker != nil {
+		lk, err := o.locker.Acquire(ctx, plan.Target)
+		if err != nil {
+			return res.skipAll(plan), err
+		}
+
+		// Stop applying as soon as the lock is lost, the remaining operations
+		// are picked up from the checkpoint by whoever holds it next.
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		go func() {
+			select {
+			case <-lk.Lost():
+				cancel(fmt.Errorf("%w: %s", lock.ErrLost, plan.Target))
+			case <-ctx.Done():
+			}
+		}()
+
+		defer func() {
+			cancel(nil)
+			if err := lk.Release(context.Background()); err != nil && retErr == nil {
+				retErr = err
+			}
+		}()
+	}
+
+	if err := o.checkSafety(ctx, plan); err != nil {
+		return res.skipAll(plan), err
+	}
+
+	if err := o.recordSnapshot(ctx, plan); err != nil {
+		return res, err
+	}
+
+	cp, err := o.loadCheckpoint(ctx, plan.Target)
+	if err != nil {
+		return res, fmt.Errorf("loading checkpoint: %w", err)
+	}
+
+	stopped := false
+	for _, op := range plan.Operations {
+		if stopped {
+			res.Operations = append(res.Operations, OperationResult{Operation: op, Status: StatusSkipped})
+			continue
+		}
+
+		if ctx.Err() != nil {
+			res.Interrupted = context.Cause(ctx)
+			res.Operations = append(res.Operations, OperationResult{Operation: op, Status: StatusSkipped, Err: res.Interrupted})
+			stopped = true
+			continue
+		}
+
+		if done, err := o.resumed(ctx, plan.Target, cp, op); err != nil {
+			res.Operations = append(res.Operations, OperationResult{Operation: op, Status: StatusFailed, Err: err})
+			stopped = !o.continueOnError
+			continue
+		} else if done {
+			res.Operations = append(res.Operations, OperationResult{Operation: op, Status: StatusCompleted})
+			continue
+		}
+
+		cp.InFlight, cp.InFlightFingerprint = op.ID(), fingerprint(op)
+		if err := o.saveCheckpoint(ctx, plan.Target, cp); err != nil {
+			return res, fmt.Errorf("saving checkpoint: %w", err)
+		}
+
+		status, approver, err := o.apply(ctx, plan, op)
+		res.Operations = append(res.Operations, OperationResult{Operation: op, Status: status, Err: err})
+		if status == StatusFailed {
+			stopped = !o.continueOnError
+		}
+
+		if status == StatusSucceeded {
+			cp.Completed[op.ID()] = fingerprint(op)
+		}
+		cp.InFlight, cp.InFlightFingerprint = "", ""
+		if err := o.saveCheckpoint(ctx, plan.Target, cp); err != nil {
+			return res, fmt.Errorf("saving checkpoint: %w", err)
+		}
+
+		if err := o.logOperation(ctx, plan.Target, op, status, approver, err); err != nil {
+			return res, fmt.Errorf("writing audit log: %w", err)
+		}
+	}
+
+	// An interrupted apply keeps its checkpoint so the next run can resume it.
+	if ctx.Err() == nil {
+		if err := o.clearCheckpoint(ctx, plan.Target); err != nil {
+			return res, fmt.Errorf("clearing checkpoint: %w", err)
+		}
+	}
+
+	return res, res.Err()
+}
+
+// apply runs a single operation and keeps the engine state in line with it.
+// It returns who approved the operation when it needed approval.
+func (o *options) apply(ctx context.Context, plan *Plan, op Operation) (OperationStatus, string, error) {
+	deferred, err := o.deprovisionGate(ctx, plan.Target, op)
+	if err != nil {
+		return StatusFailed, "", err
+	} else if deferred {
+		return StatusDeferred, "", nil
+	}
+
+	approver, pending, err := o.approvalGate(ctx, plan, op)
+	if err != nil {
+		return StatusFailed, "", err
+	} else if pending {
+		return StatusPending, "", nil
+	}
+
+	if err := op.Apply(ctx); err != nil {
+		return StatusFailed, approver, err
+	}
+
+	if err := o.recordDeprovisioning(ctx, plan.Target, op); err != nil {
+		return StatusFailed, approver, fmt.Errorf("recording deprovisioning state: %w", err)
+	}
+
+	if approver != "" {
+		if err := o.clearApproval(ctx, plan.Target, op); err != nil {
+			return StatusFailed, approver, fmt.Errorf("clearing approval: %w", err)
+		}
+	}
+
+	return StatusSucceeded, approver, nil
+}
+
+func (o *options) logOperation(ctx context.Context, target string, op Operation, status OperationStatus, approver string, opErr error) error {
+	if o.audit == nil {
+		return nil
+	}
+
+	event := audit.Event{
+		Target: target,
+		Action: string(op.Kind),
+		Key:    op.Key,
+		Status: string(status),
+		Actor:  approver,
+	}
+	if opErr != nil {
+		event.Error = opErr.Error()
+	}
+
+	return o.audit.Log(ctx, event)
+}
@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// Group operations manage groups, their members and their access. They are
+// kept apart from the user kinds, and the ones that take access away are
+// checked against the group safety thresholds instead of the user ones.
+const (
+	OperationCreateGroup  OperationKind = "create-group"
+	OperationUpdateGroup  OperationKind = "update-group"
+	OperationDeleteGroup  OperationKind = "delete-group"
+	OperationAddMember    OperationKind = "add-member"
+	OperationRemoveMember OperationKind = "remove-member"
+	// OperationGrant and OperationRevoke give and take away access, such as
+	// a permission set assignment, from a group or user.
+	OperationGrant  OperationKind = "grant"
+	OperationRevoke OperationKind = "revoke"
+)
+
+// MembershipKey identifies a member of a group in membership operations.
+func MembershipKey(group, member string) string {
+	return fmt.Sprintf("%s/%s", group, member)
+}
+
+// AddMemberships plans the membership changes that turn the current members
+// of each group into the desired ones. Only groups present in desired are
+// managed, members of any other group are left alone.
+func (p *Plan) AddMemberships(current, desired map[string][]string, add, remove func(ctx context.Context, group, member string) error) {
+	groups := make([]string, 0, len(desired))
+	for group := range desired {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	for _, group := range groups {
+		group := group
+		p.Members += len(current[group])
+		p.DesiredMembers += len(desired[group])
+
+		for _, member := range desired[group] {
+			member := member
+			if !slices.Contains(current[group], member) {
+				p.Add(OperationAddMember, MembershipKey(group, member), membershipObject(group, member), func(ctx context.Context) error {
+					return add(ctx, group, member)
+				})
+			}
+		}
+
+		for _, member := range current[group] {
+			member := member
+			if !slices.Contains(desired[group], member) {
+				p.Add(OperationRemoveMember, MembershipKey(group, member), membershipObject(group, member), func(ctx context.Context) error {
+					return remove(ctx, group, member)
+				})
+			}
+		}
+	}
+}
+
+func membershipObject(group, member string) map[string]any {
+	return map[string]any{
+		"group":  group,
+		"member": member,
+	}
+}
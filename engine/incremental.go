@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/state"
+)
+
+// ErrFullSyncRequired is returned by a change feed that cannot resume from its
+// cursor, for instance because it expired, so the source has to be read in full.
+var ErrFullSyncRequired = errors.New("engine: change feed needs a full sync")
+
+// Change is a source user that changed after a cursor.
+type Change struct {
+	// ID identifies the user in the source, as in ChangeFeed.ReadAll.
+	ID string
+	// User is the converted user, or nil when the user left the source.
+	User map[string]any
+}
+
+// ChangeFeed is implemented by sources that can list what changed since a
+// cursor, so that they do not have to be listed in full on every run.
+type ChangeFeed interface {
+	// Cursor returns the current position of the feed. It is taken before a
+	// full read so that no change made during the read is missed.
+	Cursor(ctx context.Context) (string, error)
+	// ReadAll returns every converted user by source id.
+	ReadAll(ctx context.Context) (map[string]map[string]any, error)
+	// Changes returns the users that changed after cursor and the cursor to
+	// continue from. Seeing a change twice is harmless.
+	Changes(ctx context.Context, cursor string) ([]Change, string, error)
+}
+
+// SourceState is what an incremental read keeps between runs.
+type SourceState struct {
+	Cursor string                    `json:"cursor"`
+	Users  map[string]map[string]any `json:"users"`
+	// FullSyncAt is when the source was last read in full.
+	FullSyncAt time.Time `json:"fullSyncAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// SourceRead is the outcome of ReadSource.
+type SourceRead struct {
+	Users []map[string]any
+	// Full reports whether the source was read in full.
+	Full bool
+	// Changes is the number of changes applied by an incremental read.
+	Changes int
+}
+
+func sourceKey(name string) string {
+	return fmt.Sprintf("sources/%s", name)
+}
+
+// ReadSource returns the users of a source. When incremental reads are enabled
+// it applies the feed's changes to the users stored by the previous run, and
+// falls back to a full read when there is no previous run, the feed cannot
+// resume or the last full read is older than the full sync interval.
+func ReadSource(ctx context.Context, store state.Store, name string, feed ChangeFeed, cfg *config.IncrementalConfig) (*SourceRead, error) {
+	if !cfg.Reads() || store == nil {
+		users, err := feed.ReadAll(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return &SourceRead{Users: sortedUsers(users), Full: true}, nil
+	}
+
+	var st SourceState
+	err := state.GetJSON(ctx, store, sourceKey(name), &st)
+	if err != nil && !errors.Is(err, state.ErrNotFound) {
+		return nil, fmt.Errorf("loading source state: %w", err)
+	}
+
+	due := cfg.FullSyncInterval > 0 && time.Since(st.FullSyncAt) >= cfg.FullSyncInterval
+	if st.Cursor != "" && st.Users != nil && !due {
+		read, err := readChanges(ctx, store, name, feed, &st)
+		if !errors.Is(err, ErrFullSyncRequired) {
+			return read, err
+		}
+	}
+
+	cursor, err := feed.Cursor(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting change feed cursor: %w", err)
+	}
+
+	users, err := feed.ReadAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	st = SourceState{Cursor: cursor, Users: users, FullSyncAt: now, UpdatedAt: now}
+	if err := state.PutJSON(ctx, store, sourceKey(name), st); err != nil {
+		return nil, fmt.Errorf("saving source state: %w", err)
+	}
+
+	return &SourceRead{Users: sortedUsers(users), Full: true}, nil
+}
+
+// readChanges applies the changes after the stored cursor to the stored users.
+func readChanges(ctx context.Context, store state.Store, name string, feed ChangeFeed, st *SourceState) (*SourceRead, error) {
+	changes, cursor, err := feed.Changes(ctx, st.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, change := range changes {
+		if change.User == nil {
+			delete(st.Users, change.ID)
+		} else {
+			st.Users[change.ID] = change.User
+		}
+	}
+
+	st.Cursor, st.UpdatedAt = cursor, time.Now()
+	if err := state.PutJSON(ctx, store, sourceKey(name), st); err != nil {
+		return nil, fmt.Errorf("saving source state: %w", err)
+	}
+
+	return &SourceRead{Users: sortedUsers(st.Users), Changes: len(changes)}, nil
+}
+
+// sortedUsers returns the users ordered by source id, so that plans computed
+// from the same users are the same.
+func sortedUsers(users map[string]map[string]any) []map[string]any {
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	res := make([]map[string]any, 0, len(ids))
+	for _, id := range ids {
+		res = append(res, users[id])
+	}
+
+	return res
+}
@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+type OperationStatus string
+
+const (
+	StatusSucceeded OperationStatus = "succeeded"
+	StatusFailed    OperationStatus = "failed"
+	StatusSkipped   OperationStatus = "skipped"
+	// StatusDeferred is used for operations held back by policy, such as a
+	// delete still inside its grace period.
+	StatusDeferred OperationStatus = "deferred"
+	// StatusPending is used for operations waiting for approval.
+	StatusPending OperationStatus = "pending"
+	// StatusCompleted is used for operations already applied by an
+	// interrupted run that is being resumed.
+	StatusCompleted OperationStatus = "completed"
+)
+
+// Exit codes callers should use to report the outcome of an apply.
+const (
+	ExitSuccess        = 0
+	ExitFailure        = 1
+	ExitPartialFailure = 2
+)
+
+type OperationResult struct {
+	Operation Operation
+	Status    OperationStatus
+	Err       error
+}
+
+// Result is the outcome of applying a plan.
+type Result struct {
+	Target     string
+	Operations []OperationResult
+	// Interrupted is why the apply stopped before running every operation,
+	// e.g. the context was cancelled or the target lock was lost.
+	Interrupted error
+}
+
+// skipAll marks every operation of the plan as skipped.
+func (r *Result) skipAll(plan *Plan) *Result {
+	for _, op := range plan.Operations {
+		r.Operations = append(r.Operations, OperationResult{Operation: op, Status: StatusSkipped})
+	}
+
+	return r
+}
+
+// Count returns the number of operations with the given status.
+func (r *Result) Count(status OperationStatus) int {
+	count := 0
+	for _, op := range r.Operations {
+		if op.Status == status {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Failed returns the operations that failed.
+func (r *Result) Failed() []OperationResult {
+	failed := make([]OperationResult, 0)
+	for _, op := range r.Operations {
+		if op.Status == StatusFailed {
+			failed = append(failed, op)
+		}
+	}
+
+	return failed
+}
+
+// Err returns an *ApplyError describing every failed operation and why the
+// apply was interrupted, or nil.
+func (r *Result) Err() error {
+	failed := r.Failed()
+	if len(failed) == 0 && r.Interrupted == nil {
+		return nil
+	}
+
+	return &ApplyError{
+		Target:      r.Target,
+		Failed:      failed,
+		Total:       len(r.Operations),
+		Interrupted: r.Interrupted,
+	}
+}
+
+// ExitCode maps the result to a process exit code: ExitPartialFailure when
+// some operations succeeded and others failed or were skipped because the
+// apply was interrupted, ExitFailure when none succeeded.
+func (r *Result) ExitCode() int {
+	switch {
+	case r.Count(StatusFailed) == 0 && r.Interrupted == nil:
+		return ExitSuccess
+	case r.Count(StatusSucceeded) > 0:
+		return ExitPartialFailure
+	default:
+		return ExitFailure
+	}
+}
+
+// WriteFailures prints a table of the failed operations, followed by why the
+// apply was interrupted, if it was.
+func (r *Result) WriteFailures(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tOPERATION\tKEY\tERROR")
+	for _, op := range r.Failed() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\n", r.Target, op.Operation.Kind, op.Operation.Key, op.Err)
+	}
+	if r.Interrupted != nil {
+		fmt.Fprintf(tw, "%s\t-\t-\tinterrupted, %d operations skipped: %v\n", r.Target, r.Count(StatusSkipped), r.Interrupted)
+	}
+
+	return tw.Flush()
+}
+
+// ApplyError summarises the operations that failed during an apply.
+type ApplyError struct {
+	Target      string
+	Failed      []OperationResult
+	Total       int
+	Interrupted error
+}
+
+func (e *ApplyError) Error() string {
+	msgs := make([]string, 0, len(e.Failed))
+	for _, op := range e.Failed {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", op.Operation.ID(), op.Err))
+	}
+
+	if e.Interrupted == nil {
+		return fmt.Sprintf("%s: %d of %d operations failed: %s", e.Target, len(e.Failed), e.Total, strings.Join(msgs, "; "))
+	} else if len(msgs) == 0 {
+		return fmt.Sprintf("%s: apply interrupted: %v", e.Target, e.Interrupted)
+	}
+
+	return fmt.Sprintf("%s: apply interrupted: %v, %d of %d operations failed: %s", e.Target, e.Interrupted, len(e.Failed), e.Total, strings.Join(msgs, "; "))
+}
+
+func (e *ApplyError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed)+1)
+	if e.Interrupted != nil {
+		errs = append(errs, e.Interrupted)
+	}
+	for _, op := range e.Failed {
+		errs = append(errs, op.Err)
+	}
+
+	return errs
+}
@@ -0,0 +1,209 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/state"
+)
+
+// SafetyError is returned when a plan trips a safety threshold. Apply with
+// WithOverrideSafety to go ahead regardless.
+type SafetyError struct {
+	Target  string
+	Reasons []string
+}
+
+func (e *SafetyError) Error() string {
+	return fmt.Sprintf("%s: apply blocked by safety checks, override to apply anyway: %s", e.Target, strings.Join(e.Reasons, "; "))
+}
+
+// Snapshot records the size of the source the last time a plan was applied.
+type Snapshot struct {
+	SourceCount int       `json:"sourceCount"`
+	Time        time.Time `json:"time"`
+}
+
+func snapshotKey(target string) string {
+	return fmt.Sprintf("snapshots/%s", target)
+}
+
+// counts are the changes of a plan, or of every plan in a run, that the
+// thresholds apply to, with the size of the targets they apply to.
+type counts struct {
+	deletes int
+	updates int
+	current int
+
+	groupRemovals int
+	members       int
+}
+
+func planCounts(plan *Plan) counts {
+	return counts{
+		deletes:       plan.Removals(),
+		updates:       plan.Count(OperationUpdate),
+		current:       plan.Current,
+		groupRemovals: plan.GroupRemovals(),
+		members:       plan.Members,
+	}
+}
+
+func (c counts) add(other counts) counts {
+	return counts{
+		deletes:       c.deletes + other.deletes,
+		updates:       c.updates + other.updates,
+		current:       c.current + other.current,
+		groupRemovals: c.groupRemovals + other.groupRemovals,
+		members:       c.members + other.members,
+	}
+}
+
+// Run tracks changes across every plan applied in a single run so the
+// run-wide thresholds can be enforced.
+type Run struct {
+	mu     sync.Mutex
+	cfg    *config.SafetyConfig
+	counts counts
+}
+
+func NewRun(cfg *config.SafetyConfig) *Run {
+	return &Run{cfg: cfg}
+}
+
+// WithRun counts the plan towards the run-wide safety thresholds.
+func WithRun(run *Run) Option {
+	return func(o *options) {
+		o.run = run
+	}
+}
+
+// WithOverrideSafety applies plans even when they trip a safety threshold.
+func WithOverrideSafety(val bool) Option {
+	return func(o *options) {
+		o.overrideSafety = val
+	}
+}
+
+// WithStateStore persists snapshots and other engine state between runs.
+func WithStateStore(store state.Store) Option {
+	return func(o *options) {
+		o.store = store
+	}
+}
+
+// checkSafety returns a *SafetyError when the plan exceeds the provider or run
+// thresholds, or when its source looks truncated compared with the previous run.
+func (o *options) checkSafety(ctx context.Context, plan *Plan) error {
+	c := planCounts(plan)
+	reasons := thresholdReasons(o.safety, "provider", c)
+
+	if plan.Desired == 0 && plan.Current > 0 {
+		reasons = append(reasons, fmt.Sprintf("source is empty but the target has %d objects", plan.Current))
+	}
+
+	if plan.DesiredMembers == 0 && plan.Members > 0 && c.groupRemovals > 0 {
+		reasons = append(reasons, fmt.Sprintf("source has no group members but the target groups have %d", plan.Members))
+	}
+
+	if o.store != nil {
+		var prev Snapshot
+		err := state.GetJSON(ctx, o.store, snapshotKey(plan.Target), &prev)
+		if err != nil && !errors.Is(err, state.ErrNotFound) {
+			return err
+		}
+
+		if err == nil && o.safety != nil && o.safety.MinSourcePercent > 0 && prev.SourceCount > 0 {
+			if pct := percent(plan.Desired, prev.SourceCount); pct < o.safety.MinSourcePercent {
+				reasons = append(reasons, fmt.Sprintf("source has %d objects, %.1f%% of the %d in the previous snapshot", plan.Desired, pct, prev.SourceCount))
+			}
+		}
+	}
+
+	if o.run != nil {
+		reasons = append(reasons, o.run.check(c)...)
+	}
+
+	if len(reasons) == 0 || o.overrideSafety {
+		return nil
+	}
+
+	return &SafetyError{Target: plan.Target, Reasons: reasons}
+}
+
+// recordSnapshot stores the plan's source size for the next run's comparison.
+func (o *options) recordSnapshot(ctx context.Context, plan *Plan) error {
+	if o.run != nil {
+		o.run.record(planCounts(plan))
+	}
+
+	if o.store == nil {
+		return nil
+	}
+
+	return state.PutJSON(ctx, o.store, snapshotKey(plan.Target), Snapshot{
+		SourceCount: plan.Desired,
+		Time:        time.Now(),
+	})
+}
+
+func (r *Run) check(c counts) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return thresholdReasons(r.cfg, "run", r.counts.add(c))
+}
+
+func (r *Run) record(c counts) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.counts = r.counts.add(c)
+}
+
+func thresholdReasons(cfg *config.SafetyConfig, scope string, c counts) []string {
+	reasons := make([]string, 0)
+	if cfg == nil {
+		return reasons
+	}
+
+	if cfg.MaxDeletes > 0 && c.deletes > cfg.MaxDeletes {
+		reasons = append(reasons, fmt.Sprintf("%d removals exceed the %s limit of %d", c.deletes, scope, cfg.MaxDeletes))
+	}
+
+	if cfg.MaxDeletePercent > 0 && c.current > 0 && percent(c.deletes, c.current) > cfg.MaxDeletePercent {
+		reasons = append(reasons, fmt.Sprintf("%d removals are %.1f%% of the target, over the %s limit of %.1f%%", c.deletes, percent(c.deletes, c.current), scope, cfg.MaxDeletePercent))
+	}
+
+	if cfg.MaxUpdates > 0 && c.updates > cfg.MaxUpdates {
+		reasons = append(reasons, fmt.Sprintf("%d updates exceed the %s limit of %d", c.updates, scope, cfg.MaxUpdates))
+	}
+
+	if cfg.MaxUpdatePercent > 0 && c.current > 0 && percent(c.updates, c.current) > cfg.MaxUpdatePercent {
+		reasons = append(reasons, fmt.Sprintf("%d updates are %.1f%% of the target, over the %s limit of %.1f%%", c.updates, percent(c.updates, c.current), scope, cfg.MaxUpdatePercent))
+	}
+
+	maxRemovals, maxRemovalPercent := cfg.MaxGroupRemovals, cfg.MaxGroupRemovalPercent
+	if maxRemovals == 0 && maxRemovalPercent == 0 {
+		maxRemovals, maxRemovalPercent = cfg.MaxDeletes, cfg.MaxDeletePercent
+	}
+
+	if maxRemovals > 0 && c.groupRemovals > maxRemovals {
+		reasons = append(reasons, fmt.Sprintf("%d group removals exceed the %s limit of %d", c.groupRemovals, scope, maxRemovals))
+	}
+
+	if maxRemovalPercent > 0 && c.members > 0 && percent(c.groupRemovals, c.members) > maxRemovalPercent {
+		reasons = append(reasons, fmt.Sprintf("%d group removals are %.1f%% of the group members, over the %s limit of %.1f%%", c.groupRemovals, percent(c.groupRemovals, c.members), scope, maxRemovalPercent))
+	}
+
+	return reasons
+}
+
+func percent(part, total int) float64 {
+	return float64(part) / float64(total) * 100
+}
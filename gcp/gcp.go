@@ -1 +1,204 @@
 package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/utils"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	crm "google.golang.org/api/cloudresourcemanager/v3"
+	"google.golang.org/api/option"
+)
+
+// emailAttribute is the mapped attribute holding the email users are bound by.
+const emailAttribute = "email"
+
+// gcpProvider reconciles IAM policy bindings on projects, folders and
+// organizations from the groups of the source users.
+type gcpProvider struct {
+	config.BaseConfig
+
+	client   *crm.Service
+	bindings []config.GcpBindingConfig
+}
+
+func NewGcpProvider(ctx context.Context, cfg *config.GcpConfig) (*gcpProvider, error) {
+	if _, ok := cfg.Mapping[emailAttribute]; !ok {
+		return nil, fmt.Errorf("the %s attribute must be mapped", emailAttribute)
+	}
+
+	for _, b := range cfg.Bindings {
+		if b.Role == "" {
+			return nil, errors.New("every gcp binding needs a role")
+		}
+
+		for _, resource := range b.Resources {
+			if _, err := resourceType(resource); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	transport, err := utils.NewRateLimitTransport(nil, cfg.RateLimit, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The oauth2 client picks up its base client from the context.
+	httpCtx := context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+
+	var creds *google.Credentials
+	if cfg.ServiceAccountKey != nil && cfg.ServiceAccountKey.Value != nil {
+		creds, err = google.CredentialsFromJSON(httpCtx, []byte(*cfg.ServiceAccountKey.Value), crm.CloudPlatformScope)
+	} else {
+		creds, err = google.FindDefaultCredentials(httpCtx, crm.CloudPlatformScope)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating gcp credentials: %w", err)
+	}
+
+	client, err := crm.NewService(ctx, option.WithHTTPClient(oauth2.NewClient(httpCtx, creds.TokenSource)))
+	if err != nil {
+		return nil, fmt.Errorf("creating gcp resource manager client: %w", err)
+	}
+
+	return &gcpProvider{
+		BaseConfig: cfg.BaseConfig,
+		client:     client,
+		bindings:   cfg.Bindings,
+	}, nil
+}
+
+// member returns the IAM principal of a source user.
+func member(email string) string {
+	if strings.HasSuffix(email, ".gserviceaccount.com") {
+		return "serviceAccount:" + email
+	}
+	return "user:" + email
+}
+
+// ignored reports whether a principal belongs to an ignored user, whose
+// bindings are neither granted nor revoked.
+func (gp *gcpProvider) ignored(principal string) bool {
+	_, email, _ := strings.Cut(principal, ":")
+	return slices.Contains(gp.BaseConfig.IgnoreUsers, email)
+}
+
+// desiredBindings returns the principals every managed scope should grant its
+// role to.
+func (gp *gcpProvider) desiredBindings(source []map[string]any) map[binding]bool {
+	field := gp.BaseConfig.Mapping[emailAttribute]
+
+	desired := make(map[binding]bool)
+	for _, cfg := range gp.bindings {
+		principals := make([]string, 0)
+		if cfg.BindGroups {
+			for _, group := range cfg.Groups {
+				principals = append(principals, "group:"+group)
+			}
+		} else {
+			for _, u := range source {
+				groups := gp.BaseConfig.GroupsOf(u)
+				if slices.ContainsFunc(cfg.Groups, func(group string) bool { return slices.Contains(groups, group) }) {
+					principals = append(principals, member(config.KeyOf(u, field)))
+				}
+			}
+		}
+
+		for _, resource := range cfg.Resources {
+			scope := newScope(resource, cfg.Role, cfg.Condition)
+			for _, principal := range principals {
+				if !gp.ignored(principal) {
+					desired[scope.with(principal)] = true
+				}
+			}
+		}
+	}
+
+	return desired
+}
+
+// Plan grants and revokes the managed roles so that each managed scope binds
+// exactly the desired principals. Bindings of other roles, or of the same
+// role under another condition, are left alone.
+func (gp *gcpProvider) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
+	desired := gp.desiredBindings(source)
+
+	scopes := make(map[binding]bool)
+	for _, cfg := range gp.bindings {
+		for _, resource := range cfg.Resources {
+			scopes[newScope(resource, cfg.Role, cfg.Condition)] = true
+		}
+	}
+
+	policies := make(map[string]*crm.Policy)
+	current := make(map[binding]bool)
+	for scope := range scopes {
+		policy, ok := policies[scope.Resource]
+		if !ok {
+			var err error
+			if policy, err = gp.getPolicy(ctx, scope.Resource); err != nil {
+				return nil, err
+			}
+			policies[scope.Resource] = policy
+		}
+
+		for _, b := range policy.Bindings {
+			if !scope.matches(b) {
+				continue
+			}
+
+			for _, principal := range b.Members {
+				if !gp.ignored(principal) {
+					current[scope.with(principal)] = true
+				}
+			}
+		}
+	}
+
+	plan := engine.NewPlan("gcp/iam")
+	plan.SetState(nil, source, gp.BaseConfig.Mapping[emailAttribute])
+	// The bound principals are the members revokes are checked against.
+	plan.Members, plan.DesiredMembers = len(current), len(desired)
+	for _, b := range sortedBindings(desired) {
+		b := b
+		if !current[b] {
+			plan.AddVerified(engine.OperationGrant, b.key(), b.object(), func(ctx context.Context) error {
+				return gp.grant(ctx, b)
+			}, func(ctx context.Context) (bool, error) {
+				return gp.bound(ctx, b)
+			})
+		}
+	}
+
+	for _, b := range sortedBindings(current) {
+		b := b
+		if !desired[b] {
+			plan.AddVerified(engine.OperationRevoke, b.key(), b.object(), func(ctx context.Context) error {
+				return gp.revoke(ctx, b)
+			}, func(ctx context.Context) (bool, error) {
+				bound, err := gp.bound(ctx, b)
+				return !bound, err
+			})
+		}
+	}
+
+	return plan, nil
+}
+
+func (gp *gcpProvider) SyncProvider(ctx context.Context, source []map[string]any, opts ...engine.Option) (*engine.Result, error) {
+	plan, err := gp.Plan(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]engine.Option{engine.WithConfig(gp.BaseConfig)}, opts...)
+	return engine.Apply(ctx, plan, opts...)
+}
@@ -0,0 +1,246 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	crm "google.golang.org/api/cloudresourcemanager/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// policyVersion is the policy format that supports conditional bindings.
+	policyVersion = 3
+	// maxPolicyAttempts bounds the read-modify-write retries when the policy
+	// keeps changing under us.
+	maxPolicyAttempts = 5
+)
+
+// binding is a role granted to a principal on a resource, under an optional
+// condition. Without a Member it identifies a managed scope.
+type binding struct {
+	Resource             string
+	Role                 string
+	ConditionTitle       string
+	ConditionDescription string
+	ConditionExpression  string
+	Member               string
+}
+
+func newScope(resource, role string, cond *config.GcpConditionConfig) binding {
+	b := binding{Resource: resource, Role: role}
+	if cond != nil {
+		b.ConditionTitle = cond.Title
+		b.ConditionDescription = cond.Description
+		b.ConditionExpression = cond.Expression
+	}
+	return b
+}
+
+// with returns the binding of the scope for a principal.
+func (b binding) with(principal string) binding {
+	b.Member = principal
+	return b
+}
+
+// matches reports whether a policy binding has the role and condition of b.
+func (b binding) matches(pb *crm.Binding) bool {
+	if pb.Role != b.Role {
+		return false
+	}
+
+	if pb.Condition == nil {
+		return b.ConditionExpression == ""
+	}
+	return pb.Condition.Expression == b.ConditionExpression && pb.Condition.Title == b.ConditionTitle
+}
+
+func (b binding) condition() *crm.Expr {
+	if b.ConditionExpression == "" {
+		return nil
+	}
+
+	return &crm.Expr{
+		Title:       b.ConditionTitle,
+		Description: b.ConditionDescription,
+		Expression:  b.ConditionExpression,
+	}
+}
+
+func (b binding) key() string {
+	if b.ConditionTitle != "" {
+		return fmt.Sprintf("%s/%s[%s]/%s", b.Resource, b.Role, b.ConditionTitle, b.Member)
+	}
+	return fmt.Sprintf("%s/%s/%s", b.Resource, b.Role, b.Member)
+}
+
+func (b binding) object() map[string]any {
+	obj := map[string]any{
+		"resource": b.Resource,
+		"role":     b.Role,
+		"member":   b.Member,
+	}
+	if b.ConditionExpression != "" {
+		obj["condition"] = b.ConditionExpression
+	}
+	return obj
+}
+
+func sortedBindings(set map[binding]bool) []binding {
+	list := make([]binding, 0, len(set))
+	for b := range set {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].key() < list[j].key() })
+
+	return list
+}
+
+// resourceType returns the kind of resource a policy belongs to.
+func resourceType(resource string) (string, error) {
+	kind, id, _ := strings.Cut(resource, "/")
+	switch {
+	case id == "":
+	case kind == "projects", kind == "folders", kind == "organizations":
+		return kind, nil
+	}
+
+	return "", fmt.Errorf("unsupported gcp resource %q, expected projects/<id>, folders/<id> or organizations/<id>", resource)
+}
+
+func (gp *gcpProvider) getPolicy(ctx context.Context, resource string) (*crm.Policy, error) {
+	kind, err := resourceType(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &crm.GetIamPolicyRequest{Options: &crm.GetPolicyOptions{RequestedPolicyVersion: policyVersion}}
+
+	var policy *crm.Policy
+	switch kind {
+	case "projects":
+		policy, err = gp.client.Projects.GetIamPolicy(resource, req).Context(ctx).Do()
+	case "folders":
+		policy, err = gp.client.Folders.GetIamPolicy(resource, req).Context(ctx).Do()
+	default:
+		policy, err = gp.client.Organizations.GetIamPolicy(resource, req).Context(ctx).Do()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting iam policy of %s: %w", resource, err)
+	}
+
+	return policy, nil
+}
+
+// setPolicy writes a policy back. Its etag makes the write fail when the
+// policy changed since it was read.
+func (gp *gcpProvider) setPolicy(ctx context.Context, resource string, policy *crm.Policy) error {
+	kind, err := resourceType(resource)
+	if err != nil {
+		return err
+	}
+
+	req := &crm.SetIamPolicyRequest{Policy: policy}
+	switch kind {
+	case "projects":
+		_, err = gp.client.Projects.SetIamPolicy(resource, req).Context(ctx).Do()
+	case "folders":
+		_, err = gp.client.Folders.SetIamPolicy(resource, req).Context(ctx).Do()
+	default:
+		_, err = gp.client.Organizations.SetIamPolicy(resource, req).Context(ctx).Do()
+	}
+
+	return err
+}
+
+// modifyPolicy reads the policy of a resource, lets change edit it and writes
+// it back. When someone else changed the policy in between, the etag no
+// longer matches and the whole read-modify-write is retried.
+func (gp *gcpProvider) modifyPolicy(ctx context.Context, resource string, change func(*crm.Policy) bool) error {
+	for attempt := 1; ; attempt++ {
+		policy, err := gp.getPolicy(ctx, resource)
+		if err != nil {
+			return err
+		}
+
+		if !change(policy) {
+			return nil
+		}
+
+		// Conditional bindings can only be written in version 3.
+		policy.Version = policyVersion
+		err = gp.setPolicy(ctx, resource, policy)
+
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict && attempt < maxPolicyAttempts {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("setting iam policy of %s: %w", resource, err)
+		}
+
+		return nil
+	}
+}
+
+func (gp *gcpProvider) grant(ctx context.Context, b binding) error {
+	return gp.modifyPolicy(ctx, b.Resource, func(policy *crm.Policy) bool {
+		for _, pb := range policy.Bindings {
+			if b.matches(pb) {
+				if slices.Contains(pb.Members, b.Member) {
+					return false
+				}
+
+				pb.Members = append(pb.Members, b.Member)
+				return true
+			}
+		}
+
+		policy.Bindings = append(policy.Bindings, &crm.Binding{
+			Role:      b.Role,
+			Members:   []string{b.Member},
+			Condition: b.condition(),
+		})
+		return true
+	})
+}
+
+// revoke removes the principal from the binding, and the binding itself once
+// it has no members left.
+func (gp *gcpProvider) revoke(ctx context.Context, b binding) error {
+	return gp.modifyPolicy(ctx, b.Resource, func(policy *crm.Policy) bool {
+		changed := false
+		for _, pb := range policy.Bindings {
+			if b.matches(pb) && slices.Contains(pb.Members, b.Member) {
+				pb.Members = slices.DeleteFunc(pb.Members, func(m string) bool { return m == b.Member })
+				changed = true
+			}
+		}
+
+		policy.Bindings = slices.DeleteFunc(policy.Bindings, func(pb *crm.Binding) bool {
+			return len(pb.Members) == 0
+		})
+		return changed
+	})
+}
+
+// bound reports whether the policy currently grants the binding.
+func (gp *gcpProvider) bound(ctx context.Context, b binding) (bool, error) {
+	policy, err := gp.getPolicy(ctx, b.Resource)
+	if err != nil {
+		return false, err
+	}
+
+	for _, pb := range policy.Bindings {
+		if b.matches(pb) && slices.Contains(pb.Members, b.Member) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -1,13 +1,19 @@
 package github
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/google/go-github/v57/github"
 	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
 	"github.com/tiagoposse/go-identity-sync/utils"
 )
 
@@ -19,7 +25,17 @@ type githubProvider struct {
 }
 
 func NewgithubProvider(ctx context.Context, cfg *config.GithubConfig) (*githubProvider, error) {
-	client := github.NewClient(nil).WithAuthToken(*cfg.Token.Value)
+	// Organisation members can only be removed, GitHub has no way to disable them.
+	if cfg.Deprovisioning.Suspends() {
+		return nil, errors.New("github members cannot be suspended, use the delete deprovisioning mode")
+	}
+
+	transport, err := utils.NewRateLimitTransport(nil, cfg.RateLimit, isSecondaryRateLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	client := github.NewClient(&http.Client{Transport: transport}).WithAuthToken(*cfg.Token.Value)
 
 	return &githubProvider{
 		client:     client,
@@ -28,6 +44,27 @@ func NewgithubProvider(ctx context.Context, cfg *config.GithubConfig) (*githubPr
 	}, nil
 }
 
+// isSecondaryRateLimit reports whether a 403 is one of GitHub's rate limit
+// responses rather than a permission error.
+func isSecondaryRateLimit(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusForbidden {
+		return false
+	}
+
+	if resp.Header.Get("Retry-After") != "" || resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		return true
+	}
+
+	bs, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(bs))
+	if err != nil {
+		return false
+	}
+
+	return strings.Contains(strings.ToLower(string(bs)), "secondary rate limit")
+}
+
 func (gh *githubProvider) GetUser(ctx context.Context, id string) (*github.User, error) {
 	user, _, err := gh.client.Users.Get(ctx, id)
 	if err != nil {
@@ -38,36 +75,33 @@ func (gh *githubProvider) GetUser(ctx context.Context, id string) (*github.User,
 }
 
 func (gh *githubProvider) GetUsersAndMemberships(ctx context.Context, filter string) ([]*github.User, map[string][]string, error) {
-	users, _, err := gh.client.Organizations.ListMembers(ctx, gh.org, &github.ListMembersOptions{
-		Filter: filter,
-	})
-
+	users, err := gh.listMembers(ctx, filter)
 	if err != nil {
-		return nil, nil, fmt.Errorf("fetching members: %w", err)
+		return nil, nil, err
+	}
+
+	orgMembers := make(map[int64]bool, len(users))
+	for _, user := range users {
+		orgMembers[user.GetID()] = true
 	}
 
-	teams, _, err := gh.client.Teams.ListTeams(ctx, gh.org, &github.ListOptions{})
+	teams, err := gh.listTeams(ctx)
 	if err != nil {
-		return nil, nil, fmt.Errorf("fetching teams: %w", err)
+		return nil, nil, err
 	}
 
 	groupMemberships := make(map[string][]string)
 	for _, team := range teams {
-		members, _, err := gh.client.Teams.ListTeamMembersBySlug(ctx, gh.org, *team.Slug, &github.TeamListTeamMembersOptions{})
+		members, err := gh.listTeamMembers(ctx, team)
 		if err != nil {
-			return nil, nil, fmt.Errorf("fetching team members for %d: %w", *team.ID, err)
+			return nil, nil, err
 		}
 
+		teamID := strconv.FormatInt(team.GetID(), 10)
 		for _, member := range members {
-			for _, user := range users {
-				uID := string(*user.ID)
-				if *user.ID == *member.ID {
-					if _, ok := groupMemberships[uID]; !ok {
-						groupMemberships[uID] = []string{string(*team.ID)}
-					} else {
-						groupMemberships[uID] = append(groupMemberships[uID], string(*team.ID))
-					}
-				}
+			if orgMembers[member.GetID()] {
+				uID := strconv.FormatInt(member.GetID(), 10)
+				groupMemberships[uID] = append(groupMemberships[uID], teamID)
 			}
 		}
 	}
@@ -75,6 +109,62 @@ func (gh *githubProvider) GetUsersAndMemberships(ctx context.Context, filter str
 	return users, groupMemberships, nil
 }
 
+// listMembers returns every member of the organisation matching the filter,
+// which may be empty.
+func (gh *githubProvider) listMembers(ctx context.Context, filter string) ([]*github.User, error) {
+	users := make([]*github.User, 0)
+
+	opts := &github.ListMembersOptions{Filter: filter, ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		page, resp, err := gh.client.Organizations.ListMembers(ctx, gh.org, opts)
+		if err != nil {
+			return nil, fmt.Errorf("fetching members: %w", err)
+		}
+		users = append(users, page...)
+
+		if resp.NextPage == 0 {
+			return users, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (gh *githubProvider) listTeams(ctx context.Context) ([]*github.Team, error) {
+	teams := make([]*github.Team, 0)
+
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := gh.client.Teams.ListTeams(ctx, gh.org, opts)
+		if err != nil {
+			return nil, fmt.Errorf("fetching teams: %w", err)
+		}
+		teams = append(teams, page...)
+
+		if resp.NextPage == 0 {
+			return teams, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (gh *githubProvider) listTeamMembers(ctx context.Context, team *github.Team) ([]*github.User, error) {
+	members := make([]*github.User, 0)
+
+	opts := &github.TeamListTeamMembersOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		page, resp, err := gh.client.Teams.ListTeamMembersBySlug(ctx, gh.org, team.GetSlug(), opts)
+		if err != nil {
+			return nil, fmt.Errorf("fetching team members for %d: %w", team.GetID(), err)
+		}
+		members = append(members, page...)
+
+		if resp.NextPage == 0 {
+			return members, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
 func (gh *githubProvider) GetUsersConverted(ctx context.Context) ([]map[string]any, error) {
 	users, memberships, err := gh.GetUsersAndMemberships(ctx, "")
 	if err != nil {
@@ -86,7 +176,7 @@ func (gh *githubProvider) GetUsersConverted(ctx context.Context) ([]map[string]a
 		if user, err := gh.BaseConfig.ConvertUser(item); err != nil {
 			return nil, err
 		} else {
-			user[gh.BaseConfig.GroupField] = memberships[string(*item.ID)]
+			user[gh.BaseConfig.GroupField] = memberships[strconv.FormatInt(item.GetID(), 10)]
 			convertedUsers = append(convertedUsers, user)
 		}
 	}
@@ -95,78 +185,138 @@ func (gh *githubProvider) GetUsersConverted(ctx context.Context) ([]map[string]a
 }
 
 func (gh *githubProvider) GetUsers(ctx context.Context, lo utils.ListOptions) ([]*github.User, error) {
-	opts := &github.ListMembersOptions{}
+	filter := ""
 	if lo.Filter != nil {
-		opts.Filter = *lo.Filter
+		filter = *lo.Filter
+	}
+
+	return gh.listMembers(ctx, filter)
+}
+
+func (gh *githubProvider) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
+	targetUsers, err := gh.GetUsers(ctx, utils.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	field := gh.BaseConfig.Mapping["id"]
+	current, err := gh.BaseConfig.ConvertUsers(targetUsers)
+	if err != nil {
+		return nil, err
 	}
-	users, _, err := gh.client.Organizations.ListMembers(ctx, gh.org, opts)
 
+	toAdd, toRemove, _, err := gh.BaseConfig.RawCompareUsers(current, source, field)
 	if err != nil {
-		return nil, fmt.Errorf("fetching members: %w", err)
+		return nil, err
+	}
+
+	plan := engine.NewPlan(fmt.Sprintf("github/%s", gh.org))
+	plan.SetState(current, source, field)
+	for _, u := range toAdd {
+		u := u
+		plan.AddVerified(engine.OperationCreate, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return gh.createUser(ctx, u)
+		}, func(ctx context.Context) (bool, error) {
+			return gh.invited(ctx, u)
+		})
+	}
+
+	for _, u := range toRemove {
+		key := config.KeyOf(u, field)
+		plan.Add(engine.OperationDelete, key, u, func(ctx context.Context) error {
+			return gh.deleteUser(ctx, key)
+		})
 	}
 
-	return users, nil
+	// GitHub does not allow editing another user's profile, so there are no updates to plan.
+	return plan, nil
 }
 
-func (gh *githubProvider) SyncProvider(ctx context.Context, source []map[string]any) error {
-	targetUsers, err := gh.GetUsers(ctx, utils.ListOptions{})
+func (gh *githubProvider) SyncProvider(ctx context.Context, source []map[string]any, opts ...engine.Option) (*engine.Result, error) {
+	plan, err := gh.Plan(ctx, source)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	toAdd, toRemove, toUpdate, err := gh.BaseConfig.CompareUsers(source, targetUsers, gh.BaseConfig.Mapping["id"])
+	opts = append([]engine.Option{engine.WithConfig(gh.BaseConfig)}, opts...)
+	return engine.Apply(ctx, plan, opts...)
+}
+
+// inviteeID returns the GitHub user id of a user in the common format.
+func (gh *githubProvider) inviteeID(u map[string]any) (int64, error) {
+	mapped, err := gh.BaseConfig.ConvertUserToProvider(u)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	for _, u := range toAdd {
-		mapped, err := gh.BaseConfig.ConvertUserToProvider(u)
-		if err != nil {
-			return err
-		}
+	return strconv.ParseInt(config.KeyOf(mapped, "id"), 10, 64)
+}
 
-		iID, err := strconv.Atoi(mapped[gh.BaseConfig.Mapping["id"]].(string))
-		if err != nil {
-			return err
-		}
-		if _, _, err := gh.client.Organizations.CreateOrgInvitation(ctx, gh.org, &github.CreateOrgInvitationOptions{
-			InviteeID: utils.Int64Ptr(int64(iID)),
-		}); err != nil {
-			return err
-		}
+// invited reports whether the user is already a member of the organisation or
+// has a pending invitation, so an interrupted invite is not sent twice.
+func (gh *githubProvider) invited(ctx context.Context, u map[string]any) (bool, error) {
+	iID, err := gh.inviteeID(u)
+	if err != nil {
+		return false, err
 	}
 
-	for _, u := range toRemove {
-		if _, err := gh.client.Organizations.RemoveMember(ctx, gh.org, u[gh.BaseConfig.Mapping["id"]].(string)); err != nil {
-			return err
-		}
+	user, _, err := gh.client.Users.GetByID(ctx, iID)
+	if err != nil {
+		return false, fmt.Errorf("fetching user %d: %w", iID, err)
 	}
 
-	for _, u := range toUpdate {
-		mapped, err := gh.BaseConfig.ConvertUserToProvider(u)
+	member, _, err := gh.client.Organizations.IsMember(ctx, gh.org, user.GetLogin())
+	if err != nil {
+		return false, fmt.Errorf("checking membership of %s: %w", user.GetLogin(), err)
+	} else if member {
+		return true, nil
+	}
+
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		invitations, resp, err := gh.client.Organizations.ListPendingOrgInvitations(ctx, gh.org, opts)
 		if err != nil {
-			return err
+			return false, fmt.Errorf("fetching pending invitations: %w", err)
 		}
 
-		conv, err := MapToUser(mapped)
-		if err != nil {
-			return err
+		for _, inv := range invitations {
+			if strings.EqualFold(inv.GetLogin(), user.GetLogin()) {
+				return true, nil
+			}
 		}
 
-		if _, _, err := gh.client.User.UpdateUser(
-			ctx,
-			u[gh.BaseConfig.Mapping["id"]].(string),
-			*conv, nil,
-		); err != nil {
-			return err
+		if resp.NextPage == 0 {
+			return false, nil
 		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (gh *githubProvider) createUser(ctx context.Context, u map[string]any) error {
+	iID, err := gh.inviteeID(u)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := gh.client.Organizations.CreateOrgInvitation(ctx, gh.org, &github.CreateOrgInvitationOptions{
+		InviteeID: utils.Int64Ptr(iID),
+	}); err != nil {
+		return fmt.Errorf("inviting user %d: %w", iID, err)
+	}
+
+	return nil
+}
+
+func (gh *githubProvider) deleteUser(ctx context.Context, id string) error {
+	if _, err := gh.client.Organizations.RemoveMember(ctx, gh.org, id); err != nil {
+		return fmt.Errorf("removing member %s: %w", id, err)
 	}
 
 	return nil
 }
 
 func (gh *githubProvider) Sync(ctx context.Context, users []map[string]any) (add, remove, update []map[string]any, retErr error) {
-	sourceUsers, err := gh.GetUsers(ctx)
+	sourceUsers, err := gh.GetUsers(ctx, utils.ListOptions{})
 	if err != nil {
 		retErr = err
 		return
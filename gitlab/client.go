@@ -0,0 +1,143 @@
+package gitlab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// APIError is returned for responses outside the 2xx range.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("gitlab returned %d: %s", e.StatusCode, e.Message)
+}
+
+func isNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// tokenTransport authenticates every request with the configured token.
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.token))
+	return t.base.RoundTrip(req)
+}
+
+// client talks to the GitLab REST API under baseURL, e.g. https://gitlab.com/api/v4.
+type client struct {
+	http    *http.Client
+	baseURL string
+}
+
+func (c *client) url(path string, query url.Values) string {
+	u := fmt.Sprintf("%s/%s", strings.TrimSuffix(c.baseURL, "/"), strings.TrimPrefix(path, "/"))
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// do sends a request to the given absolute URL and decodes the response into out if set.
+func (c *client) do(ctx context.Context, method, u string, body, out any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(bs)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bs, _ := io.ReadAll(resp.Body)
+		return resp, &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(bs))}
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, fmt.Errorf("decoding response of %s %s: %w", method, req.URL.Path, err)
+		}
+	}
+
+	return resp, nil
+}
+
+// getAll fetches every page of a list endpoint. It asks for keyset pagination
+// ordered by id, which does not skip or repeat items that change while paging
+// and is not capped like deep offset pages are. Endpoints without keyset
+// support ignore it and paginate by offset. Either way the next page is taken
+// from the Link header.
+func getAll[T any](ctx context.Context, c *client, path string, query url.Values) ([]T, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("pagination", "keyset")
+	query.Set("order_by", "id")
+	query.Set("sort", "asc")
+	query.Set("per_page", "100")
+
+	items := make([]T, 0)
+	next := c.url(path, query)
+	for next != "" {
+		var page []T
+		resp, err := c.do(ctx, http.MethodGet, next, nil, &page)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", path, err)
+		}
+
+		items = append(items, page...)
+		next = nextLink(resp.Header.Get("Link"))
+	}
+
+	return items, nil
+}
+
+// nextLink returns the rel="next" URL of a Link header.
+func nextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+
+	return ""
+}
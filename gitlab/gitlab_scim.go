@@ -2,101 +2,254 @@ package gitlab
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/scim"
+	"github.com/tiagoposse/go-identity-sync/utils"
 )
 
-type gitlabProvider struct {
+// scimPatchPaths are the attributes GitLab lets SCIM update, by flattened name.
+var scimPatchPaths = map[string]string{
+	"userName":       "userName",
+	"name.formatted": "name.formatted",
+	"email":          `emails[type eq "work"].value`,
+}
+
+// gitlabSCIMProvider provisions SAML identities of a GitLab.com group. The
+// SCIM id of an identity is its SAML extern_uid, which is the externalId
+// sent by the identity provider.
+type gitlabSCIMProvider struct {
 	config.BaseConfig
 
-	client *http.Client
-	org    string
+	scim  *scim.Client
+	rest  *client
+	group string
 }
 
-type myTransport struct {
-	token string
-	url   string
+func NewGitlabSCIMProvider(ctx context.Context, cfg *config.GitlabSCIMConfig) (*gitlabSCIMProvider, error) {
+	if cfg.ScimToken == nil || cfg.ScimToken.Value == nil {
+		return nil, errors.New("gitlab scim requires a scimToken")
+	}
+
+	baseURL := strings.TrimSuffix(cfg.Url, "/")
+	if baseURL == "" {
+		baseURL = defaultURL
+	}
+
+	transport, err := utils.NewRateLimitTransport(nil, cfg.RateLimit, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := &gitlabSCIMProvider{
+		BaseConfig: cfg.BaseConfig,
+		scim:       scim.NewClient(fmt.Sprintf("%s/api/scim/v2/groups/%s", baseURL, cfg.Group), *cfg.ScimToken.Value, transport),
+		group:      cfg.Group,
+	}
+
+	if cfg.Token != nil && cfg.Token.Value != nil {
+		provider.rest = &client{
+			http:    &http.Client{Transport: &tokenTransport{token: *cfg.Token.Value, base: transport}},
+			baseURL: fmt.Sprintf("%s/api/v4", baseURL),
+		}
+	}
+
+	return provider, nil
 }
 
-func (t *myTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.token))
-	req.RequestURI = fmt.Sprintf("%s/%s", t.url, req.RequestURI)
-	return http.DefaultTransport.RoundTrip(req)
+// GetUsers returns the group's SCIM identities. The filter is passed on as a
+// SCIM filter, e.g. userName eq "jdoe".
+func (gs *gitlabSCIMProvider) GetUsers(ctx context.Context, lo utils.ListOptions) ([]scim.User, error) {
+	filter := ""
+	if lo.Filter != nil {
+		filter = *lo.Filter
+	}
+
+	return gs.scim.ListUsers(ctx, filter)
 }
 
-func NewGitlabProvider(ctx context.Context, cfg *config.GitlabConfig) (*gitlabProvider, error) {
-	client := &http.Client{
-		Transport: &myTransport{
-			token: *cfg.Token.Value,
-			url:   fmt.Sprintf("%s/api/v4", cfg.Url),
-		},
+func (gs *gitlabSCIMProvider) GetUsersConverted(ctx context.Context, lo utils.ListOptions) ([]map[string]any, error) {
+	users, err := gs.GetUsers(ctx, lo)
+	if err != nil {
+		return nil, err
 	}
 
-	return &gitlabProvider{
-		BaseConfig: cfg.BaseConfig,
-		client:     client,
-		org:        cfg.Organisation,
-	}, nil
+	attrs := make([]map[string]any, 0, len(users))
+	for _, user := range users {
+		attrs = append(attrs, scim.Flatten(user))
+	}
+
+	return gs.BaseConfig.ConvertUsers(attrs)
 }
 
-func (gl *gitlabProvider) GetUsers(ctx context.Context) {
+// MembersWithoutIdentity returns the group members that have no SAML
+// identity, who lose access when SSO is enforced. It needs the API token.
+func (gs *gitlabSCIMProvider) MembersWithoutIdentity(ctx context.Context) ([]Member, error) {
+	if gs.rest == nil {
+		return nil, errors.New("reporting members without a SAML identity requires an API token")
+	}
+
+	members, err := getAll[Member](ctx, gs.rest, groupPath(gs.group)+"/members", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := make([]Member, 0)
+	for _, member := range members {
+		if member.GroupSAMLIdentity == nil {
+			missing = append(missing, member)
+		}
+	}
+
+	return missing, nil
 }
 
-func (gl *gitlabProvider) SearchUsers(ctx context.Context, filter string) {
-	// Create a request to fetch user information by username
-	// req, err := http.NewRequest("GET", fmt.Sprintf("/users?username=%s", username), nil)
-	// if err != nil {
-	// 	fmt.Println("Error creating request:", err)
-	// 	return
-	// }
-
-	// // Set the GitLab group access token for authentication
-	// req.Header.Set("Private-Token", groupToken)
-
-	// // Send the request
-	// resp, err := client.Do(req)
-	// if err != nil {
-	// 	fmt.Println("Error sending request:", err)
-	// 	return
-	// }
-	// defer resp.Body.Close()
-
-	// // Read the response body
-	// body, err := ioutil.ReadAll(resp.Body)
-	// if err != nil {
-	// 	fmt.Println("Error reading response:", err)
-	// 	return
-	// }
-
-	// // Unmarshal the JSON response to extract user details
-	// var users []map[string]interface{}
-	// err = json.Unmarshal(body, &users)
-	// if err != nil {
-	// 	fmt.Println("Error decoding JSON:", err)
-	// 	return
-	// }
-
-	// // Display user details
-	// if len(users) > 0 {
-	// 	user := users[0] // Assuming the first user in the list is the matching user
-	// 	fmt.Println("User details:")
-	// 	fmt.Printf("Username: %v\n", user["username"])
-	// 	fmt.Printf("Name: %v\n", user["name"])
-	// 	fmt.Printf("Email: %v\n", user["email"])
-	// 	// Add more fields as needed
-	// } else {
-	// 	fmt.Println("User not found")
-	// }
+// Plan keys identities by their mapped externalId.
+func (gs *gitlabSCIMProvider) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
+	users, err := gs.GetUsers(ctx, utils.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make([]map[string]any, 0, len(users))
+	for _, user := range users {
+		attrs = append(attrs, scim.Flatten(user))
+	}
+
+	field := gs.BaseConfig.Mapping["externalId"]
+	current, err := gs.BaseConfig.ConvertUsers(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	toAdd, toRemove, toUpdate, err := gs.BaseConfig.RawCompareUsers(current, source, field)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]string)
+	suspended := make(map[string]bool)
+	for i, user := range users {
+		key := config.KeyOf(current[i], field)
+		ids[key] = user.ID
+		suspended[key] = !user.IsActive()
+	}
+
+	plan := engine.NewPlan(fmt.Sprintf("gitlab-scim/%s", gs.group))
+	plan.SetState(current, source, field)
+	for _, u := range toAdd {
+		u := u
+		key := config.KeyOf(u, field)
+		plan.AddVerified(engine.OperationCreate, key, u, func(ctx context.Context) error {
+			return gs.createUser(ctx, u)
+		}, func(ctx context.Context) (bool, error) {
+			_, err := gs.scim.GetUser(ctx, key)
+			if scim.IsNotFound(err) {
+				return false, nil
+			}
+			return err == nil, err
+		})
+	}
+
+	for _, u := range toRemove {
+		id := ids[config.KeyOf(u, field)]
+		plan.AddRemoval(gs.BaseConfig.Deprovisioning, config.KeyOf(u, field), u, suspended[config.KeyOf(u, field)], func(ctx context.Context) error {
+			return gs.setActive(ctx, id, false)
+		}, func(ctx context.Context) error {
+			return gs.deleteUser(ctx, id)
+		})
+	}
+
+	// Identities that reappear in the source are reactivated, which adds them back to the group.
+	if gs.BaseConfig.Deprovisioning.Suspends() {
+		for _, u := range source {
+			key := config.KeyOf(u, field)
+			if id, ok := ids[key]; ok && suspended[key] {
+				plan.Add(engine.OperationReactivate, key, u, func(ctx context.Context) error {
+					return gs.setActive(ctx, id, true)
+				})
+			}
+		}
+	}
+
+	for _, u := range toUpdate {
+		u := u
+		id := ids[config.KeyOf(u, field)]
+		plan.Add(engine.OperationUpdate, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return gs.updateUser(ctx, id, u)
+		})
+	}
+
+	return plan, nil
 }
 
-func (gl *gitlabProvider) Sync(ctx context.Context, users []map[string]any) (add, remove, update []map[string]any, retErr error) {
-	sourceUsers, err := gl.GetUsers(ctx)
+func (gs *gitlabSCIMProvider) SyncProvider(ctx context.Context, source []map[string]any, opts ...engine.Option) (*engine.Result, error) {
+	plan, err := gs.Plan(ctx, source)
 	if err != nil {
-		retErr = err
-		return
+		return nil, err
+	}
+
+	opts = append([]engine.Option{engine.WithConfig(gs.BaseConfig)}, opts...)
+	return engine.Apply(ctx, plan, opts...)
+}
+
+func (gs *gitlabSCIMProvider) createUser(ctx context.Context, u map[string]any) error {
+	mapped, err := gs.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return err
+	}
+
+	user := scim.Unflatten(mapped)
+	user.ID = ""
+	active := true
+	user.Active = &active
+
+	_, err = gs.scim.CreateUser(ctx, user)
+	return err
+}
+
+// updateUser replaces the mapped attributes GitLab accepts over SCIM.
+func (gs *gitlabSCIMProvider) updateUser(ctx context.Context, id string, u map[string]any) error {
+	mapped, err := gs.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return err
+	}
+
+	ops := make([]scim.PatchOperation, 0)
+	for field, path := range scimPatchPaths {
+		if val, ok := mapped[field]; ok && val != nil {
+			ops = append(ops, scim.PatchOperation{Op: "Replace", Path: path, Value: fmt.Sprint(val)})
+		}
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	return gs.scim.PatchUser(ctx, id, ops)
+}
+
+// setActive deprovisions or reprovisions an identity. GitLab expects the
+// value as a string, as in its documentation.
+func (gs *gitlabSCIMProvider) setActive(ctx context.Context, id string, active bool) error {
+	value := "False"
+	if active {
+		value = "True"
+	}
+
+	return gs.scim.PatchUser(ctx, id, []scim.PatchOperation{{Op: "Replace", Path: "active", Value: value}})
+}
+
+// deleteUser removes the identity and the member from the group.
+func (gs *gitlabSCIMProvider) deleteUser(ctx context.Context, id string) error {
+	if err := gs.scim.DeleteUser(ctx, id); err != nil && !scim.IsNotFound(err) {
+		return err
 	}
 
-	return gl.BaseConfig.CompareUsers(sourceUsers, users, gl.BaseConfig.Mapping["id"])
+	return nil
 }
@@ -1,86 +1,388 @@
 package gitlab
 
-// import (
-// 	"context"
-// 	"fmt"
-// 	"net/http"
-
-// 	"github.com/tiagoposse/go-identity-sync/config"
-// )
-
-// type gitlabProvider struct {
-// 	client *http.Client
-// 	org    string
-// }
-
-// type myTransport struct {
-// 	token string
-// 	url   string
-// }
-
-// func (t *myTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-// 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.token))
-// 	req.RequestURI = fmt.Sprintf("%s/%s", t.url, req.RequestURI)
-// 	return http.DefaultTransport.RoundTrip(req)
-// }
-
-// func NewGitlabProvider(ctx context.Context, cfg *config.GitlabConfig) (*gitlabProvider, error) {
-// 	client := &http.Client{
-// 		Transport: &myTransport{
-// 			token: *cfg.Token.Value,
-// 			url:   fmt.Sprintf("%s/api/v4", cfg.Url),
-// 		},
-// 	}
-
-// 	return &gitlabProvider{
-// 		client: client,
-// 		org:    cfg.Organisation,
-// 	}, nil
-// }
-
-// func (gl *gitlabProvider) SearchUsers(ctx context.Context, filter string) {
-// 	// Create a request to fetch user information by username
-// 	// req, err := http.NewRequest("GET", fmt.Sprintf("/users?username=%s", username), nil)
-// 	// if err != nil {
-// 	// 	fmt.Println("Error creating request:", err)
-// 	// 	return
-// 	// }
-
-// 	// // Set the GitLab group access token for authentication
-// 	// req.Header.Set("Private-Token", groupToken)
-
-// 	// // Send the request
-// 	// resp, err := client.Do(req)
-// 	// if err != nil {
-// 	// 	fmt.Println("Error sending request:", err)
-// 	// 	return
-// 	// }
-// 	// defer resp.Body.Close()
-
-// 	// // Read the response body
-// 	// body, err := ioutil.ReadAll(resp.Body)
-// 	// if err != nil {
-// 	// 	fmt.Println("Error reading response:", err)
-// 	// 	return
-// 	// }
-
-// 	// // Unmarshal the JSON response to extract user details
-// 	// var users []map[string]interface{}
-// 	// err = json.Unmarshal(body, &users)
-// 	// if err != nil {
-// 	// 	fmt.Println("Error decoding JSON:", err)
-// 	// 	return
-// 	// }
-
-// 	// // Display user details
-// 	// if len(users) > 0 {
-// 	// 	user := users[0] // Assuming the first user in the list is the matching user
-// 	// 	fmt.Println("User details:")
-// 	// 	fmt.Printf("Username: %v\n", user["username"])
-// 	// 	fmt.Printf("Name: %v\n", user["name"])
-// 	// 	fmt.Printf("Email: %v\n", user["email"])
-// 	// 	// Add more fields as needed
-// 	// } else {
-// 	// 	fmt.Println("User not found")
-// 	// }
-// }
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/utils"
+)
+
+const (
+	defaultURL = "https://gitlab.com"
+	// GuestAccess is the lowest group access level and the default for new members.
+	GuestAccess = 10
+)
+
+// Member is a user's membership of a group.
+type Member struct {
+	ID          int    `json:"id"`
+	Username    string `json:"username"`
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	AccessLevel int    `json:"access_level"`
+	WebURL      string `json:"web_url"`
+	// GroupSAMLIdentity is only returned to group owners of SAML groups.
+	GroupSAMLIdentity *SAMLIdentity `json:"group_saml_identity,omitempty"`
+}
+
+// SAMLIdentity links a member to its identity in the group's SAML provider.
+type SAMLIdentity struct {
+	ExternUID      string `json:"extern_uid"`
+	Provider       string `json:"provider"`
+	SAMLProviderID int    `json:"saml_provider_id"`
+}
+
+type Group struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	FullPath string `json:"full_path"`
+}
+
+type gitlabProvider struct {
+	config.BaseConfig
+
+	client      *client
+	org         string
+	accessLevel int
+}
+
+func NewGitlabProvider(ctx context.Context, cfg *config.GitlabConfig) (*gitlabProvider, error) {
+	// Group memberships cannot be disabled, only removed.
+	if cfg.Deprovisioning.Suspends() {
+		return nil, errors.New("gitlab members cannot be suspended, use the delete deprovisioning mode")
+	}
+
+	baseURL := cfg.Url
+	if baseURL == "" {
+		baseURL = defaultURL
+	}
+
+	limited, err := utils.NewRateLimitTransport(nil, cfg.RateLimit, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var transport http.RoundTripper = limited
+	if cfg.Token != nil && cfg.Token.Value != nil {
+		transport = &tokenTransport{token: *cfg.Token.Value, base: transport}
+	}
+
+	accessLevel := cfg.AccessLevel
+	if accessLevel == 0 {
+		accessLevel = GuestAccess
+	}
+
+	return &gitlabProvider{
+		BaseConfig: cfg.BaseConfig,
+		client: &client{
+			http:    &http.Client{Transport: transport},
+			baseURL: fmt.Sprintf("%s/api/v4", strings.TrimSuffix(baseURL, "/")),
+		},
+		org:         cfg.Organisation,
+		accessLevel: accessLevel,
+	}, nil
+}
+
+func groupPath(group string) string {
+	return fmt.Sprintf("groups/%s", url.PathEscape(group))
+}
+
+// GetUsers returns the members of the group, including those inherited from parent groups.
+func (gl *gitlabProvider) GetUsers(ctx context.Context, lo utils.ListOptions) ([]Member, error) {
+	query := url.Values{}
+	if lo.Filter != nil {
+		query.Set("query", *lo.Filter)
+	}
+
+	return getAll[Member](ctx, gl.client, groupPath(gl.org)+"/members/all", query)
+}
+
+func (gl *gitlabProvider) SearchUsers(ctx context.Context, filter string) ([]Member, error) {
+	return gl.GetUsers(ctx, utils.ListOptions{Filter: &filter})
+}
+
+// GetDirectMembers returns the members added to the group itself.
+func (gl *gitlabProvider) GetDirectMembers(ctx context.Context, group string) ([]Member, error) {
+	return getAll[Member](ctx, gl.client, groupPath(group)+"/members", nil)
+}
+
+// GetGroups returns every subgroup of the group, at any depth.
+func (gl *gitlabProvider) GetGroups(ctx context.Context) ([]Group, error) {
+	return getAll[Group](ctx, gl.client, groupPath(gl.org)+"/descendant_groups", nil)
+}
+
+// relativePath names a subgroup by its path below the configured group, e.g. team-a/oncall.
+func (gl *gitlabProvider) relativePath(group Group) string {
+	return strings.TrimPrefix(group.FullPath, gl.org+"/")
+}
+
+func (gl *gitlabProvider) GetUsersConverted(ctx context.Context, lo utils.ListOptions) ([]map[string]any, error) {
+	members, err := gl.GetUsers(ctx, lo)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := gl.GetGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships := make(map[int][]string)
+	for _, group := range groups {
+		direct, err := gl.GetDirectMembers(ctx, group.FullPath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, member := range direct {
+			memberships[member.ID] = append(memberships[member.ID], gl.relativePath(group))
+		}
+	}
+
+	convertedUsers := make([]map[string]any, 0)
+	for _, item := range members {
+		if user, err := gl.BaseConfig.ConvertUser(item); err != nil {
+			return nil, err
+		} else {
+			user[gl.BaseConfig.GroupField] = memberships[item.ID]
+			convertedUsers = append(convertedUsers, user)
+		}
+	}
+	return convertedUsers, nil
+}
+
+// Plan keys members by their mapped username. Inherited members are managed
+// in the parent group they belong to, so they are never removed or updated here.
+// Source groups are matched to subgroups by their path below the configured group.
+func (gl *gitlabProvider) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
+	members, err := gl.GetUsers(ctx, utils.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	direct, err := gl.GetDirectMembers(ctx, gl.org)
+	if err != nil {
+		return nil, err
+	}
+
+	directIDs := make(map[int]bool)
+	for _, member := range direct {
+		directIDs[member.ID] = true
+	}
+
+	field := gl.BaseConfig.Mapping["username"]
+	current, err := gl.BaseConfig.ConvertUsers(members)
+	if err != nil {
+		return nil, err
+	}
+
+	toAdd, toRemove, toUpdate, err := gl.BaseConfig.RawCompareUsers(current, source, field)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]int)
+	for i, member := range members {
+		ids[config.KeyOf(current[i], field)] = member.ID
+	}
+
+	plan := engine.NewPlan(fmt.Sprintf("gitlab/%s", gl.org))
+	plan.SetState(current, source, field)
+	for _, u := range toAdd {
+		u := u
+		key := config.KeyOf(u, field)
+		plan.AddVerified(engine.OperationCreate, key, u, func(ctx context.Context) error {
+			return gl.addMember(ctx, gl.org, key, gl.accessLevelOf(u))
+		}, func(ctx context.Context) (bool, error) {
+			return gl.isMember(ctx, gl.org, key)
+		})
+	}
+
+	for _, u := range toRemove {
+		key := config.KeyOf(u, field)
+		if id := ids[key]; directIDs[id] {
+			plan.Add(engine.OperationDelete, key, u, func(ctx context.Context) error {
+				return gl.removeMember(ctx, gl.org, id)
+			})
+		}
+	}
+
+	for _, u := range toUpdate {
+		u := u
+		key := config.KeyOf(u, field)
+		if id := ids[key]; directIDs[id] {
+			plan.Add(engine.OperationUpdate, key, u, func(ctx context.Context) error {
+				return gl.setAccessLevel(ctx, gl.org, id, gl.accessLevelOf(u))
+			})
+		}
+	}
+
+	if err := gl.planSubgroups(ctx, plan, source); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// planSubgroups brings the direct members of every subgroup in line with the
+// source groups. Subgroups in IgnoreGroups are left alone.
+func (gl *gitlabProvider) planSubgroups(ctx context.Context, plan *engine.Plan, source []map[string]any) error {
+	field := gl.BaseConfig.Mapping["username"]
+
+	groups, err := gl.GetGroups(ctx)
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string][]string)
+	desired := make(map[string][]string)
+	for _, group := range groups {
+		name := gl.relativePath(group)
+		if slices.Contains(gl.BaseConfig.IgnoreGroups, name) {
+			continue
+		}
+
+		members, err := gl.GetDirectMembers(ctx, group.FullPath)
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			current[name] = append(current[name], member.Username)
+		}
+
+		desired[name] = make([]string, 0)
+		for _, u := range source {
+			if slices.Contains(gl.BaseConfig.GroupsOf(u), name) {
+				desired[name] = append(desired[name], config.KeyOf(u, field))
+			}
+		}
+	}
+
+	plan.AddMemberships(current, desired, func(ctx context.Context, group, username string) error {
+		return gl.addMember(ctx, gl.subgroupPath(group), username, gl.accessLevel)
+	}, func(ctx context.Context, group, username string) error {
+		id, err := gl.userID(ctx, username)
+		if err != nil {
+			return err
+		}
+
+		return gl.removeMember(ctx, gl.subgroupPath(group), id)
+	})
+
+	return nil
+}
+
+func (gl *gitlabProvider) subgroupPath(relative string) string {
+	return fmt.Sprintf("%s/%s", gl.org, relative)
+}
+
+func (gl *gitlabProvider) SyncProvider(ctx context.Context, source []map[string]any, opts ...engine.Option) (*engine.Result, error) {
+	plan, err := gl.Plan(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]engine.Option{engine.WithConfig(gl.BaseConfig)}, opts...)
+	return engine.Apply(ctx, plan, opts...)
+}
+
+// accessLevelOf returns the user's mapped access_level, or the configured default.
+func (gl *gitlabProvider) accessLevelOf(u map[string]any) int {
+	mapped, err := gl.BaseConfig.ConvertUserToProvider(u)
+	if err != nil || mapped["access_level"] == nil {
+		return gl.accessLevel
+	}
+
+	level, err := strconv.Atoi(fmt.Sprint(mapped["access_level"]))
+	if err != nil {
+		return gl.accessLevel
+	}
+
+	return level
+}
+
+func (gl *gitlabProvider) userID(ctx context.Context, username string) (int, error) {
+	var users []Member
+	query := url.Values{"username": []string{username}}
+	if _, err := gl.client.do(ctx, http.MethodGet, gl.client.url("users", query), nil, &users); err != nil {
+		return 0, fmt.Errorf("looking up user %s: %w", username, err)
+	}
+
+	if len(users) == 0 {
+		return 0, fmt.Errorf("user %s does not exist", username)
+	}
+
+	return users[0].ID, nil
+}
+
+func (gl *gitlabProvider) isMember(ctx context.Context, group, username string) (bool, error) {
+	id, err := gl.userID(ctx, username)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = gl.client.do(ctx, http.MethodGet, gl.client.url(fmt.Sprintf("%s/members/%d", groupPath(group), id), nil), nil, nil)
+	if isNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("getting member %s of %s: %w", username, group, err)
+	}
+
+	return true, nil
+}
+
+func (gl *gitlabProvider) addMember(ctx context.Context, group, username string, accessLevel int) error {
+	id, err := gl.userID(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]any{
+		"user_id":      id,
+		"access_level": accessLevel,
+	}
+	if _, err := gl.client.do(ctx, http.MethodPost, gl.client.url(groupPath(group)+"/members", nil), body, nil); err != nil {
+		return fmt.Errorf("adding %s to %s: %w", username, group, err)
+	}
+
+	return nil
+}
+
+func (gl *gitlabProvider) setAccessLevel(ctx context.Context, group string, id, accessLevel int) error {
+	body := map[string]any{"access_level": accessLevel}
+	if _, err := gl.client.do(ctx, http.MethodPut, gl.client.url(fmt.Sprintf("%s/members/%d", groupPath(group), id), nil), body, nil); err != nil {
+		return fmt.Errorf("updating member %d of %s: %w", id, group, err)
+	}
+
+	return nil
+}
+
+// removeMember tolerates members that are already gone.
+func (gl *gitlabProvider) removeMember(ctx context.Context, group string, id int) error {
+	_, err := gl.client.do(ctx, http.MethodDelete, gl.client.url(fmt.Sprintf("%s/members/%d", groupPath(group), id), nil), nil, nil)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("removing member %d from %s: %w", id, group, err)
+	}
+
+	return nil
+}
+
+func (gl *gitlabProvider) Sync(ctx context.Context, users []map[string]any) (add, remove, update []map[string]any, retErr error) {
+	sourceUsers, err := gl.GetUsers(ctx, utils.ListOptions{})
+	if err != nil {
+		retErr = err
+		return
+	}
+
+	return gl.BaseConfig.CompareUsers(sourceUsers, users, gl.BaseConfig.Mapping["username"])
+}
@@ -0,0 +1,251 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/utils"
+	resolvers "github.com/tiagoposse/go-secret-resolvers"
+)
+
+// fakeGitlab is a GitLab API stand-in that serves canned responses by method
+// and escaped path and records every request it gets.
+type fakeGitlab struct {
+	mu       sync.Mutex
+	routes   map[string]http.HandlerFunc
+	requests []string
+}
+
+func newFakeGitlab(t *testing.T) (*fakeGitlab, *httptest.Server) {
+	fake := &fakeGitlab{routes: make(map[string]http.HandlerFunc)}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	return fake, srv
+}
+
+func (f *fakeGitlab) handle(method, path string, h http.HandlerFunc) {
+	f.routes[method+" /api/v4/"+path] = h
+}
+
+func (f *fakeGitlab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := r.Method + " " + r.URL.EscapedPath()
+
+	f.mu.Lock()
+	f.requests = append(f.requests, route)
+	h, ok := f.routes[route]
+	f.mu.Unlock()
+
+	if !ok {
+		http.Error(w, `{"message":"404 Not Found"}`, http.StatusNotFound)
+		return
+	}
+	h(w, r)
+}
+
+func (f *fakeGitlab) received(route string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Contains(f.requests, route)
+}
+
+func writeJSON(t *testing.T, w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Errorf("encoding response: %v", err)
+	}
+}
+
+func members(usernames ...string) []Member {
+	res := make([]Member, 0, len(usernames))
+	for _, username := range usernames {
+		res = append(res, Member{ID: userIDs[username], Username: username, State: "active", AccessLevel: GuestAccess})
+	}
+	return res
+}
+
+var userIDs = map[string]int{"alice": 1, "bob": 2, "carol": 3}
+
+func newTestProvider(t *testing.T, srv *httptest.Server, cfg config.BaseConfig) *gitlabProvider {
+	token := "secret"
+	cfg.RateLimit = &config.RateLimitConfig{MaxRetries: 2, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+	gl, err := NewGitlabProvider(context.Background(), &config.GitlabConfig{
+		BaseConfig:   cfg,
+		Url:          srv.URL,
+		Organisation: "acme",
+		Token:        &resolvers.ResolverField{Value: &token},
+	})
+	if err != nil {
+		t.Fatalf("creating provider: %v", err)
+	}
+
+	return gl
+}
+
+func TestGetUsersFollowsNextLinks(t *testing.T) {
+	fake, srv := newFakeGitlab(t)
+	fake.handle(http.MethodGet, "groups/acme/members/all", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization = %q, want the configured token", got)
+		}
+		for param, want := range map[string]string{"pagination": "keyset", "order_by": "id", "sort": "asc", "per_page": "100"} {
+			if got := r.URL.Query().Get(param); got != want {
+				t.Errorf("%s = %q, want %s", param, got, want)
+			}
+		}
+
+		switch r.URL.Query().Get("id_after") {
+		case "":
+			next := fmt.Sprintf("%s/api/v4/groups/acme/members/all?pagination=keyset&order_by=id&sort=asc&per_page=100&id_after=1", srv.URL)
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next", <%s/api/v4/groups/acme/members/all>; rel="first"`, next, srv.URL))
+			writeJSON(t, w, members("alice"))
+		case "1":
+			next := fmt.Sprintf("%s/api/v4/groups/acme/members/all?pagination=keyset&order_by=id&sort=asc&per_page=100&id_after=2", srv.URL)
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next))
+			writeJSON(t, w, members("bob"))
+		default:
+			writeJSON(t, w, members("carol"))
+		}
+	})
+
+	gl := newTestProvider(t, srv, config.BaseConfig{})
+	got, err := gl.GetUsers(context.Background(), utils.ListOptions{})
+	if err != nil {
+		t.Fatalf("GetUsers: %v", err)
+	}
+
+	usernames := make([]string, 0, len(got))
+	for _, m := range got {
+		usernames = append(usernames, m.Username)
+	}
+	if want := []string{"alice", "bob", "carol"}; !slices.Equal(usernames, want) {
+		t.Errorf("GetUsers = %v, want %v", usernames, want)
+	}
+}
+
+func TestNextLink(t *testing.T) {
+	tests := map[string]string{
+		"":                                 "",
+		`<https://x/a?page=2>; rel="next"`: "https://x/a?page=2",
+		`<https://x/a?page=1>; rel="first", <https://x/a?page=3>; rel="next"`: "https://x/a?page=3",
+		`<https://x/a?page=1>; rel="first", <https://x/a?page=9>; rel="last"`: "",
+	}
+
+	for header, want := range tests {
+		if got := nextLink(header); got != want {
+			t.Errorf("nextLink(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestPlanSubgroupMemberships(t *testing.T) {
+	fake, srv := newFakeGitlab(t)
+	fake.handle(http.MethodGet, "groups/acme/members/all", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, members("alice", "bob", "carol"))
+	})
+	fake.handle(http.MethodGet, "groups/acme/members", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, members("alice", "bob", "carol"))
+	})
+	fake.handle(http.MethodGet, "groups/acme/descendant_groups", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, []Group{
+			{ID: 10, Path: "team-a", FullPath: "acme/team-a"},
+			{ID: 11, Path: "oncall", FullPath: "acme/team-a/oncall"},
+			{ID: 12, Path: "ignored", FullPath: "acme/ignored"},
+		})
+	})
+	fake.handle(http.MethodGet, "groups/acme%2Fteam-a/members", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, members("alice", "bob"))
+	})
+	fake.handle(http.MethodGet, "groups/acme%2Fteam-a%2Foncall/members", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, members())
+	})
+	fake.handle(http.MethodGet, "groups/acme%2Fignored/members", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, members("bob"))
+	})
+	fake.handle(http.MethodGet, "users", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, members(r.URL.Query().Get("username")))
+	})
+	fake.handle(http.MethodPost, "groups/acme%2Fteam-a/members", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]int
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decoding add member body: %v", err)
+		}
+		if body["user_id"] != userIDs["carol"] || body["access_level"] != GuestAccess {
+			t.Errorf("added %v to team-a, want carol as a guest", body)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	fake.handle(http.MethodPost, "groups/acme%2Fteam-a%2Foncall/members", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	fake.handle(http.MethodDelete, "groups/acme%2Fteam-a/members/2", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	gl := newTestProvider(t, srv, config.BaseConfig{
+		Mapping:      map[string]string{"username": "username"},
+		GroupField:   "groups",
+		IgnoreGroups: []string{"ignored"},
+	})
+
+	source := []map[string]any{
+		{"username": "alice", "groups": []string{"team-a"}},
+		{"username": "bob"},
+		{"username": "carol", "groups": []string{"team-a", "team-a/oncall"}},
+	}
+
+	plan, err := gl.Plan(context.Background(), source)
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+
+	ids := make([]string, 0, len(plan.Operations))
+	for _, op := range plan.Operations {
+		ids = append(ids, op.ID())
+	}
+
+	want := []string{
+		"add-member:team-a/carol",
+		"remove-member:team-a/bob",
+		"add-member:team-a/oncall/carol",
+	}
+	if !slices.Equal(ids, want) {
+		t.Fatalf("planned %v, want %v", ids, want)
+	}
+
+	res, err := engine.Apply(context.Background(), plan)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if got := res.Count(engine.StatusSucceeded); got != len(want) {
+		t.Errorf("%d operations succeeded, want %d", got, len(want))
+	}
+
+	for _, route := range []string{
+		"POST /api/v4/groups/acme%2Fteam-a/members",
+		"POST /api/v4/groups/acme%2Fteam-a%2Foncall/members",
+		"DELETE /api/v4/groups/acme%2Fteam-a/members/2",
+	} {
+		if !fake.received(route) {
+			t.Errorf("%s was not requested", route)
+		}
+	}
+
+	for _, route := range fake.requests {
+		if strings.Contains(route, "ignored") && !strings.HasPrefix(route, http.MethodGet) {
+			t.Errorf("ignored group was changed: %s", route)
+		}
+	}
+}
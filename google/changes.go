@@ -0,0 +1,168 @@
+package google
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/utils"
+	reports "google.golang.org/api/admin/reports/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// reportOverlap is how far before the cursor changes are read again, as
+	// admin activities can show up in the reports a few minutes late.
+	reportOverlap = 10 * time.Minute
+	// reportRetention is how long admin activities are kept.
+	reportRetention = 180 * 24 * time.Hour
+)
+
+// groupEvents change the groups of every member of a group, which the
+// activities do not list.
+var groupEvents = []string{"DELETE_GROUP", "CHANGE_GROUP_EMAIL"}
+
+// Cursor is the time the changes are read from.
+func (gac *googleProvider) Cursor(ctx context.Context) (string, error) {
+	if gac.reports == nil {
+		return "", errors.New("incremental reads are not enabled for google")
+	}
+
+	return time.Now().UTC().Format(time.RFC3339), nil
+}
+
+// ReadAll returns every converted user by primary email, as the admin
+// activities only name users by email.
+func (gac *googleProvider) ReadAll(ctx context.Context) (map[string]map[string]any, error) {
+	users, memberships, err := gac.GetUsersAndMemberships(ctx, utils.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]map[string]any, len(users))
+	for _, item := range users {
+		user, err := gac.BaseConfig.ConvertUser(item)
+		if err != nil {
+			return nil, err
+		}
+
+		user[gac.BaseConfig.GroupField] = memberships[item.Id]
+		res[strings.ToLower(item.PrimaryEmail)] = user
+	}
+
+	return res, nil
+}
+
+// Changes reads the users named in the admin activities after the cursor.
+// The Directory API has no updatedMin for users, so the admin activity log of
+// the Reports API stands in for it.
+func (gac *googleProvider) Changes(ctx context.Context, cursor string) ([]engine.Change, string, error) {
+	if gac.reports == nil {
+		return nil, "", errors.New("incremental reads are not enabled for google")
+	}
+
+	since, err := time.Parse(time.RFC3339, cursor)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: invalid cursor %q", engine.ErrFullSyncRequired, cursor)
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(since) > reportRetention-reportOverlap {
+		return nil, "", fmt.Errorf("%w: the admin activities no longer cover %s", engine.ErrFullSyncRequired, cursor)
+	}
+	since = since.Add(-reportOverlap)
+
+	emails := make([]string, 0)
+	changed := make(map[string]bool)
+	mark := func(email string) {
+		email = strings.ToLower(email)
+		if email != "" && !changed[email] {
+			changed[email] = true
+			emails = append(emails, email)
+		}
+	}
+
+	err = gac.reports.Activities.List("all", "admin").
+		StartTime(since.Format(time.RFC3339)).
+		EndTime(now.Format(time.RFC3339)).
+		Pages(ctx, func(page *reports.Activities) error {
+			for _, activity := range page.Items {
+				for _, event := range activity.Events {
+					for _, name := range groupEvents {
+						if event.Name == name {
+							return fmt.Errorf("%w: %s", engine.ErrFullSyncRequired, event.Name)
+						}
+					}
+
+					for _, param := range event.Parameters {
+						// A renamed user is named by its old email and the new one.
+						if param.Name == "USER_EMAIL" || (event.Name == "RENAME_USER" && param.Name == "NEW_VALUE") {
+							mark(param.Value)
+						}
+					}
+				}
+			}
+			return nil
+		})
+	if errors.Is(err, engine.ErrFullSyncRequired) {
+		return nil, "", err
+	} else if err != nil {
+		return nil, "", fmt.Errorf("listing admin activities: %w", err)
+	}
+
+	changes := make([]engine.Change, 0, len(emails))
+	for _, email := range emails {
+		user, primary, err := gac.readUser(ctx, email)
+		if err != nil {
+			return nil, "", err
+		}
+
+		// Looking up an alias, e.g. the old email of a renamed user, returns
+		// the user it belongs to.
+		if primary != email {
+			changes = append(changes, engine.Change{ID: email})
+			if user == nil || changed[primary] {
+				continue
+			}
+			changed[primary] = true
+		}
+
+		changes = append(changes, engine.Change{ID: primary, User: user})
+	}
+
+	return changes, now.Format(time.RFC3339), nil
+}
+
+// readUser returns a converted user with its groups and its primary email,
+// or nil when it no longer exists.
+func (gac *googleProvider) readUser(ctx context.Context, email string) (map[string]any, string, error) {
+	item, err := gac.client.Users.Get(email).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return nil, email, nil
+	} else if err != nil {
+		return nil, "", fmt.Errorf("fetching user %s: %w", email, err)
+	}
+
+	res, err := gac.client.Groups.List().Domain(gac.domain).UserKey(item.Id).Context(ctx).Do()
+	if err != nil {
+		return nil, "", fmt.Errorf("getting groups for user %s: %w", item.PrimaryEmail, err)
+	}
+
+	memberships := make([]string, 0, len(res.Groups))
+	for _, g := range res.Groups {
+		memberships = append(memberships, g.Email)
+	}
+
+	user, err := gac.BaseConfig.ConvertUser(item)
+	if err != nil {
+		return nil, "", err
+	}
+
+	user[gac.BaseConfig.GroupField] = memberships
+	return user, strings.ToLower(item.PrimaryEmail), nil
+}
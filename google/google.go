@@ -1,14 +1,23 @@
 package google
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 
 	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
 	"github.com/tiagoposse/go-identity-sync/utils"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	admin "google.golang.org/api/admin/directory/v1"
+	reports "google.golang.org/api/admin/reports/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/groupssettings/v1"
 	"google.golang.org/api/option"
 )
 
@@ -16,35 +25,130 @@ type googleProvider struct {
 	config.BaseConfig
 
 	client *admin.Service
-	domain string
+	// reports reads the admin activity log for incremental reads.
+	reports *reports.Service
+	// settings writes group settings, when there are any to manage.
+	settings *groupssettings.Service
+	domain   string
+	groups   *config.GoogleGroupsConfig
+	// readOnly providers only have read scopes, so they are never planned.
+	readOnly bool
 }
 
 func NewGoogleProvider(ctx context.Context, cfg *config.GoogleConfig) (*googleProvider, error) {
-	// Configure the JWT config
-	gcfg, err := google.JWTConfigFromJSON(
-		[]byte(*cfg.ServiceAccountKey.Value),
-		admin.AdminDirectoryUserReadonlyScope,
-		admin.AdminDirectoryGroupMemberReadonlyScope,
-		admin.AdminDirectoryGroupReadonlyScope,
-	)
+	if cfg.ReadOnly && cfg.Groups != nil {
+		return nil, errors.New("a read only google provider cannot manage groups")
+	} else if cfg.ServiceAccountKey == nil || cfg.ServiceAccountKey.Value == nil {
+		return nil, errors.New("google needs a service account key")
+	} else if err := validateGroups(cfg.Groups); err != nil {
+		return nil, err
+	}
 
-	gcfg.Subject = cfg.UserToImpersonate
+	gcfg, err := google.JWTConfigFromJSON([]byte(*cfg.ServiceAccountKey.Value), scopes(cfg)...)
 	if err != nil {
 		return nil, fmt.Errorf("creating google config: %w", err)
 	}
+	gcfg.Subject = cfg.UserToImpersonate
+
+	transport, err := utils.NewRateLimitTransport(nil, cfg.RateLimit, isRateLimitError)
+	if err != nil {
+		return nil, err
+	}
+
+	// The oauth2 client picks up its base client from the context.
+	httpCtx := context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
 
-	adminService, err := admin.NewService(ctx, option.WithHTTPClient(gcfg.Client(ctx)))
+	httpClient := gcfg.Client(httpCtx)
+	adminService, err := admin.NewService(ctx, option.WithHTTPClient(httpClient))
 	if err != nil {
 		return nil, fmt.Errorf("creating google admin client: %w", err)
 	}
 
+	var reportsService *reports.Service
+	if cfg.Incremental.Reads() {
+		if reportsService, err = reports.NewService(ctx, option.WithHTTPClient(httpClient)); err != nil {
+			return nil, fmt.Errorf("creating google reports client: %w", err)
+		}
+	}
+
+	var settingsService *groupssettings.Service
+	if cfg.Groups != nil && len(cfg.Groups.Settings) > 0 {
+		if settingsService, err = groupssettings.NewService(ctx, option.WithHTTPClient(httpClient)); err != nil {
+			return nil, fmt.Errorf("creating google groups settings client: %w", err)
+		}
+	}
+
 	return &googleProvider{
 		BaseConfig: cfg.BaseConfig,
 		client:     adminService,
+		reports:    reportsService,
+		settings:   settingsService,
 		domain:     cfg.Domain,
+		groups:     cfg.Groups,
+		readOnly:   cfg.ReadOnly,
 	}, nil
 }
 
+// scopes returns the scopes the provider needs for the configured mode.
+// Groups are read by every provider, for the groups of the users.
+func scopes(cfg *config.GoogleConfig) []string {
+	res := []string{admin.AdminDirectoryUserScope}
+	if cfg.ReadOnly {
+		res = []string{admin.AdminDirectoryUserReadonlyScope}
+	}
+
+	if cfg.Groups != nil {
+		// The group scope covers members too.
+		res = append(res, admin.AdminDirectoryGroupScope)
+		if len(cfg.Groups.Settings) > 0 {
+			res = append(res, groupssettings.AppsGroupsSettingsScope)
+		}
+	} else {
+		res = append(res, admin.AdminDirectoryGroupReadonlyScope, admin.AdminDirectoryGroupMemberReadonlyScope)
+	}
+
+	if cfg.Incremental.Reads() {
+		res = append(res, reports.AdminReportsAuditReadonlyScope)
+	}
+
+	return res
+}
+
+// isRateLimitError reports whether a 403 carries one of the Directory API's
+// rate limit reasons rather than a permission error.
+func isRateLimitError(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusForbidden {
+		return false
+	}
+
+	bs, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(bs))
+	if err != nil {
+		return false
+	}
+
+	var body struct {
+		Error struct {
+			Errors []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(bs, &body); err != nil {
+		return false
+	}
+
+	for _, e := range body.Error.Errors {
+		switch e.Reason {
+		case "userRateLimitExceeded", "rateLimitExceeded", "quotaExceeded":
+			return true
+		}
+	}
+
+	return false
+}
+
 func (gac *googleProvider) GetUser(ctx context.Context, id string) (*admin.User, error) {
 	user, err := gac.client.Users.Get(id).Do()
 	if err != nil {
@@ -60,11 +164,15 @@ func (gac *googleProvider) GetUsers(ctx context.Context, lo utils.ListOptions) (
 		query.Query(*lo.Filter)
 	}
 
-	res, err := query.Do()
+	users := make([]*admin.User, 0)
+	err := query.Pages(ctx, func(page *admin.Users) error {
+		users = append(users, page.Users...)
+		return nil
+	})
 	if err != nil {
 		return nil, fmt.Errorf("getting users: %w", err)
 	}
-	return res.Users, nil
+	return users, nil
 }
 
 func (gac *googleProvider) GetUsersAndMemberships(ctx context.Context, lo utils.ListOptions) ([]*admin.User, map[string][]string, error) {
@@ -108,55 +216,174 @@ func (gac *googleProvider) GetUsersConverted(ctx context.Context, lo utils.ListO
 	return convertedUsers, nil
 }
 
-func (gac *googleProvider) SyncProvider(ctx context.Context, source []map[string]any) error {
+func (gac *googleProvider) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
+	if gac.readOnly {
+		return nil, fmt.Errorf("google %s is read only and can only be used as a source", gac.domain)
+	}
+
 	targetUsers, err := gac.GetUsers(ctx, utils.ListOptions{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	toAdd, toRemove, toUpdate, err := gac.BaseConfig.CompareUsers(source, targetUsers, gac.BaseConfig.Mapping["id"])
+	field := gac.BaseConfig.Mapping["id"]
+	current, err := gac.BaseConfig.ConvertUsers(targetUsers)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, u := range toAdd {
-		mapped, err := gac.BaseConfig.ConvertUserToProvider(u)
-		if err != nil {
-			return err
-		}
+	toAdd, toRemove, toUpdate, err := gac.BaseConfig.RawCompareUsers(current, source, field)
+	if err != nil {
+		return nil, err
+	}
 
-		conv, err := MapToUser(mapped)
-		if err != nil {
-			return err
-		}
+	suspended := make(map[string]bool)
+	keys := make(map[string]string)
+	for i, u := range targetUsers {
+		suspended[config.KeyOf(current[i], field)] = u.Suspended
+		keys[u.Id] = config.KeyOf(current[i], field)
+	}
 
-		if _, err := gac.client.Users.Insert(conv).Do(); err != nil {
-			return err
-		}
+	plan := engine.NewPlan(fmt.Sprintf("google/%s", gac.domain))
+	plan.SetState(current, source, field)
+	for _, u := range toAdd {
+		u := u
+		plan.AddVerified(engine.OperationCreate, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return gac.createUser(ctx, u)
+		}, func(ctx context.Context) (bool, error) {
+			mapped, err := gac.BaseConfig.ConvertUserToProvider(u)
+			if err != nil {
+				return false, err
+			}
+
+			conv, err := MapToUser(mapped)
+			if err != nil {
+				return false, err
+			}
+
+			return gac.exists(ctx, conv.PrimaryEmail)
+		})
 	}
 
 	for _, u := range toRemove {
-		if err := gac.client.Users.Delete(u[gac.BaseConfig.Mapping["id"]].(string)).Do(); err != nil {
-			return err
+		key := config.KeyOf(u, field)
+		plan.AddRemoval(gac.BaseConfig.Deprovisioning, key, u, suspended[key], func(ctx context.Context) error {
+			return gac.setSuspended(ctx, key, true)
+		}, func(ctx context.Context) error {
+			return gac.deleteUser(ctx, key)
+		})
+	}
+
+	// Users that reappear in the source are reactivated instead of recreated.
+	if gac.BaseConfig.Deprovisioning.Suspends() {
+		for _, u := range source {
+			key := config.KeyOf(u, field)
+			if suspended[key] {
+				plan.Add(engine.OperationReactivate, key, u, func(ctx context.Context) error {
+					return gac.setSuspended(ctx, key, false)
+				})
+			}
 		}
 	}
 
 	for _, u := range toUpdate {
-		mapped, err := gac.BaseConfig.ConvertUserToProvider(u)
-		if err != nil {
-			return err
-		}
+		u := u
+		plan.Add(engine.OperationUpdate, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return gac.updateUser(ctx, u)
+		})
+	}
 
-		conv, err := MapToUser(mapped)
-		if err != nil {
-			return err
+	if gac.groups != nil {
+		if err := gac.planGroups(ctx, plan, source, keys); err != nil {
+			return nil, err
 		}
+	}
 
-		if _, err := gac.client.Users.Update(
-			conv.Id, conv,
-		).Do(); err != nil {
-			return err
-		}
+	return plan, nil
+}
+
+func (gac *googleProvider) SyncProvider(ctx context.Context, source []map[string]any, opts ...engine.Option) (*engine.Result, error) {
+	plan, err := gac.Plan(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]engine.Option{engine.WithConfig(gac.BaseConfig)}, opts...)
+	return engine.Apply(ctx, plan, opts...)
+}
+
+func (gac *googleProvider) createUser(ctx context.Context, u map[string]any) error {
+	mapped, err := gac.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return err
+	}
+
+	conv, err := MapToUser(mapped)
+	if err != nil {
+		return err
+	}
+
+	if _, err := gac.client.Users.Insert(conv).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("creating user %s: %w", conv.PrimaryEmail, err)
+	}
+
+	return nil
+}
+
+// exists reports whether a user with the given key exists.
+func (gac *googleProvider) exists(ctx context.Context, userKey string) (bool, error) {
+	_, err := gac.client.Users.Get(userKey).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("fetching user %s: %w", userKey, err)
+	}
+
+	return true, nil
+}
+
+func (gac *googleProvider) deleteUser(ctx context.Context, id string) error {
+	// A user that is already gone, e.g. deleted by an interrupted run, counts as deleted.
+	err := gac.client.Users.Delete(id).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("deleting user %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// setSuspended suspends or restores a user. Suspended is sent explicitly since
+// false would otherwise be dropped from the patch.
+func (gac *googleProvider) setSuspended(ctx context.Context, id string, suspended bool) error {
+	patch := &admin.User{
+		Suspended:       suspended,
+		ForceSendFields: []string{"Suspended"},
+	}
+
+	if _, err := gac.client.Users.Patch(id, patch).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("setting suspended=%t for user %s: %w", suspended, id, err)
+	}
+
+	return nil
+}
+
+func (gac *googleProvider) updateUser(ctx context.Context, u map[string]any) error {
+	mapped, err := gac.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return err
+	}
+
+	conv, err := MapToUser(mapped)
+	if err != nil {
+		return err
+	}
+
+	if _, err := gac.client.Users.Update(conv.Id, conv).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("updating user %s: %w", conv.Id, err)
 	}
 
 	return nil
@@ -0,0 +1,387 @@
+package google
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/groupssettings/v1"
+)
+
+const (
+	roleMember  = "MEMBER"
+	roleManager = "MANAGER"
+	roleOwner   = "OWNER"
+)
+
+// roleRank orders the member roles, so that the strongest one wins.
+var roleRank = map[string]int{roleMember: 0, roleManager: 1, roleOwner: 2}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+func (gac *googleProvider) ignoredGroup(email string) bool {
+	return slices.ContainsFunc(gac.BaseConfig.IgnoreGroups, func(group string) bool {
+		return strings.EqualFold(group, email)
+	})
+}
+
+// settingsPatch returns the managed group settings as a patch, failing on
+// fields the Groups Settings API does not have.
+func settingsPatch(settings map[string]string) (*groupssettings.Groups, error) {
+	bs, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	var patch groupssettings.Groups
+	if err := json.Unmarshal(bs, &patch); err != nil {
+		return nil, fmt.Errorf("invalid group settings: %w", err)
+	}
+
+	bs, err = json.Marshal(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	var known map[string]any
+	if err := json.Unmarshal(bs, &known); err != nil {
+		return nil, err
+	}
+
+	for field := range settings {
+		if _, ok := known[field]; !ok {
+			return nil, fmt.Errorf("unknown group setting %s", field)
+		}
+	}
+
+	return &patch, nil
+}
+
+// validateGroups checks the roles and settings of the managed groups.
+func validateGroups(cfg *config.GoogleGroupsConfig) error {
+	if cfg == nil {
+		return nil
+	}
+
+	for _, rc := range cfg.Roles {
+		if rc.Role != roleManager && rc.Role != roleOwner {
+			return fmt.Errorf("invalid role %q for group %s, must be %s or %s", rc.Role, rc.Group, roleManager, roleOwner)
+		}
+	}
+
+	if len(cfg.Settings) > 0 {
+		if _, err := settingsPatch(cfg.Settings); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// desiredMembers returns the members every group of the source users should
+// have, by key, with their role.
+func (gac *googleProvider) desiredMembers(source []map[string]any) map[string]map[string]string {
+	field := gac.BaseConfig.Mapping["id"]
+
+	desired := make(map[string]map[string]string)
+	for _, u := range source {
+		key := config.KeyOf(u, field)
+		for _, group := range gac.BaseConfig.GroupsOf(u) {
+			group = strings.ToLower(group)
+			if gac.ignoredGroup(group) {
+				continue
+			}
+
+			if desired[group] == nil {
+				desired[group] = make(map[string]string)
+			}
+			desired[group][key] = roleMember
+		}
+	}
+
+	for _, rc := range gac.groups.Roles {
+		members := desired[strings.ToLower(rc.Group)]
+		for _, u := range source {
+			key := config.KeyOf(u, field)
+			role, member := members[key]
+			if !member || roleRank[rc.Role] <= roleRank[role] {
+				continue
+			}
+
+			groups := gac.BaseConfig.GroupsOf(u)
+			if slices.ContainsFunc(rc.SourceGroups, func(group string) bool { return slices.Contains(groups, group) }) {
+				members[key] = rc.Role
+			}
+		}
+	}
+
+	return desired
+}
+
+func (gac *googleProvider) listGroups(ctx context.Context) ([]*admin.Group, error) {
+	groups := make([]*admin.Group, 0)
+	err := gac.client.Groups.List().Domain(gac.domain).Pages(ctx, func(page *admin.Groups) error {
+		groups = append(groups, page.Groups...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing groups: %w", err)
+	}
+
+	return groups, nil
+}
+
+// groupMembers returns the roles of the users in a group by key. Nested
+// groups and users from outside the domain are left out.
+func (gac *googleProvider) groupMembers(ctx context.Context, email string, keys map[string]string) (map[string]string, error) {
+	members := make(map[string]string)
+	err := gac.client.Members.List(email).Pages(ctx, func(page *admin.Members) error {
+		for _, m := range page.Members {
+			key, found := keys[m.Id]
+			if m.Type == "USER" && found && !slices.Contains(gac.BaseConfig.IgnoreUsers, key) {
+				members[key] = m.Role
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing members of group %s: %w", email, err)
+	}
+
+	return members, nil
+}
+
+func sortedKeys(set map[string]string) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// planGroups creates the groups of the source users, syncs the members and
+// roles of every group that is not ignored and applies the managed settings.
+func (gac *googleProvider) planGroups(ctx context.Context, plan *engine.Plan, source []map[string]any, keys map[string]string) error {
+	var settings *groupssettings.Groups
+	if len(gac.groups.Settings) > 0 {
+		var err error
+		if settings, err = settingsPatch(gac.groups.Settings); err != nil {
+			return err
+		}
+	}
+
+	groups, err := gac.listGroups(ctx)
+	if err != nil {
+		return err
+	}
+
+	desired := gac.desiredMembers(source)
+
+	existing := make(map[string]bool)
+	deleted := make([]string, 0)
+	current := make(map[string]map[string]string)
+	for _, g := range groups {
+		email := strings.ToLower(g.Email)
+		existing[email] = true
+		if gac.ignoredGroup(email) {
+			continue
+		}
+
+		if _, found := desired[email]; !found {
+			if gac.groups.Delete {
+				deleted = append(deleted, email)
+				continue
+			}
+			desired[email] = make(map[string]string)
+		}
+
+		if current[email], err = gac.groupMembers(ctx, email, keys); err != nil {
+			return err
+		}
+	}
+
+	emails := make([]string, 0, len(desired))
+	for email := range desired {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	for _, email := range emails {
+		email := email
+		if existing[email] {
+			continue
+		}
+
+		plan.AddVerified(engine.OperationCreateGroup, email, map[string]any{"name": email}, func(ctx context.Context) error {
+			return gac.createGroup(ctx, email)
+		}, func(ctx context.Context) (bool, error) {
+			_, err := gac.client.Groups.Get(email).Context(ctx).Do()
+			if isNotFound(err) {
+				return false, nil
+			}
+			return err == nil, err
+		})
+	}
+
+	currentKeys := make(map[string][]string, len(current))
+	for email, members := range current {
+		currentKeys[email] = sortedKeys(members)
+	}
+
+	desiredKeys := make(map[string][]string, len(desired))
+	for email, members := range desired {
+		desiredKeys[email] = sortedKeys(members)
+	}
+
+	plan.AddMemberships(currentKeys, desiredKeys, func(ctx context.Context, group, member string) error {
+		return gac.addMember(ctx, group, member, desired[group][member])
+	}, gac.removeMember)
+
+	// Members that stay get their role changed in place.
+	for _, email := range emails {
+		for _, member := range sortedKeys(desired[email]) {
+			email, member := email, member
+			role := desired[email][member]
+			was, found := current[email][member]
+			if !found || was == role {
+				continue
+			}
+
+			kind := engine.OperationGrant
+			if roleRank[role] < roleRank[was] {
+				kind = engine.OperationRevoke
+			}
+
+			obj := map[string]any{"group": email, "member": member, "role": role}
+			plan.Add(kind, engine.MembershipKey(email, member), obj, func(ctx context.Context) error {
+				return gac.setRole(ctx, email, member, role)
+			})
+		}
+	}
+
+	if settings != nil {
+		for _, email := range emails {
+			email := email
+			if existing[email] {
+				same, err := gac.hasSettings(ctx, email)
+				if err != nil {
+					return err
+				} else if same {
+					continue
+				}
+			}
+
+			obj := map[string]any{"name": email, "settings": gac.groups.Settings}
+			plan.Add(engine.OperationUpdateGroup, email, obj, func(ctx context.Context) error {
+				return gac.applySettings(ctx, email, settings)
+			})
+		}
+	}
+
+	for _, email := range deleted {
+		email := email
+		plan.Add(engine.OperationDeleteGroup, email, map[string]any{"name": email}, func(ctx context.Context) error {
+			return gac.deleteGroup(ctx, email)
+		})
+	}
+
+	return nil
+}
+
+// hasSettings reports whether a group already has the managed settings.
+func (gac *googleProvider) hasSettings(ctx context.Context, email string) (bool, error) {
+	current, err := gac.settings.Groups.Get(email).Context(ctx).Do()
+	if err != nil {
+		return false, fmt.Errorf("getting settings of group %s: %w", email, err)
+	}
+
+	bs, err := json.Marshal(current)
+	if err != nil {
+		return false, err
+	}
+
+	var values map[string]any
+	if err := json.Unmarshal(bs, &values); err != nil {
+		return false, err
+	}
+
+	for field, value := range gac.groups.Settings {
+		if fmt.Sprint(values[field]) != value {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (gac *googleProvider) applySettings(ctx context.Context, email string, settings *groupssettings.Groups) error {
+	if _, err := gac.settings.Groups.Patch(email, settings).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("updating settings of group %s: %w", email, err)
+	}
+
+	return nil
+}
+
+func (gac *googleProvider) createGroup(ctx context.Context, email string) error {
+	name, _, _ := strings.Cut(email, "@")
+	if _, err := gac.client.Groups.Insert(&admin.Group{Email: email, Name: name}).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("creating group %s: %w", email, err)
+	}
+
+	return nil
+}
+
+func (gac *googleProvider) deleteGroup(ctx context.Context, email string) error {
+	err := gac.client.Groups.Delete(email).Context(ctx).Do()
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("deleting group %s: %w", email, err)
+	}
+
+	return nil
+}
+
+// addMember adds a user to a group. Members are added by email, so the key
+// is looked up first.
+func (gac *googleProvider) addMember(ctx context.Context, group, member, role string) error {
+	user, err := gac.GetUser(ctx, member)
+	if err != nil {
+		return err
+	}
+
+	if _, err := gac.client.Members.Insert(group, &admin.Member{Email: user.PrimaryEmail, Role: role}).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("adding %s to group %s: %w", member, group, err)
+	}
+
+	return nil
+}
+
+func (gac *googleProvider) removeMember(ctx context.Context, group, member string) error {
+	err := gac.client.Members.Delete(group, member).Context(ctx).Do()
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("removing %s from group %s: %w", member, group, err)
+	}
+
+	return nil
+}
+
+func (gac *googleProvider) setRole(ctx context.Context, group, member, role string) error {
+	if _, err := gac.client.Members.Patch(group, member, &admin.Member{Role: role}).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("setting role of %s in group %s to %s: %w", member, group, role, err)
+	}
+
+	return nil
+}
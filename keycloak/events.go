@@ -0,0 +1,227 @@
+package keycloak
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/tiagoposse/go-identity-sync/engine"
+)
+
+const (
+	// eventOverlap is how far before the cursor changes are read again, so
+	// events written while the previous run read them are not missed.
+	eventOverlap  = time.Minute
+	eventPageSize = 100
+	userPageSize  = 100
+)
+
+// userEvents are the login events in which users change themselves, which
+// do not show up as admin events.
+var userEvents = []string{"REGISTER", "UPDATE_PROFILE", "UPDATE_EMAIL", "DELETE_ACCOUNT"}
+
+// adminEvent is the part of a Keycloak admin event the feed reads.
+type adminEvent struct {
+	Time          int64  `json:"time"`
+	OperationType string `json:"operationType"`
+	ResourceType  string `json:"resourceType"`
+	ResourcePath  string `json:"resourcePath"`
+}
+
+// Cursor is the time, in milliseconds, the changes are read from.
+func (kc *keycloakProvider) Cursor(ctx context.Context) (string, error) {
+	return strconv.FormatInt(time.Now().UnixMilli(), 10), nil
+}
+
+// listUsers pages through the users of the realm matching search, or every
+// user when it is empty.
+func (kc *keycloakProvider) listUsers(ctx context.Context, search string) ([]*gocloak.User, error) {
+	params := gocloak.GetUsersParams{Max: gocloak.IntP(userPageSize)}
+	if search != "" {
+		params.Search = gocloak.StringP(search)
+	}
+
+	users := make([]*gocloak.User, 0)
+	for first := 0; ; first += userPageSize {
+		params.First = gocloak.IntP(first)
+		token, err := kc.session.token(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		page, err := kc.client.GetUsers(ctx, token, kc.realm, params)
+		if err != nil {
+			return nil, fmt.Errorf("getting users: %w", err)
+		}
+
+		users = append(users, page...)
+		if len(page) < userPageSize {
+			return users, nil
+		}
+	}
+}
+
+// ReadAll returns every converted user by Keycloak id.
+func (kc *keycloakProvider) ReadAll(ctx context.Context) (map[string]map[string]any, error) {
+	users, err := kc.listUsers(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]map[string]any, len(users))
+	for _, item := range users {
+		user, err := kc.convertUser(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+
+		res[*item.ID] = user
+	}
+
+	return res, nil
+}
+
+// Changes reads the users named in the admin and login events after the
+// cursor. Events have to be saved in the realm settings, and expired events
+// cannot be detected, so the full sync interval should stay below the
+// realm's event expiration.
+func (kc *keycloakProvider) Changes(ctx context.Context, cursor string) ([]engine.Change, string, error) {
+	since, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: invalid cursor %q", engine.ErrFullSyncRequired, cursor)
+	}
+
+	now := time.Now()
+	since -= eventOverlap.Milliseconds()
+
+	ids := make([]string, 0)
+	changed := make(map[string]bool)
+	mark := func(id string) {
+		if id != "" && !changed[id] {
+			changed[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	events, err := kc.adminEvents(ctx, since)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, event := range events {
+		segments := strings.Split(event.ResourcePath, "/")
+		switch {
+		case event.ResourceType == "GROUP" && event.OperationType != "CREATE":
+			// Renaming, moving or deleting a group changes the groups of
+			// every member, which the event does not list.
+			return nil, "", fmt.Errorf("%w: group %s changed", engine.ErrFullSyncRequired, event.ResourcePath)
+		case len(segments) > 1 && segments[0] == "users":
+			mark(segments[1])
+		}
+	}
+
+	// The login events API takes days, so events before since are dropped.
+	for first := 0; ; first += eventPageSize {
+		token, err := kc.session.token(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+
+		page, err := kc.client.GetEvents(ctx, token, kc.realm, gocloak.GetEventsParams{
+			DateFrom: gocloak.StringP(time.UnixMilli(since).UTC().Format(time.DateOnly)),
+			Type:     userEvents,
+			First:    gocloak.Int32P(int32(first)),
+			Max:      gocloak.Int32P(eventPageSize),
+		})
+		if err != nil {
+			return nil, "", fmt.Errorf("getting events: %w", err)
+		}
+
+		for _, event := range page {
+			if event.Time >= since && event.UserID != nil {
+				mark(*event.UserID)
+			}
+		}
+
+		if len(page) < eventPageSize {
+			break
+		}
+	}
+
+	changes := make([]engine.Change, 0, len(ids))
+	for _, id := range ids {
+		user, err := kc.readUser(ctx, id)
+		if err != nil {
+			return nil, "", err
+		}
+
+		changes = append(changes, engine.Change{ID: id, User: user})
+	}
+
+	return changes, strconv.FormatInt(now.UnixMilli(), 10), nil
+}
+
+// adminEvents returns the admin events about users and groups after since.
+func (kc *keycloakProvider) adminEvents(ctx context.Context, since int64) ([]adminEvent, error) {
+	events := make([]adminEvent, 0)
+	for first := 0; ; first += eventPageSize {
+		var page []adminEvent
+		err := kc.adminGet(ctx, "admin-events", url.Values{
+			"dateFrom":      {time.UnixMilli(since).UTC().Format(time.DateOnly)},
+			"resourceTypes": {"USER", "GROUP_MEMBERSHIP", "GROUP"},
+			"first":         {strconv.Itoa(first)},
+			"max":           {strconv.Itoa(eventPageSize)},
+		}, &page)
+		if err != nil {
+			return nil, fmt.Errorf("getting admin events: %w", err)
+		}
+
+		for _, event := range page {
+			if event.Time >= since {
+				events = append(events, event)
+			}
+		}
+
+		if len(page) < eventPageSize {
+			return events, nil
+		}
+	}
+}
+
+// readUser returns a converted user with its groups, or nil when it no longer exists.
+func (kc *keycloakProvider) readUser(ctx context.Context, id string) (map[string]any, error) {
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := kc.client.GetUserByID(ctx, token, kc.realm, id)
+	if isNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("fetching user %s: %w", id, err)
+	}
+
+	return kc.convertUser(ctx, item)
+}
+
+// convertUser converts a user and sets its groups, which user listings
+// leave out.
+func (kc *keycloakProvider) convertUser(ctx context.Context, item *gocloak.User) (map[string]any, error) {
+	memberships, err := kc.userGroups(ctx, *item.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := kc.BaseConfig.ConvertUser(item)
+	if err != nil {
+		return nil, err
+	}
+
+	user[kc.BaseConfig.GroupField] = memberships
+	return user, nil
+}
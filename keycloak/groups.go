@@ -0,0 +1,508 @@
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+)
+
+const groupPageSize = 100
+
+// groupNode is a group as listed by the admin API. Since Keycloak 23 the
+// listings stop after the first level of subgroups and only count the rest.
+type groupNode struct {
+	ID            string      `json:"id"`
+	Name          string      `json:"name"`
+	Path          string      `json:"path"`
+	SubGroupCount *int        `json:"subGroupCount"`
+	SubGroups     []groupNode `json:"subGroups"`
+}
+
+// groupPath turns a source group into a group path.
+func groupPath(group string) string {
+	if !strings.HasPrefix(group, "/") {
+		return "/" + group
+	}
+	return group
+}
+
+// parentPath returns the path of the parent of a group, or "" for a top level group.
+func parentPath(path string) string {
+	if i := strings.LastIndex(path, "/"); i > 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+func groupName(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// within reports whether path is the group at root or one of its subgroups.
+func within(path, root string) bool {
+	return path == root || strings.HasPrefix(path, root+"/")
+}
+
+func isNotFound(err error) bool {
+	var apiErr *gocloak.APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+func (kc *keycloakProvider) ignoredGroup(path string) bool {
+	return slices.ContainsFunc(kc.BaseConfig.IgnoreGroups, func(group string) bool {
+		return groupPath(group) == path
+	})
+}
+
+// sourceGroups returns the groups of a source user as paths.
+func (kc *keycloakProvider) sourceGroups(u map[string]any) []string {
+	groups := kc.BaseConfig.GroupsOf(u)
+	paths := make([]string, 0, len(groups))
+	for _, group := range groups {
+		paths = append(paths, groupPath(group))
+	}
+	return paths
+}
+
+// groups returns every group of the realm by path.
+func (kc *keycloakProvider) groups(ctx context.Context) (map[string]groupNode, error) {
+	res := make(map[string]groupNode)
+
+	var walk func(nodes []groupNode) error
+	walk = func(nodes []groupNode) error {
+		for _, node := range nodes {
+			res[node.Path] = node
+
+			children := node.SubGroups
+			if node.SubGroupCount != nil && *node.SubGroupCount > len(children) {
+				var err error
+				if children, err = kc.groupPages(ctx, fmt.Sprintf("groups/%s/children", node.ID)); err != nil {
+					return err
+				}
+			}
+
+			if err := walk(children); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	top, err := kc.groupPages(ctx, "groups")
+	if err != nil {
+		return nil, err
+	}
+
+	return res, walk(top)
+}
+
+func (kc *keycloakProvider) groupPages(ctx context.Context, path string) ([]groupNode, error) {
+	nodes := make([]groupNode, 0)
+	for first := 0; ; first += groupPageSize {
+		var page []groupNode
+		err := kc.adminGet(ctx, path, url.Values{
+			"first": {strconv.Itoa(first)},
+			"max":   {strconv.Itoa(groupPageSize)},
+		}, &page)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %w", path, err)
+		}
+
+		nodes = append(nodes, page...)
+		if len(page) < groupPageSize {
+			return nodes, nil
+		}
+	}
+}
+
+// userGroups returns the paths of the groups a user is a direct member of.
+func (kc *keycloakProvider) userGroups(ctx context.Context, id string) ([]string, error) {
+	paths := make([]string, 0)
+	for first := 0; ; first += groupPageSize {
+		token, err := kc.session.token(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		page, err := kc.client.GetUserGroups(ctx, token, kc.realm, id, gocloak.GetGroupsParams{
+			First: gocloak.IntP(first),
+			Max:   gocloak.IntP(groupPageSize),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("getting groups of user %s: %w", id, err)
+		}
+
+		for _, g := range page {
+			if g.Path != nil {
+				paths = append(paths, *g.Path)
+			}
+		}
+
+		if len(page) < groupPageSize {
+			return paths, nil
+		}
+	}
+}
+
+// groupMembers returns the keys of the direct members of a group.
+func (kc *keycloakProvider) groupMembers(ctx context.Context, node groupNode) ([]string, error) {
+	field := kc.BaseConfig.Mapping["id"]
+
+	members := make([]string, 0)
+	for first := 0; ; first += userPageSize {
+		token, err := kc.session.token(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		page, err := kc.client.GetGroupMembers(ctx, token, kc.realm, node.ID, gocloak.GetGroupsParams{
+			First: gocloak.IntP(first),
+			Max:   gocloak.IntP(userPageSize),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("getting members of group %s: %w", node.Path, err)
+		}
+
+		users, err := kc.BaseConfig.ConvertUsers(page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, u := range users {
+			if key := config.KeyOf(u, field); !slices.Contains(kc.BaseConfig.IgnoreUsers, key) {
+				members = append(members, key)
+			}
+		}
+
+		if len(page) < userPageSize {
+			return members, nil
+		}
+	}
+}
+
+// findUser returns the Keycloak id of the user with the given key, which is
+// either its id or its username.
+func (kc *keycloakProvider) findUser(ctx context.Context, key string) (string, error) {
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	user, err := kc.client.GetUserByID(ctx, token, kc.realm, key)
+	if err == nil {
+		return *user.ID, nil
+	} else if !isNotFound(err) {
+		return "", fmt.Errorf("fetching user %s: %w", key, err)
+	}
+
+	users, err := kc.client.GetUsers(ctx, token, kc.realm, gocloak.GetUsersParams{
+		Username: gocloak.StringP(key),
+		Exact:    gocloak.BoolP(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("fetching user %s: %w", key, err)
+	} else if len(users) == 0 {
+		return "", fmt.Errorf("user %s not found", key)
+	}
+
+	return *users[0].ID, nil
+}
+
+func (kc *keycloakProvider) findGroup(ctx context.Context, path string) (string, error) {
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	group, err := kc.client.GetGroupByPath(ctx, token, kc.realm, path)
+	if err != nil {
+		return "", fmt.Errorf("fetching group %s: %w", path, err)
+	}
+
+	return *group.ID, nil
+}
+
+// planGroups creates the groups of the source users, with their parents,
+// and syncs the members of every group that is not ignored. A missing group
+// is moved rather than created when exactly one unwanted group of the same
+// name exists elsewhere in the tree, so that its roles and attributes stay.
+func (kc *keycloakProvider) planGroups(ctx context.Context, plan *engine.Plan, source []map[string]any) error {
+	field := kc.BaseConfig.Mapping["id"]
+
+	existing, err := kc.groups(ctx)
+	if err != nil {
+		return err
+	}
+
+	desired := make(map[string][]string)
+	for _, u := range source {
+		key := config.KeyOf(u, field)
+		for _, path := range kc.sourceGroups(u) {
+			if kc.ignoredGroup(path) {
+				continue
+			}
+
+			desired[path] = append(desired[path], key)
+			for parent := parentPath(path); parent != ""; parent = parentPath(parent) {
+				if _, ok := desired[parent]; !ok {
+					desired[parent] = make([]string, 0)
+				}
+			}
+		}
+	}
+
+	// located holds the groups by the path they have once the planned moves
+	// and creations are applied.
+	located := make(map[string]groupNode, len(existing))
+	for path, node := range existing {
+		located[path] = node
+	}
+
+	missing := make([]string, 0)
+	for path := range desired {
+		if _, ok := existing[path]; !ok {
+			missing = append(missing, path)
+		}
+	}
+
+	// Parents go first, so that their children can be created in them.
+	sort.Slice(missing, func(i, j int) bool {
+		di, dj := strings.Count(missing[i], "/"), strings.Count(missing[j], "/")
+		if di != dj {
+			return di < dj
+		}
+		return missing[i] < missing[j]
+	})
+
+	for _, path := range missing {
+		path := path
+		if _, ok := located[path]; ok {
+			// Moved along with one of its parents.
+			continue
+		}
+
+		if from, ok := kc.movable(located, desired, path); ok {
+			node := located[from]
+			plan.Add(engine.OperationUpdateGroup, path, map[string]any{"name": path, "from": from}, func(ctx context.Context) error {
+				return kc.moveGroup(ctx, node, path)
+			})
+
+			for p, n := range located {
+				if within(p, from) {
+					delete(located, p)
+					located[path+strings.TrimPrefix(p, from)] = n
+				}
+			}
+			continue
+		}
+
+		plan.AddVerified(engine.OperationCreateGroup, path, map[string]any{"name": path}, func(ctx context.Context) error {
+			return kc.createGroup(ctx, path)
+		}, func(ctx context.Context) (bool, error) {
+			token, err := kc.session.token(ctx)
+			if err != nil {
+				return false, err
+			}
+
+			_, err = kc.client.GetGroupByPath(ctx, token, kc.realm, path)
+			if isNotFound(err) {
+				return false, nil
+			}
+			return err == nil, err
+		})
+		located[path] = groupNode{Name: groupName(path), Path: path}
+	}
+
+	// Only the topmost unwanted groups are deleted, their subgroups go with them.
+	deleted := make([]string, 0)
+	if kc.deleteGroups {
+		for path, node := range located {
+			if _, ok := desired[path]; ok || node.ID == "" || kc.ignoredGroup(path) {
+				continue
+			}
+
+			if parent := parentPath(path); parent == "" || desired[parent] != nil || kc.ignoredGroup(parent) {
+				deleted = append(deleted, path)
+			}
+		}
+		sort.Strings(deleted)
+	}
+
+	current := make(map[string][]string)
+	for path, node := range located {
+		if kc.ignoredGroup(path) || slices.ContainsFunc(deleted, func(root string) bool { return within(path, root) }) {
+			continue
+		}
+
+		if _, ok := desired[path]; !ok {
+			desired[path] = make([]string, 0)
+		}
+
+		if node.ID == "" {
+			continue
+		}
+
+		if current[path], err = kc.groupMembers(ctx, node); err != nil {
+			return err
+		}
+	}
+
+	plan.AddMemberships(current, desired, kc.addMember, kc.removeMember)
+
+	for _, path := range deleted {
+		node := located[path]
+		plan.Add(engine.OperationDeleteGroup, path, map[string]any{"name": path}, func(ctx context.Context) error {
+			return kc.deleteGroup(ctx, node)
+		})
+	}
+
+	return nil
+}
+
+// movable returns the path of the only group named like path that is neither
+// desired nor ignored, if there is exactly one.
+func (kc *keycloakProvider) movable(located map[string]groupNode, desired map[string][]string, path string) (string, bool) {
+	candidates := make([]string, 0)
+	for p, node := range located {
+		if _, ok := desired[p]; ok || node.ID == "" || node.Name != groupName(path) {
+			continue
+		}
+
+		// A group cannot be moved into its own subgroups.
+		if within(path, p) || kc.ignoredGroup(p) {
+			continue
+		}
+
+		candidates = append(candidates, p)
+	}
+
+	if len(candidates) != 1 {
+		return "", false
+	}
+	return candidates[0], true
+}
+
+func (kc *keycloakProvider) createGroup(ctx context.Context, path string) error {
+	group := gocloak.Group{Name: gocloak.StringP(groupName(path))}
+
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	if parent := parentPath(path); parent == "" {
+		_, err = kc.client.CreateGroup(ctx, token, kc.realm, group)
+	} else {
+		var parentID string
+		if parentID, err = kc.findGroup(ctx, parent); err != nil {
+			return err
+		}
+		_, err = kc.client.CreateChildGroup(ctx, token, kc.realm, parentID, group)
+	}
+	if err != nil {
+		return fmt.Errorf("creating group %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// moveGroup moves a group under the parent of path. Posting an existing
+// group to the children of another one moves it there, with its subgroups.
+func (kc *keycloakProvider) moveGroup(ctx context.Context, node groupNode, path string) error {
+	group := gocloak.Group{ID: gocloak.StringP(node.ID), Name: gocloak.StringP(node.Name)}
+
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	if parent := parentPath(path); parent == "" {
+		_, err = kc.client.CreateGroup(ctx, token, kc.realm, group)
+	} else {
+		var parentID string
+		if parentID, err = kc.findGroup(ctx, parent); err != nil {
+			return err
+		}
+		_, err = kc.client.CreateChildGroup(ctx, token, kc.realm, parentID, group)
+	}
+	if err != nil {
+		return fmt.Errorf("moving group %s to %s: %w", node.Path, path, err)
+	}
+
+	return nil
+}
+
+func (kc *keycloakProvider) deleteGroup(ctx context.Context, node groupNode) error {
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = kc.client.DeleteGroup(ctx, token, kc.realm, node.ID)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("deleting group %s: %w", node.Path, err)
+	}
+
+	return nil
+}
+
+func (kc *keycloakProvider) memberIDs(ctx context.Context, group, member string) (string, string, error) {
+	groupID, err := kc.findGroup(ctx, group)
+	if err != nil {
+		return "", "", err
+	}
+
+	userID, err := kc.findUser(ctx, member)
+	if err != nil {
+		return "", "", err
+	}
+
+	return groupID, userID, nil
+}
+
+func (kc *keycloakProvider) addMember(ctx context.Context, group, member string) error {
+	groupID, userID, err := kc.memberIDs(ctx, group, member)
+	if err != nil {
+		return err
+	}
+
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := kc.client.AddUserToGroup(ctx, token, kc.realm, userID, groupID); err != nil {
+		return fmt.Errorf("adding %s to group %s: %w", member, group, err)
+	}
+
+	return nil
+}
+
+func (kc *keycloakProvider) removeMember(ctx context.Context, group, member string) error {
+	groupID, userID, err := kc.memberIDs(ctx, group, member)
+	if err != nil {
+		return err
+	}
+
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = kc.client.DeleteUserFromGroup(ctx, token, kc.realm, userID, groupID)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("removing %s from group %s: %w", member, group, err)
+	}
+
+	return nil
+}
@@ -5,37 +5,87 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/Nerzal/gocloak/v13"
 	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
 	"github.com/tiagoposse/go-identity-sync/utils"
 )
 
+// deprovisionedAttribute tags disabled users with the time they were deprovisioned.
+const deprovisionedAttribute = "identity-sync.deprovisionedAt"
+
 type keycloakProvider struct {
 	config.BaseConfig
-	client *gocloak.GoCloak
-	realm  string
+	client  *gocloak.GoCloak
+	url     string
+	realm   string
+	session *session
 
-	token *gocloak.JWT
+	deleteGroups bool
+	roles        []config.KeycloakRoleConfig
 }
 
 func NewKeycloakProvider(ctx context.Context, cfg *config.KeycloakConfig) (*keycloakProvider, error) {
-	client := gocloak.NewClient(cfg.Url)
-	token, err := client.LoginAdmin(ctx, *cfg.Username.Value, *cfg.Password.Value, cfg.Realm)
+	transport, err := utils.NewRateLimitTransport(nil, cfg.RateLimit, nil)
 	if err != nil {
-		return nil, errors.New("something wrong with the credentials or url")
+		return nil, err
 	}
 
+	client := gocloak.NewClient(cfg.Url)
+	client.RestyClient().SetTransport(transport)
+
+	s := &session{
+		client:   client,
+		realm:    cfg.AuthRealm,
+		clientID: adminClientID,
+	}
+	if s.realm == "" {
+		s.realm = cfg.Realm
+	}
+	if cfg.ClientID != nil && cfg.ClientID.Value != nil {
+		s.clientID = *cfg.ClientID.Value
+	}
+	if cfg.ClientSecret != nil && cfg.ClientSecret.Value != nil {
+		s.clientSecret = *cfg.ClientSecret.Value
+	}
+	if cfg.Username != nil && cfg.Username.Value != nil {
+		s.username = *cfg.Username.Value
+		if cfg.Password != nil && cfg.Password.Value != nil {
+			s.password = *cfg.Password.Value
+		}
+	} else if s.clientSecret == "" {
+		return nil, errors.New("keycloak needs either a username and password or a client id and secret")
+	}
+
+	// Logging in up front catches wrong credentials before anything is planned.
+	if _, err := s.token(ctx); err != nil {
+		return nil, err
+	}
+	s.retryUnauthorized(client.RestyClient())
+
 	return &keycloakProvider{
 		BaseConfig: cfg.BaseConfig,
 		client:     client,
+		url:        strings.TrimSuffix(cfg.Url, "/"),
 		realm:      cfg.Realm,
-		token:      token,
+		session:    s,
+
+		deleteGroups: cfg.DeleteGroups,
+		roles:        cfg.Roles,
 	}, nil
 }
 
 func (kc *keycloakProvider) GetUser(ctx context.Context, id string) (*gocloak.User, error) {
-	user, err := kc.client.GetUserByID(ctx, kc.token.AccessToken, kc.realm, id)
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := kc.client.GetUserByID(ctx, token, kc.realm, id)
 	if err != nil {
 		return nil, fmt.Errorf("fetching user details: %w", err)
 	}
@@ -63,85 +113,210 @@ func (kc *keycloakProvider) GetUsersConverted(ctx context.Context) ([]map[string
 }
 
 func (kc *keycloakProvider) GetUsers(ctx context.Context, lo utils.ListOptions) ([]*gocloak.User, error) {
-	return kc.client.GetUsers(ctx, kc.token.AccessToken, kc.realm, gocloak.GetUsersParams{
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return kc.client.GetUsers(ctx, token, kc.realm, gocloak.GetUsersParams{
 		Search: lo.Filter,
 	})
 }
 
-func (kc *keycloakProvider) SyncProvider(ctx context.Context, source []map[string]any) error {
-	targetUsers, err := kc.GetUsers(ctx, utils.ListOptions{})
+func (kc *keycloakProvider) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
+	targetUsers, err := kc.listUsers(ctx, "")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	toAdd, toRemove, toUpdate, err := kc.BaseConfig.CompareUsers(source, targetUsers, kc.BaseConfig.Mapping["id"])
+	field := kc.BaseConfig.Mapping["id"]
+	current, err := kc.BaseConfig.ConvertUsers(targetUsers)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, u := range toAdd {
-		mapped, err := kc.BaseConfig.ConvertUserToProvider(u)
-		if err != nil {
-			return err
-		}
+	toAdd, toRemove, toUpdate, err := kc.BaseConfig.RawCompareUsers(current, source, field)
+	if err != nil {
+		return nil, err
+	}
 
-		conv, err := MapToUser(mapped)
-		if err != nil {
-			return err
-		}
+	suspended := make(map[string]bool)
+	for i, u := range targetUsers {
+		suspended[config.KeyOf(current[i], field)] = u.Enabled != nil && !*u.Enabled
+	}
 
-		if _, err := kc.client.CreateUser(ctx, kc.token.AccessToken, kc.realm, *conv); err != nil {
-			return err
-		}
+	plan := engine.NewPlan(fmt.Sprintf("keycloak/%s", kc.realm))
+	plan.SetState(current, source, field)
+	for _, u := range toAdd {
+		u := u
+		plan.Add(engine.OperationCreate, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return kc.createUser(ctx, u)
+		})
 	}
 
 	for _, u := range toRemove {
-		if err := kc.client.DeleteUser(ctx, kc.token.AccessToken, kc.realm, u[kc.BaseConfig.Mapping["id"]].(string), nil); err != nil {
-			return err
+		key := config.KeyOf(u, field)
+		plan.AddRemoval(kc.BaseConfig.Deprovisioning, key, u, suspended[key], func(ctx context.Context) error {
+			return kc.setEnabled(ctx, key, false)
+		}, func(ctx context.Context) error {
+			return kc.deleteUser(ctx, key)
+		})
+	}
+
+	// Users that reappear in the source are reactivated instead of recreated.
+	if kc.BaseConfig.Deprovisioning.Suspends() {
+		for _, u := range source {
+			key := config.KeyOf(u, field)
+			if suspended[key] {
+				plan.Add(engine.OperationReactivate, key, u, func(ctx context.Context) error {
+					return kc.setEnabled(ctx, key, true)
+				})
+			}
 		}
 	}
 
 	for _, u := range toUpdate {
-		mapped, err := kc.BaseConfig.ConvertUserToProvider(u)
-		if err != nil {
-			return err
-		}
+		u := u
+		plan.Add(engine.OperationUpdate, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return kc.updateUser(ctx, u)
+		})
+	}
 
-		conv, err := MapToUser(mapped)
-		if err != nil {
-			return err
-		}
+	if err := kc.planGroups(ctx, plan, source); err != nil {
+		return nil, err
+	}
 
-		if err := kc.client.UpdateUser(
-			ctx,
-			kc.token.AccessToken, kc.realm,
-			*conv,
-		); err != nil {
-			return err
-		}
+	if err := kc.planRoles(ctx, plan, source); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+func (kc *keycloakProvider) SyncProvider(ctx context.Context, source []map[string]any, opts ...engine.Option) (*engine.Result, error) {
+	plan, err := kc.Plan(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]engine.Option{engine.WithConfig(kc.BaseConfig)}, opts...)
+	return engine.Apply(ctx, plan, opts...)
+}
+
+func (kc *keycloakProvider) createUser(ctx context.Context, u map[string]any) error {
+	mapped, err := kc.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return err
+	}
+
+	conv, err := MapToUser(mapped)
+	if err != nil {
+		return err
+	}
+
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := kc.client.CreateUser(ctx, token, kc.realm, *conv); err != nil {
+		return fmt.Errorf("creating user: %w", err)
+	}
+
+	return nil
+}
+
+func (kc *keycloakProvider) deleteUser(ctx context.Context, id string) error {
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := kc.client.DeleteUser(ctx, token, kc.realm, id); err != nil {
+		return fmt.Errorf("deleting user %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// setEnabled enables or disables a user, tagging disabled users with the
+// time they were deprovisioned.
+func (kc *keycloakProvider) setEnabled(ctx context.Context, id string, enabled bool) error {
+	user, err := kc.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	attrs := make(map[string][]string)
+	if user.Attributes != nil {
+		attrs = *user.Attributes
+	}
+
+	if enabled {
+		delete(attrs, deprovisionedAttribute)
+	} else {
+		attrs[deprovisionedAttribute] = []string{time.Now().UTC().Format(time.RFC3339)}
+	}
+
+	user.Enabled = gocloak.BoolP(enabled)
+	user.Attributes = &attrs
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := kc.client.UpdateUser(ctx, token, kc.realm, *user); err != nil {
+		return fmt.Errorf("setting enabled=%t for user %s: %w", enabled, id, err)
+	}
+
+	return nil
+}
+
+func (kc *keycloakProvider) updateUser(ctx context.Context, u map[string]any) error {
+	mapped, err := kc.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return err
+	}
+
+	conv, err := MapToUser(mapped)
+	if err != nil {
+		return err
+	}
+
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := kc.client.UpdateUser(ctx, token, kc.realm, *conv); err != nil {
+		return fmt.Errorf("updating user: %w", err)
 	}
 
 	return nil
 }
 
 func (kc *keycloakProvider) GetUsersAndMemberships(ctx context.Context, filter string) ([]*gocloak.User, map[string][]string, error) {
-	users, err := kc.client.GetUsers(ctx, kc.token.AccessToken, kc.realm, gocloak.GetUsersParams{
-		Search: utils.StrPtr(filter),
-	})
+	users, err := kc.listUsers(ctx, filter)
 	if err != nil {
-		return nil, nil, fmt.Errorf("getting users: %w", err)
+		return nil, nil, err
 	}
 
+	// User listings leave the groups out, so they are read per user.
 	memberships := make(map[string][]string)
 	for _, u := range users {
-		memberships[*u.ID] = *u.Groups
+		groups, err := kc.userGroups(ctx, *u.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		memberships[*u.ID] = groups
 	}
 
 	return users, memberships, nil
 }
 
 func (kc *keycloakProvider) Sync(ctx context.Context, users []map[string]any) (add, remove, update []map[string]any, retErr error) {
-	sourceUsers, err := kc.GetUsers(ctx)
+	sourceUsers, err := kc.GetUsers(ctx, utils.ListOptions{})
 	if err != nil {
 		retErr = err
 		return
@@ -150,6 +325,28 @@ func (kc *keycloakProvider) Sync(ctx context.Context, users []map[string]any) (a
 	return kc.BaseConfig.CompareUsers(sourceUsers, users, kc.BaseConfig.Mapping["id"])
 }
 
+// adminGet reads from the admin API of the realm, for the calls gocloak lacks.
+func (kc *keycloakProvider) adminGet(ctx context.Context, path string, query url.Values, out any) error {
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := kc.client.RestyClient().R().
+		SetContext(ctx).
+		SetAuthToken(token).
+		SetQueryParamsFromValues(query).
+		SetResult(out).
+		Get(fmt.Sprintf("%s/admin/realms/%s/%s", kc.url, kc.realm, path))
+	if err != nil {
+		return err
+	} else if resp.IsError() {
+		return fmt.Errorf("%s", resp.Status())
+	}
+
+	return nil
+}
+
 func MapToUser(user map[string]any) (*gocloak.User, error) {
 	bs, err := json.Marshal(user)
 	if err != nil {
@@ -0,0 +1,336 @@
+package keycloak
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+)
+
+// roleScope is a realm role, or a client role when Client is set, mapped to
+// users or, with Groups set, to groups.
+type roleScope struct {
+	Client string
+	Role   string
+	Groups bool
+}
+
+// roleMapping is a role mapped to a principal, which is the key of a user or
+// the path of a group.
+type roleMapping struct {
+	roleScope
+	Principal string
+}
+
+func (s roleScope) with(principal string) roleMapping {
+	return roleMapping{roleScope: s, Principal: principal}
+}
+
+func (m roleMapping) key() string {
+	container := "realm"
+	if m.Client != "" {
+		container = m.Client
+	}
+
+	kind := "user"
+	if m.Groups {
+		kind = "group"
+	}
+
+	return fmt.Sprintf("%s/%s/%s:%s", container, m.Role, kind, m.Principal)
+}
+
+func (m roleMapping) object() map[string]any {
+	obj := map[string]any{"role": m.Role}
+	if m.Client != "" {
+		obj["client"] = m.Client
+	}
+
+	if m.Groups {
+		obj["group"] = m.Principal
+	} else {
+		obj["user"] = m.Principal
+	}
+	return obj
+}
+
+func sortedMappings(set map[roleMapping]bool) []roleMapping {
+	list := make([]roleMapping, 0, len(set))
+	for m := range set {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].key() < list[j].key() })
+
+	return list
+}
+
+// role is a role of the realm or of a client, with the internal id of the client.
+type role struct {
+	gocloak.Role
+	clientID string
+}
+
+// desiredMappings returns the principals every managed role should be mapped to.
+func (kc *keycloakProvider) desiredMappings(source []map[string]any) map[roleMapping]bool {
+	field := kc.BaseConfig.Mapping["id"]
+
+	desired := make(map[roleMapping]bool)
+	for _, cfg := range kc.roles {
+		scope := roleScope{Client: cfg.Client, Role: cfg.Role, Groups: cfg.BindGroups}
+
+		paths := make([]string, 0, len(cfg.Groups))
+		for _, group := range cfg.Groups {
+			paths = append(paths, groupPath(group))
+		}
+
+		if cfg.BindGroups {
+			for _, path := range paths {
+				if !kc.ignoredGroup(path) {
+					desired[scope.with(path)] = true
+				}
+			}
+			continue
+		}
+
+		for _, u := range source {
+			key := config.KeyOf(u, field)
+			if slices.Contains(kc.BaseConfig.IgnoreUsers, key) {
+				continue
+			}
+
+			if slices.ContainsFunc(kc.sourceGroups(u), func(path string) bool { return slices.Contains(paths, path) }) {
+				desired[scope.with(key)] = true
+			}
+		}
+	}
+
+	return desired
+}
+
+// planRoles maps the declared roles to exactly the desired users and groups.
+// Mappings of other roles are left alone.
+func (kc *keycloakProvider) planRoles(ctx context.Context, plan *engine.Plan, source []map[string]any) error {
+	desired := kc.desiredMappings(source)
+
+	roles := make(map[roleScope]role)
+	current := make(map[roleMapping]bool)
+	clients := make(map[string]string)
+	for _, cfg := range kc.roles {
+		scope := roleScope{Client: cfg.Client, Role: cfg.Role, Groups: cfg.BindGroups}
+		if _, ok := roles[scope]; ok {
+			continue
+		}
+
+		r, err := kc.getRole(ctx, clients, cfg.Client, cfg.Role)
+		if err != nil {
+			return err
+		}
+		roles[scope] = r
+
+		holders, err := kc.roleHolders(ctx, r, scope)
+		if err != nil {
+			return err
+		}
+
+		for _, principal := range holders {
+			current[scope.with(principal)] = true
+		}
+	}
+
+	for _, m := range sortedMappings(desired) {
+		m := m
+		if !current[m] {
+			r := roles[m.roleScope]
+			plan.Add(engine.OperationGrant, m.key(), m.object(), func(ctx context.Context) error {
+				return kc.grantRole(ctx, r, m)
+			})
+		}
+	}
+
+	for _, m := range sortedMappings(current) {
+		m := m
+		if !desired[m] {
+			r := roles[m.roleScope]
+			plan.Add(engine.OperationRevoke, m.key(), m.object(), func(ctx context.Context) error {
+				return kc.revokeRole(ctx, r, m)
+			})
+		}
+	}
+
+	return nil
+}
+
+// getRole looks up a realm role, or the role of the client with the given
+// clientId. The internal ids of the clients are cached in clients.
+func (kc *keycloakProvider) getRole(ctx context.Context, clients map[string]string, client, name string) (role, error) {
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return role{}, err
+	}
+
+	if client == "" {
+		r, err := kc.client.GetRealmRole(ctx, token, kc.realm, name)
+		if err != nil {
+			return role{}, fmt.Errorf("getting realm role %s: %w", name, err)
+		}
+
+		return role{Role: *r}, nil
+	}
+
+	id, ok := clients[client]
+	if !ok {
+		found, err := kc.client.GetClients(ctx, token, kc.realm, gocloak.GetClientsParams{
+			ClientID: gocloak.StringP(client),
+		})
+		if err != nil {
+			return role{}, fmt.Errorf("getting client %s: %w", client, err)
+		} else if len(found) == 0 {
+			return role{}, fmt.Errorf("client %s not found", client)
+		}
+
+		id = *found[0].ID
+		clients[client] = id
+	}
+
+	r, err := kc.client.GetClientRole(ctx, token, kc.realm, id, name)
+	if err != nil {
+		return role{}, fmt.Errorf("getting role %s of client %s: %w", name, client, err)
+	}
+
+	return role{Role: *r, clientID: id}, nil
+}
+
+// roleHolders returns the principals a role is directly mapped to, leaving
+// out ignored users and groups.
+func (kc *keycloakProvider) roleHolders(ctx context.Context, r role, scope roleScope) ([]string, error) {
+	holders := make([]string, 0)
+
+	if scope.Groups {
+		token, err := kc.session.token(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var groups []*gocloak.Group
+		if r.clientID == "" {
+			groups, err = kc.client.GetGroupsByRole(ctx, token, kc.realm, scope.Role)
+		} else {
+			groups, err = kc.client.GetGroupsByClientRole(ctx, token, kc.realm, scope.Role, r.clientID)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("getting groups with role %s: %w", scope.Role, err)
+		}
+
+		for _, g := range groups {
+			if g.Path != nil && !kc.ignoredGroup(*g.Path) {
+				holders = append(holders, *g.Path)
+			}
+		}
+		return holders, nil
+	}
+
+	field := kc.BaseConfig.Mapping["id"]
+	for first := 0; ; first += userPageSize {
+		params := gocloak.GetUsersByRoleParams{First: gocloak.IntP(first), Max: gocloak.IntP(userPageSize)}
+
+		token, err := kc.session.token(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var page []*gocloak.User
+		if r.clientID == "" {
+			page, err = kc.client.GetUsersByRoleName(ctx, token, kc.realm, scope.Role, params)
+		} else {
+			page, err = kc.client.GetUsersByClientRoleName(ctx, token, kc.realm, r.clientID, scope.Role, params)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("getting users with role %s: %w", scope.Role, err)
+		}
+
+		users, err := kc.BaseConfig.ConvertUsers(page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, u := range users {
+			if key := config.KeyOf(u, field); !slices.Contains(kc.BaseConfig.IgnoreUsers, key) {
+				holders = append(holders, key)
+			}
+		}
+
+		if len(page) < userPageSize {
+			return holders, nil
+		}
+	}
+}
+
+// principalID returns the Keycloak id of the user or group of a mapping.
+func (kc *keycloakProvider) principalID(ctx context.Context, m roleMapping) (string, error) {
+	if m.Groups {
+		return kc.findGroup(ctx, m.Principal)
+	}
+	return kc.findUser(ctx, m.Principal)
+}
+
+func (kc *keycloakProvider) grantRole(ctx context.Context, r role, m roleMapping) error {
+	id, err := kc.principalID(ctx, m)
+	if err != nil {
+		return err
+	}
+
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	roles := []gocloak.Role{r.Role}
+	switch {
+	case r.clientID == "" && m.Groups:
+		err = kc.client.AddRealmRoleToGroup(ctx, token, kc.realm, id, roles)
+	case r.clientID == "":
+		err = kc.client.AddRealmRoleToUser(ctx, token, kc.realm, id, roles)
+	case m.Groups:
+		err = kc.client.AddClientRolesToGroup(ctx, token, kc.realm, r.clientID, id, roles)
+	default:
+		err = kc.client.AddClientRolesToUser(ctx, token, kc.realm, r.clientID, id, roles)
+	}
+	if err != nil {
+		return fmt.Errorf("granting %s: %w", m.key(), err)
+	}
+
+	return nil
+}
+
+func (kc *keycloakProvider) revokeRole(ctx context.Context, r role, m roleMapping) error {
+	id, err := kc.principalID(ctx, m)
+	if err != nil {
+		return err
+	}
+
+	token, err := kc.session.token(ctx)
+	if err != nil {
+		return err
+	}
+
+	roles := []gocloak.Role{r.Role}
+	switch {
+	case r.clientID == "" && m.Groups:
+		err = kc.client.DeleteRealmRoleFromGroup(ctx, token, kc.realm, id, roles)
+	case r.clientID == "":
+		err = kc.client.DeleteRealmRoleFromUser(ctx, token, kc.realm, id, roles)
+	case m.Groups:
+		err = kc.client.DeleteClientRoleFromGroup(ctx, token, kc.realm, r.clientID, id, roles)
+	default:
+		err = kc.client.DeleteClientRolesFromUser(ctx, token, kc.realm, r.clientID, id, roles)
+	}
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("revoking %s: %w", m.key(), err)
+	}
+
+	return nil
+}
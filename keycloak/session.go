@@ -0,0 +1,155 @@
+package keycloak
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	// tokenMargin is how long before they expire tokens are renewed, so they
+	// do not expire in flight.
+	tokenMargin = 30 * time.Second
+	// adminClientID is the public client users log in to the admin API with.
+	adminClientID = "admin-cli"
+	tokenEndpoint = "/protocol/openid-connect/token"
+)
+
+// session keeps the provider logged in. The access token is refreshed before
+// it expires, and the provider logs in again once the refresh token expired
+// too or when a request is rejected as unauthorized.
+type session struct {
+	client *gocloak.GoCloak
+	// realm is the realm logged in to, which can differ from the managed one.
+	realm        string
+	clientID     string
+	clientSecret string
+	// Without a username the client logs in with its service account.
+	username string
+	password string
+
+	mu               sync.Mutex
+	jwt              *gocloak.JWT
+	expiresAt        time.Time
+	refreshExpiresAt time.Time
+}
+
+// token returns a valid access token, renewing it when it is about to expire.
+func (s *session) token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.jwt != nil && now.Before(s.expiresAt.Add(-tokenMargin)) {
+		return s.jwt.AccessToken, nil
+	}
+
+	// A refresh token without an expiry is an offline token.
+	refreshable := s.jwt != nil && s.jwt.RefreshToken != "" &&
+		(s.jwt.RefreshExpiresIn == 0 || now.Before(s.refreshExpiresAt.Add(-tokenMargin)))
+	if refreshable {
+		if err := s.refresh(ctx); err == nil {
+			return s.jwt.AccessToken, nil
+		}
+	}
+
+	if err := s.login(ctx); err != nil {
+		return "", err
+	}
+
+	return s.jwt.AccessToken, nil
+}
+
+// reject drops the access token after a request was rejected with it, so
+// that the next one is renewed. Tokens renewed in the meantime are kept.
+func (s *session) reject(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.jwt != nil && s.jwt.AccessToken == token {
+		s.expiresAt = time.Time{}
+	}
+}
+
+func (s *session) login(ctx context.Context) error {
+	opts := gocloak.TokenOptions{ClientID: gocloak.StringP(s.clientID)}
+	if s.clientSecret != "" {
+		opts.ClientSecret = gocloak.StringP(s.clientSecret)
+	}
+
+	if s.username != "" {
+		opts.GrantType = gocloak.StringP("password")
+		opts.Username = gocloak.StringP(s.username)
+		opts.Password = gocloak.StringP(s.password)
+	} else {
+		opts.GrantType = gocloak.StringP("client_credentials")
+	}
+
+	jwt, err := s.client.GetToken(ctx, s.realm, opts)
+	if err != nil {
+		return fmt.Errorf("logging in to realm %s as %s: %w", s.realm, s.principal(), err)
+	}
+
+	s.set(jwt)
+	return nil
+}
+
+func (s *session) refresh(ctx context.Context) error {
+	opts := gocloak.TokenOptions{
+		ClientID:     gocloak.StringP(s.clientID),
+		GrantType:    gocloak.StringP("refresh_token"),
+		RefreshToken: gocloak.StringP(s.jwt.RefreshToken),
+	}
+	if s.clientSecret != "" {
+		opts.ClientSecret = gocloak.StringP(s.clientSecret)
+	}
+
+	jwt, err := s.client.GetToken(ctx, s.realm, opts)
+	if err != nil {
+		return err
+	}
+
+	s.set(jwt)
+	return nil
+}
+
+func (s *session) set(jwt *gocloak.JWT) {
+	now := time.Now()
+	s.jwt = jwt
+	s.expiresAt = now.Add(time.Duration(jwt.ExpiresIn) * time.Second)
+	s.refreshExpiresAt = now.Add(time.Duration(jwt.RefreshExpiresIn) * time.Second)
+}
+
+func (s *session) principal() string {
+	if s.username != "" {
+		return s.username
+	}
+	return s.clientID
+}
+
+// retryUnauthorized makes the client retry a request once when its token is
+// rejected, e.g. because the session was revoked, with a renewed token.
+func (s *session) retryUnauthorized(client *resty.Client) {
+	client.
+		SetRetryCount(1).
+		AddRetryCondition(func(resp *resty.Response, err error) bool {
+			return resp != nil && resp.StatusCode() == http.StatusUnauthorized &&
+				!strings.HasSuffix(resp.Request.URL, tokenEndpoint)
+		}).
+		AddRetryHook(func(resp *resty.Response, err error) {
+			if resp == nil || resp.StatusCode() != http.StatusUnauthorized {
+				return
+			}
+
+			s.reject(resp.Request.Token)
+			if token, err := s.token(resp.Request.Context()); err == nil {
+				resp.Request.SetAuthToken(token)
+			}
+		})
+}
@@ -0,0 +1,405 @@
+package ldap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/utils"
+)
+
+const (
+	defaultADUserFilter  = "(&(objectCategory=person)(objectClass=user))"
+	defaultADGroupFilter = "(objectClass=group)"
+	defaultKeyAttribute  = "objectGUID"
+
+	// matchingRuleInChain is LDAP_MATCHING_RULE_IN_CHAIN, which matches
+	// through nested group memberships.
+	matchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+	// accountDisabled is the ACCOUNTDISABLE flag of userAccountControl.
+	accountDisabled = 0x2
+
+	// enabledAttribute is derived from userAccountControl.
+	enabledAttribute = "enabled"
+
+	// unixEpochOffset is the number of seconds from 1601-01-01, the epoch of
+	// the 100ns intervals accountExpires counts, to the Unix epoch.
+	unixEpochOffset = 11644473600
+)
+
+// adProvider reads Active Directory. objectGUID and objectSid are decoded into
+// their string forms, accountExpires into an RFC 3339 time, and enabled is
+// derived from the disabled bit of userAccountControl.
+type adProvider struct {
+	*ldapProvider
+
+	keyAttribute string
+	nested       bool
+}
+
+func NewADProvider(ctx context.Context, cfg *config.ADConfig) (*adProvider, error) {
+	dial, err := NewDialer(&cfg.LdapConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewADProviderWithDialer(cfg, dial)
+}
+
+// NewADProviderWithDialer connects through dial instead of the configured URL.
+func NewADProviderWithDialer(cfg *config.ADConfig, dial Dialer) (*adProvider, error) {
+	lp, err := newProvider(&cfg.LdapConfig, dial, defaultADUserFilter, defaultADGroupFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	keyAttribute := cfg.KeyAttribute
+	if keyAttribute == "" {
+		keyAttribute = defaultKeyAttribute
+	}
+
+	return &adProvider{
+		ldapProvider: lp,
+		keyAttribute: keyAttribute,
+		nested:       cfg.NestedGroups,
+	}, nil
+}
+
+// userAttributes are the mapped attributes, without the derived ones, and the
+// attributes needed for keys and status.
+func (ad *adProvider) userAttributes() []string {
+	attrs := slices.DeleteFunc(ad.ldapProvider.userAttributes(), func(attr string) bool {
+		return attr == enabledAttribute
+	})
+
+	for _, attr := range []string{"userAccountControl", ad.keyAttribute} {
+		if !slices.Contains(attrs, attr) {
+			attrs = append(attrs, attr)
+		}
+	}
+
+	return attrs
+}
+
+// GetUsers returns the user entries. The filter in the list options is an
+// LDAP filter combined with the configured one.
+func (ad *adProvider) GetUsers(ctx context.Context, lo utils.ListOptions) ([]*ldap.Entry, error) {
+	conn, err := ad.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return ad.getUsers(conn, lo)
+}
+
+func (ad *adProvider) getUsers(conn Conn, lo utils.ListOptions) ([]*ldap.Entry, error) {
+	filter := ad.cfg.UserFilter
+	if lo.Filter != nil {
+		filter = fmt.Sprintf("(&%s%s)", filter, *lo.Filter)
+	}
+
+	return ad.search(conn, ad.cfg.UserBaseDN, filter, ad.userAttributes())
+}
+
+// memberships resolves group names by user DN. Nested memberships are found
+// with one in-chain search per group.
+func (ad *adProvider) memberships(conn Conn, users, groups []*ldap.Entry) (map[string][]string, error) {
+	if !ad.nested {
+		return ad.ldapProvider.memberships(users, groups), nil
+	}
+
+	memberships := make(map[string][]string)
+	for _, group := range groups {
+		name := group.GetAttributeValue(groupNameAttribute)
+		filter := fmt.Sprintf("(&%s(memberOf:%s:=%s))", ad.cfg.UserFilter, matchingRuleInChain, ldap.EscapeFilter(group.DN))
+
+		members, err := ad.search(conn, ad.cfg.UserBaseDN, filter, []string{noAttributes})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, member := range members {
+			memberships[normalizeDN(member.DN)] = append(memberships[normalizeDN(member.DN)], name)
+		}
+	}
+
+	return memberships, nil
+}
+
+// adAttributes flattens an entry, decoding the AD specific attributes.
+func (ad *adProvider) adAttributes(entry *ldap.Entry) (map[string]any, error) {
+	attrs := entryAttributes(entry, ad.userAttributes())
+
+	if raw := entry.GetEqualFoldRawAttributeValue("objectGUID"); len(raw) > 0 {
+		guid, err := formatGUID(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.DN, err)
+		}
+		attrs["objectGUID"] = guid
+	}
+
+	if raw := entry.GetEqualFoldRawAttributeValue("objectSid"); len(raw) > 0 {
+		sid, err := formatSID(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.DN, err)
+		}
+		attrs["objectSid"] = sid
+	}
+
+	if val := entry.GetEqualFoldAttributeValue("accountExpires"); val != "" {
+		expires, err := formatAccountExpires(val)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.DN, err)
+		}
+		attrs["accountExpires"] = expires
+	}
+
+	uac, err := userAccountControl(entry)
+	if err != nil {
+		return nil, err
+	}
+	attrs[enabledAttribute] = uac&accountDisabled == 0
+
+	return attrs, nil
+}
+
+func userAccountControl(entry *ldap.Entry) (int64, error) {
+	val := entry.GetEqualFoldAttributeValue("userAccountControl")
+	if val == "" {
+		return 0, nil
+	}
+
+	uac, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid userAccountControl %s", entry.DN, val)
+	}
+
+	return uac, nil
+}
+
+// formatGUID renders an objectGUID, whose first three fields are little endian.
+func formatGUID(raw []byte) (string, error) {
+	if len(raw) != 16 {
+		return "", fmt.Errorf("invalid objectGUID of %d bytes", len(raw))
+	}
+
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(raw[0:4]),
+		binary.LittleEndian.Uint16(raw[4:6]),
+		binary.LittleEndian.Uint16(raw[6:8]),
+		raw[8:10],
+		raw[10:16],
+	), nil
+}
+
+// formatSID renders an objectSid as S-1-5-21-...
+func formatSID(raw []byte) (string, error) {
+	if len(raw) < 8 || len(raw) != 8+4*int(raw[1]) {
+		return "", fmt.Errorf("invalid objectSid of %d bytes", len(raw))
+	}
+
+	// The identifier authority is a 48 bit big endian number.
+	authority := uint64(0)
+	for _, b := range raw[2:8] {
+		authority = authority<<8 | uint64(b)
+	}
+
+	var sid strings.Builder
+	fmt.Fprintf(&sid, "S-%d-%d", raw[0], authority)
+	for i := 0; i < int(raw[1]); i++ {
+		fmt.Fprintf(&sid, "-%d", binary.LittleEndian.Uint32(raw[8+4*i:]))
+	}
+
+	return sid.String(), nil
+}
+
+// formatAccountExpires renders accountExpires as an RFC 3339 time, or an
+// empty string for accounts that never expire.
+func formatAccountExpires(val string) (string, error) {
+	intervals, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid accountExpires %s", val)
+	}
+
+	if intervals == 0 || intervals == math.MaxInt64 {
+		return "", nil
+	}
+
+	return time.Unix(intervals/1e7-unixEpochOffset, intervals%1e7*100).UTC().Format(time.RFC3339), nil
+}
+
+func (ad *adProvider) GetUsersConverted(ctx context.Context, lo utils.ListOptions) ([]map[string]any, error) {
+	conn, err := ad.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	users, err := ad.getUsers(conn, lo)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := ad.getGroups(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships, err := ad.memberships(conn, users, groups)
+	if err != nil {
+		return nil, err
+	}
+
+	convertedUsers := make([]map[string]any, 0, len(users))
+	for _, item := range users {
+		attrs, err := ad.adAttributes(item)
+		if err != nil {
+			return nil, err
+		}
+
+		user, err := ad.BaseConfig.ConvertUser(attrs)
+		if err != nil {
+			return nil, err
+		}
+
+		user[ad.BaseConfig.GroupField] = memberships[normalizeDN(item.DN)]
+		convertedUsers = append(convertedUsers, user)
+	}
+
+	return convertedUsers, nil
+}
+
+// Plan only deprovisions: accounts missing from the source are disabled and,
+// when they reappear, enabled again. Other changes are not planned.
+func (ad *adProvider) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
+	if !ad.BaseConfig.Deprovisioning.Suspends() {
+		return nil, errors.New("active directory accounts are disabled rather than deleted, use the suspend deprovisioning mode")
+	}
+
+	if ad.BaseConfig.Deprovisioning.GracePeriod > 0 {
+		return nil, errors.New("active directory accounts are never deleted, remove the deprovisioning grace period")
+	}
+
+	field, ok := ad.BaseConfig.Mapping[ad.keyAttribute]
+	if !ok {
+		return nil, fmt.Errorf("the %s attribute must be mapped", ad.keyAttribute)
+	}
+
+	conn, err := ad.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	users, err := ad.getUsers(conn, utils.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make([]map[string]any, 0, len(users))
+	for _, user := range users {
+		attr, err := ad.adAttributes(user)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+
+	current, err := ad.BaseConfig.ConvertUsers(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	_, toRemove, _, err := ad.BaseConfig.RawCompareUsers(current, source, field)
+	if err != nil {
+		return nil, err
+	}
+
+	dns := make(map[string]string)
+	disabled := make(map[string]bool)
+	for i, user := range users {
+		key := config.KeyOf(current[i], field)
+		dns[key] = user.DN
+		disabled[key] = !attrs[i][enabledAttribute].(bool)
+	}
+
+	plan := engine.NewPlan(fmt.Sprintf("ad/%s", ad.cfg.UserBaseDN))
+	plan.SetState(current, source, field)
+	for _, u := range toRemove {
+		key := config.KeyOf(u, field)
+		if disabled[key] {
+			continue
+		}
+
+		dn := dns[key]
+		plan.Add(engine.OperationSuspend, key, u, func(ctx context.Context) error {
+			return ad.setDisabled(ctx, dn, true)
+		})
+	}
+
+	for _, u := range source {
+		key := config.KeyOf(u, field)
+		if dn, ok := dns[key]; ok && disabled[key] {
+			plan.Add(engine.OperationReactivate, key, u, func(ctx context.Context) error {
+				return ad.setDisabled(ctx, dn, false)
+			})
+		}
+	}
+
+	return plan, nil
+}
+
+func (ad *adProvider) SyncProvider(ctx context.Context, source []map[string]any, opts ...engine.Option) (*engine.Result, error) {
+	plan, err := ad.Plan(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]engine.Option{engine.WithConfig(ad.BaseConfig)}, opts...)
+	return engine.Apply(ctx, plan, opts...)
+}
+
+// setDisabled flips the disabled bit of the account's current userAccountControl.
+func (ad *adProvider) setDisabled(ctx context.Context, dn string, disabled bool) error {
+	conn, err := ad.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	req := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"userAccountControl"}, nil)
+	res, err := conn.SearchWithPaging(req, ad.cfg.PageSize)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", dn, err)
+	}
+
+	if len(res.Entries) != 1 {
+		return fmt.Errorf("account %s not found", dn)
+	}
+
+	uac, err := userAccountControl(res.Entries[0])
+	if err != nil {
+		return err
+	}
+
+	if disabled {
+		uac |= accountDisabled
+	} else {
+		uac &^= accountDisabled
+	}
+
+	modify := ldap.NewModifyRequest(dn, nil)
+	modify.Replace("userAccountControl", []string{strconv.FormatInt(uac, 10)})
+	return conn.Modify(modify)
+}
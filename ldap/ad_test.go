@@ -0,0 +1,101 @@
+package ldap
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/state"
+	resolvers "github.com/tiagoposse/go-secret-resolvers"
+)
+
+const staffDN = "OU=Staff,DC=example,DC=org"
+
+// dontExpirePassword is another userAccountControl flag, which enabling and
+// disabling must keep.
+const dontExpirePassword = 0x10000
+
+func account(name string, uac int) *ldap.Entry {
+	return ldap.NewEntry(fmt.Sprintf("CN=%s,%s", ldap.EscapeDN(name), staffDN), map[string][]string{
+		"objectClass":        {"top", "person", "organizationalPerson", "user"},
+		"objectCategory":     {"person"},
+		"cn":                 {name},
+		"sAMAccountName":     {name},
+		"userAccountControl": {strconv.Itoa(uac)},
+	})
+}
+
+func TestPlanDisablesAndEnablesAccounts(t *testing.T) {
+	dir := newDirectory(
+		account("alice", 0x200),
+		account("bob", 0x200),
+		account("carol", 0x200|accountDisabled|dontExpirePassword),
+		account("dave", 0x200|accountDisabled),
+	)
+
+	password := adminPassword
+	ad, err := NewADProviderWithDialer(&config.ADConfig{
+		LdapConfig: config.LdapConfig{
+			BaseConfig: config.BaseConfig{
+				Mapping:        map[string]string{"sAMAccountName": "username"},
+				Deprovisioning: &config.DeprovisioningConfig{Mode: config.DeprovisionSuspend},
+			},
+			BindDN:       adminDN,
+			BindPassword: &resolvers.ResolverField{Value: &password},
+			UserBaseDN:   staffDN,
+			PageSize:     2,
+		},
+		KeyAttribute: "sAMAccountName",
+	}, dir.dial)
+	if err != nil {
+		t.Fatalf("creating provider: %v", err)
+	}
+
+	source := []map[string]any{{"username": "alice"}, {"username": "carol"}}
+	plan, err := ad.Plan(context.Background(), source)
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+
+	ids := make([]string, 0, len(plan.Operations))
+	for _, op := range plan.Operations {
+		ids = append(ids, op.ID())
+	}
+	if want := []string{"suspend:bob", "reactivate:carol"}; !slices.Equal(ids, want) {
+		t.Fatalf("planned %v, want %v", ids, want)
+	}
+
+	// carol was disabled by an earlier sync, so the engine has a record of it.
+	store, err := state.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("creating store: %v", err)
+	}
+	if err := state.PutJSON(context.Background(), store, fmt.Sprintf("deprovisioned/%s/carol", plan.Target), engine.Deprovisioned{SuspendedAt: time.Now()}); err != nil {
+		t.Fatalf("recording carol: %v", err)
+	}
+
+	if _, err := engine.Apply(context.Background(), plan, engine.WithStateStore(store)); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	for name, want := range map[string]int{
+		"alice": 0x200,
+		"bob":   0x200 | accountDisabled,
+		"carol": 0x200 | dontExpirePassword,
+		"dave":  0x200 | accountDisabled,
+	} {
+		if got := dir.entry(account(name, 0).DN).GetAttributeValue("userAccountControl"); got != strconv.Itoa(want) {
+			t.Errorf("userAccountControl of %s = %s, want %d", name, got, want)
+		}
+	}
+
+	if want := []string{"modify CN=bob," + staffDN, "modify CN=carol," + staffDN}; !slices.Equal(dir.writes, want) {
+		t.Errorf("writes = %v, want %v", dir.writes, want)
+	}
+}
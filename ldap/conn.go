@@ -0,0 +1,64 @@
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/tiagoposse/go-identity-sync/config"
+)
+
+// Conn is the part of *ldap.Conn the providers use, so that they can run
+// against an in-process stand-in of a directory.
+type Conn interface {
+	Bind(username, password string) error
+	SearchWithPaging(req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error)
+	Add(req *ldap.AddRequest) error
+	Modify(req *ldap.ModifyRequest) error
+	Del(req *ldap.DelRequest) error
+	Close() error
+}
+
+// Dialer opens an unauthenticated connection to the directory.
+type Dialer func(ctx context.Context) (Conn, error)
+
+// NewDialer dials the configured URL, upgrading plain connections with
+// StartTLS when asked to.
+func NewDialer(cfg *config.LdapConfig) (Dialer, error) {
+	u, err := url.Parse(cfg.Url)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ldap url: %w", err)
+	}
+
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, fmt.Errorf("unsupported ldap url scheme %s", u.Scheme)
+	}
+
+	if cfg.StartTLS && u.Scheme == "ldaps" {
+		return nil, errors.New("startTLS cannot be used with ldaps")
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	return func(ctx context.Context) (Conn, error) {
+		conn, err := ldap.DialURL(cfg.Url, ldap.DialWithTLSConfig(tlsConfig))
+		if err != nil {
+			return nil, fmt.Errorf("connecting to %s: %w", u.Host, err)
+		}
+
+		if cfg.StartTLS {
+			if err := conn.StartTLS(tlsConfig); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("starting tls: %w", err)
+			}
+		}
+
+		return conn, nil
+	}, nil
+}
@@ -0,0 +1,679 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/utils"
+)
+
+const (
+	defaultUserFilter      = "(objectClass=inetOrgPerson)"
+	defaultGroupFilter     = "(objectClass=groupOfNames)"
+	defaultMemberAttribute = "member"
+	defaultPageSize        = 500
+	defaultUserRDN         = "uid"
+
+	// groupNameAttribute names groups in the common group field.
+	groupNameAttribute = "cn"
+	memberOfAttribute  = "memberOf"
+	// noAttributes requests entries without any attribute, only their DN.
+	noAttributes = "1.1"
+)
+
+var (
+	defaultUserObjectClasses  = []string{"top", "person", "organizationalPerson", "inetOrgPerson"}
+	defaultGroupObjectClasses = []string{"top", "groupOfNames"}
+)
+
+type ldapProvider struct {
+	config.BaseConfig
+
+	cfg      config.LdapConfig
+	dial     Dialer
+	password string
+}
+
+func NewLdapProvider(ctx context.Context, cfg *config.LdapConfig) (*ldapProvider, error) {
+	dial, err := NewDialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewLdapProviderWithDialer(cfg, dial)
+}
+
+// NewLdapProviderWithDialer connects through dial instead of the configured
+// URL, e.g. to an in-process stand-in of the directory.
+func NewLdapProviderWithDialer(cfg *config.LdapConfig, dial Dialer) (*ldapProvider, error) {
+	if cfg.Deprovisioning.Suspends() {
+		return nil, errors.New("ldap entries cannot be suspended, use the delete deprovisioning mode")
+	}
+
+	return newProvider(cfg, dial, defaultUserFilter, defaultGroupFilter)
+}
+
+// newProvider applies the defaults shared by LDAP and Active Directory.
+func newProvider(cfg *config.LdapConfig, dial Dialer, userFilter, groupFilter string) (*ldapProvider, error) {
+	if cfg.UserBaseDN == "" {
+		return nil, errors.New("ldap requires a userBaseDN")
+	}
+
+	withDefaults := *cfg
+	if withDefaults.UserFilter == "" {
+		withDefaults.UserFilter = userFilter
+	}
+	if withDefaults.GroupFilter == "" {
+		withDefaults.GroupFilter = groupFilter
+	}
+	if withDefaults.GroupBaseDN == "" {
+		withDefaults.GroupBaseDN = withDefaults.UserBaseDN
+	}
+	if withDefaults.MemberAttribute == "" {
+		withDefaults.MemberAttribute = defaultMemberAttribute
+	}
+	if withDefaults.PageSize == 0 {
+		withDefaults.PageSize = defaultPageSize
+	}
+	if withDefaults.UserRDN == "" {
+		withDefaults.UserRDN = defaultUserRDN
+	}
+	if len(withDefaults.UserObjectClasses) == 0 {
+		withDefaults.UserObjectClasses = defaultUserObjectClasses
+	}
+	if len(withDefaults.GroupObjectClasses) == 0 {
+		withDefaults.GroupObjectClasses = defaultGroupObjectClasses
+	}
+
+	provider := &ldapProvider{
+		BaseConfig: cfg.BaseConfig,
+		cfg:        withDefaults,
+		dial:       dial,
+	}
+
+	if cfg.BindPassword != nil && cfg.BindPassword.Value != nil {
+		provider.password = *cfg.BindPassword.Value
+	}
+
+	return provider, nil
+}
+
+// connect opens a connection and binds as the configured DN, or stays
+// anonymous without one.
+func (lp *ldapProvider) connect(ctx context.Context) (Conn, error) {
+	conn, err := lp.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if lp.cfg.BindDN != "" {
+		if err := conn.Bind(lp.cfg.BindDN, lp.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("binding as %s: %w", lp.cfg.BindDN, err)
+		}
+	}
+
+	return conn, nil
+}
+
+// search returns every entry under base matching the filter, page by page.
+func (lp *ldapProvider) search(conn Conn, base, filter string, attrs []string) ([]*ldap.Entry, error) {
+	req := ldap.NewSearchRequest(base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, filter, attrs, nil)
+
+	res, err := conn.SearchWithPaging(req, lp.cfg.PageSize)
+	if err != nil {
+		return nil, fmt.Errorf("searching %s for %s: %w", base, filter, err)
+	}
+
+	return res.Entries, nil
+}
+
+// userAttributes are the attributes read from user entries: the mapped ones
+// and memberOf.
+func (lp *ldapProvider) userAttributes() []string {
+	attrs := []string{memberOfAttribute}
+	for attr := range lp.BaseConfig.Mapping {
+		if attr != "dn" && !slices.Contains(attrs, attr) {
+			attrs = append(attrs, attr)
+		}
+	}
+	sort.Strings(attrs)
+
+	return attrs
+}
+
+// GetUsers returns the user entries. The filter in the list options is an
+// LDAP filter combined with the configured one.
+func (lp *ldapProvider) GetUsers(ctx context.Context, lo utils.ListOptions) ([]*ldap.Entry, error) {
+	conn, err := lp.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return lp.getUsers(conn, lo)
+}
+
+func (lp *ldapProvider) getUsers(conn Conn, lo utils.ListOptions) ([]*ldap.Entry, error) {
+	filter := lp.cfg.UserFilter
+	if lo.Filter != nil {
+		filter = fmt.Sprintf("(&%s%s)", filter, *lo.Filter)
+	}
+
+	return lp.search(conn, lp.cfg.UserBaseDN, filter, lp.userAttributes())
+}
+
+func (lp *ldapProvider) GetGroups(ctx context.Context) ([]*ldap.Entry, error) {
+	conn, err := lp.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return lp.getGroups(conn)
+}
+
+func (lp *ldapProvider) getGroups(conn Conn) ([]*ldap.Entry, error) {
+	return lp.search(conn, lp.cfg.GroupBaseDN, lp.cfg.GroupFilter, []string{groupNameAttribute, lp.cfg.MemberAttribute})
+}
+
+// normalizeDN makes DNs comparable regardless of case and spacing.
+func normalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+
+	rdns := make([]string, 0, len(parsed.RDNs))
+	for _, rdn := range parsed.RDNs {
+		attrs := make([]string, 0, len(rdn.Attributes))
+		for _, attr := range rdn.Attributes {
+			attrs = append(attrs, strings.ToLower(attr.Type)+"="+strings.ToLower(attr.Value))
+		}
+		rdns = append(rdns, strings.Join(attrs, "+"))
+	}
+
+	return strings.Join(rdns, ",")
+}
+
+// memberships resolves the group names of every user, by normalized DN, from
+// both the groups' member attribute and the users' memberOf.
+func (lp *ldapProvider) memberships(users, groups []*ldap.Entry) map[string][]string {
+	names := make(map[string]string)
+	memberships := make(map[string][]string)
+	add := func(user, group string) {
+		if !slices.Contains(memberships[user], group) {
+			memberships[user] = append(memberships[user], group)
+		}
+	}
+
+	for _, group := range groups {
+		name := group.GetAttributeValue(groupNameAttribute)
+		names[normalizeDN(group.DN)] = name
+
+		for _, member := range group.GetEqualFoldAttributeValues(lp.cfg.MemberAttribute) {
+			add(normalizeDN(member), name)
+		}
+	}
+
+	for _, user := range users {
+		for _, groupDN := range user.GetEqualFoldAttributeValues(memberOfAttribute) {
+			if name, ok := names[normalizeDN(groupDN)]; ok {
+				add(normalizeDN(user.DN), name)
+			}
+		}
+	}
+
+	for user := range memberships {
+		sort.Strings(memberships[user])
+	}
+
+	return memberships
+}
+
+// entryAttributes flattens an entry into the attributes that can be mapped.
+// Attributes hold their first value, memberOf holds every group DN.
+func entryAttributes(entry *ldap.Entry, attrs []string) map[string]any {
+	res := map[string]any{"dn": entry.DN}
+	for _, attr := range attrs {
+		if attr == memberOfAttribute {
+			res[attr] = entry.GetEqualFoldAttributeValues(attr)
+		} else {
+			res[attr] = entry.GetEqualFoldAttributeValue(attr)
+		}
+	}
+
+	return res
+}
+
+func (lp *ldapProvider) GetUsersConverted(ctx context.Context, lo utils.ListOptions) ([]map[string]any, error) {
+	conn, err := lp.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	users, err := lp.getUsers(conn, lo)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := lp.getGroups(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships := lp.memberships(users, groups)
+	convertedUsers := make([]map[string]any, 0, len(users))
+	for _, item := range users {
+		user, err := lp.BaseConfig.ConvertUser(entryAttributes(item, lp.userAttributes()))
+		if err != nil {
+			return nil, err
+		}
+
+		user[lp.BaseConfig.GroupField] = memberships[normalizeDN(item.DN)]
+		convertedUsers = append(convertedUsers, user)
+	}
+
+	return convertedUsers, nil
+}
+
+// Plan keys users by the mapped field of the RDN attribute new entries are
+// named by. It needs writes to be enabled.
+func (lp *ldapProvider) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
+	if !lp.cfg.Write {
+		return nil, errors.New("the ldap provider is read-only, enable write to manage entries")
+	}
+
+	field, ok := lp.BaseConfig.Mapping[lp.cfg.UserRDN]
+	if !ok {
+		return nil, fmt.Errorf("the %s attribute must be mapped", lp.cfg.UserRDN)
+	}
+
+	conn, err := lp.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	users, err := lp.getUsers(conn, utils.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := lp.getGroups(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make([]map[string]any, 0, len(users))
+	for _, user := range users {
+		attrs = append(attrs, entryAttributes(user, lp.userAttributes()))
+	}
+
+	current, err := lp.BaseConfig.ConvertUsers(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	toAdd, toRemove, toUpdate, err := lp.BaseConfig.RawCompareUsers(current, source, field)
+	if err != nil {
+		return nil, err
+	}
+
+	dns := make(map[string]string)
+	names := make(map[string]string)
+	for i, user := range users {
+		key := config.KeyOf(current[i], field)
+		dns[key] = user.DN
+		names[normalizeDN(user.DN)] = key
+	}
+
+	plan := engine.NewPlan(fmt.Sprintf("ldap/%s", lp.cfg.UserBaseDN))
+	plan.SetState(current, source, field)
+	for _, u := range toAdd {
+		u := u
+		key := config.KeyOf(u, field)
+		plan.AddVerified(engine.OperationCreate, key, u, func(ctx context.Context) error {
+			return lp.createUser(ctx, u)
+		}, func(ctx context.Context) (bool, error) {
+			return lp.exists(ctx, lp.cfg.UserBaseDN, lp.userFilter(key))
+		})
+	}
+
+	for _, u := range toRemove {
+		dn := dns[config.KeyOf(u, field)]
+		plan.Add(engine.OperationDelete, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return lp.deleteEntry(ctx, dn)
+		})
+	}
+
+	for _, u := range toUpdate {
+		u := u
+		dn := dns[config.KeyOf(u, field)]
+		plan.Add(engine.OperationUpdate, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return lp.updateUser(ctx, dn, u)
+		})
+	}
+
+	lp.planGroups(plan, source, users, groups, names)
+	return plan, nil
+}
+
+// planGroups creates missing source groups with their members and syncs the
+// members of the groups source users are in. groupOfNames entries need at
+// least one member, so the groups no source user is in are deleted when
+// deleteGroups is set and left alone otherwise.
+func (lp *ldapProvider) planGroups(plan *engine.Plan, source []map[string]any, users, groups []*ldap.Entry, names map[string]string) {
+	field := lp.BaseConfig.Mapping[lp.cfg.UserRDN]
+
+	desired := make(map[string][]string)
+	for _, u := range source {
+		for _, group := range lp.BaseConfig.GroupsOf(u) {
+			if !slices.Contains(lp.BaseConfig.IgnoreGroups, group) {
+				desired[group] = append(desired[group], config.KeyOf(u, field))
+			}
+		}
+	}
+
+	current := make(map[string][]string)
+	// The DNs of the groups and of their members as read, by name and by
+	// membership key, so removals do not depend on the user still existing.
+	groupDNs := make(map[string]string)
+	memberDNs := make(map[string]string)
+	deleted := make([]string, 0)
+	for _, group := range groups {
+		name := group.GetAttributeValue(groupNameAttribute)
+		if slices.Contains(lp.BaseConfig.IgnoreGroups, name) {
+			continue
+		}
+
+		groupDNs[name] = group.DN
+		if _, ok := desired[name]; !ok {
+			if lp.cfg.DeleteGroups {
+				deleted = append(deleted, name)
+			}
+			continue
+		}
+
+		for _, member := range group.GetEqualFoldAttributeValues(lp.cfg.MemberAttribute) {
+			if key, ok := names[normalizeDN(member)]; ok {
+				current[name] = append(current[name], key)
+				memberDNs[engine.MembershipKey(name, key)] = member
+			}
+		}
+	}
+	sort.Strings(deleted)
+
+	missing := make([]string, 0)
+	for group := range desired {
+		if _, ok := groupDNs[group]; !ok {
+			missing = append(missing, group)
+		}
+	}
+	sort.Strings(missing)
+
+	for _, group := range missing {
+		group, members := group, desired[group]
+		plan.AddVerified(engine.OperationCreateGroup, group, map[string]any{"name": group}, func(ctx context.Context) error {
+			return lp.createGroup(ctx, group, members)
+		}, func(ctx context.Context) (bool, error) {
+			return lp.exists(ctx, lp.cfg.GroupBaseDN, lp.groupFilter(group))
+		})
+	}
+
+	// Members are added before they are removed, so a group never runs empty.
+	plan.AddMemberships(current, desired, lp.addMember, func(ctx context.Context, group, member string) error {
+		return lp.removeMember(ctx, groupDNs[group], memberDNs[engine.MembershipKey(group, member)])
+	})
+
+	for _, group := range deleted {
+		dn := groupDNs[group]
+		plan.Add(engine.OperationDeleteGroup, group, map[string]any{"name": group}, func(ctx context.Context) error {
+			return lp.deleteEntry(ctx, dn)
+		})
+	}
+}
+
+func (lp *ldapProvider) SyncProvider(ctx context.Context, source []map[string]any, opts ...engine.Option) (*engine.Result, error) {
+	plan, err := lp.Plan(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]engine.Option{engine.WithConfig(lp.BaseConfig)}, opts...)
+	return engine.Apply(ctx, plan, opts...)
+}
+
+func (lp *ldapProvider) userFilter(key string) string {
+	return fmt.Sprintf("(&%s(%s=%s))", lp.cfg.UserFilter, lp.cfg.UserRDN, ldap.EscapeFilter(key))
+}
+
+func (lp *ldapProvider) groupFilter(name string) string {
+	return fmt.Sprintf("(&%s(%s=%s))", lp.cfg.GroupFilter, groupNameAttribute, ldap.EscapeFilter(name))
+}
+
+func (lp *ldapProvider) exists(ctx context.Context, base, filter string) (bool, error) {
+	conn, err := lp.connect(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	entries, err := lp.search(conn, base, filter, []string{noAttributes})
+	if err != nil {
+		return false, err
+	}
+
+	return len(entries) > 0, nil
+}
+
+// findDN returns the DN of the single entry under base matching the filter.
+func (lp *ldapProvider) findDN(conn Conn, base, filter string) (string, error) {
+	entries, err := lp.search(conn, base, filter, []string{noAttributes})
+	if err != nil {
+		return "", err
+	}
+
+	if len(entries) != 1 {
+		return "", fmt.Errorf("expected one entry for %s under %s, found %d", filter, base, len(entries))
+	}
+
+	return entries[0].DN, nil
+}
+
+// values turns a mapped value into attribute values. Empty values clear the attribute.
+func values(val any) []string {
+	switch v := val.(type) {
+	case nil:
+		return nil
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []string:
+		return v
+	case []any:
+		res := make([]string, 0, len(v))
+		for _, item := range v {
+			res = append(res, fmt.Sprint(item))
+		}
+		return res
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// writableAttribute reports whether a mapped attribute is written to entries.
+// The DN and memberOf are maintained by the directory.
+func writableAttribute(attr string) bool {
+	return attr != "dn" && !strings.EqualFold(attr, memberOfAttribute)
+}
+
+func (lp *ldapProvider) createUser(ctx context.Context, u map[string]any) error {
+	mapped, err := lp.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return err
+	}
+
+	rdn := values(mapped[lp.cfg.UserRDN])
+	if len(rdn) == 0 {
+		return fmt.Errorf("user has no %s", lp.cfg.UserRDN)
+	}
+
+	req := ldap.NewAddRequest(fmt.Sprintf("%s=%s,%s", lp.cfg.UserRDN, ldap.EscapeDN(rdn[0]), lp.cfg.UserBaseDN), nil)
+	req.Attribute("objectClass", lp.cfg.UserObjectClasses)
+
+	attrs := make([]string, 0, len(mapped))
+	for attr := range mapped {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+
+	for _, attr := range attrs {
+		if vals := values(mapped[attr]); writableAttribute(attr) && len(vals) > 0 {
+			req.Attribute(attr, vals)
+		}
+	}
+
+	conn, err := lp.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Add(req)
+}
+
+// updateUser replaces every mapped attribute but the RDN. Replacing with no
+// values removes an attribute.
+func (lp *ldapProvider) updateUser(ctx context.Context, dn string, u map[string]any) error {
+	mapped, err := lp.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return err
+	}
+
+	attrs := make([]string, 0, len(mapped))
+	for attr := range mapped {
+		if writableAttribute(attr) && !strings.EqualFold(attr, lp.cfg.UserRDN) {
+			attrs = append(attrs, attr)
+		}
+	}
+	sort.Strings(attrs)
+
+	if len(attrs) == 0 {
+		return nil
+	}
+
+	req := ldap.NewModifyRequest(dn, nil)
+	for _, attr := range attrs {
+		req.Replace(attr, values(mapped[attr]))
+	}
+
+	conn, err := lp.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Modify(req)
+}
+
+func (lp *ldapProvider) deleteEntry(ctx context.Context, dn string) error {
+	conn, err := lp.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Del(ldap.NewDelRequest(dn, nil)); err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return err
+	}
+
+	return nil
+}
+
+// createGroup adds the group with its members, as groupOfNames needs at least one.
+func (lp *ldapProvider) createGroup(ctx context.Context, name string, members []string) error {
+	conn, err := lp.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	dns := make([]string, 0, len(members))
+	for _, member := range members {
+		dn, err := lp.findDN(conn, lp.cfg.UserBaseDN, lp.userFilter(member))
+		if err != nil {
+			return err
+		}
+		dns = append(dns, dn)
+	}
+
+	req := ldap.NewAddRequest(fmt.Sprintf("%s=%s,%s", groupNameAttribute, ldap.EscapeDN(name), lp.cfg.GroupBaseDN), nil)
+	req.Attribute("objectClass", lp.cfg.GroupObjectClasses)
+	req.Attribute(groupNameAttribute, []string{name})
+	if len(dns) > 0 {
+		req.Attribute(lp.cfg.MemberAttribute, dns)
+	}
+
+	return conn.Add(req)
+}
+
+// addMember resolves the group and the user by name when applied, so both may
+// have been created earlier in the same plan. It tolerates members that are
+// already present, such as the ones a group was created with.
+func (lp *ldapProvider) addMember(ctx context.Context, group, member string) error {
+	conn, err := lp.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	groupDN, err := lp.findDN(conn, lp.cfg.GroupBaseDN, lp.groupFilter(group))
+	if err != nil {
+		return err
+	}
+
+	userDN, err := lp.findDN(conn, lp.cfg.UserBaseDN, lp.userFilter(member))
+	if err != nil {
+		return err
+	}
+
+	req := ldap.NewModifyRequest(groupDN, nil)
+	req.Add(lp.cfg.MemberAttribute, []string{userDN})
+	err = conn.Modify(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultAttributeOrValueExists) {
+		return err
+	}
+
+	return nil
+}
+
+// removeMember deletes the member value read while planning rather than
+// looking the user up, as its entry may have been deleted earlier in the same
+// plan. Members that are already gone are tolerated.
+func (lp *ldapProvider) removeMember(ctx context.Context, groupDN, memberDN string) error {
+	conn, err := lp.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	req := ldap.NewModifyRequest(groupDN, nil)
+	req.Delete(lp.cfg.MemberAttribute, []string{memberDN})
+	err = conn.Modify(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchAttribute) {
+		return err
+	}
+
+	return nil
+}
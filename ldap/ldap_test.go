@@ -0,0 +1,586 @@
+package ldap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/utils"
+	resolvers "github.com/tiagoposse/go-secret-resolvers"
+)
+
+const (
+	adminDN       = "cn=admin,dc=example,dc=org"
+	adminPassword = "secret"
+	peopleDN      = "ou=people,dc=example,dc=org"
+	groupsDN      = "ou=groups,dc=example,dc=org"
+)
+
+// directory is an in-process LDAP server that keeps its entries in memory.
+// It speaks enough of the protocol for the providers: simple binds, paged
+// searches with and, or, not, equality and presence filters, and adds,
+// modifies and deletes by bound clients.
+type directory struct {
+	mu      sync.Mutex
+	entries []*ldap.Entry
+	// pages holds the page size of every paged search request.
+	pages []uint32
+	// writes holds every write request as the operation and the DN.
+	writes []string
+}
+
+func newDirectory(entries ...*ldap.Entry) *directory {
+	return &directory{entries: entries}
+}
+
+// dial connects a go-ldap client to the directory over an in-memory pipe.
+func (d *directory) dial(ctx context.Context) (Conn, error) {
+	client, server := net.Pipe()
+	go d.serve(server)
+
+	conn := ldap.NewConn(client, false)
+	conn.Start()
+	return conn, nil
+}
+
+func (d *directory) serve(conn net.Conn) {
+	defer conn.Close()
+
+	bound := false
+	for {
+		req, err := ber.ReadPacket(conn)
+		if err != nil || len(req.Children) < 2 {
+			return
+		}
+
+		id, op := req.Children[0].Value.(int64), req.Children[1]
+		var controls []*ber.Packet
+		if len(req.Children) > 2 {
+			controls = req.Children[2].Children
+		}
+
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationUnbindRequest:
+			return
+		case ldap.ApplicationBindRequest:
+			code := d.bind(op)
+			bound = code == ldap.LDAPResultSuccess
+			responses = []*ber.Packet{result(ldap.ApplicationBindResponse, code, "")}
+		case ldap.ApplicationSearchRequest:
+			responses = d.search(op, controls)
+		case ldap.ApplicationAddRequest, ldap.ApplicationModifyRequest, ldap.ApplicationDelRequest:
+			code := uint16(ldap.LDAPResultInsufficientAccessRights)
+			if bound {
+				code = d.write(op)
+			}
+			responses = []*ber.Packet{result(op.Tag+1, code, "")}
+		default:
+			responses = []*ber.Packet{result(op.Tag+1, ldap.LDAPResultUnwillingToPerform, "unsupported operation")}
+		}
+
+		for _, res := range responses {
+			msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+			msg.AppendChild(res.Children[0])
+			if len(res.Children) > 1 {
+				msg.AppendChild(res.Children[1])
+			}
+
+			if _, err := conn.Write(msg.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// result wraps an LDAPResult, and optionally its controls, for serve to send.
+func result(tag ber.Tag, code uint16, diagnostic string, controls ...ldap.Control) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(octets("", "Matched DN"))
+	op.AppendChild(octets(diagnostic, "Diagnostic Message"))
+
+	return response(op, controls...)
+}
+
+func response(op *ber.Packet, controls ...ldap.Control) *ber.Packet {
+	res := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Response")
+	res.AppendChild(op)
+	if len(controls) > 0 {
+		packet := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+		for _, control := range controls {
+			packet.AppendChild(control.Encode())
+		}
+		res.AppendChild(packet)
+	}
+
+	return res
+}
+
+func octets(val, description string) *ber.Packet {
+	return ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, val, description)
+}
+
+func (d *directory) bind(op *ber.Packet) uint16 {
+	if op.Children[1].Data.String() != adminDN || op.Children[2].Data.String() != adminPassword {
+		return ldap.LDAPResultInvalidCredentials
+	}
+
+	return ldap.LDAPResultSuccess
+}
+
+// find returns the entry with the DN, compared as the providers compare them.
+func (d *directory) find(dn string) (int, *ldap.Entry) {
+	for i, entry := range d.entries {
+		if normalizeDN(entry.DN) == normalizeDN(dn) {
+			return i, entry
+		}
+	}
+
+	return -1, nil
+}
+
+func (d *directory) entry(dn string) *ldap.Entry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, entry := d.find(dn)
+	return entry
+}
+
+func (d *directory) search(op *ber.Packet, controls []*ber.Packet) []*ber.Packet {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	base := normalizeDN(op.Children[0].Data.String())
+	scope := op.Children[1].Value.(int64)
+	filter := op.Children[6]
+
+	attrs := make([]string, 0, len(op.Children[7].Children))
+	for _, attr := range op.Children[7].Children {
+		attrs = append(attrs, attr.Data.String())
+	}
+
+	matched := make([]*ldap.Entry, 0)
+	for _, entry := range d.entries {
+		dn := normalizeDN(entry.DN)
+		if dn != base && (scope == ldap.ScopeBaseObject || !strings.HasSuffix(dn, ","+base)) {
+			continue
+		}
+
+		ok, err := matches(filter, entry)
+		if err != nil {
+			return []*ber.Packet{result(ldap.ApplicationSearchResultDone, ldap.LDAPResultUnwillingToPerform, err.Error())}
+		}
+		if ok {
+			matched = append(matched, entry)
+		}
+	}
+
+	if scope == ldap.ScopeBaseObject && len(matched) == 0 {
+		return []*ber.Packet{result(ldap.ApplicationSearchResultDone, ldap.LDAPResultNoSuchObject, "")}
+	}
+
+	var paging *ldap.ControlPaging
+	for _, packet := range controls {
+		if control, err := ldap.DecodeControl(packet); err == nil && control.GetControlType() == ldap.ControlTypePaging {
+			paging = control.(*ldap.ControlPaging)
+		}
+	}
+
+	var done []ldap.Control
+	if paging != nil {
+		d.pages = append(d.pages, paging.PagingSize)
+
+		offset, _ := strconv.Atoi(string(paging.Cookie))
+		end := min(offset+int(paging.PagingSize), len(matched))
+		next := ldap.NewControlPaging(paging.PagingSize)
+		if end < len(matched) {
+			next.SetCookie([]byte(strconv.Itoa(end)))
+		}
+
+		matched, done = matched[offset:end], []ldap.Control{next}
+	}
+
+	responses := make([]*ber.Packet, 0, len(matched)+1)
+	for _, entry := range matched {
+		responses = append(responses, response(entryPacket(entry, attrs)))
+	}
+
+	return append(responses, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, "", done...))
+}
+
+// entryPacket returns the requested attributes of an entry, every one when
+// none are requested and only the DN for 1.1.
+func entryPacket(entry *ldap.Entry, attrs []string) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	packet.AppendChild(octets(entry.DN, "Object Name"))
+
+	list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, attr := range entry.Attributes {
+		requested := len(attrs) == 0 || slices.ContainsFunc(attrs, func(name string) bool {
+			return strings.EqualFold(name, attr.Name)
+		})
+		if !requested || len(attr.Values) == 0 {
+			continue
+		}
+
+		item := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		item.AppendChild(octets(attr.Name, "Type"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, val := range attr.Values {
+			vals.AppendChild(octets(val, "Value"))
+		}
+		item.AppendChild(vals)
+		list.AppendChild(item)
+	}
+	packet.AppendChild(list)
+
+	return packet
+}
+
+func matches(filter *ber.Packet, entry *ldap.Entry) (bool, error) {
+	switch filter.Tag {
+	case ldap.FilterAnd, ldap.FilterOr:
+		for _, child := range filter.Children {
+			ok, err := matches(child, entry)
+			if err != nil {
+				return false, err
+			}
+			if ok == (filter.Tag == ldap.FilterOr) {
+				return ok, nil
+			}
+		}
+		return filter.Tag == ldap.FilterAnd, nil
+	case ldap.FilterNot:
+		ok, err := matches(filter.Children[0], entry)
+		return !ok, err
+	case ldap.FilterEqualityMatch:
+		val := filter.Children[1].Data.String()
+		return slices.ContainsFunc(entry.GetEqualFoldAttributeValues(filter.Children[0].Data.String()), func(v string) bool {
+			return strings.EqualFold(v, val)
+		}), nil
+	case ldap.FilterPresent:
+		return len(entry.GetEqualFoldAttributeValues(filter.Data.String())) > 0, nil
+	default:
+		return false, fmt.Errorf("unsupported filter %s", ldap.FilterMap[uint64(filter.Tag)])
+	}
+}
+
+// write applies an add, modify or delete request and returns its result code.
+func (d *directory) write(op *ber.Packet) uint16 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch op.Tag {
+	case ldap.ApplicationAddRequest:
+		dn := op.Children[0].Data.String()
+		d.writes = append(d.writes, "add "+dn)
+
+		attrs := make(map[string][]string)
+		for _, attr := range op.Children[1].Children {
+			name := attr.Children[0].Data.String()
+			for _, val := range attr.Children[1].Children {
+				attrs[name] = append(attrs[name], val.Data.String())
+			}
+		}
+		entry := ldap.NewEntry(dn, attrs)
+
+		parsed, err := ldap.ParseDN(dn)
+		if err != nil || len(parsed.RDNs) == 0 {
+			return ldap.LDAPResultInvalidDNSyntax
+		}
+
+		// The RDN must be one of the entry's values, as it names the entry.
+		rdn := parsed.RDNs[0].Attributes[0]
+		if !slices.Contains(entry.GetEqualFoldAttributeValues(rdn.Type), rdn.Value) {
+			return ldap.LDAPResultNamingViolation
+		}
+
+		if _, existing := d.find(dn); existing != nil {
+			return ldap.LDAPResultEntryAlreadyExists
+		}
+		d.entries = append(d.entries, entry)
+	case ldap.ApplicationModifyRequest:
+		dn := op.Children[0].Data.String()
+		d.writes = append(d.writes, "modify "+dn)
+
+		_, entry := d.find(dn)
+		if entry == nil {
+			return ldap.LDAPResultNoSuchObject
+		}
+
+		for _, change := range op.Children[1].Children {
+			kind := change.Children[0].Value.(int64)
+			name := change.Children[1].Children[0].Data.String()
+			vals := make([]string, 0)
+			for _, val := range change.Children[1].Children[1].Children {
+				vals = append(vals, val.Data.String())
+			}
+
+			if code := modify(entry, kind, name, vals); code != ldap.LDAPResultSuccess {
+				return code
+			}
+		}
+	case ldap.ApplicationDelRequest:
+		dn := op.Data.String()
+		d.writes = append(d.writes, "delete "+dn)
+
+		i, entry := d.find(dn)
+		if entry == nil {
+			return ldap.LDAPResultNoSuchObject
+		}
+		d.entries = slices.Delete(d.entries, i, i+1)
+	}
+
+	return ldap.LDAPResultSuccess
+}
+
+func modify(entry *ldap.Entry, kind int64, name string, vals []string) uint16 {
+	var attr *ldap.EntryAttribute
+	for _, existing := range entry.Attributes {
+		if strings.EqualFold(existing.Name, name) {
+			attr = existing
+		}
+	}
+	if attr == nil {
+		attr = ldap.NewEntryAttribute(name, nil)
+		entry.Attributes = append(entry.Attributes, attr)
+	}
+
+	switch kind {
+	case ldap.AddAttribute:
+		for _, val := range vals {
+			if slices.Contains(attr.Values, val) {
+				return ldap.LDAPResultAttributeOrValueExists
+			}
+			attr.Values = append(attr.Values, val)
+		}
+	case ldap.DeleteAttribute:
+		if len(vals) == 0 {
+			attr.Values = nil
+		}
+		for _, val := range vals {
+			i := slices.Index(attr.Values, val)
+			if i < 0 {
+				return ldap.LDAPResultNoSuchAttribute
+			}
+			attr.Values = slices.Delete(attr.Values, i, i+1)
+		}
+	case ldap.ReplaceAttribute:
+		attr.Values = vals
+	default:
+		return ldap.LDAPResultUnwillingToPerform
+	}
+
+	return ldap.LDAPResultSuccess
+}
+
+func person(uid string) *ldap.Entry {
+	return ldap.NewEntry(fmt.Sprintf("uid=%s,%s", ldap.EscapeDN(uid), peopleDN), map[string][]string{
+		"objectClass": defaultUserObjectClasses,
+		"uid":         {uid},
+		"cn":          {uid},
+	})
+}
+
+func group(cn string, members ...string) *ldap.Entry {
+	dns := make([]string, 0, len(members))
+	for _, member := range members {
+		dns = append(dns, person(member).DN)
+	}
+
+	return ldap.NewEntry(fmt.Sprintf("cn=%s,%s", ldap.EscapeDN(cn), groupsDN), map[string][]string{
+		"objectClass": defaultGroupObjectClasses,
+		"cn":          {cn},
+		"member":      dns,
+	})
+}
+
+func newTestProvider(t *testing.T, dir *directory, cfg config.LdapConfig) *ldapProvider {
+	password := adminPassword
+	cfg.BaseConfig.Mapping = map[string]string{"uid": "username", "cn": "name"}
+	cfg.BaseConfig.GroupField = "groups"
+	cfg.UserBaseDN, cfg.GroupBaseDN = peopleDN, groupsDN
+	cfg.BindDN, cfg.BindPassword = adminDN, &resolvers.ResolverField{Value: &password}
+
+	lp, err := NewLdapProviderWithDialer(&cfg, dir.dial)
+	if err != nil {
+		t.Fatalf("creating provider: %v", err)
+	}
+
+	return lp
+}
+
+func TestGetUsersPagesThroughResults(t *testing.T) {
+	dir := newDirectory(person("alice"), person("bob"), person("carol"), person("dave"), person("erin"), group("ops", "alice"))
+	lp := newTestProvider(t, dir, config.LdapConfig{PageSize: 2})
+
+	users, err := lp.GetUsers(context.Background(), utils.ListOptions{})
+	if err != nil {
+		t.Fatalf("GetUsers: %v", err)
+	}
+
+	uids := make([]string, 0, len(users))
+	for _, user := range users {
+		uids = append(uids, user.GetAttributeValue("uid"))
+	}
+	if want := []string{"alice", "bob", "carol", "dave", "erin"}; !slices.Equal(uids, want) {
+		t.Errorf("GetUsers = %v, want %v", uids, want)
+	}
+
+	if want := []uint32{2, 2, 2}; !slices.Equal(dir.pages, want) {
+		t.Errorf("searched with pages %v, want %v", dir.pages, want)
+	}
+}
+
+func TestGetUsersNeedsValidCredentials(t *testing.T) {
+	dir := newDirectory(person("alice"))
+	lp := newTestProvider(t, dir, config.LdapConfig{})
+	lp.password = "wrong"
+
+	_, err := lp.GetUsers(context.Background(), utils.ListOptions{})
+
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) || ldapErr.ResultCode != ldap.LDAPResultInvalidCredentials {
+		t.Errorf("GetUsers error = %v, want invalid credentials", err)
+	}
+}
+
+func TestPlanEscapesDNs(t *testing.T) {
+	dir := newDirectory(person("alice"), person("smith, anna"), group("ops", "alice"))
+	lp := newTestProvider(t, dir, config.LdapConfig{Write: true})
+
+	source := []map[string]any{
+		{"username": "alice", "name": "alice", "groups": []string{"ops"}},
+		{"username": "doe, john (jr)", "name": "John Doe", "groups": []string{"ops", "eu, west"}},
+	}
+
+	plan, err := lp.Plan(context.Background(), source)
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+
+	ids := make([]string, 0, len(plan.Operations))
+	for _, op := range plan.Operations {
+		ids = append(ids, op.ID())
+	}
+
+	want := []string{
+		"create:doe, john (jr)",
+		"delete:smith, anna",
+		"create-group:eu, west",
+		"add-member:eu, west/doe, john (jr)",
+		"add-member:ops/doe, john (jr)",
+	}
+	if !slices.Equal(ids, want) {
+		t.Fatalf("planned %v, want %v", ids, want)
+	}
+
+	res, err := engine.Apply(context.Background(), plan)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if got := res.Count(engine.StatusSucceeded); got != len(want) {
+		t.Errorf("%d operations succeeded, want %d", got, len(want))
+	}
+
+	john := `uid=doe\, john (jr),ou=people,dc=example,dc=org`
+	for _, write := range []string{
+		"add " + john,
+		`delete uid=smith\, anna,ou=people,dc=example,dc=org`,
+		`add cn=eu\, west,ou=groups,dc=example,dc=org`,
+		"modify cn=ops,ou=groups,dc=example,dc=org",
+	} {
+		if !slices.Contains(dir.writes, write) {
+			t.Errorf("%s was not requested, got %v", write, dir.writes)
+		}
+	}
+
+	if entry := dir.entry(john); entry == nil || entry.GetAttributeValue("cn") != "John Doe" {
+		t.Errorf("created entry = %+v, want John Doe", entry)
+	}
+
+	for _, name := range []string{"ops", "eu, west"} {
+		if members := dir.entry(group(name).DN).GetAttributeValues("member"); !slices.Contains(members, john) {
+			t.Errorf("members of %s = %v, want %s", name, members, john)
+		}
+	}
+}
+
+func TestPlanRemovesDeletedUsersFromGroups(t *testing.T) {
+	dir := newDirectory(person("alice"), person("bob"), group("ops", "alice", "bob"))
+	lp := newTestProvider(t, dir, config.LdapConfig{Write: true})
+
+	plan, err := lp.Plan(context.Background(), []map[string]any{
+		{"username": "alice", "name": "alice", "groups": []string{"ops"}},
+	})
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+
+	res, err := engine.Apply(context.Background(), plan)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if got := res.Count(engine.StatusSucceeded); got != 2 {
+		t.Errorf("%d operations succeeded, want the delete and the member removal", got)
+	}
+
+	if members := dir.entry(group("ops").DN).GetAttributeValues("member"); !slices.Equal(members, []string{person("alice").DN}) {
+		t.Errorf("members of ops = %v, want only alice", members)
+	}
+}
+
+func TestPlanLeavesOrDeletesGroupsWithoutSourceMembers(t *testing.T) {
+	tests := []struct {
+		deleteGroups bool
+		want         []string
+	}{
+		{deleteGroups: false, want: []string{"remove-member:ops/bob"}},
+		{deleteGroups: true, want: []string{"remove-member:ops/bob", "delete-group:legacy"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("deleteGroups=%v", tt.deleteGroups), func(t *testing.T) {
+			dir := newDirectory(person("alice"), person("bob"), group("ops", "alice", "bob"), group("legacy", "bob"))
+			lp := newTestProvider(t, dir, config.LdapConfig{Write: true, DeleteGroups: tt.deleteGroups})
+
+			plan, err := lp.Plan(context.Background(), []map[string]any{
+				{"username": "alice", "name": "alice", "groups": []string{"ops"}},
+				{"username": "bob", "name": "bob"},
+			})
+			if err != nil {
+				t.Fatalf("Plan: %v", err)
+			}
+
+			ids := make([]string, 0, len(plan.Operations))
+			for _, op := range plan.Operations {
+				ids = append(ids, op.ID())
+			}
+			if !slices.Equal(ids, tt.want) {
+				t.Fatalf("planned %v, want %v", ids, tt.want)
+			}
+
+			if _, err := engine.Apply(context.Background(), plan); err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+
+			legacy := dir.entry(group("legacy").DN)
+			if deleted := legacy == nil; deleted != tt.deleteGroups {
+				t.Errorf("legacy deleted = %v, want %v", deleted, tt.deleteGroups)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package lock
+
+import "errors"
+
+func newFileLocker(dir string) (Locker, error) {
+	return nil, errors.New("lock files need flock, which this platform does not have, use leases in the state store instead")
+}
@@ -0,0 +1,190 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fileCheckInterval is how often a held file lock checks that it was not
+// force unlocked.
+var fileCheckInterval = 10 * time.Second
+
+// FileLocker holds an flock on one file per key in a directory. The kernel
+// drops the lock when its holder exits, so there is no lease to renew or
+// expire, but every runner has to share the directory through a filesystem
+// where flock works across hosts, which rules out most network filesystems.
+type FileLocker struct {
+	dir   string
+	owner string
+}
+
+func NewFileLocker(dir string) (*FileLocker, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating lock directory: %w", err)
+	}
+
+	return &FileLocker{dir: dir, owner: ownerID()}, nil
+}
+
+func newFileLocker(dir string) (Locker, error) {
+	return NewFileLocker(dir)
+}
+
+func (l *FileLocker) path(key string) string {
+	return filepath.Join(l.dir, url.PathEscape(key)+".lock")
+}
+
+// Acquire locks the key's file without waiting for it. The holder's lease is
+// written into the file, so others can report who holds it.
+func (l *FileLocker) Acquire(ctx context.Context, key string) (Lock, error) {
+	path := l.path(key)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("acquiring lock %s: %w", key, err)
+		}
+
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); errors.Is(err, syscall.EWOULDBLOCK) {
+			var held Lease
+			_ = json.NewDecoder(f).Decode(&held)
+			f.Close()
+			return nil, &HeldError{Key: key, Lease: held}
+		} else if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("acquiring lock %s: %w", key, err)
+		}
+
+		// A force unlock may have removed the file between opening and
+		// locking it, in which case the lock guards nothing.
+		if current, err := sameFile(f, path); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("acquiring lock %s: %w", key, err)
+		} else if !current {
+			f.Close()
+			continue
+		}
+
+		lease := Lease{Owner: l.owner, Token: newToken(), AcquiredAt: time.Now()}
+		if err := writeLease(f, lease); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("acquiring lock %s: %w", key, err)
+		}
+
+		lk := &fileLock{
+			key:  key,
+			path: path,
+			f:    f,
+			lost: make(chan struct{}),
+			stop: make(chan struct{}),
+			done: make(chan struct{}),
+		}
+		go lk.watch()
+
+		return lk, nil
+	}
+}
+
+// ForceUnlock removes the key's file. The holder keeps its flock on the
+// removed file, notices it is gone and reports the lock as lost.
+func (l *FileLocker) ForceUnlock(ctx context.Context, key string) error {
+	if err := os.Remove(l.path(key)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("force unlocking %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// sameFile reports whether path still names the open file f.
+func sameFile(f *os.File, path string) (bool, error) {
+	held, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	named, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return os.SameFile(held, named), nil
+}
+
+func writeLease(f *os.File, lease Lease) error {
+	bs, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(bs, 0)
+	return err
+}
+
+type fileLock struct {
+	key  string
+	path string
+	f    *os.File
+
+	lost     chan struct{}
+	lostOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func (lk *fileLock) Lost() <-chan struct{} {
+	return lk.lost
+}
+
+// watch reports the lock as lost once its file was force unlocked, as
+// someone else can then lock a new file under the same name.
+func (lk *fileLock) watch() {
+	defer close(lk.done)
+
+	ticker := time.NewTicker(fileCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lk.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if current, err := sameFile(lk.f, lk.path); err == nil && !current {
+			lk.lostOnce.Do(func() { close(lk.lost) })
+			return
+		}
+	}
+}
+
+// Release closes the file, which drops the flock. The file is kept, so a
+// runner that opened it meanwhile locks the same file instead of a removed one.
+func (lk *fileLock) Release(ctx context.Context) error {
+	close(lk.stop)
+	<-lk.done
+
+	if err := lk.f.Close(); err != nil {
+		return fmt.Errorf("releasing lock %s: %w", lk.key, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package lock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+)
+
+func TestFileLocker(t *testing.T) {
+	fileCheckInterval = time.Millisecond
+	ctx := context.Background()
+
+	// Both runners share the directory, as separate processes would.
+	cfg := &config.LockConfig{Dir: t.TempDir()}
+	first, err := New(cfg, nil)
+	if err != nil {
+		t.Fatalf("creating locker: %v", err)
+	}
+	second, err := New(cfg, nil)
+	if err != nil {
+		t.Fatalf("creating locker: %v", err)
+	}
+
+	lk, err := first.Acquire(ctx, "github/acme")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	var held *HeldError
+	if _, err := second.Acquire(ctx, "github/acme"); !errors.As(err, &held) {
+		t.Fatalf("second Acquire error = %v, want a HeldError", err)
+	} else if held.Lease.Owner != first.(*FileLocker).owner {
+		t.Errorf("held by %q, want the first runner", held.Lease.Owner)
+	}
+
+	other, err := second.Acquire(ctx, "okta/acme")
+	if err != nil {
+		t.Fatalf("Acquire of another key: %v", err)
+	}
+	if err := other.Release(ctx); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	if err := lk.Release(ctx); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	lk, err = second.Acquire(ctx, "github/acme")
+	if err != nil {
+		t.Fatalf("Acquire after release: %v", err)
+	}
+
+	if err := first.ForceUnlock(ctx, "github/acme"); err != nil {
+		t.Fatalf("ForceUnlock: %v", err)
+	}
+
+	select {
+	case <-lk.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("lock was not lost after a force unlock")
+	}
+
+	taken, err := first.Acquire(ctx, "github/acme")
+	if err != nil {
+		t.Fatalf("Acquire after force unlock: %v", err)
+	}
+
+	for _, l := range []Lock{lk, taken} {
+		if err := l.Release(ctx); err != nil {
+			t.Fatalf("Release: %v", err)
+		}
+	}
+}
+
+func TestNewRequiresAStoreOrADirectory(t *testing.T) {
+	if _, err := New(&config.LockConfig{TTL: time.Minute}, nil); err == nil {
+		t.Error("New succeeded without a store or a directory, want an error")
+	}
+}
@@ -0,0 +1,339 @@
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/state"
+)
+
+const DefaultTTL = time.Minute
+
+// ErrLost is the cause an apply is cancelled with when its lock was lost.
+var ErrLost = errors.New("lock lost")
+
+// Lease is the record kept for a held lock.
+type Lease struct {
+	Owner string `json:"owner"`
+	// Token is unique to every acquisition, so a lease that was taken over
+	// and renewed is never mistaken for the one it replaced.
+	Token      string    `json:"token"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// HeldError is returned when someone else holds an unexpired lock, or an
+// expired one the store cannot take over atomically. Locks that do not expire,
+// such as file locks, have a zero ExpiresAt.
+type HeldError struct {
+	Key     string
+	Lease   Lease
+	Expired bool
+}
+
+func (e *HeldError) Error() string {
+	if e.Expired {
+		return fmt.Sprintf(
+			"%s is locked by %s since %s, the lease expired at %s but the state store cannot take it over safely, force unlock it if the holder is gone",
+			e.Key, e.Lease.Owner, e.Lease.AcquiredAt.Format(time.RFC3339), e.Lease.ExpiresAt.Format(time.RFC3339),
+		)
+	}
+
+	if e.Lease.ExpiresAt.IsZero() {
+		return fmt.Sprintf(
+			"%s is locked by %s since %s, force unlock it if the holder is gone",
+			e.Key, e.Lease.Owner, e.Lease.AcquiredAt.Format(time.RFC3339),
+		)
+	}
+
+	return fmt.Sprintf(
+		"%s is locked by %s since %s until %s, force unlock it if the holder is gone",
+		e.Key, e.Lease.Owner, e.Lease.AcquiredAt.Format(time.RFC3339), e.Lease.ExpiresAt.Format(time.RFC3339),
+	)
+}
+
+type Locker interface {
+	// Acquire takes the lock for key or returns a *HeldError.
+	Acquire(ctx context.Context, key string) (Lock, error)
+	// ForceUnlock releases the lock for key regardless of who holds it.
+	ForceUnlock(ctx context.Context, key string) error
+}
+
+type Lock interface {
+	// Lost is closed when the lock could not be renewed and may be held by someone else.
+	Lost() <-chan struct{}
+	Release(ctx context.Context) error
+}
+
+// LeaseLocker keeps locks as leases in a state store. Holders renew their
+// lease with a heartbeat, and a lease that outlives its TTL can be taken over.
+type LeaseLocker struct {
+	store state.Store
+	owner string
+	ttl   time.Duration
+}
+
+// NewLeaseLocker keeps leases in the given state store. A zero ttl uses DefaultTTL.
+func NewLeaseLocker(store state.Store, ttl time.Duration) *LeaseLocker {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	return &LeaseLocker{
+		store: store,
+		owner: ownerID(),
+		ttl:   ttl,
+	}
+}
+
+// New returns the locker the config asks for: a FileLocker when it sets a
+// directory, and leases in the given state store otherwise.
+func New(cfg *config.LockConfig, store state.Store) (Locker, error) {
+	if cfg != nil && cfg.Dir != "" {
+		return newFileLocker(cfg.Dir)
+	}
+
+	if store == nil {
+		return nil, errors.New("locking needs a state store or a lock directory")
+	}
+
+	var ttl time.Duration
+	if cfg != nil {
+		ttl = cfg.TTL
+	}
+
+	return NewLeaseLocker(store, ttl), nil
+}
+
+// ownerID identifies this process as a lock holder.
+func ownerID() string {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), hex.EncodeToString(suffix))
+}
+
+func newToken() string {
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+
+	return hex.EncodeToString(token)
+}
+
+func leaseKey(key string) string {
+	return fmt.Sprintf("locks/%s", key)
+}
+
+// Acquire creates the lease, or takes over an expired one by swapping it for
+// ours while it still holds the expired lease, so that of several runners
+// taking over the same lease only one wins. Stores that cannot create or swap
+// atomically cannot take over expired leases, which have to be force unlocked.
+func (l *LeaseLocker) Acquire(ctx context.Context, key string) (Lock, error) {
+	creator, ok := l.store.(state.Creator)
+	if !ok {
+		return nil, fmt.Errorf("acquiring lock %s: the state store cannot create keys atomically", key)
+	}
+
+	now := time.Now()
+	lease := Lease{
+		Owner:      l.owner,
+		Token:      newToken(),
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(l.ttl),
+	}
+
+	bs, err := json.Marshal(lease)
+	if err != nil {
+		return nil, err
+	}
+
+	// The second attempt runs after the lease was released meanwhile.
+	for attempt := 0; attempt < 2; attempt++ {
+		err := creator.Create(ctx, leaseKey(key), bs)
+		if err == nil {
+			return l.start(key, lease, bs), nil
+		} else if !errors.Is(err, state.ErrExists) {
+			return nil, fmt.Errorf("acquiring lock %s: %w", key, err)
+		}
+
+		raw, err := l.store.Get(ctx, leaseKey(key))
+		if errors.Is(err, state.ErrNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("acquiring lock %s: %w", key, err)
+		}
+
+		var held Lease
+		if err := json.Unmarshal(raw, &held); err != nil {
+			return nil, fmt.Errorf("acquiring lock %s: decoding lease: %w", key, err)
+		}
+
+		if time.Now().Before(held.ExpiresAt) {
+			return nil, &HeldError{Key: key, Lease: held}
+		}
+
+		swapper, ok := l.store.(state.Swapper)
+		if !ok {
+			return nil, &HeldError{Key: key, Lease: held, Expired: true}
+		}
+
+		err = swapper.CompareAndSwap(ctx, leaseKey(key), raw, bs)
+		if err == nil {
+			return l.start(key, lease, bs), nil
+		} else if errors.Is(err, state.ErrNotFound) {
+			continue
+		} else if !errors.Is(err, state.ErrConflict) {
+			return nil, fmt.Errorf("taking over expired lock %s: %w", key, err)
+		}
+
+		// Someone else took the expired lease over first.
+		if err := state.GetJSON(ctx, l.store, leaseKey(key), &held); err != nil {
+			return nil, fmt.Errorf("acquiring lock %s: taken by another holder", key)
+		}
+		return nil, &HeldError{Key: key, Lease: held}
+	}
+
+	return nil, fmt.Errorf("acquiring lock %s: taken by another holder", key)
+}
+
+func (l *LeaseLocker) ForceUnlock(ctx context.Context, key string) error {
+	return l.store.Delete(ctx, leaseKey(key))
+}
+
+func (l *LeaseLocker) start(key string, lease Lease, raw []byte) *leaseLock {
+	lk := &leaseLock{
+		locker: l,
+		key:    key,
+		lease:  lease,
+		raw:    raw,
+		lost:   make(chan struct{}),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go lk.heartbeat()
+	return lk
+}
+
+type leaseLock struct {
+	locker *LeaseLocker
+	key    string
+	lease  Lease
+	// raw is the lease as stored, which swaps are conditioned on.
+	raw []byte
+
+	lost     chan struct{}
+	lostOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func (lk *leaseLock) Lost() <-chan struct{} {
+	return lk.lost
+}
+
+// heartbeat renews the lease until the lock is released. The lock is lost
+// when someone else took the lease or it could not be renewed before expiring.
+func (lk *leaseLock) heartbeat() {
+	defer close(lk.done)
+
+	ticker := time.NewTicker(lk.locker.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lk.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), lk.locker.ttl/3)
+		err := lk.renew(ctx)
+		cancel()
+
+		if errors.Is(err, errNotOwner) || (err != nil && time.Now().After(lk.lease.ExpiresAt)) {
+			lk.lostOnce.Do(func() { close(lk.lost) })
+			return
+		}
+	}
+}
+
+var errNotOwner = errors.New("lease is held by someone else")
+
+// renew extends the lease if it is still ours. Stores that can swap only
+// replace the exact lease this holder wrote.
+func (lk *leaseLock) renew(ctx context.Context) error {
+	renewed := lk.lease
+	renewed.ExpiresAt = time.Now().Add(lk.locker.ttl)
+	bs, err := json.Marshal(renewed)
+	if err != nil {
+		return err
+	}
+
+	if swapper, ok := lk.locker.store.(state.Swapper); ok {
+		err := swapper.CompareAndSwap(ctx, leaseKey(lk.key), lk.raw, bs)
+		if errors.Is(err, state.ErrConflict) || errors.Is(err, state.ErrNotFound) {
+			return errNotOwner
+		} else if err != nil {
+			return err
+		}
+	} else {
+		if err := lk.owned(ctx); err != nil {
+			return err
+		}
+
+		if err := lk.locker.store.Put(ctx, leaseKey(lk.key), bs); err != nil {
+			return err
+		}
+	}
+
+	lk.lease, lk.raw = renewed, bs
+	return nil
+}
+
+// owned checks that the stored lease is still ours.
+func (lk *leaseLock) owned(ctx context.Context) error {
+	var current Lease
+	if err := state.GetJSON(ctx, lk.locker.store, leaseKey(lk.key), &current); errors.Is(err, state.ErrNotFound) {
+		return errNotOwner
+	} else if err != nil {
+		return err
+	}
+
+	if current.Token != lk.lease.Token {
+		return errNotOwner
+	}
+
+	return nil
+}
+
+// Release stops the heartbeat and removes the lease if it is still ours.
+func (lk *leaseLock) Release(ctx context.Context) error {
+	close(lk.stop)
+	<-lk.done
+
+	if swapper, ok := lk.locker.store.(state.Swapper); ok {
+		err := swapper.CompareAndSwap(ctx, leaseKey(lk.key), lk.raw, nil)
+		if err != nil && !errors.Is(err, state.ErrConflict) && !errors.Is(err, state.ErrNotFound) {
+			return fmt.Errorf("releasing lock %s: %w", lk.key, err)
+		}
+		return nil
+	}
+
+	if err := lk.owned(ctx); errors.Is(err, errNotOwner) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("releasing lock %s: %w", lk.key, err)
+	}
+
+	return lk.locker.store.Delete(ctx, leaseKey(lk.key))
+}
@@ -0,0 +1,215 @@
+package okta
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/okta/okta-sdk-golang/v2/okta"
+	"github.com/okta/okta-sdk-golang/v2/okta/query"
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+)
+
+// assignment is an application assigned to a user, by key, or to a group,
+// by name.
+type assignment struct {
+	App       string
+	Group     bool
+	Principal string
+}
+
+func (a assignment) key() string {
+	kind := "user"
+	if a.Group {
+		kind = "group"
+	}
+	return fmt.Sprintf("%s/%s:%s", a.App, kind, a.Principal)
+}
+
+func (a assignment) object() map[string]any {
+	obj := map[string]any{"app": a.App}
+	if a.Group {
+		obj["group"] = a.Principal
+	} else {
+		obj["user"] = a.Principal
+	}
+	return obj
+}
+
+func sortedAssignments(set map[assignment]bool) []assignment {
+	list := make([]assignment, 0, len(set))
+	for a := range set {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].key() < list[j].key() })
+
+	return list
+}
+
+// desiredAssignments returns the users or groups every managed application
+// should be assigned to.
+func (ok *oktaProvider) desiredAssignments(source []map[string]any) map[assignment]bool {
+	field := ok.BaseConfig.Mapping["id"]
+
+	desired := make(map[assignment]bool)
+	for _, cfg := range ok.apps {
+		if cfg.AssignGroups {
+			for _, group := range cfg.Groups {
+				if !slices.Contains(ok.BaseConfig.IgnoreGroups, group) {
+					desired[assignment{App: cfg.ID, Group: true, Principal: group}] = true
+				}
+			}
+			continue
+		}
+
+		for _, u := range source {
+			key := config.KeyOf(u, field)
+			if slices.Contains(ok.BaseConfig.IgnoreUsers, key) {
+				continue
+			}
+
+			groups := ok.BaseConfig.GroupsOf(u)
+			if slices.ContainsFunc(cfg.Groups, func(group string) bool { return slices.Contains(groups, group) }) {
+				desired[assignment{App: cfg.ID, Principal: key}] = true
+			}
+		}
+	}
+
+	return desired
+}
+
+// currentAssignments returns the assignments of an application. Users
+// assigned through a group cannot be unassigned on their own, so only
+// individual assignments are returned for them.
+func (ok *oktaProvider) currentAssignments(ctx context.Context, cfg config.OktaAppConfig, groups orgGroups, keys map[string]string) ([]assignment, error) {
+	res := make([]assignment, 0)
+
+	if cfg.AssignGroups {
+		assigned, resp, err := ok.client.Application.ListApplicationGroupAssignments(ctx, cfg.ID, query.NewQueryParams())
+		for err == nil && resp.HasNextPage() {
+			var next []*okta.ApplicationGroupAssignment
+			resp, err = resp.Next(ctx, &next)
+			assigned = append(assigned, next...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing groups assigned to app %s: %w", cfg.ID, err)
+		}
+
+		for _, a := range assigned {
+			if name := groups.name(a.Id); name != "" && !slices.Contains(ok.BaseConfig.IgnoreGroups, name) {
+				res = append(res, assignment{App: cfg.ID, Group: true, Principal: name})
+			}
+		}
+		return res, nil
+	}
+
+	assigned, resp, err := ok.client.Application.ListApplicationUsers(ctx, cfg.ID, query.NewQueryParams())
+	for err == nil && resp.HasNextPage() {
+		var next []*okta.AppUser
+		resp, err = resp.Next(ctx, &next)
+		assigned = append(assigned, next...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing users assigned to app %s: %w", cfg.ID, err)
+	}
+
+	for _, a := range assigned {
+		key, found := keys[a.Id]
+		if a.Scope == "USER" && found && !slices.Contains(ok.BaseConfig.IgnoreUsers, key) {
+			res = append(res, assignment{App: cfg.ID, Principal: key})
+		}
+	}
+
+	return res, nil
+}
+
+// planApps assigns the managed applications to exactly the desired users or
+// groups. Assignments of other applications are left alone.
+func (ok *oktaProvider) planApps(ctx context.Context, plan *engine.Plan, source []map[string]any, groups orgGroups, keys map[string]string) error {
+	desired := ok.desiredAssignments(source)
+
+	current := make(map[assignment]bool)
+	for _, cfg := range ok.apps {
+		assigned, err := ok.currentAssignments(ctx, cfg, groups, keys)
+		if err != nil {
+			return err
+		}
+
+		for _, a := range assigned {
+			current[a] = true
+		}
+	}
+
+	for _, a := range sortedAssignments(desired) {
+		a := a
+		if !current[a] {
+			plan.Add(engine.OperationGrant, a.key(), a.object(), func(ctx context.Context) error {
+				return ok.assign(ctx, a)
+			})
+		}
+	}
+
+	for _, a := range sortedAssignments(current) {
+		a := a
+		if !desired[a] {
+			plan.Add(engine.OperationRevoke, a.key(), a.object(), func(ctx context.Context) error {
+				return ok.unassign(ctx, a)
+			})
+		}
+	}
+
+	return nil
+}
+
+// principalID returns the id of the user or group of an assignment.
+func (ok *oktaProvider) principalID(ctx context.Context, a assignment) (string, error) {
+	if !a.Group {
+		return ok.findUser(ctx, a.Principal)
+	}
+
+	id, err := ok.findGroup(ctx, a.Principal)
+	if err == nil && id == "" {
+		err = fmt.Errorf("group %s not found", a.Principal)
+	}
+	return id, err
+}
+
+func (ok *oktaProvider) assign(ctx context.Context, a assignment) error {
+	id, err := ok.principalID(ctx, a)
+	if err != nil {
+		return err
+	}
+
+	if a.Group {
+		_, _, err = ok.client.Application.CreateApplicationGroupAssignment(ctx, a.App, id, okta.ApplicationGroupAssignment{})
+	} else {
+		_, _, err = ok.client.Application.AssignUserToApplication(ctx, a.App, okta.AppUser{Id: id, Scope: "USER"})
+	}
+	if err != nil {
+		return fmt.Errorf("assigning %s: %w", a.key(), err)
+	}
+
+	return nil
+}
+
+func (ok *oktaProvider) unassign(ctx context.Context, a assignment) error {
+	id, err := ok.principalID(ctx, a)
+	if err != nil {
+		return err
+	}
+
+	var resp *okta.Response
+	if a.Group {
+		resp, err = ok.client.Application.DeleteApplicationGroupAssignment(ctx, a.App, id)
+	} else {
+		resp, err = ok.client.Application.DeleteApplicationUser(ctx, a.App, id, nil)
+	}
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+		return fmt.Errorf("unassigning %s: %w", a.key(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package okta
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/okta/okta-sdk-golang/v2/okta"
+	"github.com/okta/okta-sdk-golang/v2/okta/query"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/utils"
+)
+
+const (
+	// logOverlap is how far before the cursor changes are read again, as
+	// System Log events can show up shortly after they happened.
+	logOverlap = 5 * time.Minute
+	// logRetention is how long Okta keeps System Log events.
+	logRetention = 90 * 24 * time.Hour
+)
+
+// changeEvents are the System Log events that change a user without
+// bumping its lastUpdated.
+var changeEvents = []string{
+	"group.user_membership.add",
+	"group.user_membership.remove",
+	"user.lifecycle.delete.initiated",
+}
+
+// Cursor is the time the changes are read from.
+func (ok *oktaProvider) Cursor(ctx context.Context) (string, error) {
+	return time.Now().UTC().Format(time.RFC3339), nil
+}
+
+// ReadAll returns every converted user by Okta id.
+func (ok *oktaProvider) ReadAll(ctx context.Context) (map[string]map[string]any, error) {
+	users, memberships, err := ok.GetUsersAndMemberships(ctx, utils.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]map[string]any, len(users))
+	for _, item := range users {
+		user, err := ok.convertUser(item, memberships[item.Id])
+		if err != nil {
+			return nil, err
+		}
+
+		res[item.Id] = user
+	}
+
+	return res, nil
+}
+
+// Changes reads the users whose profile or status changed after the cursor
+// through a lastUpdated filter, and the ones whose memberships changed or that
+// were deleted through the System Log.
+func (ok *oktaProvider) Changes(ctx context.Context, cursor string) ([]engine.Change, string, error) {
+	since, err := time.Parse(time.RFC3339, cursor)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: invalid cursor %q", engine.ErrFullSyncRequired, cursor)
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(since) > logRetention-logOverlap {
+		return nil, "", fmt.Errorf("%w: the System Log no longer covers %s", engine.ErrFullSyncRequired, cursor)
+	}
+	since = since.Add(-logOverlap)
+
+	ids := make([]string, 0)
+	changed := make(map[string]bool)
+	mark := func(id string) {
+		if !changed[id] {
+			changed[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	filter := fmt.Sprintf(`lastUpdated gt "%s"`, since.Format("2006-01-02T15:04:05.000Z"))
+	users, resp, err := ok.client.User.ListUsers(ctx, query.NewQueryParams(query.WithFilter(filter)))
+	for err == nil && resp.HasNextPage() {
+		var next []*okta.User
+		resp, err = resp.Next(ctx, &next)
+		users = append(users, next...)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("listing changed users: %w", err)
+	}
+
+	for _, user := range users {
+		mark(user.Id)
+	}
+
+	// Without an until the System Log keeps returning next pages to poll.
+	events, resp, err := ok.client.LogEvent.GetLogs(ctx, query.NewQueryParams(
+		query.WithSince(since.Format(time.RFC3339)),
+		query.WithUntil(now.Format(time.RFC3339)),
+		query.WithFilter(eventFilter(changeEvents)),
+	))
+	for err == nil && resp.HasNextPage() {
+		var next []*okta.LogEvent
+		resp, err = resp.Next(ctx, &next)
+		events = append(events, next...)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("reading system log: %w", err)
+	}
+
+	for _, event := range events {
+		for _, target := range event.Target {
+			if target.Type == "User" {
+				mark(target.Id)
+			}
+		}
+	}
+
+	changes := make([]engine.Change, 0, len(ids))
+	for _, id := range ids {
+		user, err := ok.readUser(ctx, id)
+		if err != nil {
+			return nil, "", err
+		}
+
+		changes = append(changes, engine.Change{ID: id, User: user})
+	}
+
+	return changes, now.Format(time.RFC3339), nil
+}
+
+func eventFilter(types []string) string {
+	clauses := make([]string, 0, len(types))
+	for _, t := range types {
+		clauses = append(clauses, fmt.Sprintf(`eventType eq "%s"`, t))
+	}
+
+	return strings.Join(clauses, " or ")
+}
+
+// readUser returns a converted user with its groups, or nil when it was
+// deleted or deprovisioned, as those are not listed in a full read either.
+func (ok *oktaProvider) readUser(ctx context.Context, id string) (map[string]any, error) {
+	item, resp, err := ok.client.User.GetUser(ctx, id)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("getting user %s: %w", id, err)
+	}
+
+	if item.Status == statusDeprovisioned {
+		return nil, nil
+	}
+
+	groups, _, err := ok.client.User.ListUserGroups(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("getting groups of user %s: %w", id, err)
+	}
+
+	return ok.convertUser(item, groupNames(groups))
+}
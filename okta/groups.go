@@ -0,0 +1,285 @@
+package okta
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+
+	"github.com/okta/okta-sdk-golang/v2/okta"
+	"github.com/okta/okta-sdk-golang/v2/okta/query"
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+)
+
+// oktaGroupType is the type of the groups managed in Okta itself. Groups
+// imported from applications and directories, and Everyone, cannot be written.
+const oktaGroupType = "OKTA_GROUP"
+
+func groupNames(groups []*okta.Group) []string {
+	names := make([]string, 0, len(groups))
+	for _, g := range groups {
+		if g.Profile != nil {
+			names = append(names, g.Profile.Name)
+		}
+	}
+	return names
+}
+
+// orgGroups are the groups of the org by name, with the ones whose members
+// are assigned by active group rules.
+type orgGroups struct {
+	byName map[string]*okta.Group
+	ruled  map[string]bool
+}
+
+func (g orgGroups) id(name string) string {
+	if group, ok := g.byName[name]; ok {
+		return group.Id
+	}
+	return ""
+}
+
+func (g orgGroups) name(id string) string {
+	for name, group := range g.byName {
+		if group.Id == id {
+			return name
+		}
+	}
+	return ""
+}
+
+// writable reports whether the members of a group can be changed.
+func (g orgGroups) writable(name string) bool {
+	group, ok := g.byName[name]
+	return ok && group.Type == oktaGroupType && !g.ruled[group.Id]
+}
+
+func (ok *oktaProvider) listGroups(ctx context.Context) (orgGroups, error) {
+	groups, resp, err := ok.client.Group.ListGroups(ctx, query.NewQueryParams())
+	for err == nil && resp.HasNextPage() {
+		var next []*okta.Group
+		resp, err = resp.Next(ctx, &next)
+		groups = append(groups, next...)
+	}
+	if err != nil {
+		return orgGroups{}, fmt.Errorf("listing groups: %w", err)
+	}
+
+	res := orgGroups{byName: make(map[string]*okta.Group), ruled: make(map[string]bool)}
+	for _, g := range groups {
+		if g.Profile != nil {
+			res.byName[g.Profile.Name] = g
+		}
+	}
+
+	rules, resp, err := ok.client.Group.ListGroupRules(ctx, query.NewQueryParams())
+	for err == nil && resp.HasNextPage() {
+		var next []*okta.GroupRule
+		resp, err = resp.Next(ctx, &next)
+		rules = append(rules, next...)
+	}
+	if err != nil {
+		return orgGroups{}, fmt.Errorf("listing group rules: %w", err)
+	}
+
+	for _, rule := range rules {
+		if rule.Status != "ACTIVE" || rule.Actions == nil || rule.Actions.AssignUserToGroups == nil {
+			continue
+		}
+
+		for _, id := range rule.Actions.AssignUserToGroups.GroupIds {
+			res.ruled[id] = true
+		}
+	}
+
+	return res, nil
+}
+
+// groupMembers returns the keys of the members of a group. Members that are
+// not listed as users, e.g. deprovisioned ones, are left out.
+func (ok *oktaProvider) groupMembers(ctx context.Context, group *okta.Group, keys map[string]string) ([]string, error) {
+	users, resp, err := ok.client.Group.ListGroupUsers(ctx, group.Id, query.NewQueryParams())
+	for err == nil && resp.HasNextPage() {
+		var next []*okta.User
+		resp, err = resp.Next(ctx, &next)
+		users = append(users, next...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing members of group %s: %w", group.Profile.Name, err)
+	}
+
+	members := make([]string, 0, len(users))
+	for _, u := range users {
+		if key, found := keys[u.Id]; found && !slices.Contains(ok.BaseConfig.IgnoreUsers, key) {
+			members = append(members, key)
+		}
+	}
+
+	return members, nil
+}
+
+// planGroups creates the groups of the source users and syncs the members of
+// every Okta group that is not ignored. Groups imported from applications or
+// directories, and the ones group rules assign members to, are read only:
+// they are neither created, emptied nor deleted.
+func (ok *oktaProvider) planGroups(ctx context.Context, plan *engine.Plan, source []map[string]any, groups orgGroups, keys map[string]string) error {
+	field := ok.BaseConfig.Mapping["id"]
+
+	desired := make(map[string][]string)
+	for _, u := range source {
+		for _, group := range ok.BaseConfig.GroupsOf(u) {
+			if slices.Contains(ok.BaseConfig.IgnoreGroups, group) {
+				continue
+			}
+
+			if _, found := groups.byName[group]; found && !groups.writable(group) {
+				continue
+			}
+
+			desired[group] = append(desired[group], config.KeyOf(u, field))
+		}
+	}
+
+	missing := make([]string, 0)
+	for group := range desired {
+		if _, found := groups.byName[group]; !found {
+			missing = append(missing, group)
+		}
+	}
+	sort.Strings(missing)
+
+	for _, name := range missing {
+		name := name
+		plan.AddVerified(engine.OperationCreateGroup, name, map[string]any{"name": name}, func(ctx context.Context) error {
+			return ok.createGroup(ctx, name)
+		}, func(ctx context.Context) (bool, error) {
+			id, err := ok.findGroup(ctx, name)
+			return id != "", err
+		})
+	}
+
+	deleted := make([]string, 0)
+	current := make(map[string][]string)
+	for name, group := range groups.byName {
+		if slices.Contains(ok.BaseConfig.IgnoreGroups, name) || !groups.writable(name) {
+			continue
+		}
+
+		if _, found := desired[name]; !found {
+			if ok.deleteGroups {
+				deleted = append(deleted, name)
+				continue
+			}
+			desired[name] = make([]string, 0)
+		}
+
+		members, err := ok.groupMembers(ctx, group, keys)
+		if err != nil {
+			return err
+		}
+		current[name] = members
+	}
+
+	plan.AddMemberships(current, desired, ok.addMember, ok.removeMember)
+
+	sort.Strings(deleted)
+	for _, name := range deleted {
+		id := groups.id(name)
+		plan.Add(engine.OperationDeleteGroup, name, map[string]any{"name": name}, func(ctx context.Context) error {
+			return ok.deleteGroup(ctx, id)
+		})
+	}
+
+	return nil
+}
+
+// findGroup returns the id of the group with the given name, or "" if there is none.
+func (ok *oktaProvider) findGroup(ctx context.Context, name string) (string, error) {
+	groups, _, err := ok.client.Group.ListGroups(ctx, query.NewQueryParams(query.WithQ(name)))
+	if err != nil {
+		return "", fmt.Errorf("finding group %s: %w", name, err)
+	}
+
+	// q matches name prefixes.
+	for _, g := range groups {
+		if g.Profile != nil && g.Profile.Name == name {
+			return g.Id, nil
+		}
+	}
+
+	return "", nil
+}
+
+// findUser returns the id of the user with the given key, which is either
+// its id or its login.
+func (ok *oktaProvider) findUser(ctx context.Context, key string) (string, error) {
+	user, _, err := ok.client.User.GetUser(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("getting user %s: %w", key, err)
+	}
+
+	return user.Id, nil
+}
+
+func (ok *oktaProvider) createGroup(ctx context.Context, name string) error {
+	group := okta.Group{Profile: &okta.GroupProfile{Name: name}}
+	if _, _, err := ok.client.Group.CreateGroup(ctx, group); err != nil {
+		return fmt.Errorf("creating group %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (ok *oktaProvider) deleteGroup(ctx context.Context, id string) error {
+	resp, err := ok.client.Group.DeleteGroup(ctx, id)
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+		return fmt.Errorf("deleting group %s: %w", id, err)
+	}
+
+	return nil
+}
+
+func (ok *oktaProvider) memberIDs(ctx context.Context, group, member string) (string, string, error) {
+	groupID, err := ok.findGroup(ctx, group)
+	if err != nil {
+		return "", "", err
+	} else if groupID == "" {
+		return "", "", fmt.Errorf("group %s not found", group)
+	}
+
+	userID, err := ok.findUser(ctx, member)
+	if err != nil {
+		return "", "", err
+	}
+
+	return groupID, userID, nil
+}
+
+func (ok *oktaProvider) addMember(ctx context.Context, group, member string) error {
+	groupID, userID, err := ok.memberIDs(ctx, group, member)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ok.client.Group.AddUserToGroup(ctx, groupID, userID); err != nil {
+		return fmt.Errorf("adding %s to group %s: %w", member, group, err)
+	}
+
+	return nil
+}
+
+func (ok *oktaProvider) removeMember(ctx context.Context, group, member string) error {
+	groupID, userID, err := ok.memberIDs(ctx, group, member)
+	if err != nil {
+		return err
+	}
+
+	resp, err := ok.client.Group.RemoveUserFromGroup(ctx, groupID, userID)
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+		return fmt.Errorf("removing %s from group %s: %w", member, group, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package okta
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/okta/okta-sdk-golang/v2/okta"
+	"github.com/okta/okta-sdk-golang/v2/okta/query"
+	"github.com/tiagoposse/go-identity-sync/config"
+)
+
+// Okta user lifecycle states.
+const (
+	statusStaged          = "STAGED"
+	statusProvisioned     = "PROVISIONED"
+	statusActive          = "ACTIVE"
+	statusRecovery        = "RECOVERY"
+	statusPasswordExpired = "PASSWORD_EXPIRED"
+	statusLockedOut       = "LOCKED_OUT"
+	statusSuspended       = "SUSPENDED"
+	statusDeprovisioned   = "DEPROVISIONED"
+)
+
+// normalizeStatus maps an Okta lifecycle state to a common user status.
+// Provisioned users were activated by an admin and only have to set up their
+// credentials, so they count as active.
+func normalizeStatus(status string) string {
+	switch status {
+	case statusStaged:
+		return config.UserStaged
+	case statusSuspended:
+		return config.UserSuspended
+	case statusDeprovisioned:
+		return config.UserDeprovisioned
+	default:
+		return config.UserActive
+	}
+}
+
+// unactivated reports whether a user was never activated.
+func unactivated(status string) bool {
+	return status == statusStaged || status == statusProvisioned
+}
+
+// suspendable reports whether Okta can suspend a user in the given state.
+func suspendable(status string) bool {
+	switch status {
+	case statusActive, statusRecovery, statusPasswordExpired, statusLockedOut:
+		return true
+	}
+	return false
+}
+
+// reactivates reports whether moving a user from its Okta state to a common
+// status reactivates it. Reactivations are planned as their own operations,
+// so the engine only applies them to users it suspended.
+func reactivates(from, to string) bool {
+	return to == config.UserActive && (from == statusSuspended || from == statusDeprovisioned)
+}
+
+// statusField returns the common field the Okta status is mapped to, or ""
+// when statuses are not synced.
+func (ok *oktaProvider) statusField() string {
+	return ok.BaseConfig.Mapping["status"]
+}
+
+// convertUser converts a user with its groups and its status normalized.
+func (ok *oktaProvider) convertUser(item *okta.User, groups []string) (map[string]any, error) {
+	user, err := ok.BaseConfig.ConvertUser(item)
+	if err != nil {
+		return nil, err
+	}
+
+	if field := ok.statusField(); field != "" {
+		user[field] = normalizeStatus(item.Status)
+	}
+
+	if groups != nil {
+		user[ok.BaseConfig.GroupField] = groups
+	}
+	return user, nil
+}
+
+// desiredStatus returns the common status a source user should have, or ""
+// when statuses are not synced.
+func (ok *oktaProvider) desiredStatus(u map[string]any) string {
+	field := ok.statusField()
+	if field == "" {
+		return ""
+	}
+
+	status, _ := u[field].(string)
+	return status
+}
+
+// transition moves a user from its Okta state to a common status through the
+// lifecycle API.
+func (ok *oktaProvider) transition(ctx context.Context, id, from, to string) error {
+	if to == "" || normalizeStatus(from) == to {
+		return nil
+	}
+
+	switch {
+	case to == config.UserActive && from == statusSuspended:
+		return ok.unsuspendUser(ctx, id)
+	case to == config.UserActive:
+		return ok.activateUser(ctx, id)
+	case to == config.UserSuspended && suspendable(from):
+		return ok.suspendUser(ctx, id)
+	case to == config.UserDeprovisioned:
+		return ok.deactivateUser(ctx, id)
+	}
+
+	return fmt.Errorf("okta cannot move user %s from %s to %s", id, from, to)
+}
+
+// activateUser activates a staged user, or one that was deactivated, which
+// emails them an activation link.
+func (ok *oktaProvider) activateUser(ctx context.Context, id string) error {
+	if _, _, err := ok.client.User.ActivateUser(ctx, id, query.NewQueryParams(query.WithSendEmail(true))); err != nil {
+		return fmt.Errorf("activating user %s: %w", id, err)
+	}
+
+	return nil
+}
+
+func (ok *oktaProvider) deactivateUser(ctx context.Context, id string) error {
+	if _, err := ok.client.User.DeactivateUser(ctx, id, nil); err != nil {
+		return fmt.Errorf("deactivating user %s: %w", id, err)
+	}
+
+	return nil
+}
+
+func (ok *oktaProvider) suspendUser(ctx context.Context, id string) error {
+	if _, err := ok.client.User.SuspendUser(ctx, id); err != nil {
+		return fmt.Errorf("suspending user %s: %w", id, err)
+	}
+
+	return nil
+}
+
+func (ok *oktaProvider) unsuspendUser(ctx context.Context, id string) error {
+	if _, err := ok.client.User.UnsuspendUser(ctx, id); err != nil {
+		return fmt.Errorf("unsuspending user %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// removeUser suspends a user that left the source. Users that cannot be
+// suspended, e.g. staged ones, are deactivated instead.
+func (ok *oktaProvider) removeUser(ctx context.Context, id, status string) error {
+	if suspendable(status) {
+		return ok.suspendUser(ctx, id)
+	}
+	return ok.deactivateUser(ctx, id)
+}
+
+// deleteUser deletes a user for good. Okta only deletes deactivated users,
+// so others are deactivated first.
+func (ok *oktaProvider) deleteUser(ctx context.Context, id, status string) error {
+	if status != statusDeprovisioned {
+		if err := ok.deactivateUser(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := ok.client.User.DeactivateOrDeleteUser(ctx, id, nil); err != nil {
+		return fmt.Errorf("deleting user %s: %w", id, err)
+	}
+
+	return nil
+}
@@ -4,10 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"slices"
 
 	"github.com/okta/okta-sdk-golang/v2/okta"
 	"github.com/okta/okta-sdk-golang/v2/okta/query"
 	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
 	"github.com/tiagoposse/go-identity-sync/utils"
 )
 
@@ -15,33 +18,73 @@ type oktaProvider struct {
 	config.BaseConfig
 
 	client *okta.Client
+	domain string
+
+	activate     bool
+	staged       string
+	deleteGroups bool
+	apps         []config.OktaAppConfig
 }
 
 func NewOktaProvider(ctx context.Context, cfg *config.OktaConfig) (*oktaProvider, error) {
+	staged := cfg.Staged
+	switch staged {
+	case "":
+		staged = config.OktaStagedKeep
+	case config.OktaStagedKeep, config.OktaStagedActivate, config.OktaStagedIgnore:
+	default:
+		return nil, fmt.Errorf("unknown policy %q for staged okta users, expected keep, activate or ignore", staged)
+	}
+
+	transport, err := utils.NewRateLimitTransport(nil, cfg.RateLimit, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retries are handled by our transport, so the SDK's own rate limit retries are disabled.
+	httpClient := &http.Client{Transport: transport}
+
 	_, cli, err := okta.NewClient(
 		ctx,
 		okta.WithOrgUrl(cfg.Domain),
 		okta.WithToken(*cfg.Token.Value),
+		okta.WithHttpClientPtr(httpClient),
+		okta.WithRateLimitMaxRetries(0),
 	)
 
 	return &oktaProvider{
 		client:     cli,
+		domain:     cfg.Domain,
 		BaseConfig: cfg.BaseConfig,
+
+		activate:     cfg.Activate,
+		staged:       staged,
+		deleteGroups: cfg.DeleteGroups,
+		apps:         cfg.Apps,
 	}, err
 }
 
-func (ok *oktaProvider) GetUser(ctx context.Context, id string) {
-	user, resp, err := ok.client.User.GetUser(ctx, id)
+func (ok *oktaProvider) GetUser(ctx context.Context, id string) (*okta.User, error) {
+	user, _, err := ok.client.User.GetUser(ctx, id)
 	if err != nil {
-		fmt.Printf("Error Getting User: %v\n", err)
+		return nil, fmt.Errorf("getting user %s: %w", id, err)
 	}
-	fmt.Printf("User: %+v\n Response: %+v\n\n", user, resp)
+
+	return user, nil
 }
 
 func (ok *oktaProvider) GetUsers(ctx context.Context, lo utils.ListOptions) ([]*okta.User, error) {
-	fquery := query.NewQueryParams(query.WithFilter(*lo.Filter))
+	fquery := query.NewQueryParams()
+	if lo.Filter != nil {
+		fquery = query.NewQueryParams(query.WithFilter(*lo.Filter))
+	}
 
-	users, _, err := ok.client.User.ListUsers(ctx, fquery)
+	users, resp, err := ok.client.User.ListUsers(ctx, fquery)
+	for err == nil && resp.HasNextPage() {
+		var next []*okta.User
+		resp, err = resp.Next(ctx, &next)
+		users = append(users, next...)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("getting users: %w", err)
 	}
@@ -61,10 +104,7 @@ func (ok *oktaProvider) GetUsersAndMemberships(ctx context.Context, lo utils.Lis
 		if err != nil {
 			return nil, nil, err
 		}
-		memberships[user.Id] = make([]string, 0)
-		for _, g := range groups {
-			memberships[user.Id] = append(memberships[user.Id], g.Id)
-		}
+		memberships[user.Id] = groupNames(groups)
 	}
 
 	return users, memberships, nil
@@ -78,10 +118,9 @@ func (ok *oktaProvider) GetUsersConverted(ctx context.Context, lo utils.ListOpti
 
 	convertedUsers := make([]map[string]any, 0)
 	for _, item := range users {
-		if user, err := ok.BaseConfig.ConvertUser(item); err != nil {
+		if user, err := ok.convertUser(item, memberships[item.Id]); err != nil {
 			return nil, err
 		} else {
-			user[ok.BaseConfig.GroupField] = memberships[item.Id]
 			convertedUsers = append(convertedUsers, user)
 		}
 
@@ -89,68 +128,209 @@ func (ok *oktaProvider) GetUsersConverted(ctx context.Context, lo utils.ListOpti
 	return convertedUsers, nil
 }
 
-func (ok *oktaProvider) SyncProvider(ctx context.Context, source []map[string]any) error {
+// Plan compares the users of the org with the source. Deactivated users
+// count as removed already and are only looked at when they reappear in the
+// source, in which case they are activated again instead of recreated.
+func (ok *oktaProvider) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
 	targetUsers, err := ok.GetUsers(ctx, utils.ListOptions{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	toAdd, toRemove, toUpdate, err := ok.BaseConfig.CompareUsers(source, targetUsers, ok.BaseConfig.Mapping["id"])
+	deactivated, err := ok.GetUsers(ctx, utils.ListOptions{Filter: utils.StrPtr(fmt.Sprintf(`status eq "%s"`, statusDeprovisioned))})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, u := range toAdd {
-		mapped, err := ok.BaseConfig.ConvertUserToProvider(u)
+	field := ok.BaseConfig.Mapping["id"]
+	inSource := make(map[string]bool, len(source))
+	for _, u := range source {
+		inSource[config.KeyOf(u, field)] = true
+	}
+
+	current := make([]map[string]any, 0, len(targetUsers))
+	// Deactivated users that left the source, which may have been
+	// deactivated in place of a suspension, see removeUser.
+	gone := make([]map[string]any, 0)
+	statuses := make(map[string]string)
+	keys := make(map[string]string)
+	ignored := make(map[string]bool)
+	for _, item := range append(targetUsers, deactivated...) {
+		u, err := ok.convertUser(item, nil)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		cur := okta.CreateUserRequest{
-			Type: &okta.UserType{
-				DisplayName: mapped[ok.BaseConfig.Mapping["type.displayName"]].(string),
-				Name:        mapped[ok.BaseConfig.Mapping["type.name"]].(string),
-				Description: mapped[ok.BaseConfig.Mapping["type.description"]].(string),
-			},
-			GroupIds: u[ok.BaseConfig.GroupField].([]string),
+		key := config.KeyOf(u, field)
+		switch {
+		case item.Status == statusDeprovisioned && !inSource[key]:
+			gone = append(gone, u)
+			continue
+		case unactivated(item.Status) && ok.staged == config.OktaStagedIgnore:
+			ignored[key] = true
+			continue
 		}
 
-		if _, _, err := ok.client.User.CreateUser(ctx, cur, nil); err != nil {
-			return err
-		}
+		current = append(current, u)
+		statuses[key] = item.Status
+		keys[item.Id] = key
+	}
+
+	if len(ignored) > 0 {
+		source = slices.DeleteFunc(slices.Clone(source), func(u map[string]any) bool {
+			return ignored[config.KeyOf(u, field)]
+		})
+	}
+
+	toAdd, toRemove, toUpdate, err := ok.BaseConfig.RawCompareUsers(current, source, field)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := engine.NewPlan(fmt.Sprintf("okta/%s", ok.domain))
+	plan.SetState(current, source, field)
+	for _, u := range toAdd {
+		u := u
+		plan.Add(engine.OperationCreate, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return ok.createUser(ctx, u)
+		})
 	}
 
 	for _, u := range toRemove {
-		if _, err := ok.client.User.DeactivateOrDeleteUser(ctx, u[ok.BaseConfig.Mapping["id"]].(string), nil); err != nil {
-			return err
-		}
+		key := config.KeyOf(u, field)
+		status := statuses[key]
+		plan.AddRemoval(ok.BaseConfig.Deprovisioning, key, u, status == statusSuspended, func(ctx context.Context) error {
+			return ok.removeUser(ctx, key, status)
+		}, func(ctx context.Context) error {
+			return ok.deleteUser(ctx, key, status)
+		})
 	}
 
-	for _, u := range toUpdate {
-		mapped, err := ok.BaseConfig.ConvertUserToProvider(u)
-		if err != nil {
-			return err
+	// Users deactivated in place of a suspension are deleted once their grace
+	// period has passed, the ones deactivated by hand are kept.
+	if ok.BaseConfig.Deprovisioning.Suspends() {
+		for _, u := range gone {
+			key := config.KeyOf(u, field)
+			plan.AddRecordedDelete(key, u, func(ctx context.Context) error {
+				return ok.deleteUser(ctx, key, statusDeprovisioned)
+			})
 		}
+	}
 
-		conv, err := MapToUser(mapped)
-		if err != nil {
-			return err
+	// Users that reappear in the source are reactivated instead of recreated.
+	// Deactivated users are always reactivated, suspended ones only when
+	// removed users are suspended. With statuses synced, users the source has
+	// as active are reactivated, and updates move the others to the status
+	// of the source.
+	for _, u := range source {
+		key := config.KeyOf(u, field)
+		status, found := statuses[key]
+		desired := ok.desiredStatus(u)
+		switch {
+		case !found:
+		case reactivates(status, desired),
+			desired == "" && (status == statusDeprovisioned || (status == statusSuspended && ok.BaseConfig.Deprovisioning.Suspends())):
+			plan.Add(engine.OperationReactivate, key, u, func(ctx context.Context) error {
+				return ok.transition(ctx, key, status, config.UserActive)
+			})
+		case desired != "":
+			// Updates move the user to the status of the source.
+		case status == statusStaged && ok.staged == config.OktaStagedActivate:
+			plan.Add(engine.OperationUpdate, key, u, func(ctx context.Context) error {
+				return ok.activateUser(ctx, key)
+			})
 		}
+	}
 
-		if _, _, err := ok.client.User.UpdateUser(
-			ctx,
-			u[ok.BaseConfig.Mapping["id"]].(string),
-			*conv, nil,
-		); err != nil {
-			return err
-		}
+	for _, u := range toUpdate {
+		u := u
+		key := config.KeyOf(u, field)
+		status := statuses[key]
+		plan.Add(engine.OperationUpdate, key, u, func(ctx context.Context) error {
+			return ok.updateUser(ctx, key, status, u)
+		})
+	}
+
+	groups, err := ok.listGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ok.planGroups(ctx, plan, source, groups, keys); err != nil {
+		return nil, err
+	}
+
+	if err := ok.planApps(ctx, plan, source, groups, keys); err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+func (ok *oktaProvider) SyncProvider(ctx context.Context, source []map[string]any, opts ...engine.Option) (*engine.Result, error) {
+	plan, err := ok.Plan(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]engine.Option{engine.WithConfig(ok.BaseConfig)}, opts...)
+	return engine.Apply(ctx, plan, opts...)
+}
+
+func (ok *oktaProvider) createUser(ctx context.Context, u map[string]any) error {
+	mapped, err := ok.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return err
+	}
+
+	conv, err := MapToUser(mapped)
+	if err != nil {
+		return err
+	}
+
+	// Groups are added by the membership operations, once they exist.
+	req := okta.CreateUserRequest{Profile: conv.Profile}
+	if conv.Type != nil && conv.Type.Id != "" {
+		req.Type = &okta.UserType{Id: conv.Type.Id}
+	}
+
+	// Users the source has as staged are not activated.
+	activate := ok.activate && ok.desiredStatus(u) != config.UserStaged
+	if _, _, err := ok.client.User.CreateUser(ctx, req, query.NewQueryParams(query.WithActivate(activate))); err != nil {
+		return fmt.Errorf("creating user: %w", err)
+	}
+
+	return nil
+}
+
+// updateUser updates the profile of a user and, when statuses are synced,
+// moves it to the status of the source. Reactivations are left to their own
+// operation.
+func (ok *oktaProvider) updateUser(ctx context.Context, id, status string, u map[string]any) error {
+	mapped, err := ok.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return err
+	}
+	delete(mapped, "status")
+
+	conv, err := MapToUser(mapped)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := ok.client.User.UpdateUser(ctx, id, *conv, nil); err != nil {
+		return fmt.Errorf("updating user %s: %w", id, err)
+	}
+
+	if to := ok.desiredStatus(u); !reactivates(status, to) {
+		return ok.transition(ctx, id, status, to)
 	}
 
 	return nil
 }
 
 func (ok *oktaProvider) Sync(ctx context.Context, users []map[string]any) (add, remove, update []map[string]any, retErr error) {
-	sourceUsers, err := ok.GetUsers(ctx)
+	sourceUsers, err := ok.GetUsers(ctx, utils.ListOptions{})
 	if err != nil {
 		retErr = err
 		return
@@ -11,9 +11,17 @@ import (
 	"github.com/onelogin/onelogin-go-sdk/v4/pkg/onelogin/models"
 	utl "github.com/onelogin/onelogin-go-sdk/v4/pkg/onelogin/utilities"
 	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
 	"github.com/tiagoposse/go-identity-sync/utils"
 )
 
+// User statuses of the OneLogin API. Suspended users cannot sign in but keep
+// their apps and roles.
+const (
+	statusActive    = 1
+	statusSuspended = 2
+)
+
 type oneloginProvider struct {
 	config.BaseConfig
 
@@ -165,58 +173,136 @@ func (ol *oneloginProvider) GetUsersConverted(ctx context.Context, lo utils.List
 	return convertedUsers, nil
 }
 
-func (ol *oneloginProvider) SyncProvider(ctx context.Context, source []map[string]any) error {
+func (ol *oneloginProvider) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
 	targetUsers, err := ol.GetUsers(ctx, utils.ListOptions{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	toAdd, toRemove, toUpdate, err := ol.BaseConfig.CompareUsers(source, targetUsers, ol.BaseConfig.Mapping["id"])
+	field := ol.BaseConfig.Mapping["id"]
+	current, err := ol.BaseConfig.ConvertUsers(targetUsers)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	for _, u := range toAdd {
-		mapped, err := ol.BaseConfig.ConvertUserToProvider(u)
-		if err != nil {
-			return err
-		}
+	toAdd, toRemove, toUpdate, err := ol.BaseConfig.RawCompareUsers(current, source, field)
+	if err != nil {
+		return nil, err
+	}
 
-		conv, err := MapToUser(mapped)
-		if err != nil {
-			return err
-		}
+	suspended := make(map[string]bool)
+	for i, user := range targetUsers {
+		suspended[config.KeyOf(current[i], field)] = user.Status == statusSuspended
+	}
 
-		if _, err := ol.client.CreateUser(*conv); err != nil {
-			return err
-		}
+	plan := engine.NewPlan("onelogin")
+	plan.SetState(current, source, field)
+	for _, u := range toAdd {
+		u := u
+		plan.Add(engine.OperationCreate, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return ol.createUser(ctx, u)
+		})
 	}
 
 	for _, u := range toRemove {
-		iID, err := strconv.Atoi(u[ol.BaseConfig.Mapping["id"]].(string))
-		if err != nil {
-			return err
-		}
+		key := config.KeyOf(u, field)
+		plan.AddRemoval(ol.BaseConfig.Deprovisioning, key, u, suspended[key], func(ctx context.Context) error {
+			return ol.setStatus(ctx, key, statusSuspended)
+		}, func(ctx context.Context) error {
+			return ol.deleteUser(ctx, key)
+		})
+	}
 
-		if _, err := ol.client.DeleteUser(iID); err != nil {
-			return err
+	if ol.BaseConfig.Deprovisioning.Suspends() {
+		for _, u := range source {
+			key := config.KeyOf(u, field)
+			if suspended[key] {
+				plan.Add(engine.OperationReactivate, key, u, func(ctx context.Context) error {
+					return ol.setStatus(ctx, key, statusActive)
+				})
+			}
 		}
 	}
 
 	for _, u := range toUpdate {
-		mapped, err := ol.BaseConfig.ConvertUserToProvider(u)
-		if err != nil {
-			return err
-		}
+		u := u
+		plan.Add(engine.OperationUpdate, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return ol.updateUser(ctx, u)
+		})
+	}
 
-		conv, err := MapToUser(mapped)
-		if err != nil {
-			return err
-		}
+	return plan, nil
+}
 
-		if _, err := ol.client.UpdateUser(int(conv.ID), *conv); err != nil {
-			return err
-		}
+func (ol *oneloginProvider) SyncProvider(ctx context.Context, source []map[string]any, opts ...engine.Option) (*engine.Result, error) {
+	plan, err := ol.Plan(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]engine.Option{engine.WithConfig(ol.BaseConfig)}, opts...)
+	return engine.Apply(ctx, plan, opts...)
+}
+
+func (ol *oneloginProvider) createUser(ctx context.Context, u map[string]any) error {
+	mapped, err := ol.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return err
+	}
+
+	conv, err := MapToUser(mapped)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ol.client.CreateUser(*conv); err != nil {
+		return fmt.Errorf("creating user: %w", err)
+	}
+
+	return nil
+}
+
+func (ol *oneloginProvider) deleteUser(ctx context.Context, id string) error {
+	iID, err := strconv.Atoi(id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ol.client.DeleteUser(iID); err != nil {
+		return fmt.Errorf("deleting user %d: %w", iID, err)
+	}
+
+	return nil
+}
+
+// setStatus suspends or reactivates a user. Only the status is sent, so the
+// rest of the user is left as it is.
+func (ol *oneloginProvider) setStatus(ctx context.Context, id string, status int32) error {
+	iID, err := strconv.Atoi(id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ol.client.UpdateUser(iID, models.User{Status: status}); err != nil {
+		return fmt.Errorf("setting status of user %d: %w", iID, err)
+	}
+
+	return nil
+}
+
+func (ol *oneloginProvider) updateUser(ctx context.Context, u map[string]any) error {
+	mapped, err := ol.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return err
+	}
+
+	conv, err := MapToUser(mapped)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ol.client.UpdateUser(int(conv.ID), *conv); err != nil {
+		return fmt.Errorf("updating user %d: %w", conv.ID, err)
 	}
 
 	return nil
@@ -0,0 +1,80 @@
+package scim
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ListGroups pages through every group matching the filter, which may be empty.
+func (c *Client) ListGroups(ctx context.Context, filter string) ([]Group, error) {
+	return list[Group](ctx, c, "/Groups", filter)
+}
+
+func (c *Client) GetGroup(ctx context.Context, id string) (*Group, error) {
+	var group Group
+	if err := c.do(ctx, http.MethodGet, "/Groups/"+url.PathEscape(id), nil, nil, &group); err != nil {
+		return nil, fmt.Errorf("getting group %s: %w", id, err)
+	}
+
+	return &group, nil
+}
+
+func (c *Client) CreateGroup(ctx context.Context, group Group) (*Group, error) {
+	if len(group.Schemas) == 0 {
+		group.Schemas = []string{SchemaGroup}
+	}
+
+	var created Group
+	if err := c.do(ctx, http.MethodPost, "/Groups", nil, group, &created); err != nil {
+		return nil, fmt.Errorf("creating group %s: %w", group.DisplayName, err)
+	}
+
+	return &created, nil
+}
+
+func (c *Client) PatchGroup(ctx context.Context, id string, ops []PatchOperation) error {
+	req := PatchRequest{
+		Schemas:    []string{SchemaPatchOp},
+		Operations: ops,
+	}
+
+	if err := c.do(ctx, http.MethodPatch, "/Groups/"+url.PathEscape(id), nil, req, nil); err != nil {
+		return fmt.Errorf("patching group %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// ReplaceGroup overwrites the group and its members, for service providers
+// without PATCH support.
+func (c *Client) ReplaceGroup(ctx context.Context, group Group) error {
+	if len(group.Schemas) == 0 {
+		group.Schemas = []string{SchemaGroup}
+	}
+
+	if err := c.do(ctx, http.MethodPut, "/Groups/"+url.PathEscape(group.ID), nil, group, nil); err != nil {
+		return fmt.Errorf("replacing group %s: %w", group.ID, err)
+	}
+
+	return nil
+}
+
+func (c *Client) DeleteGroup(ctx context.Context, id string) error {
+	if err := c.do(ctx, http.MethodDelete, "/Groups/"+url.PathEscape(id), nil, nil, nil); err != nil {
+		return fmt.Errorf("deleting group %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// AddMemberOp adds a user to a group.
+func AddMemberOp(userID string) PatchOperation {
+	return PatchOperation{Op: "add", Path: "members", Value: []Reference{{Value: userID}}}
+}
+
+// RemoveMemberOp removes a user from a group.
+func RemoveMemberOp(userID string) PatchOperation {
+	return PatchOperation{Op: "remove", Path: fmt.Sprintf(`members[value eq "%s"]`, userID)}
+}
@@ -0,0 +1,532 @@
+package scim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/utils"
+)
+
+// eqFilter matches the only filter evaluated client side, attribute eq "value".
+var eqFilter = regexp.MustCompile(`^\s*(\S+)\s+eq\s+"(.*)"\s*$`)
+
+// scimProvider provisions users and groups into a generic SCIM 2.0 service
+// provider. Users are keyed by their mapped userName and groups by displayName.
+type scimProvider struct {
+	config.BaseConfig
+
+	client *Client
+	name   string
+	quirks config.SCIMQuirks
+}
+
+func NewSCIMProvider(ctx context.Context, cfg *config.SCIMConfig) (*scimProvider, error) {
+	if cfg.Url == "" {
+		return nil, errors.New("scim requires a url")
+	}
+
+	if cfg.Token == nil || cfg.Token.Value == nil {
+		return nil, fmt.Errorf("scim %s requires a token", cfg.Name)
+	}
+
+	transport, err := utils.NewRateLimitTransport(nil, cfg.RateLimit, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := NewClient(cfg.Url, *cfg.Token.Value, transport)
+	client.SetPageSize(cfg.Quirks.PageSize)
+
+	return &scimProvider{
+		BaseConfig: cfg.BaseConfig,
+		client:     client,
+		name:       cfg.Name,
+		quirks:     cfg.Quirks,
+	}, nil
+}
+
+// GetUsers returns the users matching the SCIM filter in the list options.
+func (sp *scimProvider) GetUsers(ctx context.Context, lo utils.ListOptions) ([]User, error) {
+	filter := ""
+	if lo.Filter != nil {
+		filter = *lo.Filter
+	}
+
+	if !sp.quirks.NoFilter || filter == "" {
+		return sp.client.ListUsers(ctx, filter)
+	}
+
+	users, err := sp.client.ListUsers(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return filterLocally(users, filter, Flatten)
+}
+
+func (sp *scimProvider) GetGroups(ctx context.Context, filter string) ([]Group, error) {
+	if !sp.quirks.NoFilter || filter == "" {
+		return sp.client.ListGroups(ctx, filter)
+	}
+
+	groups, err := sp.client.ListGroups(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return filterLocally(groups, filter, func(g Group) map[string]any {
+		return map[string]any{"id": g.ID, "externalId": g.ExternalID, "displayName": g.DisplayName}
+	})
+}
+
+// filterLocally applies an attribute eq "value" filter for service providers
+// that ignore filters.
+func filterLocally[T any](items []T, filter string, attrs func(T) map[string]any) ([]T, error) {
+	match := eqFilter.FindStringSubmatch(filter)
+	if match == nil {
+		return nil, fmt.Errorf("filter %q cannot be evaluated client side", filter)
+	}
+
+	res := make([]T, 0)
+	for _, item := range items {
+		if strings.EqualFold(fmt.Sprint(attrs(item)[match[1]]), match[2]) {
+			res = append(res, item)
+		}
+	}
+
+	return res, nil
+}
+
+func (sp *scimProvider) GetUsersConverted(ctx context.Context, lo utils.ListOptions) ([]map[string]any, error) {
+	users, err := sp.GetUsers(ctx, lo)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships := make(map[string][]string)
+	if !sp.quirks.NoGroups {
+		groups, err := sp.GetGroups(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, group := range groups {
+			members, err := sp.groupMembers(ctx, group.ID)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, member := range members {
+				memberships[member.Value] = append(memberships[member.Value], group.DisplayName)
+			}
+		}
+	}
+
+	convertedUsers := make([]map[string]any, 0, len(users))
+	for _, item := range users {
+		user, err := sp.BaseConfig.ConvertUser(Flatten(item))
+		if err != nil {
+			return nil, err
+		}
+
+		user[sp.BaseConfig.GroupField] = memberships[item.ID]
+		convertedUsers = append(convertedUsers, user)
+	}
+
+	return convertedUsers, nil
+}
+
+func (sp *scimProvider) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
+	users, err := sp.client.ListUsers(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make([]map[string]any, 0, len(users))
+	for _, user := range users {
+		attrs = append(attrs, Flatten(user))
+	}
+
+	field := sp.BaseConfig.Mapping["userName"]
+	current, err := sp.BaseConfig.ConvertUsers(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	toAdd, toRemove, toUpdate, err := sp.BaseConfig.RawCompareUsers(current, source, field)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]string)
+	names := make(map[string]string)
+	suspended := make(map[string]bool)
+	for i, user := range users {
+		key := config.KeyOf(current[i], field)
+		ids[key] = user.ID
+		names[user.ID] = key
+		suspended[key] = !user.IsActive()
+	}
+
+	known := &planIDs{users: ids, groups: make(map[string]string)}
+
+	plan := engine.NewPlan(fmt.Sprintf("scim/%s", sp.name))
+	plan.SetState(current, source, field)
+	for _, u := range toAdd {
+		u := u
+		key := config.KeyOf(u, field)
+		plan.AddVerified(engine.OperationCreate, key, u, func(ctx context.Context) error {
+			id, err := sp.createUser(ctx, u)
+			if err == nil {
+				known.users[key] = id
+			}
+			return err
+		}, func(ctx context.Context) (bool, error) {
+			user, err := sp.findUser(ctx, key)
+			return user != nil, err
+		})
+	}
+
+	for _, u := range toRemove {
+		id := ids[config.KeyOf(u, field)]
+		plan.AddRemoval(sp.BaseConfig.Deprovisioning, config.KeyOf(u, field), u, suspended[config.KeyOf(u, field)], func(ctx context.Context) error {
+			return sp.setActive(ctx, id, false)
+		}, func(ctx context.Context) error {
+			return sp.deleteUser(ctx, id)
+		})
+	}
+
+	if sp.BaseConfig.Deprovisioning.Suspends() {
+		for _, u := range source {
+			key := config.KeyOf(u, field)
+			if id, ok := ids[key]; ok && suspended[key] {
+				plan.Add(engine.OperationReactivate, key, u, func(ctx context.Context) error {
+					return sp.setActive(ctx, id, true)
+				})
+			}
+		}
+	}
+
+	for _, u := range toUpdate {
+		u := u
+		id := ids[config.KeyOf(u, field)]
+		plan.Add(engine.OperationUpdate, config.KeyOf(u, field), u, func(ctx context.Context) error {
+			return sp.updateUser(ctx, id, u)
+		})
+	}
+
+	if !sp.quirks.NoGroups {
+		if err := sp.planGroups(ctx, plan, source, names, known); err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// planGroups creates missing source groups and syncs the members of every
+// group that is not ignored.
+func (sp *scimProvider) planGroups(ctx context.Context, plan *engine.Plan, source []map[string]any, names map[string]string, known *planIDs) error {
+	field := sp.BaseConfig.Mapping["userName"]
+
+	groups, err := sp.GetGroups(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string][]string)
+	desired := make(map[string][]string)
+	for _, group := range groups {
+		if slices.Contains(sp.BaseConfig.IgnoreGroups, group.DisplayName) {
+			continue
+		}
+		known.groups[group.DisplayName] = group.ID
+
+		members, err := sp.groupMembers(ctx, group.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			if userName, ok := names[member.Value]; ok {
+				current[group.DisplayName] = append(current[group.DisplayName], userName)
+			}
+		}
+		desired[group.DisplayName] = make([]string, 0)
+	}
+
+	missing := make([]string, 0)
+	for _, u := range source {
+		for _, group := range sp.BaseConfig.GroupsOf(u) {
+			if slices.Contains(sp.BaseConfig.IgnoreGroups, group) {
+				continue
+			}
+
+			if _, ok := desired[group]; !ok {
+				missing = append(missing, group)
+				desired[group] = make([]string, 0)
+			}
+			desired[group] = append(desired[group], config.KeyOf(u, field))
+		}
+	}
+	sort.Strings(missing)
+
+	for _, group := range missing {
+		group := group
+		plan.AddVerified(engine.OperationCreateGroup, group, map[string]any{"name": group}, func(ctx context.Context) error {
+			created, err := sp.client.CreateGroup(ctx, Group{DisplayName: group})
+			if err == nil {
+				known.groups[group] = created.ID
+			}
+			return err
+		}, func(ctx context.Context) (bool, error) {
+			found, err := sp.findGroup(ctx, group)
+			return found != nil, err
+		})
+	}
+
+	plan.AddMemberships(current, desired, func(ctx context.Context, group, member string) error {
+		return sp.addMember(ctx, known, group, member)
+	}, func(ctx context.Context, group, member string) error {
+		return sp.removeMember(ctx, known, group, member)
+	})
+	return nil
+}
+
+func (sp *scimProvider) SyncProvider(ctx context.Context, source []map[string]any, opts ...engine.Option) (*engine.Result, error) {
+	plan, err := sp.Plan(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]engine.Option{engine.WithConfig(sp.BaseConfig)}, opts...)
+	return engine.Apply(ctx, plan, opts...)
+}
+
+// findUser returns the user with the given userName, or nil if there is none.
+func (sp *scimProvider) findUser(ctx context.Context, userName string) (*User, error) {
+	userName = strings.ReplaceAll(userName, `"`, `\"`)
+	filter := fmt.Sprintf(`userName eq "%s"`, userName)
+
+	users, err := sp.GetUsers(ctx, utils.ListOptions{Filter: &filter})
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+
+	return &users[0], nil
+}
+
+// findGroup returns the group with the given displayName, or nil if there is none.
+func (sp *scimProvider) findGroup(ctx context.Context, name string) (*Group, error) {
+	groups, err := sp.GetGroups(ctx, fmt.Sprintf(`displayName eq "%s"`, strings.ReplaceAll(name, `"`, `\"`)))
+	if err != nil || len(groups) == 0 {
+		return nil, err
+	}
+
+	return &groups[0], nil
+}
+
+// createUser creates a user and returns its id.
+func (sp *scimProvider) createUser(ctx context.Context, u map[string]any) (string, error) {
+	mapped, err := sp.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return "", err
+	}
+
+	user := Unflatten(mapped)
+	user.ID = ""
+	active := true
+	user.Active = &active
+
+	created, err := sp.client.CreateUser(ctx, user)
+	if err != nil {
+		return "", err
+	}
+
+	return created.ID, nil
+}
+
+// patchPath is the PATCH path of a flattened attribute.
+func patchPath(attr string) string {
+	if attr == "email" {
+		return `emails[type eq "work"].value`
+	}
+	return attr
+}
+
+// updateUser replaces the mapped attributes, removing the ones that are empty.
+func (sp *scimProvider) updateUser(ctx context.Context, id string, u map[string]any) error {
+	mapped, err := sp.BaseConfig.ConvertUserToProvider(u)
+	if err != nil {
+		return err
+	}
+	delete(mapped, "id")
+	delete(mapped, "active")
+
+	if sp.quirks.PutOnly {
+		return sp.replaceUser(ctx, id, func(attrs map[string]any) {
+			for attr, val := range mapped {
+				attrs[attr] = val
+			}
+		})
+	}
+
+	attrs := make([]string, 0, len(mapped))
+	for attr := range mapped {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+
+	ops := make([]PatchOperation, 0, len(attrs))
+	for _, attr := range attrs {
+		if val := mapped[attr]; val == nil || val == "" {
+			ops = append(ops, PatchOperation{Op: "remove", Path: patchPath(attr)})
+		} else {
+			ops = append(ops, PatchOperation{Op: "replace", Path: patchPath(attr), Value: val})
+		}
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	return sp.client.PatchUser(ctx, id, ops)
+}
+
+// replaceUser reads the user, lets change modify its flattened attributes and
+// writes it back with PUT.
+func (sp *scimProvider) replaceUser(ctx context.Context, id string, change func(map[string]any)) error {
+	user, err := sp.client.GetUser(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	attrs := Flatten(*user)
+	change(attrs)
+
+	replaced := Unflatten(attrs)
+	replaced.ID = id
+	return sp.client.ReplaceUser(ctx, replaced)
+}
+
+func (sp *scimProvider) setActive(ctx context.Context, id string, active bool) error {
+	if sp.quirks.PutOnly {
+		return sp.replaceUser(ctx, id, func(attrs map[string]any) {
+			attrs["active"] = active
+		})
+	}
+
+	var value any = active
+	if sp.quirks.BooleanStrings {
+		value = "False"
+		if active {
+			value = "True"
+		}
+	}
+
+	return sp.client.PatchUser(ctx, id, []PatchOperation{{Op: "replace", Path: "active", Value: value}})
+}
+
+func (sp *scimProvider) deleteUser(ctx context.Context, id string) error {
+	if err := sp.client.DeleteUser(ctx, id); err != nil && !IsNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// planIDs are the ids of the users and groups of a plan by name. They are
+// known from planning or recorded as objects are created, so membership
+// operations only look up objects created by an earlier, interrupted apply.
+type planIDs struct {
+	users  map[string]string
+	groups map[string]string
+}
+
+// memberIDs resolves a group and a user by name to their ids, looking them up
+// once when they are not known yet.
+func (sp *scimProvider) memberIDs(ctx context.Context, known *planIDs, group, member string) (string, string, error) {
+	if _, ok := known.groups[group]; !ok {
+		g, err := sp.findGroup(ctx, group)
+		if err != nil {
+			return "", "", err
+		}
+		if g == nil {
+			return "", "", fmt.Errorf("group %s not found", group)
+		}
+		known.groups[group] = g.ID
+	}
+
+	if _, ok := known.users[member]; !ok {
+		user, err := sp.findUser(ctx, member)
+		if err != nil {
+			return "", "", err
+		}
+		if user == nil {
+			return "", "", fmt.Errorf("user %s not found", member)
+		}
+		known.users[member] = user.ID
+	}
+
+	return known.groups[group], known.users[member], nil
+}
+
+func (sp *scimProvider) addMember(ctx context.Context, known *planIDs, group, member string) error {
+	groupID, userID, err := sp.memberIDs(ctx, known, group, member)
+	if err != nil {
+		return err
+	}
+
+	if !sp.quirks.PutOnly {
+		return sp.client.PatchGroup(ctx, groupID, []PatchOperation{AddMemberOp(userID)})
+	}
+
+	return sp.replaceMembers(ctx, groupID, func(members []Reference) []Reference {
+		return append(members, Reference{Value: userID})
+	})
+}
+
+func (sp *scimProvider) removeMember(ctx context.Context, known *planIDs, group, member string) error {
+	groupID, userID, err := sp.memberIDs(ctx, known, group, member)
+	if err != nil {
+		return err
+	}
+
+	if !sp.quirks.PutOnly {
+		return sp.client.PatchGroup(ctx, groupID, []PatchOperation{RemoveMemberOp(userID)})
+	}
+
+	return sp.replaceMembers(ctx, groupID, func(members []Reference) []Reference {
+		return slices.DeleteFunc(members, func(ref Reference) bool { return ref.Value == userID })
+	})
+}
+
+// groupMembers reads the members of a group on its own, as list responses
+// may omit them.
+func (sp *scimProvider) groupMembers(ctx context.Context, id string) ([]Reference, error) {
+	group, err := sp.client.GetGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return group.Members, nil
+}
+
+// replaceMembers reads the group's members, which list responses may omit,
+// and writes the changed list back with PUT.
+func (sp *scimProvider) replaceMembers(ctx context.Context, id string, change func([]Reference) []Reference) error {
+	group, err := sp.client.GetGroup(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	group.Members = change(group.Members)
+	return sp.client.ReplaceGroup(ctx, *group)
+}
@@ -0,0 +1,62 @@
+package scim
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	resolvers "github.com/tiagoposse/go-secret-resolvers"
+)
+
+func TestPlanReadsGroupMembersThatListingsOmit(t *testing.T) {
+	users := []User{{ID: "u1", UserName: "alice"}, {ID: "u2", UserName: "bob"}}
+	group := Group{ID: "g1", DisplayName: "eng", Members: []Reference{{Value: "u1"}, {Value: "u2"}}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Users", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ListResponse[User]{TotalResults: len(users), StartIndex: 1, Resources: users})
+	})
+	// Like some service providers, the listing leaves the members out.
+	mux.HandleFunc("/Groups", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ListResponse[Group]{TotalResults: 1, StartIndex: 1, Resources: []Group{{ID: group.ID, DisplayName: group.DisplayName}}})
+	})
+	mux.HandleFunc("/Groups/g1", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, group)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	token := "secret"
+	sp, err := NewSCIMProvider(context.Background(), &config.SCIMConfig{
+		BaseConfig: config.BaseConfig{Mapping: map[string]string{"userName": "username"}, GroupField: "groups"},
+		Name:       "test",
+		Url:        srv.URL,
+		Token:      &resolvers.ResolverField{Value: &token},
+	})
+	if err != nil {
+		t.Fatalf("creating provider: %v", err)
+	}
+
+	plan, err := sp.Plan(context.Background(), []map[string]any{
+		{"username": "alice", "groups": []string{"eng"}},
+		{"username": "bob"},
+	})
+	if err != nil {
+		t.Fatalf("Plan: %v", err)
+	}
+
+	ops := make([]string, 0, len(plan.Operations))
+	for _, op := range plan.Operations {
+		ops = append(ops, op.ID())
+	}
+	if want := []string{string(engine.OperationRemoveMember) + ":eng/bob"}; !slices.Equal(ops, want) {
+		t.Errorf("planned %v, want %v", ops, want)
+	}
+	if plan.Members != 2 || plan.DesiredMembers != 1 {
+		t.Errorf("members = %d, desired members = %d, want 2 and 1", plan.Members, plan.DesiredMembers)
+	}
+}
@@ -0,0 +1,410 @@
+package scim
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SchemaUser           = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SchemaGroup          = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SchemaEnterpriseUser = "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"
+	SchemaListResponse   = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SchemaPatchOp        = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SchemaError          = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+	defaultPageSize = 100
+)
+
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// Meta holds the resource metadata set by the service provider.
+type Meta struct {
+	ResourceType string    `json:"resourceType,omitempty"`
+	Created      time.Time `json:"created,omitempty"`
+	LastModified time.Time `json:"lastModified,omitempty"`
+	Location     string    `json:"location,omitempty"`
+}
+
+// EnterpriseUser holds the enterprise extension attributes.
+type EnterpriseUser struct {
+	EmployeeNumber string     `json:"employeeNumber,omitempty"`
+	CostCenter     string     `json:"costCenter,omitempty"`
+	Organization   string     `json:"organization,omitempty"`
+	Division       string     `json:"division,omitempty"`
+	Department     string     `json:"department,omitempty"`
+	Manager        *Reference `json:"manager,omitempty"`
+}
+
+// Reference points at another resource by its id.
+type Reference struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+type User struct {
+	Schemas     []string        `json:"schemas,omitempty"`
+	ID          string          `json:"id,omitempty"`
+	ExternalID  string          `json:"externalId,omitempty"`
+	UserName    string          `json:"userName,omitempty"`
+	DisplayName string          `json:"displayName,omitempty"`
+	Title       string          `json:"title,omitempty"`
+	Active      *bool           `json:"active,omitempty"`
+	Name        *Name           `json:"name,omitempty"`
+	Emails      []Email         `json:"emails,omitempty"`
+	Enterprise  *EnterpriseUser `json:"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User,omitempty"`
+	Meta        *Meta           `json:"meta,omitempty"`
+}
+
+type Group struct {
+	Schemas     []string    `json:"schemas,omitempty"`
+	ID          string      `json:"id,omitempty"`
+	ExternalID  string      `json:"externalId,omitempty"`
+	DisplayName string      `json:"displayName"`
+	Members     []Reference `json:"members,omitempty"`
+	Meta        *Meta       `json:"meta,omitempty"`
+}
+
+// IsActive treats a user without an active attribute as active.
+func (u User) IsActive() bool {
+	return u.Active == nil || *u.Active
+}
+
+type ListResponse[T any] struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []T      `json:"Resources"`
+}
+
+type PatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path,omitempty"`
+	Value any    `json:"value,omitempty"`
+}
+
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+// Error is a SCIM error response.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Detail     string `json:"detail"`
+	ScimType   string `json:"scimType,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.ScimType != "" {
+		return fmt.Sprintf("scim returned %d (%s): %s", e.StatusCode, e.ScimType, e.Detail)
+	}
+	return fmt.Sprintf("scim returned %d: %s", e.StatusCode, e.Detail)
+}
+
+func IsNotFound(err error) bool {
+	var scimErr *Error
+	return errors.As(err, &scimErr) && scimErr.StatusCode == http.StatusNotFound
+}
+
+// tokenTransport authenticates every request with a bearer token.
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.token))
+	return t.base.RoundTrip(req)
+}
+
+// Client talks to the Users and Groups endpoints of a SCIM 2.0 service provider.
+type Client struct {
+	http     *http.Client
+	baseURL  string
+	pageSize int
+}
+
+// NewClient returns a client for the service provider at baseURL, the URL
+// that /Users and /Groups are relative to. base may be nil to use the default transport.
+func NewClient(baseURL, token string, base http.RoundTripper) *Client {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &Client{
+		http:     &http.Client{Transport: &tokenTransport{token: token, base: base}},
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		pageSize: defaultPageSize,
+	}
+}
+
+// SetPageSize changes how many resources are requested per page.
+func (c *Client) SetPageSize(size int) {
+	if size > 0 {
+		c.pageSize = size
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(bs)
+	}
+
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/scim+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/scim+json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bs, _ := io.ReadAll(resp.Body)
+		scimErr := &Error{StatusCode: resp.StatusCode}
+		if json.Unmarshal(bs, scimErr) != nil || scimErr.Detail == "" {
+			scimErr.Detail = strings.TrimSpace(string(bs))
+		}
+		return scimErr
+	}
+
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("decoding response of %s %s: %w", method, path, err)
+		}
+	}
+
+	return nil
+}
+
+// list pages through every resource of an endpoint matching the filter, which may be empty.
+func list[T any](ctx context.Context, c *Client, path, filter string) ([]T, error) {
+	items := make([]T, 0)
+
+	for startIndex := 1; ; {
+		query := url.Values{
+			"startIndex": []string{strconv.Itoa(startIndex)},
+			"count":      []string{strconv.Itoa(c.pageSize)},
+		}
+		if filter != "" {
+			query.Set("filter", filter)
+		}
+
+		var page ListResponse[T]
+		if err := c.do(ctx, http.MethodGet, path, query, nil, &page); err != nil {
+			return nil, fmt.Errorf("listing %s: %w", path, err)
+		}
+
+		items = append(items, page.Resources...)
+		startIndex += len(page.Resources)
+		if len(page.Resources) == 0 || startIndex > page.TotalResults {
+			return items, nil
+		}
+	}
+}
+
+// ListUsers pages through every user matching the filter, which may be empty.
+func (c *Client) ListUsers(ctx context.Context, filter string) ([]User, error) {
+	return list[User](ctx, c, "/Users", filter)
+}
+
+func (c *Client) GetUser(ctx context.Context, id string) (*User, error) {
+	var user User
+	if err := c.do(ctx, http.MethodGet, "/Users/"+url.PathEscape(id), nil, nil, &user); err != nil {
+		return nil, fmt.Errorf("getting user %s: %w", id, err)
+	}
+
+	return &user, nil
+}
+
+func (c *Client) CreateUser(ctx context.Context, user User) (*User, error) {
+	if len(user.Schemas) == 0 {
+		user.Schemas = []string{SchemaUser}
+	}
+
+	var created User
+	if err := c.do(ctx, http.MethodPost, "/Users", nil, user, &created); err != nil {
+		return nil, fmt.Errorf("creating user %s: %w", user.UserName, err)
+	}
+
+	return &created, nil
+}
+
+func (c *Client) PatchUser(ctx context.Context, id string, ops []PatchOperation) error {
+	req := PatchRequest{
+		Schemas:    []string{SchemaPatchOp},
+		Operations: ops,
+	}
+
+	if err := c.do(ctx, http.MethodPatch, "/Users/"+url.PathEscape(id), nil, req, nil); err != nil {
+		return fmt.Errorf("patching user %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// ReplaceUser overwrites the user, for service providers without PATCH support.
+func (c *Client) ReplaceUser(ctx context.Context, user User) error {
+	if len(user.Schemas) == 0 {
+		user.Schemas = []string{SchemaUser}
+	}
+
+	if err := c.do(ctx, http.MethodPut, "/Users/"+url.PathEscape(user.ID), nil, user, nil); err != nil {
+		return fmt.Errorf("replacing user %s: %w", user.ID, err)
+	}
+
+	return nil
+}
+
+func (c *Client) DeleteUser(ctx context.Context, id string) error {
+	if err := c.do(ctx, http.MethodDelete, "/Users/"+url.PathEscape(id), nil, nil, nil); err != nil {
+		return fmt.Errorf("deleting user %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// EnterpriseAttribute is the flattened name and patch path of an enterprise
+// extension attribute, e.g. EnterpriseAttribute("department").
+func EnterpriseAttribute(name string) string {
+	return fmt.Sprintf("%s:%s", SchemaEnterpriseUser, name)
+}
+
+// Flatten turns a user into the attributes that can be mapped, keyed by
+// their SCIM attribute path. The primary email is kept as email and the
+// manager as its id.
+func Flatten(u User) map[string]any {
+	attrs := map[string]any{
+		"id":              u.ID,
+		"externalId":      u.ExternalID,
+		"userName":        u.UserName,
+		"displayName":     u.DisplayName,
+		"title":           u.Title,
+		"active":          u.IsActive(),
+		"name.formatted":  "",
+		"name.givenName":  "",
+		"name.familyName": "",
+		"email":           "",
+	}
+
+	if u.Name != nil {
+		attrs["name.formatted"] = u.Name.Formatted
+		attrs["name.givenName"] = u.Name.GivenName
+		attrs["name.familyName"] = u.Name.FamilyName
+	}
+
+	for i, email := range u.Emails {
+		if email.Primary || i == 0 {
+			attrs["email"] = email.Value
+		}
+	}
+
+	ent := EnterpriseUser{}
+	if u.Enterprise != nil {
+		ent = *u.Enterprise
+	}
+
+	attrs[EnterpriseAttribute("employeeNumber")] = ent.EmployeeNumber
+	attrs[EnterpriseAttribute("costCenter")] = ent.CostCenter
+	attrs[EnterpriseAttribute("organization")] = ent.Organization
+	attrs[EnterpriseAttribute("division")] = ent.Division
+	attrs[EnterpriseAttribute("department")] = ent.Department
+	attrs[EnterpriseAttribute("manager")] = ""
+	if ent.Manager != nil {
+		attrs[EnterpriseAttribute("manager")] = ent.Manager.Value
+	}
+
+	return attrs
+}
+
+// Unflatten builds a user from attributes keyed like Flatten.
+func Unflatten(attrs map[string]any) User {
+	str := func(key string) string {
+		if val, ok := attrs[key]; ok && val != nil {
+			return fmt.Sprint(val)
+		}
+		return ""
+	}
+
+	u := User{
+		Schemas:     []string{SchemaUser},
+		ID:          str("id"),
+		ExternalID:  str("externalId"),
+		UserName:    str("userName"),
+		DisplayName: str("displayName"),
+		Title:       str("title"),
+	}
+
+	if active, ok := attrs["active"].(bool); ok {
+		u.Active = &active
+	}
+
+	name := Name{
+		Formatted:  str("name.formatted"),
+		GivenName:  str("name.givenName"),
+		FamilyName: str("name.familyName"),
+	}
+	if name != (Name{}) {
+		u.Name = &name
+	}
+
+	if email := str("email"); email != "" {
+		u.Emails = []Email{{Value: email, Type: "work", Primary: true}}
+	}
+
+	ent := EnterpriseUser{
+		EmployeeNumber: str(EnterpriseAttribute("employeeNumber")),
+		CostCenter:     str(EnterpriseAttribute("costCenter")),
+		Organization:   str(EnterpriseAttribute("organization")),
+		Division:       str(EnterpriseAttribute("division")),
+		Department:     str(EnterpriseAttribute("department")),
+	}
+	if manager := str(EnterpriseAttribute("manager")); manager != "" {
+		ent.Manager = &Reference{Value: manager}
+	}
+	if ent != (EnterpriseUser{}) {
+		u.Enterprise = &ent
+		u.Schemas = append(u.Schemas, SchemaEnterpriseUser)
+	}
+
+	return u
+}
@@ -0,0 +1,606 @@
+package scim
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/audit"
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/state"
+	"github.com/tiagoposse/go-identity-sync/utils"
+)
+
+const (
+	// directoryKey is where the server keeps the users and groups pushed to it.
+	directoryKey = "scim-server/directory"
+	// auditTarget is the target recorded for writes to the server itself.
+	auditTarget = "scim-server"
+)
+
+// Planner plans the changes that bring a target in line with a source, as
+// every provider's Plan does.
+type Planner interface {
+	Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error)
+}
+
+// Target is a provider the server pushes writes to. Options are passed to
+// the engine, usually engine.WithConfig with the provider's config.
+type Target struct {
+	Planner Planner
+	Options []engine.Option
+}
+
+// directory holds the users and groups by id.
+type directory struct {
+	Users  map[string]User  `json:"users"`
+	Groups map[string]Group `json:"groups"`
+}
+
+// Server is a SCIM 2.0 service provider identity providers push changes to.
+// Every write is kept in the state store and applied to the targets in the
+// background: each target is planned against the whole directory and the
+// operations that concern the written users and groups are applied. Close
+// stops the server once the pending writes have been applied.
+type Server struct {
+	cfg     *config.SCIMServerConfig
+	tokens  map[string]string
+	store   state.Store
+	audit   audit.Logger
+	targets []Target
+
+	// mu serialises writes so they are queued in the order they are saved.
+	mu sync.Mutex
+
+	// queue holds the saved writes that have yet to reach the targets. A
+	// single worker applies them in order, see run.
+	queueMu   sync.Mutex
+	queue     []*change
+	wake      chan struct{}
+	closing   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	cancel    context.CancelFunc
+}
+
+func NewServer(cfg *config.SCIMServerConfig, store state.Store, log audit.Logger, targets ...Target) (*Server, error) {
+	if store == nil {
+		return nil, errors.New("scim server requires a state store")
+	}
+
+	tokens := make(map[string]string)
+	for name, token := range cfg.Tokens {
+		if token == nil || token.Value == nil || *token.Value == "" {
+			return nil, fmt.Errorf("scim server token %s is empty", name)
+		}
+		tokens[name] = *token.Value
+	}
+
+	if len(tokens) == 0 {
+		return nil, errors.New("scim server requires at least one token")
+	}
+
+	// Writes are applied after their request returns, so the worker's
+	// context is only cancelled by Close.
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		cfg:     cfg,
+		tokens:  tokens,
+		store:   store,
+		audit:   log,
+		targets: targets,
+		wake:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+		cancel:  cancel,
+	}
+	go s.run(ctx)
+
+	return s, nil
+}
+
+// Close waits for the pending writes to be applied to the targets and stops
+// the worker. When ctx is done first, the write being applied is cancelled
+// and the remaining ones are left to the next full sync. Writes the server
+// accepts after Close are saved but not applied.
+func (s *Server) Close(ctx context.Context) error {
+	s.closeOnce.Do(func() { close(s.closing) })
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		<-s.done
+		return ctx.Err()
+	}
+}
+
+// enqueue hands a saved write to the worker.
+func (s *Server) enqueue(ch *change) {
+	s.queueMu.Lock()
+	s.queue = append(s.queue, ch)
+	s.queueMu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Server) dequeue() (*change, bool) {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+
+	if len(s.queue) == 0 {
+		return nil, false
+	}
+
+	ch := s.queue[0]
+	s.queue = s.queue[1:]
+	return ch, true
+}
+
+// run applies the queued writes one at a time until the server is closed
+// and the queue is drained.
+func (s *Server) run(ctx context.Context) {
+	defer close(s.done)
+	defer s.cancel()
+
+	for {
+		if ch, ok := s.dequeue(); ok {
+			s.apply(ctx, ch)
+			continue
+		}
+
+		select {
+		case <-s.wake:
+		case <-s.closing:
+			for ch, ok := s.dequeue(); ok && ctx.Err() == nil; ch, ok = s.dequeue() {
+				s.apply(ctx, ch)
+			}
+			return
+		}
+	}
+}
+
+// apply propagates a write and records a failure in the audit trail.
+func (s *Server) apply(ctx context.Context, ch *change) {
+	if err := s.propagate(ctx, ch); err != nil {
+		s.log(ctx, ch.actor, ch.action, ch.key, err)
+	}
+}
+
+func (s *Server) pageSize() int {
+	if s.cfg.PageSize > 0 {
+		return s.cfg.PageSize
+	}
+	return defaultPageSize
+}
+
+// authenticate returns the name of the client whose token the request carries.
+func (s *Server) authenticate(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", false
+	}
+
+	for name, expected := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// ServeHTTP serves the SCIM endpoints relative to the handler's root, so it
+// is usually mounted with http.StripPrefix.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	actor, ok := s.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "", "missing or invalid bearer token")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) > 2 {
+		writeError(w, http.StatusNotFound, "", "not found")
+		return
+	}
+
+	id := ""
+	if len(parts) == 2 {
+		id = parts[1]
+	}
+
+	switch parts[0] {
+	case "ServiceProviderConfig":
+		s.serveStatic(w, r, id, newServiceProviderConfig(s.pageSize()))
+	case "ResourceTypes":
+		s.serveStatic(w, r, id, ListResponse[resourceType]{
+			Schemas:      []string{SchemaListResponse},
+			TotalResults: len(resourceTypes),
+			StartIndex:   1,
+			ItemsPerPage: len(resourceTypes),
+			Resources:    resourceTypes,
+		})
+	case "Schemas":
+		s.serveStatic(w, r, id, ListResponse[schema]{
+			Schemas:      []string{SchemaListResponse},
+			TotalResults: len(schemas),
+			StartIndex:   1,
+			ItemsPerPage: len(schemas),
+			Resources:    schemas,
+		})
+	case "Users":
+		s.serveUsers(w, r, actor, id)
+	case "Groups":
+		s.serveGroups(w, r, actor, id)
+	default:
+		writeError(w, http.StatusNotFound, "", "not found")
+	}
+}
+
+func (s *Server) serveStatic(w http.ResponseWriter, r *http.Request, id string, body any) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+		return
+	}
+
+	if id != "" {
+		writeError(w, http.StatusNotFound, "", "not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, scimType, detail string) {
+	writeJSON(w, status, struct {
+		Schemas  []string `json:"schemas"`
+		Status   string   `json:"status"`
+		ScimType string   `json:"scimType,omitempty"`
+		Detail   string   `json:"detail"`
+	}{
+		Schemas:  []string{SchemaError},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+// writeFailure answers with the status matching err.
+func writeFailure(w http.ResponseWriter, err error) {
+	var patchErr *patchError
+	var scimErr *Error
+	switch {
+	case errors.As(err, &patchErr):
+		writeError(w, http.StatusBadRequest, patchErr.scimType, patchErr.detail)
+	case errors.As(err, &scimErr):
+		writeError(w, scimErr.StatusCode, scimErr.ScimType, scimErr.Detail)
+	default:
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+	}
+}
+
+func notFound(kind, id string) error {
+	return &Error{StatusCode: http.StatusNotFound, Detail: fmt.Sprintf("%s %s not found", kind, id)}
+}
+
+func conflict(detail string) error {
+	return &Error{StatusCode: http.StatusConflict, ScimType: "uniqueness", Detail: detail}
+}
+
+func badRequest(scimType, detail string) error {
+	return &Error{StatusCode: http.StatusBadRequest, ScimType: scimType, Detail: detail}
+}
+
+func (s *Server) load(ctx context.Context) (*directory, error) {
+	dir := &directory{}
+	if err := state.GetJSON(ctx, s.store, directoryKey, dir); err != nil && !errors.Is(err, state.ErrNotFound) {
+		return nil, err
+	}
+
+	if dir.Users == nil {
+		dir.Users = make(map[string]User)
+	}
+	if dir.Groups == nil {
+		dir.Groups = make(map[string]Group)
+	}
+	return dir, nil
+}
+
+func newID() (string, error) {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bs), nil
+}
+
+// page applies the filter and pagination parameters of a list request.
+func page[T any](r *http.Request, items []T, attrs func(T) map[string]any, pageSize int) (ListResponse[T], error) {
+	match, err := parseFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		return ListResponse[T]{}, badRequest("invalidFilter", err.Error())
+	}
+
+	matched := make([]T, 0)
+	for _, item := range items {
+		if match(attrs(item)) {
+			matched = append(matched, item)
+		}
+	}
+
+	startIndex, count := 1, pageSize
+	if val := r.URL.Query().Get("startIndex"); val != "" {
+		if startIndex, err = strconv.Atoi(val); err != nil {
+			return ListResponse[T]{}, badRequest("invalidValue", "startIndex must be a number")
+		}
+	}
+	if val := r.URL.Query().Get("count"); val != "" {
+		if count, err = strconv.Atoi(val); err != nil {
+			return ListResponse[T]{}, badRequest("invalidValue", "count must be a number")
+		}
+	}
+	startIndex = max(startIndex, 1)
+	count = min(max(count, 0), pageSize)
+
+	resources := make([]T, 0)
+	if startIndex <= len(matched) {
+		resources = matched[startIndex-1 : min(startIndex-1+count, len(matched))]
+	}
+
+	return ListResponse[T]{
+		Schemas:      []string{SchemaListResponse},
+		TotalResults: len(matched),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}, nil
+}
+
+// sortedValues returns the map's values ordered by id, for stable pagination.
+func sortedValues[T any](items map[string]T) []T {
+	ids := make([]string, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	values := make([]T, 0, len(ids))
+	for _, id := range ids {
+		values = append(values, items[id])
+	}
+	return values
+}
+
+func groupAttributes(g Group) map[string]any {
+	members := make([]string, 0, len(g.Members))
+	for _, member := range g.Members {
+		members = append(members, member.Value)
+	}
+
+	return map[string]any{
+		"id":            g.ID,
+		"externalId":    g.ExternalID,
+		"displayName":   g.DisplayName,
+		"members.value": members,
+	}
+}
+
+// change is the outcome of a write: the users and groups it touched, before
+// and after, for propagation and the audit trail.
+type change struct {
+	key    string
+	status int
+	body   any
+	users  []User
+	groups []string
+
+	// actor and action are recorded with a failure to propagate the change.
+	actor  string
+	action string
+}
+
+// write runs a modification of the directory, saves it, records it in the
+// audit trail and queues it for the targets. The identity provider gets the
+// response as soon as the directory is saved; a failure to apply it to a
+// target is recorded in the audit trail and reconciled by the next full sync.
+func (s *Server) write(w http.ResponseWriter, r *http.Request, actor, action, key string, modify func(dir *directory) (*change, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ctx := r.Context()
+	dir, err := s.load(ctx)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	ch, err := modify(dir)
+	if err == nil {
+		err = state.PutJSON(ctx, s.store, directoryKey, dir)
+	}
+
+	if err != nil {
+		s.log(ctx, actor, action, key, err)
+		writeFailure(w, err)
+		return
+	}
+
+	s.log(ctx, actor, action, ch.key, nil)
+	if len(s.targets) > 0 {
+		ch.actor, ch.action = actor, action
+		s.enqueue(ch)
+	}
+
+	if ch.body == nil {
+		w.WriteHeader(ch.status)
+		return
+	}
+	writeJSON(w, ch.status, ch.body)
+}
+
+func (s *Server) log(ctx context.Context, actor, action, key string, err error) {
+	if s.audit == nil {
+		return
+	}
+
+	event := audit.Event{
+		Target: auditTarget,
+		Action: action,
+		Key:    key,
+		Status: string(engine.StatusSucceeded),
+		Actor:  actor,
+	}
+	if err != nil {
+		event.Status = string(engine.StatusFailed)
+		event.Error = err.Error()
+	}
+
+	// The write already happened, a failure to record it must not undo it.
+	_ = s.audit.Log(ctx, event)
+}
+
+// source converts the active users of the directory into common fields, with
+// their group names under the group field.
+func (s *Server) source(dir *directory) ([]map[string]any, error) {
+	memberships := make(map[string][]string)
+	for _, group := range sortedValues(dir.Groups) {
+		for _, member := range group.Members {
+			memberships[member.Value] = append(memberships[member.Value], group.DisplayName)
+		}
+	}
+
+	users := make([]map[string]any, 0, len(dir.Users))
+	for _, item := range sortedValues(dir.Users) {
+		if !item.IsActive() {
+			continue
+		}
+
+		user, err := s.cfg.ConvertUser(Flatten(item))
+		if err != nil {
+			return nil, err
+		}
+
+		if s.cfg.GroupField != "" {
+			user[s.cfg.GroupField] = memberships[item.ID]
+		}
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+// GetUsersConverted returns the pushed users like a source provider does, so
+// the directory can also be synced in full.
+func (s *Server) GetUsersConverted(ctx context.Context, lo utils.ListOptions) ([]map[string]any, error) {
+	dir, err := s.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.source(dir)
+}
+
+// propagate plans every target against the directory as it is now, which
+// includes the change and the ones saved before it, and applies the
+// operations concerning the changed users and groups.
+func (s *Server) propagate(ctx context.Context, ch *change) error {
+	s.mu.Lock()
+	dir, err := s.load(ctx)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	source, err := s.source(dir)
+	if err != nil {
+		return err
+	}
+
+	touched := make([]map[string]any, 0, len(ch.users))
+	for _, user := range ch.users {
+		converted, err := s.cfg.ConvertUser(Flatten(user))
+		if err != nil {
+			return err
+		}
+		touched = append(touched, converted)
+	}
+
+	errs := make([]error, 0)
+	for _, target := range s.targets {
+		plan, err := target.Planner.Plan(ctx, source)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		opts := target.Options
+		if s.audit != nil {
+			opts = append(slices.Clip(opts), engine.WithAuditLogger(s.audit))
+		}
+
+		if _, err := engine.Apply(ctx, only(plan, touched, ch.groups), opts...); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", plan.Target, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// only returns a copy of the plan with the operations on the given users and
+// groups. Users are matched by the plan's key field.
+func only(plan *engine.Plan, users []map[string]any, groups []string) *engine.Plan {
+	keys := make([]string, 0, len(users))
+	for _, user := range users {
+		keys = append(keys, config.KeyOf(user, plan.Field))
+	}
+
+	filtered := *plan
+	filtered.Operations = make([]engine.Operation, 0)
+	for _, op := range plan.Operations {
+		var keep bool
+		switch op.Kind {
+		case engine.OperationAddMember, engine.OperationRemoveMember:
+			keep = slices.Contains(keys, fmt.Sprint(op.Object["member"])) || slices.Contains(groups, fmt.Sprint(op.Object["group"]))
+		case engine.OperationCreateGroup, engine.OperationUpdateGroup, engine.OperationDeleteGroup:
+			keep = slices.Contains(groups, op.Key)
+		case engine.OperationGrant, engine.OperationRevoke:
+			keep = slices.Contains(groups, fmt.Sprint(op.Object["group"]))
+		default:
+			keep = slices.Contains(keys, op.Key)
+		}
+
+		if keep {
+			filtered.Operations = append(filtered.Operations, op)
+		}
+	}
+
+	return &filtered
+}
+
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
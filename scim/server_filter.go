@@ -0,0 +1,220 @@
+package scim
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// filterFunc reports whether a resource, given as its flattened attributes,
+// matches a filter.
+type filterFunc func(attrs map[string]any) bool
+
+// parseFilter parses the subset of the SCIM filter grammar identity providers
+// send: comparisons joined by and and or, without grouping. Attribute names
+// are case insensitive and multi-valued attributes match if any value does.
+func parseFilter(filter string) (filterFunc, error) {
+	tokens, err := tokenizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return func(map[string]any) bool { return true }, nil
+	}
+
+	// Split on or first so that and binds tighter.
+	alternatives := make([][]filterFunc, 1)
+	for i := 0; i < len(tokens); {
+		if len(alternatives[len(alternatives)-1]) > 0 {
+			switch strings.ToLower(tokens[i]) {
+			case "and":
+				i++
+			case "or":
+				alternatives = append(alternatives, nil)
+				i++
+			default:
+				return nil, fmt.Errorf("expected and or or at %q", tokens[i])
+			}
+		}
+
+		cmp, n, err := parseComparison(tokens[i:])
+		if err != nil {
+			return nil, err
+		}
+		alternatives[len(alternatives)-1] = append(alternatives[len(alternatives)-1], cmp)
+		i += n
+	}
+
+	return func(attrs map[string]any) bool {
+		for _, all := range alternatives {
+			matched := true
+			for _, cmp := range all {
+				if !cmp(attrs) {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// parseComparison parses attr pr or attr op value and returns the number of
+// tokens it used.
+func parseComparison(tokens []string) (filterFunc, int, error) {
+	if len(tokens) < 2 {
+		return nil, 0, fmt.Errorf("incomplete filter expression %q", strings.Join(tokens, " "))
+	}
+
+	attr, op := filterAttribute(tokens[0]), strings.ToLower(tokens[1])
+	if op == "pr" {
+		return func(attrs map[string]any) bool {
+			return anyValue(lookup(attrs, attr), func(val string) bool { return val != "" })
+		}, 2, nil
+	}
+
+	if len(tokens) < 3 {
+		return nil, 0, fmt.Errorf("missing value for %s %s", tokens[0], tokens[1])
+	}
+
+	want, err := filterValue(tokens[2])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var compare func(val string) bool
+	switch op {
+	case "eq":
+		compare = func(val string) bool { return strings.EqualFold(val, want) }
+	case "ne":
+		return func(attrs map[string]any) bool {
+			return !anyValue(lookup(attrs, attr), func(val string) bool { return strings.EqualFold(val, want) })
+		}, 3, nil
+	case "co":
+		compare = func(val string) bool { return strings.Contains(strings.ToLower(val), strings.ToLower(want)) }
+	case "sw":
+		compare = func(val string) bool { return strings.HasPrefix(strings.ToLower(val), strings.ToLower(want)) }
+	case "ew":
+		compare = func(val string) bool { return strings.HasSuffix(strings.ToLower(val), strings.ToLower(want)) }
+	case "gt":
+		compare = func(val string) bool { return val > want }
+	case "ge":
+		compare = func(val string) bool { return val >= want }
+	case "lt":
+		compare = func(val string) bool { return val < want }
+	case "le":
+		compare = func(val string) bool { return val <= want }
+	default:
+		return nil, 0, fmt.Errorf("unsupported filter operator %s", tokens[1])
+	}
+
+	return func(attrs map[string]any) bool {
+		return anyValue(lookup(attrs, attr), compare)
+	}, 3, nil
+}
+
+// filterAttribute maps the attribute paths identity providers filter on to
+// the flattened attribute names.
+func filterAttribute(attr string) string {
+	switch strings.ToLower(attr) {
+	case "emails", "emails.value", `emails[type eq "work"].value`, "emails[primary eq true].value":
+		return "email"
+	case "members":
+		return "members.value"
+	}
+	return attr
+}
+
+// filterValue decodes a quoted string, boolean, null or number.
+func filterValue(token string) (string, error) {
+	if strings.HasPrefix(token, `"`) {
+		val, err := strconv.Unquote(token)
+		if err != nil {
+			return "", fmt.Errorf("invalid filter value %s: %w", token, err)
+		}
+		return val, nil
+	}
+
+	switch strings.ToLower(token) {
+	case "true", "false":
+		return strings.ToLower(token), nil
+	case "null":
+		return "", nil
+	}
+
+	if _, err := strconv.ParseFloat(token, 64); err != nil {
+		return "", fmt.Errorf("invalid filter value %s", token)
+	}
+	return token, nil
+}
+
+// lookup finds an attribute ignoring case.
+func lookup(attrs map[string]any, attr string) any {
+	if val, ok := attrs[attr]; ok {
+		return val
+	}
+
+	for key, val := range attrs {
+		if strings.EqualFold(key, attr) {
+			return val
+		}
+	}
+	return nil
+}
+
+func anyValue(val any, match func(string) bool) bool {
+	switch v := val.(type) {
+	case nil:
+		return false
+	case []string:
+		for _, item := range v {
+			if match(item) {
+				return true
+			}
+		}
+		return false
+	default:
+		return match(fmt.Sprint(v))
+	}
+}
+
+// tokenizeFilter splits a filter on whitespace, keeping quoted strings whole.
+func tokenizeFilter(filter string) ([]string, error) {
+	tokens := make([]string, 0)
+	for i := 0; i < len(filter); {
+		switch {
+		case filter[i] == ' ' || filter[i] == '\t':
+			i++
+		case filter[i] == '"':
+			end := i + 1
+			for ; end < len(filter) && filter[end] != '"'; end++ {
+				if filter[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(filter) {
+				return nil, fmt.Errorf("unterminated string in filter %q", filter)
+			}
+			tokens = append(tokens, filter[i:end+1])
+			i = end + 1
+		default:
+			end := i
+			for ; end < len(filter) && filter[end] != ' ' && filter[end] != '\t'; end++ {
+				// Value filters such as emails[type eq "work"] stay one token.
+				if filter[end] == '[' {
+					if close := strings.IndexByte(filter[end:], ']'); close > 0 {
+						end += close
+					}
+				}
+			}
+			tokens = append(tokens, filter[i:end])
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
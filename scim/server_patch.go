@@ -0,0 +1,294 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// memberFilterPath matches members[value eq "id"] paths.
+var memberFilterPath = regexp.MustCompile(`(?i)^members\[value eq "([^"]*)"\]$`)
+
+// patchError is returned for operations the server cannot apply. It carries
+// the scimType of the resulting 400 response.
+type patchError struct {
+	scimType string
+	detail   string
+}
+
+func (e *patchError) Error() string {
+	return e.detail
+}
+
+func invalidPath(path string) error {
+	return &patchError{scimType: "invalidPath", detail: fmt.Sprintf("unsupported path %s", path)}
+}
+
+func invalidValue(format string, args ...any) error {
+	return &patchError{scimType: "invalidValue", detail: fmt.Sprintf(format, args...)}
+}
+
+// patchUser applies the operations to the user's flattened attributes.
+func patchUser(user User, ops []PatchOperation) (User, error) {
+	attrs := Flatten(user)
+
+	for _, op := range ops {
+		switch strings.ToLower(op.Op) {
+		case "add", "replace":
+			values := map[string]any{}
+			if op.Path == "" {
+				obj, ok := op.Value.(map[string]any)
+				if !ok {
+					return user, invalidValue("%s without a path needs an object value", op.Op)
+				}
+				flattenValue("", obj, values)
+			} else {
+				flattenValue("", map[string]any{op.Path: op.Value}, values)
+			}
+
+			for path, val := range values {
+				attr, ok := userAttribute(attrs, path)
+				if !ok {
+					return user, invalidPath(path)
+				}
+
+				if attr == "active" {
+					active, err := parseBool(val)
+					if err != nil {
+						return user, err
+					}
+					val = active
+				}
+				attrs[attr] = val
+			}
+		case "remove":
+			attr, ok := userAttribute(attrs, op.Path)
+			if !ok {
+				return user, invalidPath(op.Path)
+			}
+
+			if attr == "active" {
+				delete(attrs, attr)
+			} else {
+				attrs[attr] = ""
+			}
+		default:
+			return user, invalidValue("unsupported op %s", op.Op)
+		}
+	}
+
+	patched := Unflatten(attrs)
+	patched.Meta = user.Meta
+	return patched, nil
+}
+
+// flattenValue flattens nested objects such as {"name": {"givenName": ...}}
+// into dotted paths. Extension attributes are joined with a colon, and
+// multi-valued or complex values are reduced to their primary value.
+func flattenValue(prefix string, obj map[string]any, into map[string]any) {
+	for key, val := range obj {
+		path := key
+		if strings.HasPrefix(strings.ToLower(prefix), "urn:") {
+			path = prefix + ":" + key
+		} else if prefix != "" {
+			path = prefix + "." + key
+		}
+
+		switch v := val.(type) {
+		case map[string]any:
+			if inner, ok := v["value"]; ok {
+				into[path] = inner
+			} else {
+				flattenValue(path, v, into)
+			}
+		case []any:
+			into[path] = primaryValue(v)
+		default:
+			into[path] = v
+		}
+	}
+}
+
+// primaryValue returns the value of the primary entry of a multi-valued
+// attribute, or of its first entry.
+func primaryValue(items []any) any {
+	var value any
+	for i, item := range items {
+		entry, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		if primary, _ := entry["primary"].(bool); primary || i == 0 {
+			value = entry["value"]
+		}
+	}
+	return value
+}
+
+// userAttribute resolves a patch path to the flattened attribute it changes.
+func userAttribute(attrs map[string]any, path string) (string, bool) {
+	path = filterAttribute(path)
+	if _, ok := attrs[path]; ok {
+		return path, true
+	}
+
+	for attr := range attrs {
+		if strings.EqualFold(attr, path) {
+			return attr, true
+		}
+	}
+	return "", false
+}
+
+// parseBool accepts booleans and the "True" and "False" strings some
+// identity providers send.
+func parseBool(val any) (bool, error) {
+	switch v := val.(type) {
+	case bool:
+		return v, nil
+	case string:
+		switch strings.ToLower(v) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+	}
+	return false, invalidValue("%v is not a boolean", val)
+}
+
+// patchGroup applies the operations to the group. exists reports whether a
+// member id refers to a known user.
+func patchGroup(group Group, ops []PatchOperation, exists func(id string) bool) (Group, error) {
+	for _, op := range ops {
+		kind := strings.ToLower(op.Op)
+		if kind != "add" && kind != "replace" && kind != "remove" {
+			return group, invalidValue("unsupported op %s", op.Op)
+		}
+
+		if op.Path == "" {
+			if kind == "remove" {
+				return group, invalidPath("")
+			}
+
+			obj, ok := op.Value.(map[string]any)
+			if !ok {
+				return group, invalidValue("%s without a path needs an object value", op.Op)
+			}
+
+			for key, val := range obj {
+				var err error
+				if group, err = patchGroupAttribute(group, kind, key, val, exists); err != nil {
+					return group, err
+				}
+			}
+			continue
+		}
+
+		if match := memberFilterPath.FindStringSubmatch(op.Path); match != nil {
+			if kind != "remove" {
+				return group, invalidPath(op.Path)
+			}
+			group.Members = withoutMembers(group.Members, []Reference{{Value: match[1]}})
+			continue
+		}
+
+		var err error
+		if group, err = patchGroupAttribute(group, kind, op.Path, op.Value, exists); err != nil {
+			return group, err
+		}
+	}
+
+	return group, nil
+}
+
+func patchGroupAttribute(group Group, kind, path string, val any, exists func(id string) bool) (Group, error) {
+	switch strings.ToLower(path) {
+	case "displayname":
+		if kind == "remove" {
+			return group, invalidValue("displayName is required")
+		}
+		name, ok := val.(string)
+		if !ok || name == "" {
+			return group, invalidValue("displayName must be a non-empty string")
+		}
+		group.DisplayName = name
+	case "externalid":
+		if kind == "remove" {
+			group.ExternalID = ""
+		} else {
+			group.ExternalID = fmt.Sprint(val)
+		}
+	case "members":
+		if kind == "remove" && val == nil {
+			group.Members = nil
+			return group, nil
+		}
+
+		refs, err := references(val)
+		if err != nil {
+			return group, err
+		}
+
+		switch kind {
+		case "remove":
+			group.Members = withoutMembers(group.Members, refs)
+			return group, nil
+		case "replace":
+			group.Members = nil
+		}
+
+		for _, ref := range refs {
+			if !exists(ref.Value) {
+				return group, invalidValue("member %s does not exist", ref.Value)
+			}
+			if !hasMember(group.Members, ref.Value) {
+				group.Members = append(group.Members, Reference{Value: ref.Value})
+			}
+		}
+	default:
+		return group, invalidPath(path)
+	}
+
+	return group, nil
+}
+
+// references decodes a members value, either a single reference or a list.
+func references(val any) ([]Reference, error) {
+	bs, err := json.Marshal(val)
+	if err != nil {
+		return nil, invalidValue("invalid members value: %s", err)
+	}
+
+	var refs []Reference
+	if err := json.Unmarshal(bs, &refs); err == nil {
+		return refs, nil
+	}
+
+	var ref Reference
+	if err := json.Unmarshal(bs, &ref); err != nil {
+		return nil, invalidValue("invalid members value: %s", err)
+	}
+	return []Reference{ref}, nil
+}
+
+func hasMember(members []Reference, id string) bool {
+	for _, member := range members {
+		if member.Value == id {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutMembers(members, removed []Reference) []Reference {
+	kept := make([]Reference, 0, len(members))
+	for _, member := range members {
+		if !hasMember(removed, member.Value) {
+			kept = append(kept, member)
+		}
+	}
+	return kept
+}
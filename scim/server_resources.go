@@ -0,0 +1,308 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+func decode(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return badRequest("invalidSyntax", err.Error())
+	}
+	return nil
+}
+
+func (s *Server) serveUsers(w http.ResponseWriter, r *http.Request, actor, id string) {
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		dir, err := s.load(r.Context())
+		if err != nil {
+			writeFailure(w, err)
+			return
+		}
+
+		list, err := page(r, sortedValues(dir.Users), Flatten, s.pageSize())
+		if err != nil {
+			writeFailure(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case r.Method == http.MethodGet:
+		dir, err := s.load(r.Context())
+		if err != nil {
+			writeFailure(w, err)
+			return
+		}
+
+		user, ok := dir.Users[id]
+		if !ok {
+			writeFailure(w, notFound("user", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, user)
+	case r.Method == http.MethodPost && id == "":
+		var user User
+		if err := decode(r, &user); err != nil {
+			writeFailure(w, err)
+			return
+		}
+
+		s.write(w, r, actor, "create-user", user.UserName, func(dir *directory) (*change, error) {
+			if err := validateUser(dir, user, ""); err != nil {
+				return nil, err
+			}
+
+			var err error
+			if user.ID, err = newID(); err != nil {
+				return nil, err
+			}
+
+			if len(user.Schemas) == 0 {
+				user.Schemas = []string{SchemaUser}
+			}
+
+			created := now()
+			user.Meta = &Meta{ResourceType: "User", Created: created, LastModified: created}
+			dir.Users[user.ID] = user
+			return &change{key: user.UserName, status: http.StatusCreated, body: user, users: []User{user}}, nil
+		})
+	case r.Method == http.MethodPut && id != "":
+		var user User
+		if err := decode(r, &user); err != nil {
+			writeFailure(w, err)
+			return
+		}
+
+		s.write(w, r, actor, "replace-user", id, func(dir *directory) (*change, error) {
+			old, ok := dir.Users[id]
+			if !ok {
+				return nil, notFound("user", id)
+			}
+
+			if err := validateUser(dir, user, id); err != nil {
+				return nil, err
+			}
+
+			user.ID = id
+			user.Meta = touch(old.Meta, "User")
+			dir.Users[id] = user
+			return &change{key: user.UserName, status: http.StatusOK, body: user, users: []User{old, user}}, nil
+		})
+	case r.Method == http.MethodPatch && id != "":
+		var req PatchRequest
+		if err := decode(r, &req); err != nil {
+			writeFailure(w, err)
+			return
+		}
+
+		s.write(w, r, actor, "patch-user", id, func(dir *directory) (*change, error) {
+			old, ok := dir.Users[id]
+			if !ok {
+				return nil, notFound("user", id)
+			}
+
+			user, err := patchUser(old, req.Operations)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := validateUser(dir, user, id); err != nil {
+				return nil, err
+			}
+
+			user.ID = id
+			user.Meta = touch(old.Meta, "User")
+			dir.Users[id] = user
+			return &change{key: user.UserName, status: http.StatusOK, body: user, users: []User{old, user}}, nil
+		})
+	case r.Method == http.MethodDelete && id != "":
+		s.write(w, r, actor, "delete-user", id, func(dir *directory) (*change, error) {
+			old, ok := dir.Users[id]
+			if !ok {
+				return nil, notFound("user", id)
+			}
+
+			delete(dir.Users, id)
+			for gid, group := range dir.Groups {
+				group.Members = withoutMembers(group.Members, []Reference{{Value: id}})
+				dir.Groups[gid] = group
+			}
+			return &change{key: old.UserName, status: http.StatusNoContent, users: []User{old}}, nil
+		})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+	}
+}
+
+// validateUser checks the user has a userName no other user than id has.
+func validateUser(dir *directory, user User, id string) error {
+	if user.UserName == "" {
+		return badRequest("invalidValue", "userName is required")
+	}
+
+	for other, existing := range dir.Users {
+		if other != id && strings.EqualFold(existing.UserName, user.UserName) {
+			return conflict(fmt.Sprintf("user %s already exists", user.UserName))
+		}
+	}
+	return nil
+}
+
+// touch updates the modification time of a resource's meta.
+func touch(meta *Meta, resourceType string) *Meta {
+	updated := Meta{ResourceType: resourceType, Created: now()}
+	if meta != nil {
+		updated = *meta
+	}
+	updated.LastModified = now()
+	return &updated
+}
+
+func (s *Server) serveGroups(w http.ResponseWriter, r *http.Request, actor, id string) {
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		dir, err := s.load(r.Context())
+		if err != nil {
+			writeFailure(w, err)
+			return
+		}
+
+		list, err := page(r, sortedValues(dir.Groups), groupAttributes, s.pageSize())
+		if err != nil {
+			writeFailure(w, err)
+			return
+		}
+
+		// Entra ID lists groups with excludedAttributes=members to keep responses small.
+		if strings.Contains(r.URL.Query().Get("excludedAttributes"), "members") {
+			for i := range list.Resources {
+				list.Resources[i].Members = nil
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+	case r.Method == http.MethodGet:
+		dir, err := s.load(r.Context())
+		if err != nil {
+			writeFailure(w, err)
+			return
+		}
+
+		group, ok := dir.Groups[id]
+		if !ok {
+			writeFailure(w, notFound("group", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, group)
+	case r.Method == http.MethodPost && id == "":
+		var group Group
+		if err := decode(r, &group); err != nil {
+			writeFailure(w, err)
+			return
+		}
+
+		s.write(w, r, actor, "create-group", group.DisplayName, func(dir *directory) (*change, error) {
+			if err := validateGroup(dir, group, ""); err != nil {
+				return nil, err
+			}
+
+			var err error
+			if group.ID, err = newID(); err != nil {
+				return nil, err
+			}
+
+			if len(group.Schemas) == 0 {
+				group.Schemas = []string{SchemaGroup}
+			}
+
+			created := now()
+			group.Meta = &Meta{ResourceType: "Group", Created: created, LastModified: created}
+			dir.Groups[group.ID] = group
+			return &change{key: group.DisplayName, status: http.StatusCreated, body: group, groups: []string{group.DisplayName}}, nil
+		})
+	case r.Method == http.MethodPut && id != "":
+		var group Group
+		if err := decode(r, &group); err != nil {
+			writeFailure(w, err)
+			return
+		}
+
+		s.write(w, r, actor, "replace-group", id, func(dir *directory) (*change, error) {
+			old, ok := dir.Groups[id]
+			if !ok {
+				return nil, notFound("group", id)
+			}
+
+			if err := validateGroup(dir, group, id); err != nil {
+				return nil, err
+			}
+
+			group.ID = id
+			group.Meta = touch(old.Meta, "Group")
+			dir.Groups[id] = group
+			return &change{key: group.DisplayName, status: http.StatusOK, body: group, groups: []string{old.DisplayName, group.DisplayName}}, nil
+		})
+	case r.Method == http.MethodPatch && id != "":
+		var req PatchRequest
+		if err := decode(r, &req); err != nil {
+			writeFailure(w, err)
+			return
+		}
+
+		s.write(w, r, actor, "patch-group", id, func(dir *directory) (*change, error) {
+			old, ok := dir.Groups[id]
+			if !ok {
+				return nil, notFound("group", id)
+			}
+
+			group, err := patchGroup(old, req.Operations, func(member string) bool {
+				_, ok := dir.Users[member]
+				return ok
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			if err := validateGroup(dir, group, id); err != nil {
+				return nil, err
+			}
+
+			group.Meta = touch(old.Meta, "Group")
+			dir.Groups[id] = group
+			return &change{key: group.DisplayName, status: http.StatusOK, body: group, groups: []string{old.DisplayName, group.DisplayName}}, nil
+		})
+	case r.Method == http.MethodDelete && id != "":
+		s.write(w, r, actor, "delete-group", id, func(dir *directory) (*change, error) {
+			old, ok := dir.Groups[id]
+			if !ok {
+				return nil, notFound("group", id)
+			}
+
+			delete(dir.Groups, id)
+			return &change{key: old.DisplayName, status: http.StatusNoContent, groups: []string{old.DisplayName}}, nil
+		})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+	}
+}
+
+// validateGroup checks the group has a unique displayName and only known members.
+func validateGroup(dir *directory, group Group, id string) error {
+	if group.DisplayName == "" {
+		return badRequest("invalidValue", "displayName is required")
+	}
+
+	for other, existing := range dir.Groups {
+		if other != id && strings.EqualFold(existing.DisplayName, group.DisplayName) {
+			return conflict(fmt.Sprintf("group %s already exists", group.DisplayName))
+		}
+	}
+
+	for _, member := range group.Members {
+		if _, ok := dir.Users[member.Value]; !ok {
+			return badRequest("invalidValue", fmt.Sprintf("member %s does not exist", member.Value))
+		}
+	}
+	return nil
+}
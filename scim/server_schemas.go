@@ -0,0 +1,185 @@
+package scim
+
+const (
+	SchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	SchemaResourceType          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	SchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+)
+
+type supported struct {
+	Supported bool `json:"supported"`
+}
+
+type filterSupport struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+type bulkSupport struct {
+	Supported      bool `json:"supported"`
+	MaxOperations  int  `json:"maxOperations"`
+	MaxPayloadSize int  `json:"maxPayloadSize"`
+}
+
+type authenticationScheme struct {
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Primary     bool   `json:"primary"`
+}
+
+type serviceProviderConfig struct {
+	Schemas               []string               `json:"schemas"`
+	Patch                 supported              `json:"patch"`
+	Bulk                  bulkSupport            `json:"bulk"`
+	Filter                filterSupport          `json:"filter"`
+	ChangePassword        supported              `json:"changePassword"`
+	Sort                  supported              `json:"sort"`
+	ETag                  supported              `json:"etag"`
+	AuthenticationSchemes []authenticationScheme `json:"authenticationSchemes"`
+}
+
+func newServiceProviderConfig(pageSize int) serviceProviderConfig {
+	return serviceProviderConfig{
+		Schemas: []string{SchemaServiceProviderConfig},
+		Patch:   supported{Supported: true},
+		Filter:  filterSupport{Supported: true, MaxResults: pageSize},
+		AuthenticationSchemes: []authenticationScheme{{
+			Type:        "oauthbearertoken",
+			Name:        "Bearer Token",
+			Description: "Authentication with a bearer token issued per client",
+			Primary:     true,
+		}},
+	}
+}
+
+type schemaExtension struct {
+	Schema   string `json:"schema"`
+	Required bool   `json:"required"`
+}
+
+type resourceType struct {
+	Schemas          []string          `json:"schemas"`
+	ID               string            `json:"id"`
+	Name             string            `json:"name"`
+	Endpoint         string            `json:"endpoint"`
+	Schema           string            `json:"schema"`
+	SchemaExtensions []schemaExtension `json:"schemaExtensions,omitempty"`
+}
+
+var resourceTypes = []resourceType{
+	{
+		Schemas:          []string{SchemaResourceType},
+		ID:               "User",
+		Name:             "User",
+		Endpoint:         "/Users",
+		Schema:           SchemaUser,
+		SchemaExtensions: []schemaExtension{{Schema: SchemaEnterpriseUser}},
+	},
+	{
+		Schemas:  []string{SchemaResourceType},
+		ID:       "Group",
+		Name:     "Group",
+		Endpoint: "/Groups",
+		Schema:   SchemaGroup,
+	},
+}
+
+type schemaAttribute struct {
+	Name          string            `json:"name"`
+	Type          string            `json:"type"`
+	MultiValued   bool              `json:"multiValued"`
+	Required      bool              `json:"required"`
+	CaseExact     bool              `json:"caseExact"`
+	Mutability    string            `json:"mutability"`
+	Returned      string            `json:"returned"`
+	Uniqueness    string            `json:"uniqueness"`
+	SubAttributes []schemaAttribute `json:"subAttributes,omitempty"`
+}
+
+type schema struct {
+	Schemas     []string          `json:"schemas"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Attributes  []schemaAttribute `json:"attributes"`
+}
+
+// attribute describes a single valued, optional, read-write string.
+func attribute(name string, subs ...schemaAttribute) schemaAttribute {
+	attr := schemaAttribute{
+		Name:          name,
+		Type:          "string",
+		Mutability:    "readWrite",
+		Returned:      "default",
+		Uniqueness:    "none",
+		SubAttributes: subs,
+	}
+	if len(subs) > 0 {
+		attr.Type = "complex"
+	}
+	return attr
+}
+
+func multiValued(attr schemaAttribute) schemaAttribute {
+	attr.MultiValued = true
+	return attr
+}
+
+func required(attr schemaAttribute) schemaAttribute {
+	attr.Required = true
+	return attr
+}
+
+func unique(attr schemaAttribute) schemaAttribute {
+	attr.Uniqueness = "server"
+	return attr
+}
+
+func ofType(typ string, attr schemaAttribute) schemaAttribute {
+	attr.Type = typ
+	return attr
+}
+
+var schemas = []schema{
+	{
+		Schemas:     []string{SchemaSchema},
+		ID:          SchemaUser,
+		Name:        "User",
+		Description: "User Account",
+		Attributes: []schemaAttribute{
+			required(unique(attribute("userName"))),
+			attribute("externalId"),
+			attribute("name", attribute("formatted"), attribute("givenName"), attribute("familyName")),
+			attribute("displayName"),
+			attribute("title"),
+			ofType("boolean", attribute("active")),
+			multiValued(attribute("emails", attribute("value"), attribute("type"), ofType("boolean", attribute("primary")))),
+		},
+	},
+	{
+		Schemas:     []string{SchemaSchema},
+		ID:          SchemaEnterpriseUser,
+		Name:        "EnterpriseUser",
+		Description: "Enterprise User",
+		Attributes: []schemaAttribute{
+			attribute("employeeNumber"),
+			attribute("costCenter"),
+			attribute("organization"),
+			attribute("division"),
+			attribute("department"),
+			attribute("manager", attribute("value")),
+		},
+	},
+	{
+		Schemas:     []string{SchemaSchema},
+		ID:          SchemaGroup,
+		Name:        "Group",
+		Description: "Group",
+		Attributes: []schemaAttribute{
+			required(unique(attribute("displayName"))),
+			attribute("externalId"),
+			multiValued(attribute("members", attribute("value"), attribute("display"))),
+		},
+	},
+}
@@ -0,0 +1,408 @@
+package scim
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+	"github.com/tiagoposse/go-identity-sync/engine"
+	"github.com/tiagoposse/go-identity-sync/state"
+	resolvers "github.com/tiagoposse/go-secret-resolvers"
+)
+
+func TestParseFilter(t *testing.T) {
+	attrs := map[string]any{
+		"userName":      "Alice",
+		"displayName":   "Alice Smith",
+		"email":         "alice@example.org",
+		"title":         "",
+		"active":        true,
+		"members.value": []string{"u1", "u2"},
+	}
+
+	tests := []struct {
+		filter  string
+		match   bool
+		invalid bool
+	}{
+		{filter: "", match: true},
+		{filter: `userName eq "alice"`, match: true},
+		{filter: `USERNAME eq "alice"`, match: true},
+		{filter: `userName eq "bob"`, match: false},
+		{filter: `userName ne "alice"`, match: false},
+		{filter: `userName sw "al" and active eq true`, match: true},
+		{filter: `userName sw "al" and active eq false`, match: false},
+		{filter: `userName eq "bob" or displayName co "smith"`, match: true},
+		{filter: `userName eq "bob" or displayName ew "jones"`, match: false},
+		{filter: `emails[type eq "work"].value eq "alice@example.org"`, match: true},
+		{filter: `members eq "u2"`, match: true},
+		{filter: `members eq "u3"`, match: false},
+		{filter: `title pr`, match: false},
+		{filter: `email pr`, match: true},
+		{filter: `userName gt "Aa" and userName lt "B"`, match: true},
+		{filter: `userName eq`, invalid: true},
+		{filter: `userName xx "alice"`, invalid: true},
+		{filter: `userName eq "alice`, invalid: true},
+		{filter: `userName eq alice`, invalid: true},
+		{filter: `userName eq "alice" nand title pr`, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			match, err := parseFilter(tt.filter)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("parseFilter succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseFilter: %v", err)
+			}
+
+			if got := match(attrs); got != tt.match {
+				t.Errorf("match = %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	active := true
+	user := User{
+		ID:       "u1",
+		UserName: "alice",
+		Title:    "Engineer",
+		Active:   &active,
+		Name:     &Name{GivenName: "Alice", FamilyName: "Smith"},
+		Emails:   []Email{{Value: "alice@example.org", Primary: true}},
+		Meta:     &Meta{ResourceType: "User"},
+	}
+
+	tests := []struct {
+		name     string
+		ops      []PatchOperation
+		want     map[string]any
+		scimType string
+	}{
+		{
+			name: "replace active from a string",
+			ops:  []PatchOperation{{Op: "Replace", Path: "active", Value: "False"}},
+			want: map[string]any{"active": false},
+		},
+		{
+			name: "replace without a path",
+			ops: []PatchOperation{{Op: "replace", Value: map[string]any{
+				"name":   map[string]any{"givenName": "Ally"},
+				"emails": []any{map[string]any{"value": "other@example.org"}, map[string]any{"value": "ally@example.org", "primary": true}},
+			}}},
+			want: map[string]any{"name.givenName": "Ally", "name.familyName": "Smith", "email": "ally@example.org"},
+		},
+		{
+			name: "add a value filtered email",
+			ops:  []PatchOperation{{Op: "add", Path: `emails[type eq "work"].value`, Value: "work@example.org"}},
+			want: map[string]any{"email": "work@example.org"},
+		},
+		{
+			name: "add an enterprise attribute by path",
+			ops:  []PatchOperation{{Op: "add", Path: EnterpriseAttribute("department"), Value: "Engineering"}},
+			want: map[string]any{EnterpriseAttribute("department"): "Engineering"},
+		},
+		{
+			name: "add an enterprise attribute without a path",
+			ops: []PatchOperation{{Op: "add", Value: map[string]any{
+				SchemaEnterpriseUser: map[string]any{"manager": map[string]any{"value": "u2"}},
+			}}},
+			want: map[string]any{EnterpriseAttribute("manager"): "u2"},
+		},
+		{
+			name: "remove",
+			ops:  []PatchOperation{{Op: "remove", Path: "title"}, {Op: "remove", Path: "active"}},
+			want: map[string]any{"title": "", "active": true},
+		},
+		{
+			name:     "unknown path",
+			ops:      []PatchOperation{{Op: "replace", Path: "nickName", Value: "al"}},
+			scimType: "invalidPath",
+		},
+		{
+			name:     "unsupported op",
+			ops:      []PatchOperation{{Op: "move", Path: "title"}},
+			scimType: "invalidValue",
+		},
+		{
+			name:     "active that is not a boolean",
+			ops:      []PatchOperation{{Op: "replace", Path: "active", Value: "maybe"}},
+			scimType: "invalidValue",
+		},
+		{
+			name:     "no path and no object",
+			ops:      []PatchOperation{{Op: "add", Value: "alice"}},
+			scimType: "invalidValue",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patched, err := patchUser(user, tt.ops)
+			if tt.scimType != "" {
+				var patchErr *patchError
+				if !errors.As(err, &patchErr) || patchErr.scimType != tt.scimType {
+					t.Fatalf("patchUser error = %v, want %s", err, tt.scimType)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("patchUser: %v", err)
+			}
+
+			attrs := Flatten(patched)
+			for attr, want := range tt.want {
+				if attrs[attr] != want {
+					t.Errorf("%s = %v, want %v", attr, attrs[attr], want)
+				}
+			}
+			if attrs["userName"] != "alice" || patched.Meta != user.Meta {
+				t.Errorf("patched %+v, want the userName and meta kept", patched)
+			}
+		})
+	}
+}
+
+func TestPatchGroup(t *testing.T) {
+	group := Group{ID: "g1", DisplayName: "eng", Members: []Reference{{Value: "u1"}}}
+	exists := func(id string) bool { return slices.Contains([]string{"u1", "u2", "u3"}, id) }
+
+	tests := []struct {
+		name     string
+		ops      []PatchOperation
+		wantName string
+		want     []string
+		scimType string
+	}{
+		{
+			name: "add members",
+			ops:  []PatchOperation{{Op: "add", Path: "members", Value: []any{map[string]any{"value": "u2"}, map[string]any{"value": "u1"}}}},
+			want: []string{"u1", "u2"},
+		},
+		{
+			name: "add a single member",
+			ops:  []PatchOperation{{Op: "Add", Path: "members", Value: map[string]any{"value": "u3"}}},
+			want: []string{"u1", "u3"},
+		},
+		{
+			name: "replace members",
+			ops:  []PatchOperation{{Op: "replace", Path: "members", Value: []any{map[string]any{"value": "u3"}}}},
+			want: []string{"u3"},
+		},
+		{
+			name: "remove a member by filter",
+			ops:  []PatchOperation{{Op: "remove", Path: `members[value eq "u1"]`}},
+			want: []string{},
+		},
+		{
+			name: "remove members by value",
+			ops:  []PatchOperation{{Op: "remove", Path: "members", Value: []any{map[string]any{"value": "u1"}}}},
+			want: []string{},
+		},
+		{
+			name: "remove every member",
+			ops:  []PatchOperation{{Op: "remove", Path: "members"}},
+			want: []string{},
+		},
+		{
+			name:     "replace without a path",
+			ops:      []PatchOperation{{Op: "replace", Value: map[string]any{"displayName": "ops", "members": []any{map[string]any{"value": "u2"}}}}},
+			wantName: "ops",
+			want:     []string{"u2"},
+		},
+		{
+			name:     "add an unknown member",
+			ops:      []PatchOperation{{Op: "add", Path: "members", Value: []any{map[string]any{"value": "u9"}}}},
+			scimType: "invalidValue",
+		},
+		{
+			name:     "empty displayName",
+			ops:      []PatchOperation{{Op: "replace", Path: "displayName", Value: ""}},
+			scimType: "invalidValue",
+		},
+		{
+			name:     "remove without a path",
+			ops:      []PatchOperation{{Op: "remove"}},
+			scimType: "invalidPath",
+		},
+		{
+			name:     "add by filter",
+			ops:      []PatchOperation{{Op: "add", Path: `members[value eq "u2"]`}},
+			scimType: "invalidPath",
+		},
+		{
+			name:     "unsupported op",
+			ops:      []PatchOperation{{Op: "copy", Path: "members"}},
+			scimType: "invalidValue",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patched, err := patchGroup(group, tt.ops, exists)
+			if tt.scimType != "" {
+				var patchErr *patchError
+				if !errors.As(err, &patchErr) || patchErr.scimType != tt.scimType {
+					t.Fatalf("patchGroup error = %v, want %s", err, tt.scimType)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("patchGroup: %v", err)
+			}
+
+			wantName := tt.wantName
+			if wantName == "" {
+				wantName = group.DisplayName
+			}
+			if patched.DisplayName != wantName {
+				t.Errorf("displayName = %s, want %s", patched.DisplayName, wantName)
+			}
+
+			members := make([]string, 0, len(patched.Members))
+			for _, member := range patched.Members {
+				members = append(members, member.Value)
+			}
+			if !slices.Equal(members, tt.want) {
+				t.Errorf("members = %v, want %v", members, tt.want)
+			}
+		})
+	}
+}
+
+func TestPage(t *testing.T) {
+	users := make([]User, 0)
+	for _, name := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		users = append(users, User{ID: name, UserName: name})
+	}
+
+	tests := []struct {
+		name       string
+		query      url.Values
+		total      int
+		startIndex int
+		want       []string
+		scimType   string
+	}{
+		{name: "first page", query: url.Values{}, total: 5, startIndex: 1, want: []string{"alice", "bob", "carol"}},
+		{name: "start index and count", query: url.Values{"startIndex": {"2"}, "count": {"2"}}, total: 5, startIndex: 2, want: []string{"bob", "carol"}},
+		{name: "count capped at the page size", query: url.Values{"startIndex": {"3"}, "count": {"10"}}, total: 5, startIndex: 3, want: []string{"carol", "dave", "erin"}},
+		{name: "last partial page", query: url.Values{"startIndex": {"5"}}, total: 5, startIndex: 5, want: []string{"erin"}},
+		{name: "past the end", query: url.Values{"startIndex": {"9"}}, total: 5, startIndex: 9, want: []string{}},
+		{name: "start index below 1", query: url.Values{"startIndex": {"0"}, "count": {"1"}}, total: 5, startIndex: 1, want: []string{"alice"}},
+		{name: "count of 0", query: url.Values{"count": {"0"}}, total: 5, startIndex: 1, want: []string{}},
+		{name: "negative count", query: url.Values{"count": {"-1"}}, total: 5, startIndex: 1, want: []string{}},
+		{name: "filtered", query: url.Values{"filter": {`userName co "a"`}, "startIndex": {"2"}}, total: 3, startIndex: 2, want: []string{"carol", "dave"}},
+		{name: "invalid start index", query: url.Values{"startIndex": {"two"}}, scimType: "invalidValue"},
+		{name: "invalid count", query: url.Values{"count": {"many"}}, scimType: "invalidValue"},
+		{name: "invalid filter", query: url.Values{"filter": {"userName eq"}}, scimType: "invalidFilter"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/Users?"+tt.query.Encode(), nil)
+			list, err := page(r, users, Flatten, 3)
+			if tt.scimType != "" {
+				var scimErr *Error
+				if !errors.As(err, &scimErr) || scimErr.StatusCode != http.StatusBadRequest || scimErr.ScimType != tt.scimType {
+					t.Fatalf("page error = %v, want a 400 %s", err, tt.scimType)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("page: %v", err)
+			}
+
+			names := make([]string, 0, len(list.Resources))
+			for _, user := range list.Resources {
+				names = append(names, user.UserName)
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("resources = %v, want %v", names, tt.want)
+			}
+			if list.TotalResults != tt.total || list.StartIndex != tt.startIndex || list.ItemsPerPage != len(tt.want) {
+				t.Errorf("totalResults, startIndex, itemsPerPage = %d, %d, %d, want %d, %d, %d",
+					list.TotalResults, list.StartIndex, list.ItemsPerPage, tt.total, tt.startIndex, len(tt.want))
+			}
+		})
+	}
+}
+
+// blockingPlanner plans a create of every source user, once release is closed.
+type blockingPlanner struct {
+	release chan struct{}
+
+	mu      sync.Mutex
+	created []string
+}
+
+func (p *blockingPlanner) Plan(ctx context.Context, source []map[string]any) (*engine.Plan, error) {
+	<-p.release
+
+	plan := engine.NewPlan("test")
+	plan.SetState(nil, source, "username")
+	for _, u := range source {
+		key := config.KeyOf(u, "username")
+		plan.Add(engine.OperationCreate, key, u, func(ctx context.Context) error {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+
+			p.created = append(p.created, key)
+			return nil
+		})
+	}
+
+	return plan, nil
+}
+
+func TestWritesArePropagatedAfterTheResponse(t *testing.T) {
+	store, err := state.NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("creating store: %v", err)
+	}
+
+	token := "secret"
+	planner := &blockingPlanner{release: make(chan struct{})}
+	srv, err := NewServer(&config.SCIMServerConfig{
+		BaseConfig: config.BaseConfig{Mapping: map[string]string{"userName": "username"}},
+		Tokens:     map[string]*resolvers.ResolverField{"idp": {Value: &token}},
+	}, store, nil, Target{Planner: planner})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	for _, name := range []string{"alice", "bob"} {
+		r := httptest.NewRequest(http.MethodPost, "/Users", strings.NewReader(`{"userName": "`+name+`"}`))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+
+		// The planner blocks, so the request only returns if it does not wait
+		// for the targets.
+		srv.ServeHTTP(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("creating %s: %d %s", name, w.Code, w.Body)
+		}
+	}
+
+	close(planner.release)
+	if err := srv.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if want := []string{"alice", "bob"}; !slices.Equal(planner.created, want) {
+		t.Errorf("created %v in the targets, want %v", planner.created, want)
+	}
+}
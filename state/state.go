@@ -0,0 +1,199 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+)
+
+var (
+	ErrNotFound = errors.New("state: key not found")
+	ErrExists   = errors.New("state: key already exists")
+	ErrConflict = errors.New("state: key holds another value")
+)
+
+// Store persists engine state such as snapshots between runs.
+type Store interface {
+	// Get returns ErrNotFound when the key does not exist.
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, value []byte) error
+	Delete(ctx context.Context, key string) error
+	// List returns every key starting with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Creator is implemented by stores that can atomically create a key only if
+// it does not exist yet.
+type Creator interface {
+	// Create returns ErrExists when the key already exists.
+	Create(ctx context.Context, key string, value []byte) error
+}
+
+// Swapper is implemented by stores that can atomically replace or delete a
+// key only while it still holds a given value.
+type Swapper interface {
+	// CompareAndSwap replaces the value of key with new if it currently is
+	// old, or deletes it if new is nil. It returns ErrConflict when the key
+	// holds another value and ErrNotFound when it does not exist.
+	CompareAndSwap(ctx context.Context, key string, old, new []byte) error
+}
+
+// GetJSON reads the key and decodes it into v.
+func GetJSON(ctx context.Context, store Store, key string, v any) error {
+	bs, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(bs, v); err != nil {
+		return fmt.Errorf("decoding %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// PutJSON encodes v and stores it under key.
+func PutJSON(ctx context.Context, store Store, key string, v any) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding %s: %w", key, err)
+	}
+
+	return store.Put(ctx, key, bs)
+}
+
+// swapPrefix names the files FileStore locks while swapping a key.
+const swapPrefix = ".swap-"
+
+// FileStore keeps one file per key in a directory. It implements Swapper on
+// platforms with flock.
+type FileStore struct {
+	dir string
+}
+
+// New returns the store the config asks for. Without a directory it returns
+// no store, and the engine runs without state.
+func New(cfg *config.StateConfig) (Store, error) {
+	if cfg == nil || cfg.Dir == "" {
+		return nil, nil
+	}
+
+	return NewFileStore(cfg.Dir)
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating state directory: %w", err)
+	}
+
+	return &FileStore{dir: dir}, nil
+}
+
+func (fs *FileStore) path(key string) string {
+	return filepath.Join(fs.dir, url.PathEscape(key))
+}
+
+func (fs *FileStore) Get(ctx context.Context, key string) ([]byte, error) {
+	bs, err := os.ReadFile(fs.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", key, err)
+	}
+
+	return bs, nil
+}
+
+// writeTemp writes value to a temporary file in the store directory and
+// returns its path, so it can be moved into place in one step.
+func (fs *FileStore) writeTemp(key string, value []byte) (string, error) {
+	tmp, err := os.CreateTemp(fs.dir, ".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("writing %s: %w", key, err)
+	}
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("writing %s: %w", key, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("writing %s: %w", key, err)
+	}
+
+	return tmp.Name(), nil
+}
+
+// Put writes to a temporary file first so readers never see a partial value.
+func (fs *FileStore) Put(ctx context.Context, key string, value []byte) error {
+	tmp, err := fs.writeTemp(key, value)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := os.Rename(tmp, fs.path(key)); err != nil {
+		return fmt.Errorf("writing %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// Create links a fully written temporary file into place, which fails if the key exists.
+func (fs *FileStore) Create(ctx context.Context, key string, value []byte) error {
+	tmp, err := fs.writeTemp(key, value)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := os.Link(tmp, fs.path(key)); errors.Is(err, os.ErrExist) {
+		return ErrExists
+	} else if err != nil {
+		return fmt.Errorf("writing %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (fs *FileStore) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(fs.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("deleting %s: %w", key, err)
+	}
+
+	return nil
+}
+
+func (fs *FileStore) List(ctx context.Context, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(fs.dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing state: %w", err)
+	}
+
+	keys := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") || strings.HasPrefix(entry.Name(), swapPrefix) {
+			continue
+		}
+
+		key, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
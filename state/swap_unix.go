@@ -0,0 +1,43 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// CompareAndSwap holds an exclusive flock on a file next to the key while it
+// compares and replaces the value, so swaps of the same key by processes
+// sharing the directory run one at a time. Create cannot overwrite a key and
+// needs no flock.
+func (fs *FileStore) CompareAndSwap(ctx context.Context, key string, old, new []byte) error {
+	f, err := os.OpenFile(filepath.Join(fs.dir, swapPrefix+url.PathEscape(key)), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return fmt.Errorf("swapping %s: %w", key, err)
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("swapping %s: %w", key, err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	current, err := fs.Get(ctx, key)
+	if err != nil {
+		return err
+	} else if !bytes.Equal(current, old) {
+		return ErrConflict
+	}
+
+	if new == nil {
+		return fs.Delete(ctx, key)
+	}
+
+	return fs.Put(ctx, key, new)
+}
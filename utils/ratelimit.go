@@ -0,0 +1,254 @@
+package utils
+
+import (
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+)
+
+// RateLimitClassifier reports whether a response that is not a plain 429 is a
+// provider specific rate limit signal, e.g. GitHub secondary rate limits or
+// Google userRateLimitExceeded errors, both of which are returned as 403s.
+type RateLimitClassifier func(resp *http.Response) bool
+
+// RateLimitTransport is an http.RoundTripper that throttles requests with a
+// token bucket and retries rate limited and transient failures with
+// exponential backoff and jitter.
+type RateLimitTransport struct {
+	base       http.RoundTripper
+	cfg        config.RateLimitConfig
+	classifier RateLimitClassifier
+	bucket     *tokenBucket
+}
+
+// NewRateLimitTransport wraps base, which defaults to http.DefaultTransport.
+// Each provider should own its transport so limits are tracked per provider.
+func NewRateLimitTransport(base http.RoundTripper, cfg *config.RateLimitConfig, classifier RateLimitClassifier) (*RateLimitTransport, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	resolved := cfg.WithDefaults()
+	return &RateLimitTransport{
+		base:       base,
+		cfg:        resolved,
+		classifier: classifier,
+		bucket: &tokenBucket{
+			rate:   resolved.RequestsPerSecond,
+			burst:  float64(resolved.Burst),
+			tokens: float64(resolved.Burst),
+			last:   time.Now(),
+		},
+	}, nil
+}
+
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	for attempt := 0; ; attempt++ {
+		if err := t.bucket.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		r := req
+		if attempt > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(ctx)
+			r.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(r)
+		if resp != nil {
+			if reset, ok := rateLimitReset(resp); ok {
+				t.bucket.BlockUntil(reset)
+			}
+		}
+
+		retry, wait := t.shouldRetry(req, resp, err)
+		if !retry || attempt >= t.cfg.MaxRetries {
+			return resp, err
+		}
+
+		if wait <= 0 {
+			wait = t.backoff(attempt)
+		} else if wait > t.cfg.MaxBackoff {
+			// A server asking for longer than we are willing to wait still
+			// gets retried, only sooner than it asked.
+			wait = t.cfg.MaxBackoff
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// shouldRetry decides whether a request is retried and how long to wait. A
+// request the server rejected without processing (429, 503 or a provider rate
+// limit) is always safe to retry; anything else is only retried when the
+// request is idempotent.
+func (t *RateLimitTransport) shouldRetry(req *http.Request, resp *http.Response, err error) (bool, time.Duration) {
+	if req.Body != nil && req.GetBody == nil {
+		return false, 0
+	}
+
+	if err != nil {
+		return req.Context().Err() == nil && t.idempotent(req), 0
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode == http.StatusServiceUnavailable,
+		t.classifier != nil && t.classifier(resp):
+		return true, retryAfter(resp)
+	case resp.StatusCode == http.StatusInternalServerError,
+		resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusGatewayTimeout:
+		return t.idempotent(req), retryAfter(resp)
+	}
+
+	return false, 0
+}
+
+func (t *RateLimitTransport) idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	return t.cfg.RetryWrites || req.Header.Get("Idempotency-Key") != ""
+}
+
+// backoff returns an exponential backoff with equal jitter for the given attempt.
+func (t *RateLimitTransport) backoff(attempt int) time.Duration {
+	d := float64(t.cfg.MinBackoff) * math.Pow(2, float64(attempt))
+	if d > float64(t.cfg.MaxBackoff) {
+		d = float64(t.cfg.MaxBackoff)
+	}
+
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// retryAfter returns how long the server asked us to wait, either through
+// Retry-After or through an exhausted quota and its reset time.
+func retryAfter(resp *http.Response) time.Duration {
+	if val := resp.Header.Get("Retry-After"); val != "" {
+		if secs, err := strconv.Atoi(val); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+		if at, err := http.ParseTime(val); err == nil {
+			return time.Until(at)
+		}
+	}
+
+	if reset, ok := rateLimitReset(resp); ok {
+		return time.Until(reset)
+	}
+
+	return 0
+}
+
+// rateLimitReset returns the reset time of an exhausted quota. GitHub uses
+// X-RateLimit-*, Okta X-Rate-Limit-* and GitLab RateLimit-* headers, all as
+// epoch seconds.
+func rateLimitReset(resp *http.Response) (time.Time, bool) {
+	for _, prefix := range []string{"X-RateLimit-", "X-Rate-Limit-", "RateLimit-"} {
+		if resp.Header.Get(prefix+"Remaining") != "0" {
+			continue
+		}
+
+		epoch, err := strconv.ParseInt(resp.Header.Get(prefix+"Reset"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		return time.Unix(epoch, 0), true
+	}
+
+	return time.Time{}, false
+}
+
+type tokenBucket struct {
+	mu sync.Mutex
+
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	blocked time.Time
+}
+
+// BlockUntil stops handing out tokens until the given time.
+func (b *tokenBucket) BlockUntil(t time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if t.After(b.blocked) {
+		b.blocked = t
+	}
+}
+
+// Wait blocks until a token is available or the context is done.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	for {
+		wait := b.reserve()
+		if wait <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (b *tokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(b.blocked) {
+		return b.blocked.Sub(now)
+	}
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
@@ -0,0 +1,161 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiagoposse/go-identity-sync/config"
+)
+
+// reply is a canned response of the test server.
+type reply struct {
+	status     int
+	retryAfter string
+}
+
+func TestRateLimitTransportRetries(t *testing.T) {
+	quick := config.RateLimitConfig{MaxRetries: 2, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+
+	tests := []struct {
+		name    string
+		cfg     config.RateLimitConfig
+		method  string
+		replies []reply
+		// wantCalls is the number of requests the server gets and wantStatus
+		// the status of the response the caller gets back.
+		wantCalls  int
+		wantStatus int
+		// The first retry is sent between minWait and maxWait after the
+		// first request.
+		minWait time.Duration
+		maxWait time.Duration
+	}{
+		{
+			name:       "waits out Retry-After",
+			cfg:        config.RateLimitConfig{MaxRetries: 2, MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Second},
+			method:     http.MethodGet,
+			replies:    []reply{{status: http.StatusTooManyRequests, retryAfter: "1"}, {status: http.StatusOK}},
+			wantCalls:  2,
+			wantStatus: http.StatusOK,
+			minWait:    time.Second,
+			maxWait:    2 * time.Second,
+		},
+		{
+			name:       "caps Retry-After at maxBackoff",
+			cfg:        quick,
+			method:     http.MethodGet,
+			replies:    []reply{{status: http.StatusTooManyRequests, retryAfter: "60"}, {status: http.StatusOK}},
+			wantCalls:  2,
+			wantStatus: http.StatusOK,
+			minWait:    10 * time.Millisecond,
+			maxWait:    time.Second,
+		},
+		{
+			name:       "gives up after maxRetries",
+			cfg:        quick,
+			method:     http.MethodGet,
+			replies:    []reply{{status: http.StatusTooManyRequests}},
+			wantCalls:  3,
+			wantStatus: http.StatusTooManyRequests,
+			maxWait:    time.Second,
+		},
+		{
+			name:       "negative maxRetries disables retries",
+			cfg:        config.RateLimitConfig{MaxRetries: -1, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+			method:     http.MethodGet,
+			replies:    []reply{{status: http.StatusTooManyRequests}},
+			wantCalls:  1,
+			wantStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:       "retries writes the server rejected",
+			cfg:        quick,
+			method:     http.MethodPost,
+			replies:    []reply{{status: http.StatusServiceUnavailable}, {status: http.StatusCreated}},
+			wantCalls:  2,
+			wantStatus: http.StatusCreated,
+			maxWait:    time.Second,
+		},
+		{
+			name:       "does not retry writes the server may have processed",
+			cfg:        quick,
+			method:     http.MethodPost,
+			replies:    []reply{{status: http.StatusBadGateway}, {status: http.StatusCreated}},
+			wantCalls:  1,
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var calls []time.Time
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				calls = append(calls, time.Now())
+				rep := tt.replies[min(len(calls), len(tt.replies))-1]
+				mu.Unlock()
+
+				if rep.retryAfter != "" {
+					w.Header().Set("Retry-After", rep.retryAfter)
+				}
+				w.WriteHeader(rep.status)
+			}))
+			t.Cleanup(srv.Close)
+
+			transport, err := NewRateLimitTransport(nil, &tt.cfg, nil)
+			if err != nil {
+				t.Fatalf("NewRateLimitTransport: %v", err)
+			}
+
+			req, err := http.NewRequest(tt.method, srv.URL, strings.NewReader("{}"))
+			if err != nil {
+				t.Fatalf("creating request: %v", err)
+			}
+
+			resp, err := (&http.Client{Transport: transport}).Do(req)
+			if err != nil {
+				t.Fatalf("sending request: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(calls) != tt.wantCalls {
+				t.Fatalf("got %d requests, want %d", len(calls), tt.wantCalls)
+			}
+			if len(calls) > 1 {
+				if waited := calls[1].Sub(calls[0]); waited < tt.minWait || waited >= tt.maxWait {
+					t.Errorf("retried after %s, want between %s and %s", waited, tt.minWait, tt.maxWait)
+				}
+			}
+		})
+	}
+}
+
+func TestNewRateLimitTransportRejectsInvalidBackoffs(t *testing.T) {
+	tests := map[string]config.RateLimitConfig{
+		"negative minBackoff":         {MinBackoff: -time.Second},
+		"negative maxBackoff":         {MaxBackoff: -time.Second},
+		"minBackoff above maxBackoff": {MinBackoff: time.Minute, MaxBackoff: time.Second},
+		"minBackoff above default":    {MinBackoff: time.Hour},
+	}
+
+	for name, cfg := range tests {
+		cfg := cfg
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewRateLimitTransport(nil, &cfg, nil); err == nil {
+				t.Error("NewRateLimitTransport succeeded, want an error")
+			}
+		})
+	}
+}